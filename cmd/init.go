@@ -21,6 +21,7 @@ func init() {
 	rootCmd.AddCommand(initCmd)
 
 	viper.SetDefault("bucket", db.DefaultBucketName)
+	viper.SetDefault("layout", db.LayoutDir)
 
 	// Parse environment variables.
 	viper.SetEnvPrefix(configEnvPrefix)
@@ -33,13 +34,20 @@ func init() {
 	if err := viper.BindPFlag("bucket", initCmd.Flags().Lookup("bucket")); err != nil {
 		log.Fatal(err)
 	}
+
+	// Storage layout.
+	initCmd.Flags().String("layout", db.LayoutDir, "storage layout ('dir' for Badger instance per bucket, 'shared' for one Badger instance)")
+	if err := viper.BindPFlag("layout", initCmd.Flags().Lookup("layout")); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func initializeDatabase(cmd *cobra.Command, args []string) {
 	datadir := viper.GetString("datadir")
 	bucket := viper.GetString("bucket")
+	layout := viper.GetString("layout")
 
-	if err := db.InitDatabase(datadir, bucket); err != nil {
+	if err := db.InitDatabase(datadir, bucket, layout); err != nil {
 		log.Error("initializing database", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// migrateCmd represents the command to migrate the database to another storage layout.
+var migrateCmd = &cobra.Command{
+	Use:   "migrate <layout>",
+	Short: "Migrate the database to another storage layout",
+	Long: `Migrate all buckets of the database to another storage layout ('dir' or 'shared').
+The server must not be running during migration.`,
+	Args: cobra.ExactArgs(1),
+	Run:  migrateDatabase,
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+}
+
+func migrateDatabase(cmd *cobra.Command, args []string) {
+	datadir := viper.GetString("datadir")
+
+	if err := db.Migrate(datadir, args[0]); err != nil {
+		log.Error("migrating database", err)
+		os.Exit(1)
+	}
+}
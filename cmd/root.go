@@ -3,6 +3,7 @@ package cmd
 
 import (
 	"os"
+	"time"
 
 	"github.com/pepol/databuddy/internal/log"
 	"github.com/pepol/databuddy/server"
@@ -18,6 +19,19 @@ const (
 	defaultHost     = "127.0.0.1"
 	defaultLogLevel = "info"
 	defaultSerfPort = 6544
+	defaultRegion   = "default"
+	defaultZone     = ""
+
+	defaultDropRetention     = 24 * time.Hour
+	defaultBucketIdleTimeout = 10 * time.Minute
+	defaultMaxOpenBuckets    = 256
+	defaultValueCacheSize    = 0
+	defaultReadOnly          = false
+
+	defaultReplicationLogSize = 100000
+	defaultShardReplicas      = 0
+	defaultShardVirtualNodes  = 64
+	defaultShardProxy         = false
 )
 
 var rootCmd = &cobra.Command{
@@ -39,6 +53,17 @@ func init() {
 	viper.SetDefault("loglevel", defaultLogLevel)
 	viper.SetDefault("join", []string{})
 	viper.SetDefault("serfport", defaultSerfPort)
+	viper.SetDefault("region", defaultRegion)
+	viper.SetDefault("zone", defaultZone)
+	viper.SetDefault("dropretention", defaultDropRetention)
+	viper.SetDefault("bucketidletimeout", defaultBucketIdleTimeout)
+	viper.SetDefault("maxopenbuckets", defaultMaxOpenBuckets)
+	viper.SetDefault("valuecachesize", defaultValueCacheSize)
+	viper.SetDefault("readonly", defaultReadOnly)
+	viper.SetDefault("replicationlogsize", defaultReplicationLogSize)
+	viper.SetDefault("shardreplicas", defaultShardReplicas)
+	viper.SetDefault("shardvnodes", defaultShardVirtualNodes)
+	viper.SetDefault("shardproxy", defaultShardProxy)
 
 	// Parse environment variables.
 	viper.SetEnvPrefix(configEnvPrefix)
@@ -52,6 +77,51 @@ func init() {
 		log.Fatal(err)
 	}
 
+	rootCmd.Flags().Duration("dropretention", defaultDropRetention, "how long dropped buckets are kept before purging (0 keeps them until purged explicitly)")
+	if err := viper.BindPFlag("dropretention", rootCmd.Flags().Lookup("dropretention")); err != nil {
+		log.Fatal(err)
+	}
+
+	rootCmd.Flags().Duration("bucketidletimeout", defaultBucketIdleTimeout, "how long unused buckets stay opened (0 keeps them opened)")
+	if err := viper.BindPFlag("bucketidletimeout", rootCmd.Flags().Lookup("bucketidletimeout")); err != nil {
+		log.Fatal(err)
+	}
+
+	rootCmd.Flags().Int("maxopenbuckets", defaultMaxOpenBuckets, "maximum number of simultaneously opened buckets (0 for no limit)")
+	if err := viper.BindPFlag("maxopenbuckets", rootCmd.Flags().Lookup("maxopenbuckets")); err != nil {
+		log.Fatal(err)
+	}
+
+	rootCmd.Flags().Int64("valuecachesize", defaultValueCacheSize, "size of value cache of each opened bucket in bytes (0 disables the cache)")
+	if err := viper.BindPFlag("valuecachesize", rootCmd.Flags().Lookup("valuecachesize")); err != nil {
+		log.Fatal(err)
+	}
+
+	rootCmd.Flags().Bool("readonly", defaultReadOnly, "open all storage read-only and reject every write (e.g. to serve reads from a copied datadir)")
+	if err := viper.BindPFlag("readonly", rootCmd.Flags().Lookup("readonly")); err != nil {
+		log.Fatal(err)
+	}
+
+	rootCmd.Flags().Uint64("replicationlogsize", defaultReplicationLogSize, "number of the latest writes of each bucket kept for replication to peers (0 disables replication of local writes)")
+	if err := viper.BindPFlag("replicationlogsize", rootCmd.Flags().Lookup("replicationlogsize")); err != nil {
+		log.Fatal(err)
+	}
+
+	rootCmd.Flags().Int("shardreplicas", defaultShardReplicas, "number of kv members owning each key when keys are partitioned (0 disables partitioning)")
+	if err := viper.BindPFlag("shardreplicas", rootCmd.Flags().Lookup("shardreplicas")); err != nil {
+		log.Fatal(err)
+	}
+
+	rootCmd.Flags().Int("shardvnodes", defaultShardVirtualNodes, "number of virtual nodes of each member on the hash ring of partitioning")
+	if err := viper.BindPFlag("shardvnodes", rootCmd.Flags().Lookup("shardvnodes")); err != nil {
+		log.Fatal(err)
+	}
+
+	rootCmd.Flags().Bool("shardproxy", defaultShardProxy, "proxy requests for keys owned by other members instead of redirecting with MOVED")
+	if err := viper.BindPFlag("shardproxy", rootCmd.Flags().Lookup("shardproxy")); err != nil {
+		log.Fatal(err)
+	}
+
 	// RESP server settings.
 	rootCmd.Flags().IntP("port", "p", defaultPort, "port to listen on")
 	if err := viper.BindPFlag("port", rootCmd.Flags().Lookup("port")); err != nil {
@@ -79,6 +149,16 @@ func init() {
 		log.Fatal(err)
 	}
 
+	rootCmd.Flags().String("region", defaultRegion, "region of this member, buckets are only replicated across regions listed in their replication policy")
+	if err := viper.BindPFlag("region", rootCmd.Flags().Lookup("region")); err != nil {
+		log.Fatal(err)
+	}
+
+	rootCmd.Flags().String("zone", defaultZone, "availability zone of this member within its region (informational)")
+	if err := viper.BindPFlag("zone", rootCmd.Flags().Lookup("zone")); err != nil {
+		log.Fatal(err)
+	}
+
 	rootCmd.Flags().StringSliceP("join", "j", []string{}, "comma-separated list of connection strings (address and port) to connect to for cluster bootstrap")
 	if err := viper.BindPFlag("join", rootCmd.Flags().Lookup("join")); err != nil {
 		log.Fatal(err)
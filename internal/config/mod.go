@@ -1,7 +1,48 @@
 // Package config implements DataBuddy configuration.
 package config
 
+import "time"
+
 // Config contains settings shared for the entire DataBuddy instance.
 type Config struct {
 	DataDir string
+
+	// How long dropped buckets are kept on disk before being purged.
+	// Zero keeps dropped buckets until purged explicitly.
+	DropRetention time.Duration
+
+	// How long unused buckets stay opened. Zero keeps them opened.
+	BucketIdleTimeout time.Duration
+
+	// Maximum number of simultaneously opened buckets. Zero means no limit.
+	MaxOpenBuckets int
+
+	// Size of value cache of each opened bucket (in bytes). Zero disables
+	// the cache.
+	ValueCacheSize int64
+
+	// Open all storage read-only, rejecting every write.
+	ReadOnly bool
+
+	// Name of this member, identifying its writes in versions of values of
+	// buckets with conflict policy. Hostname is used if empty.
+	NodeName string
+
+	// Number of the latest writes kept in replication log of each bucket
+	// for peers catching up. Zero disables the log, so that writes aren't
+	// replicated.
+	ReplicationLogSize uint64
+
+	// Number of members owning each key (replication factor) when keys are
+	// partitioned among kv members. Zero disables partitioning, so that
+	// every member holds all keys.
+	ShardReplicas int
+
+	// Number of virtual nodes of each member on the hash ring assigning
+	// slots to members.
+	ShardVirtualNodes int
+
+	// Proxy requests for keys owned by other members, instead of
+	// redirecting clients with MOVED error.
+	ShardProxy bool
 }
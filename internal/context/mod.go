@@ -1,9 +1,57 @@
 // Package context contains connection-specific information.
 package context
 
-import "github.com/pepol/databuddy/internal/db"
+import (
+	"sync"
+
+	"github.com/pepol/databuddy/internal/db"
+)
 
 // Context contains information pertaining to the current connection.
+//
+// Context may be read by other connections (e.g. for statistics), so all
+// access to its fields goes through the synchronized accessors.
 type Context struct {
-	Bucket *db.Bucket
+	bucket *db.Bucket
+	name   string
+	mutex  sync.RWMutex
+}
+
+// New creates connection context using given bucket.
+func New(bucket *db.Bucket) *Context {
+	return &Context{
+		bucket: bucket,
+	}
+}
+
+// Bucket returns the bucket currently used by the connection.
+func (c *Context) Bucket() *db.Bucket {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.bucket
+}
+
+// SetBucket sets the bucket used by the connection.
+func (c *Context) SetBucket(bucket *db.Bucket) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.bucket = bucket
+}
+
+// Name returns the client name set by the connection (empty if not set).
+func (c *Context) Name() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.name
+}
+
+// SetName sets the client name of the connection.
+func (c *Context) SetName(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.name = name
 }
@@ -0,0 +1,501 @@
+// Package crdt implements conflict-free replicated data types: values
+// which members of the cluster change independently and merge into the same
+// state regardless of order and repetition of merges.
+//
+// Supported types are PN-counter (Counter), observed-remove set (Set, which
+// is a grow-only set unless members are removed), last-writer-wins register
+// (Register) and observed-remove map of registers (Map). Changes are made on
+// copies of states, so states passed to them and to Merge are never
+// modified, and states are kept in canonical form, so that equal states
+// encode equally.
+//
+// Every change is identified by Tag, the name of the member making it and
+// its hybrid logical clock time, unique for each change of the member.
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Types of values.
+const (
+	TypeCounter  = "counter"
+	TypeSet      = "set"
+	TypeRegister = "register"
+	TypeMap      = "map"
+)
+
+var (
+	// ErrWrongType is returned for changes of value of another type.
+	ErrWrongType = errors.New("operation against a key holding the wrong kind of value")
+	// ErrNotDeletable is returned for deleting counters, which can only be
+	// decremented.
+	ErrNotDeletable = errors.New("counters can't be deleted")
+)
+
+// Tag identifies change of value.
+type Tag struct {
+	Node string
+	Time uint64
+}
+
+func (t Tag) String() string {
+	return t.Node + ":" + strconv.FormatUint(t.Time, 10)
+}
+
+// Whether change identified by t was made after other.
+func (t Tag) after(other Tag) bool {
+	if t.Time != other.Time {
+		return t.Time > other.Time
+	}
+
+	return t.Node > other.Node
+}
+
+// Value holds state of exactly one of the types.
+type Value struct {
+	Counter  *Counter  `json:"counter,omitempty"`
+	Set      *Set      `json:"set,omitempty"`
+	Register *Register `json:"register,omitempty"`
+	Map      *Map      `json:"map,omitempty"`
+}
+
+// Type returns type of value.
+func (v *Value) Type() string {
+	switch {
+	case v.Counter != nil:
+		return TypeCounter
+	case v.Set != nil:
+		return TypeSet
+	case v.Map != nil:
+		return TypeMap
+	default:
+		return TypeRegister
+	}
+}
+
+// Bytes returns plain representation of value: decimal number for
+// counters, JSON array of members for sets, value of register and JSON
+// object for maps. Returns true if value is deleted (register was deleted,
+// or set or map is empty).
+func (v *Value) Bytes() ([]byte, bool) {
+	switch {
+	case v.Counter != nil:
+		return []byte(strconv.FormatInt(v.Counter.Value(), 10)), false
+	case v.Set != nil:
+		members := v.Set.Members()
+		if len(members) == 0 {
+			return nil, true
+		}
+
+		// Marshalling slice of strings cannot fail.
+		value, _ := json.Marshal(members)
+		return value, false
+	case v.Map != nil:
+		fields := v.Map.Fields()
+		if len(fields) == 0 {
+			return nil, true
+		}
+
+		object := make(map[string]string, len(fields))
+		for field, value := range fields {
+			object[field] = string(value)
+		}
+
+		// Marshalling map of strings cannot fail.
+		value, _ := json.Marshal(object)
+		return value, false
+	case v.Register != nil && !v.Register.Deleted:
+		return v.Register.Value, false
+	default:
+		return nil, true
+	}
+}
+
+// Time returns the latest time of changes of registers of value, so that
+// clocks of members can be advanced past it before writing them.
+func (v *Value) Time() uint64 {
+	var latest uint64
+
+	switch {
+	case v.Register != nil:
+		latest = v.Register.Time
+	case v.Map != nil:
+		for _, register := range v.Map.Values {
+			if register.Time > latest {
+				latest = register.Time
+			}
+		}
+	}
+
+	return latest
+}
+
+// Merge returns state including all changes of a and b (either may be
+// nil). Values of different types (changed concurrently by members unaware
+// of each other) resolve to the one whose type sorts last.
+func Merge(a, b *Value) *Value {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.Type() != b.Type():
+		if a.Type() > b.Type() {
+			return a
+		}
+		return b
+	}
+
+	switch {
+	case a.Counter != nil:
+		return &Value{Counter: a.Counter.Merge(b.Counter)}
+	case a.Set != nil:
+		return &Value{Set: a.Set.Merge(b.Set)}
+	case a.Map != nil:
+		return &Value{Map: a.Map.Merge(b.Map)}
+	case a.Register == nil:
+		return b
+	case b.Register == nil:
+		return a
+	default:
+		return &Value{Register: a.Register.Merge(b.Register)}
+	}
+}
+
+// Delete returns value v (nil if missing) with all its observed contents
+// removed.
+func Delete(v *Value, tag Tag) (*Value, error) {
+	switch {
+	case v == nil:
+		return &Value{Register: &Register{Deleted: true, Time: tag.Time, Node: tag.Node}}, nil
+	case v.Counter != nil:
+		return nil, ErrNotDeletable
+	case v.Set != nil:
+		return &Value{Set: v.Set.Remove(v.Set.Members()...)}, nil
+	case v.Map != nil:
+		return &Value{Map: v.Map.Remove(v.Map.keys().Members()...)}, nil
+	default:
+		return &Value{Register: v.Register.Set(nil, true, tag)}, nil
+	}
+}
+
+// AsCounter returns counter of value v, empty one if v is nil.
+func AsCounter(v *Value) (*Counter, error) {
+	switch {
+	case v == nil:
+		return &Counter{}, nil
+	case v.Counter == nil:
+		return nil, fmt.Errorf("%w (%s)", ErrWrongType, v.Type())
+	default:
+		return v.Counter, nil
+	}
+}
+
+// AsSet returns set of value v, empty one if v is nil.
+func AsSet(v *Value) (*Set, error) {
+	switch {
+	case v == nil:
+		return &Set{}, nil
+	case v.Set == nil:
+		return nil, fmt.Errorf("%w (%s)", ErrWrongType, v.Type())
+	default:
+		return v.Set, nil
+	}
+}
+
+// AsRegister returns register of value v, empty one if v is nil.
+func AsRegister(v *Value) (*Register, error) {
+	switch {
+	case v == nil:
+		return &Register{Deleted: true}, nil
+	case v.Register == nil:
+		return nil, fmt.Errorf("%w (%s)", ErrWrongType, v.Type())
+	default:
+		return v.Register, nil
+	}
+}
+
+// AsMap returns map of value v, empty one if v is nil.
+func AsMap(v *Value) (*Map, error) {
+	switch {
+	case v == nil:
+		return &Map{}, nil
+	case v.Map == nil:
+		return nil, fmt.Errorf("%w (%s)", ErrWrongType, v.Type())
+	default:
+		return v.Map, nil
+	}
+}
+
+// Counter is a PN-counter: sums of increments and decrements made by each
+// member.
+type Counter struct {
+	Inc map[string]uint64 `json:"p,omitempty"`
+	Dec map[string]uint64 `json:"n,omitempty"`
+}
+
+// Value returns the current count.
+func (c *Counter) Value() int64 {
+	var value int64
+	for _, n := range c.Inc {
+		value += int64(n)
+	}
+	for _, n := range c.Dec {
+		value -= int64(n)
+	}
+
+	return value
+}
+
+// Add returns counter with delta added by member node.
+func (c *Counter) Add(node string, delta int64) *Counter {
+	if delta == 0 {
+		return c
+	}
+
+	next := &Counter{Inc: copyCounts(c.Inc), Dec: copyCounts(c.Dec)}
+
+	if delta > 0 {
+		next.Inc[node] += uint64(delta)
+	} else {
+		next.Dec[node] += uint64(-delta)
+	}
+
+	return next
+}
+
+// Merge returns counter including all changes of c and other.
+func (c *Counter) Merge(other *Counter) *Counter {
+	next := &Counter{Inc: copyCounts(c.Inc), Dec: copyCounts(c.Dec)}
+	maxCounts(next.Inc, other.Inc)
+	maxCounts(next.Dec, other.Dec)
+
+	return next
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	copied := make(map[string]uint64, len(counts))
+	for node, n := range counts {
+		copied[node] = n
+	}
+
+	return copied
+}
+
+func maxCounts(counts, other map[string]uint64) {
+	for node, n := range other {
+		if current, ok := counts[node]; !ok || n > current {
+			counts[node] = n
+		}
+	}
+}
+
+// Set is an observed-remove set: members are present while they have tags
+// of additions not observed by any removal. Concurrent addition and removal
+// of the same member keeps it.
+type Set struct {
+	// Tags of additions and of removed additions by member, sorted.
+	Added   map[string][]string `json:"a,omitempty"`
+	Removed map[string][]string `json:"r,omitempty"`
+}
+
+// Members returns present members in ascending order.
+func (s *Set) Members() []string {
+	members := make([]string, 0, len(s.Added))
+	for member := range s.Added {
+		if s.Contains(member) {
+			members = append(members, member)
+		}
+	}
+
+	sort.Strings(members)
+	return members
+}
+
+// Contains returns whether member is present.
+func (s *Set) Contains(member string) bool {
+	for _, tag := range s.Added[member] {
+		if !containsSorted(s.Removed[member], tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Add returns set with members added by change identified by tag.
+func (s *Set) Add(tag Tag, members ...string) *Set {
+	next := s.copy()
+	for _, member := range members {
+		next.Added[member] = union(next.Added[member], []string{tag.String()})
+	}
+
+	return next
+}
+
+// Remove returns set without members (all their observed additions are
+// removed).
+func (s *Set) Remove(members ...string) *Set {
+	next := s.copy()
+	for _, member := range members {
+		if len(next.Added[member]) > 0 {
+			next.Removed[member] = union(next.Removed[member], next.Added[member])
+		}
+	}
+
+	return next
+}
+
+// Merge returns set including all changes of s and other.
+func (s *Set) Merge(other *Set) *Set {
+	next := s.copy()
+	for member, tags := range other.Added {
+		next.Added[member] = union(next.Added[member], tags)
+	}
+	for member, tags := range other.Removed {
+		next.Removed[member] = union(next.Removed[member], tags)
+	}
+
+	return next
+}
+
+func (s *Set) copy() *Set {
+	next := &Set{Added: make(map[string][]string, len(s.Added)), Removed: make(map[string][]string, len(s.Removed))}
+	for member, tags := range s.Added {
+		next.Added[member] = tags
+	}
+	for member, tags := range s.Removed {
+		next.Removed[member] = tags
+	}
+
+	return next
+}
+
+// Sorted union of sorted slices, not sharing memory with them.
+func union(a, b []string) []string {
+	merged := make([]string, 0, len(a)+len(b))
+
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0] < b[0]):
+			merged, a = append(merged, a[0]), a[1:]
+		case len(a) == 0 || b[0] < a[0]:
+			merged, b = append(merged, b[0]), b[1:]
+		default:
+			merged, a, b = append(merged, a[0]), a[1:], b[1:]
+		}
+	}
+
+	return merged
+}
+
+func containsSorted(values []string, value string) bool {
+	i := sort.SearchStrings(values, value)
+	return i < len(values) && values[i] == value
+}
+
+// Register is a last-writer-wins register: the value written by the latest
+// change (by hybrid logical clock time, ties broken by member name).
+type Register struct {
+	Value   []byte `json:"v,omitempty"`
+	Deleted bool   `json:"d,omitempty"`
+	Time    uint64 `json:"t,omitempty"`
+	Node    string `json:"n,omitempty"`
+}
+
+// Set returns register with value written (or deleted) by change
+// identified by tag.
+func (r *Register) Set(value []byte, deleted bool, tag Tag) *Register {
+	if deleted {
+		value = nil
+	}
+
+	return r.Merge(&Register{Value: value, Deleted: deleted, Time: tag.Time, Node: tag.Node})
+}
+
+// Merge returns the later of r and other.
+func (r *Register) Merge(other *Register) *Register {
+	if (Tag{Node: other.Node, Time: other.Time}).after(Tag{Node: r.Node, Time: r.Time}) {
+		return other
+	}
+
+	return r
+}
+
+// Map is an observed-remove map of registers: fields are present while
+// they are members of the set of keys, and their values are registers.
+type Map struct {
+	Keys   *Set                 `json:"f,omitempty"`
+	Values map[string]*Register `json:"v,omitempty"`
+}
+
+// Fields returns values of present fields.
+func (m *Map) Fields() map[string][]byte {
+	fields := make(map[string][]byte)
+	for _, field := range m.keys().Members() {
+		fields[field] = m.Values[field].Value
+	}
+
+	return fields
+}
+
+// Set returns map with fields set to values by change identified by tag.
+func (m *Map) Set(tag Tag, values map[string][]byte) *Map {
+	fields := make([]string, 0, len(values))
+	for field := range values {
+		fields = append(fields, field)
+	}
+
+	next := &Map{Keys: m.keys().Add(tag, fields...), Values: copyRegisters(m.Values)}
+	for field, value := range values {
+		current, ok := next.Values[field]
+		if !ok {
+			current = &Register{Deleted: true}
+		}
+
+		next.Values[field] = current.Set(value, false, tag)
+	}
+
+	return next
+}
+
+// Remove returns map without fields.
+func (m *Map) Remove(fields ...string) *Map {
+	return &Map{Keys: m.keys().Remove(fields...), Values: copyRegisters(m.Values)}
+}
+
+// Merge returns map including all changes of m and other.
+func (m *Map) Merge(other *Map) *Map {
+	next := &Map{Keys: m.keys().Merge(other.keys()), Values: copyRegisters(m.Values)}
+	for field, value := range other.Values {
+		if current, ok := next.Values[field]; ok {
+			next.Values[field] = current.Merge(value)
+		} else {
+			next.Values[field] = value
+		}
+	}
+
+	return next
+}
+
+func (m *Map) keys() *Set {
+	if m.Keys == nil {
+		return &Set{}
+	}
+
+	return m.Keys
+}
+
+func copyRegisters(registers map[string]*Register) map[string]*Register {
+	copied := make(map[string]*Register, len(registers))
+	for field, register := range registers {
+		copied[field] = register
+	}
+
+	return copied
+}
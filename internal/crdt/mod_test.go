@@ -0,0 +1,154 @@
+package crdt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"testing/quick"
+)
+
+var testNodes = [3]string{"a", "b", "c"}
+
+// replicas are states of one key on three members, built by random changes
+// of each member interleaved with merges of states of the others, so that
+// they share part of their history. Rarely a member writes value of another
+// type.
+type replicas [3]*Value
+
+func (replicas) Generate(r *rand.Rand, size int) reflect.Value {
+	types := []string{TypeCounter, TypeSet, TypeRegister, TypeMap}
+	typ := types[r.Intn(len(types))]
+
+	var (
+		states replicas
+		clocks [3]uint64
+	)
+
+	for step := 0; step < 1+r.Intn(size+1); step++ {
+		i := r.Intn(len(states))
+
+		if j := r.Intn(len(states)); j != i && r.Intn(4) == 0 {
+			states[i] = Merge(states[i], states[j])
+			continue
+		}
+
+		// Clocks of members advance independently, so that their times
+		// may be equal.
+		clocks[i] += 1 + uint64(r.Intn(3))
+		tag := Tag{Node: testNodes[i], Time: clocks[i]}
+
+		changeType := typ
+		if r.Intn(20) == 0 {
+			changeType = types[r.Intn(len(types))]
+		}
+
+		if changed, err := randomChange(r, states[i], changeType, tag); err == nil {
+			states[i] = changed
+		}
+	}
+
+	return reflect.ValueOf(states)
+}
+
+func (s replicas) GoString() string {
+	return fmt.Sprintf("replicas{%s, %s, %s}", encode(s[0]), encode(s[1]), encode(s[2]))
+}
+
+// Change value v (nil if missing) of given type by member with tag.
+func randomChange(r *rand.Rand, v *Value, typ string, tag Tag) (*Value, error) {
+	field := strconv.Itoa(r.Intn(4))
+	value := []byte(strconv.Itoa(r.Intn(10)))
+
+	switch typ {
+	case TypeCounter:
+		counter, err := AsCounter(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Value{Counter: counter.Add(tag.Node, int64(r.Intn(11)-5))}, nil
+	case TypeSet:
+		set, err := AsSet(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Intn(3) == 0 {
+			return &Value{Set: set.Remove(field)}, nil
+		}
+		return &Value{Set: set.Add(tag, field)}, nil
+	case TypeRegister:
+		if r.Intn(4) == 0 {
+			return Delete(v, tag)
+		}
+
+		register, err := AsRegister(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Value{Register: register.Set(value, false, tag)}, nil
+	default:
+		m, err := AsMap(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Intn(3) == 0 {
+			return &Value{Map: m.Remove(field)}, nil
+		}
+		return &Value{Map: m.Set(tag, map[string][]byte{field: value})}, nil
+	}
+}
+
+func encode(v *Value) string {
+	// Marshalling struct of plain fields cannot fail.
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func checkProperty(t *testing.T, property func(s replicas) bool) {
+	t.Helper()
+
+	cfg := &quick.Config{MaxCount: 2000, Rand: rand.New(rand.NewSource(1))}
+	if err := quick.Check(property, cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeCommutative(t *testing.T) {
+	checkProperty(t, func(s replicas) bool {
+		return encode(Merge(s[0], s[1])) == encode(Merge(s[1], s[0]))
+	})
+}
+
+func TestMergeAssociative(t *testing.T) {
+	checkProperty(t, func(s replicas) bool {
+		return encode(Merge(Merge(s[0], s[1]), s[2])) == encode(Merge(s[0], Merge(s[1], s[2])))
+	})
+}
+
+func TestMergeIdempotent(t *testing.T) {
+	checkProperty(t, func(s replicas) bool {
+		merged := Merge(s[0], s[1])
+
+		return encode(Merge(s[0], s[0])) == encode(s[0]) &&
+			encode(Merge(merged, s[1])) == encode(merged) &&
+			encode(Merge(merged, merged)) == encode(merged)
+	})
+}
+
+// Merges return new states, leaving the merged ones unchanged.
+func TestMergeKeepsStates(t *testing.T) {
+	checkProperty(t, func(s replicas) bool {
+		before := s.GoString()
+
+		Merge(Merge(s[0], s[1]), s[2])
+		Merge(s[2], Merge(s[1], s[0]))
+
+		return s.GoString() == before
+	})
+}
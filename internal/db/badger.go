@@ -0,0 +1,239 @@
+package db
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Transactions conflicting with concurrent ones are retried with linearly
+// increasing delay.
+const (
+	maxConflictRetries   = 10
+	conflictRetryBackoff = time.Millisecond
+)
+
+// badgerEngine stores bucket data in Badger instance, under key prefix (if
+// the instance is shared by multiple buckets).
+type badgerEngine struct {
+	db     *badger.DB
+	prefix []byte
+}
+
+func newBadgerEngine(db *badger.DB, prefix []byte) *badgerEngine {
+	return &badgerEngine{db: db, prefix: prefix}
+}
+
+func (e *badgerEngine) Get(key []byte) ([]byte, error) {
+	var value []byte
+
+	err := e.db.View(func(txn *badger.Txn) error {
+		var err error
+		value, err = badgerGet(txn, e.key(key))
+		return err
+	})
+
+	return value, err
+}
+
+func (e *badgerEngine) Iterate(prefix []byte, keysOnly bool, fn func(key, value []byte) error) error {
+	return e.db.View(func(txn *badger.Txn) error {
+		return badgerIterate(txn, e.prefix, prefix, nil, keysOnly, fn)
+	})
+}
+
+func (e *badgerEngine) IterateFrom(prefix, start []byte, keysOnly bool, fn func(key, value []byte) error) error {
+	return e.db.View(func(txn *badger.Txn) error {
+		return badgerIterate(txn, e.prefix, prefix, start, keysOnly, fn)
+	})
+}
+
+func (e *badgerEngine) Set(key, value []byte) error {
+	return e.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(e.key(key), value)
+	})
+}
+
+func (e *badgerEngine) Delete(key []byte) error {
+	return e.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(e.key(key))
+	})
+}
+
+func (e *badgerEngine) Update(fn func(txn Txn) error) error {
+	for attempt := 1; ; attempt++ {
+		err := e.db.Update(func(txn *badger.Txn) error {
+			return fn(&badgerTxn{txn: txn, prefix: e.prefix})
+		})
+		if err != badger.ErrConflict || attempt == maxConflictRetries {
+			return err
+		}
+
+		time.Sleep(time.Duration(attempt) * conflictRetryBackoff)
+	}
+}
+
+func (e *badgerEngine) NewBatch() Batch {
+	return &badgerBatch{batch: e.db.NewWriteBatch(), prefix: e.prefix}
+}
+
+func (e *badgerEngine) View(fn func(txn Reader) error) error {
+	return e.db.View(func(txn *badger.Txn) error {
+		return fn(&badgerTxn{txn: txn, prefix: e.prefix})
+	})
+}
+
+func (e *badgerEngine) Snapshot() Snapshot {
+	return &badgerTxn{txn: e.db.NewTransaction(false), prefix: e.prefix}
+}
+
+func (e *badgerEngine) DropAll() error {
+	if len(e.prefix) == 0 {
+		return e.db.DropAll()
+	}
+
+	return badgerDeletePrefix(e.db, e.prefix)
+}
+
+func (e *badgerEngine) Close() error {
+	return e.db.Close()
+}
+
+// Return full key of item within the Badger instance.
+func (e *badgerEngine) key(key []byte) []byte {
+	return prefixedKey(e.prefix, key)
+}
+
+// Delete all keys with prefix from shared Badger instance. Unlike
+// DropPrefix, which blocks writes to the whole instance while dropping, this
+// deletes keys in batches, so that buckets sharing the instance can be
+// written concurrently.
+func badgerDeletePrefix(db *badger.DB, prefix []byte) error {
+	batch := db.NewWriteBatch()
+	defer batch.Cancel()
+
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := batch.Delete(it.Item().KeyCopy(nil)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return batch.Flush()
+}
+
+// badgerBatch implements Batch using Badger WriteBatch, which commits
+// writes in multiple transactions as needed.
+type badgerBatch struct {
+	batch  *badger.WriteBatch
+	prefix []byte
+}
+
+func (b *badgerBatch) Set(key, value []byte) error {
+	return b.batch.Set(prefixedKey(b.prefix, key), value)
+}
+
+func (b *badgerBatch) Delete(key []byte) error {
+	return b.batch.Delete(prefixedKey(b.prefix, key))
+}
+
+func (b *badgerBatch) Flush() error {
+	return b.batch.Flush()
+}
+
+func (b *badgerBatch) Cancel() {
+	b.batch.Cancel()
+}
+
+// badgerTxn implements both Txn and Snapshot.
+type badgerTxn struct {
+	txn    *badger.Txn
+	prefix []byte
+}
+
+func (t *badgerTxn) Get(key []byte) ([]byte, error) {
+	return badgerGet(t.txn, prefixedKey(t.prefix, key))
+}
+
+func (t *badgerTxn) Iterate(prefix []byte, keysOnly bool, fn func(key, value []byte) error) error {
+	return badgerIterate(t.txn, t.prefix, prefix, nil, keysOnly, fn)
+}
+
+func (t *badgerTxn) IterateFrom(prefix, start []byte, keysOnly bool, fn func(key, value []byte) error) error {
+	return badgerIterate(t.txn, t.prefix, prefix, start, keysOnly, fn)
+}
+
+func (t *badgerTxn) Set(key, value []byte) error {
+	return t.txn.Set(prefixedKey(t.prefix, key), value)
+}
+
+func (t *badgerTxn) Delete(key []byte) error {
+	return t.txn.Delete(prefixedKey(t.prefix, key))
+}
+
+func (t *badgerTxn) Release() {
+	t.txn.Discard()
+}
+
+func badgerGet(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+func badgerIterate(txn *badger.Txn, base, prefix, start []byte, keysOnly bool, fn func(key, value []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = !keysOnly
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	full := prefixedKey(base, prefix)
+
+	seek := full
+	if bytes.Compare(start, prefix) > 0 {
+		seek = prefixedKey(base, start)
+	}
+
+	for it.Seek(seek); it.ValidForPrefix(full); it.Next() {
+		item := it.Item()
+
+		var value []byte
+		if !keysOnly {
+			var err error
+			if value, err = item.ValueCopy(value); err != nil {
+				return err
+			}
+		}
+
+		if err := fn(item.Key()[len(base):], value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func prefixedKey(prefix, key []byte) []byte {
+	full := make([]byte, 0, len(prefix)+len(key))
+	full = append(full, prefix...)
+
+	return append(full, key...)
+}
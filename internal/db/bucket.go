@@ -1,13 +1,13 @@
 package db
 
 import (
+	"container/list"
 	"fmt"
 	"path/filepath"
 	"regexp"
 	"sync"
-
-	"github.com/dgraph-io/badger/v3"
-	"github.com/pepol/databuddy/internal/log"
+	"sync/atomic"
+	"time"
 )
 
 // DefaultBucketName contains the name of bucket created on database initialization.
@@ -15,11 +15,47 @@ const DefaultBucketName = "default"
 
 // Bucket is the single "table" within the database.
 type Bucket struct {
+	// Unix time (in nanoseconds) of the last write, accessed atomically.
+	lastWrite int64
+
 	Name string
 
-	path  string
-	db    *badger.DB
+	meta      bucketMeta
+	store     storage
+	engine    Engine
+	cache     *valueCache // Nil if disabled.
+	committer *committer
+	validator *validator // Compiled schema, nil if there is none.
+	// Set for all buckets of database opened read-only.
+	databaseReadOnly bool
+	// Guards opening and closing of the engine; concurrency of data
+	// operations is left to the engine. Exclusive access must be taken
+	// using lock.
 	mutex sync.RWMutex
+	// Count of goroutines waiting for exclusive access, accessed atomically.
+	exclusiveWaiters int32
+
+	validationMutex sync.Mutex
+	validation      SchemaValidation
+
+	// Progress of running index build.
+	buildMutex   sync.Mutex
+	buildIndex   string
+	buildScanned uint64
+
+	// Serializes writes to vector indexes.
+	vectorMutex sync.Mutex
+	// Serializes writes to time series.
+	seriesMutex sync.Mutex
+
+	// Position of replication log when the bucket was last closed.
+	closedPosition LogPosition
+
+	// Lifecycle state, guarded by the Database mutex.
+	refs     int
+	lastUsed time.Time
+	lru      *list.Element // Set while the bucket is opened.
+	building bool          // Whether index build is running.
 }
 
 const (
@@ -27,153 +63,330 @@ const (
 	rfc1123LabelMaxLength = 63
 )
 
-func openBucket(name, basePath string) (*Bucket, error) {
+func newBucket(name string, store storage, meta bucketMeta) (*Bucket, error) {
+	if !isValidBucketName(name) {
+		return nil, fmt.Errorf("bucket name '%s' does not match RFC1123 label requirements", name)
+	}
+
+	validator, err := compileSchema(meta.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("compiling schema of bucket '%s': %v", name, err)
+	}
+
+	return &Bucket{
+		Name:      name,
+		meta:      meta,
+		store:     store,
+		validator: validator,
+	}, nil
+}
+
+// Open bucket stored in its own directory, bypassing name validation.
+func openBucketNoCheck(name, basePath string, readOnly bool) (*Bucket, error) {
 	if basePath == "" {
 		return nil, fmt.Errorf("no path specified for bucket %s", name)
 	}
 
-	if !isValidBucketName(name) {
-		return nil, fmt.Errorf("bucket name '%s' does not match RFC1123 label requirements", name)
+	bucket := &Bucket{
+		Name:             name,
+		store:            &dirStorage{datadir: basePath, readOnly: readOnly},
+		databaseReadOnly: readOnly,
+	}
+
+	if err := bucket.open(0, false, nil); err != nil {
+		return nil, err
 	}
 
-	return openBucketNoCheck(name, basePath)
+	return bucket, nil
 }
 
-func openBucketNoCheck(name, basePath string) (*Bucket, error) {
-	path, err := filepath.Abs(filepath.Join(basePath, "buckets", name))
-	if err != nil {
-		return nil, err
+// Open the underlying storage engine (no-op if already opened), with value
+// cache of given size (in bytes, 0 disables the cache), recording writes in
+// replication log if logged is set and versioning them with given versioner
+// (nil if the bucket has no conflict policy).
+func (b *Bucket) open(cacheSize int64, logged bool, versions *versioner) error {
+	b.lock()
+	defer b.mutex.Unlock()
+
+	if b.engine != nil {
+		return nil
 	}
 
-	logger := log.GetBadgerLogger()
+	if b.meta.engine() == EngineMemory {
+		cacheSize = 0 // Nothing to gain.
+	}
 
-	opt := badger.DefaultOptions(path).
-		WithCompactL0OnClose(true).
-		WithMetricsEnabled(true).
-		WithLogger(logger)
+	cache, err := newValueCache(cacheSize)
+	if err != nil {
+		return fmt.Errorf("creating value cache: %v", err)
+	}
 
-	db, err := badger.Open(opt)
+	engine, err := b.store.open(b.Name, b.meta)
 	if err != nil {
-		return nil, err
+		cache.close()
+		return err
 	}
 
-	return &Bucket{
-		Name: name,
-		path: path,
-		db:   db,
-	}, nil
+	b.engine = engine
+	b.cache = cache
+	b.committer = newCommitter(engine, cache, b.meta.Quota, compileIndexes(b.meta.Indexes), logged, versions)
+	return nil
+}
+
+// Engine returns name of the storage engine of bucket.
+func (b *Bucket) Engine() string {
+	return b.meta.engine()
 }
 
 // List keys with given prefix.
 func (b *Bucket) List(prefix string) ([]string, error) {
-	if b.db == nil {
-		return nil, fmt.Errorf("bucket '%s' not opened", b.Name)
-	}
-
-	var buckets []string
+	var keys []string
 
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
 
-	err := b.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		prefixB := []byte(prefix)
+	if b.engine == nil {
+		return nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
 
-		for it.Seek(prefixB); it.ValidForPrefix(prefixB); it.Next() {
-			item := it.Item()
-			key := string(item.KeyCopy(nil))
-			buckets = append(buckets, key)
+	err := b.engine.Iterate([]byte(prefix), true, func(key, _ []byte) error {
+		if isInternalKey(key) {
+			return errStopIteration
 		}
 
+		keys = append(keys, string(key))
 		return nil
 	})
-	if err != nil {
+	if err != nil && err != errStopIteration {
 		return nil, err
 	}
 
-	return buckets, nil
+	return keys, nil
 }
 
 // Get value stored under key.
 func (b *Bucket) Get(key string) ([]byte, error) {
-	if b.db == nil {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
 		return nil, fmt.Errorf("bucket '%s' not opened", b.Name)
 	}
 
-	var value []byte
-
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
+	if isInternalKey([]byte(key)) {
+		return nil, ErrKeyNotFound
+	}
 
-	err := b.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
-		if err != nil {
-			return err
-		}
+	if value, ok := b.cache.get([]byte(key)); ok {
+		return value, nil
+	}
 
-		value, err = item.ValueCopy(nil)
-		if err != nil {
-			return err
-		}
+	generation := b.cache.current()
 
-		return nil
-	})
+	value, err := b.engine.Get([]byte(key))
 	if err != nil {
 		return nil, err
 	}
 
+	b.cache.fill([]byte(key), value, generation)
 	return value, nil
 }
 
 // Set key to point to value.
 func (b *Bucket) Set(key string, value []byte) error {
-	if b.db == nil {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
 		return fmt.Errorf("bucket '%s' not opened", b.Name)
 	}
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
 
-	return b.db.Update(func(txn *badger.Txn) error {
-		entry := badger.NewEntry([]byte(key), value)
+	if isInternalKey([]byte(key)) {
+		return errReservedKey
+	}
 
-		if err := txn.SetEntry(entry); err != nil {
-			return err
-		}
+	if err := b.validator.check([]byte(key), value); err != nil {
+		return err
+	}
 
-		return nil
-	})
+	if err := b.committer.write([]byte(key), value, false); err != nil {
+		return err
+	}
+
+	b.touch()
+	return nil
 }
 
 // Delete value stored under key.
 func (b *Bucket) Delete(key string) error {
-	if b.db == nil {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
 		return fmt.Errorf("bucket '%s' not opened", b.Name)
 	}
 
-	b.mutex.Lock()
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	if isInternalKey([]byte(key)) {
+		return errReservedKey
+	}
+
+	if err := b.committer.write([]byte(key), nil, true); err != nil {
+		return err
+	}
+
+	b.touch()
+	return nil
+}
+
+// LastWrite returns time of the last successful write to bucket (zero time
+// if there was no write since the bucket was opened).
+func (b *Bucket) LastWrite() time.Time {
+	nsec := atomic.LoadInt64(&b.lastWrite)
+	if nsec == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nsec)
+}
+
+func (b *Bucket) touch() {
+	atomic.StoreInt64(&b.lastWrite, time.Now().UnixNano())
+}
+
+// Flush removes all data stored in bucket.
+func (b *Bucket) Flush() error {
+	// Exclusive lock waits for all writes and reads, so that the cache can
+	// be replaced.
+	b.lock()
 	defer b.mutex.Unlock()
 
-	return b.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(key))
-	})
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := b.engine.DropAll(); err != nil {
+		return err
+	}
+
+	if err := b.cache.reset(); err != nil {
+		return fmt.Errorf("resetting value cache: %v", err)
+	}
+
+	b.committer.resetUsage()
+	if b.committer.logged {
+		b.committer.resetLog()
+	}
+
+	b.touch()
+	return nil
 }
 
-// Close the underlying BadgerDB.
+// Close the underlying storage engine.
 func (b *Bucket) Close() error {
-	if b.db == nil {
-		return nil // Database isn't even opened.
+	b.lock()
+	defer b.mutex.Unlock()
+
+	if b.engine == nil {
+		return nil // Engine isn't even opened.
 	}
 
+	// Writes of clients hold the read lock, so nothing is queued anymore.
+	b.committer.close()
+	b.closedPosition = b.committer.position()
+
+	b.cache.close()
+
+	err := b.store.close(b.engine)
+	b.engine = nil
+	b.cache = nil
+	b.committer = nil
+
+	return err
+}
+
+// Take exclusive access to the bucket, interrupting long-running scans.
+func (b *Bucket) lock() {
+	atomic.AddInt32(&b.exclusiveWaiters, 1)
 	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	atomic.AddInt32(&b.exclusiveWaiters, -1)
+}
+
+// Run read-write transaction over multiple keys of the bucket.
+func (b *Bucket) update(fn func(txn Txn) error) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	var written [][]byte
+
+	err := b.engine.Update(func(txn Txn) error {
+		recorder := &recordingTxn{Txn: txn}
+		err := fn(recorder)
+		written = recorder.written
+		return err
+	})
+
+	// Even failed commit may be partially applied.
+	b.cache.invalidate(written)
+	if len(written) > 0 {
+		b.committer.invalidateUsage()
+	}
+
+	return err
+}
+
+// recordingTxn records keys written by transaction.
+type recordingTxn struct {
+	Txn
+	written [][]byte
+}
+
+func (t *recordingTxn) Set(key, value []byte) error {
+	t.written = append(t.written, key)
+	return t.Txn.Set(key, value)
+}
+
+func (t *recordingTxn) Delete(key []byte) error {
+	t.written = append(t.written, key)
+	return t.Txn.Delete(key)
+}
+
+// Copy all data of the bucket into given engine.
+func (b *Bucket) copyTo(dst Engine) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	snapshot := b.engine.Snapshot()
+	defer snapshot.Release()
+
+	return copyData(snapshot, dst)
+}
 
-	return b.db.Close()
+func bucketPath(basePath, name string) (string, error) {
+	return filepath.Abs(filepath.Join(basePath, "buckets", name))
 }
 
 func isValidBucketName(name string) bool {
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+// Values read from Badger are cached per bucket. Readers fill the cache on
+// misses, while the committer removes every written key, so that the next
+// read fills the new value. Written values are not cached directly: ristretto
+// admits new keys asynchronously and rejects a key already admitted, so a
+// write could be lost behind a fill of older value still pending. Removal is
+// ordered with pending fills. Each write also increments the cache
+// generation, and readers only fill values read within a single generation,
+// so that a value read before concurrent write is never cached after it.
+
+const (
+	// Expected average cost of cached item, used to size admission counters.
+	valueCacheAvgItemCost = 256
+	valueCacheMinCounters = 1000
+	valueCacheBufferItems = 64
+)
+
+// valueCache is an optional read cache of bucket values. All methods are
+// no-op on nil (disabled) cache.
+type valueCache struct {
+	size  int64
+	cache *ristretto.Cache
+
+	mutex      sync.Mutex // Orders filling of the cache with writes.
+	generation uint64
+
+	// Metrics of caches replaced on reset.
+	retired CacheStats
+}
+
+func newValueCache(size int64) (*valueCache, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+
+	cache, err := newRistretto(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &valueCache{size: size, cache: cache}, nil
+}
+
+func newRistretto(size int64) (*ristretto.Cache, error) {
+	counters := size / valueCacheAvgItemCost * 10 //nolint:gomnd // Recommended by ristretto.
+	if counters < valueCacheMinCounters {
+		counters = valueCacheMinCounters
+	}
+
+	return ristretto.NewCache(&ristretto.Config{
+		NumCounters:        counters,
+		MaxCost:            size,
+		BufferItems:        valueCacheBufferItems,
+		Metrics:            true,
+		IgnoreInternalCost: true,
+	})
+}
+
+// Get copy of cached value.
+func (c *valueCache) get(key []byte) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	value, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	cached, _ := value.([]byte)
+	return append([]byte(nil), cached...), true
+}
+
+// Current generation, to be passed to fill after reading the value.
+func (c *valueCache) current() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.generation
+}
+
+// Cache value read in given generation, unless there was a write since.
+func (c *valueCache) fill(key, value []byte, generation uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.generation == generation {
+		c.cache.Set(key, append([]byte(nil), value...), int64(len(key)+len(value)))
+	}
+}
+
+// Remove keys of committed (or failed) writes from cache.
+func (c *valueCache) written(ops []*writeOp) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+
+	for _, op := range ops {
+		c.cache.Del(op.key)
+	}
+}
+
+// Remove given keys from cache.
+func (c *valueCache) invalidate(keys [][]byte) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+
+	for _, key := range keys {
+		c.cache.Del(key)
+	}
+}
+
+// Replace the cache with an empty one. No other methods may be called
+// concurrently.
+func (c *valueCache) reset() error {
+	if c == nil {
+		return nil
+	}
+
+	cache, err := newRistretto(c.size)
+	if err != nil {
+		return err
+	}
+
+	c.retired = addCacheStats(c.retired, cacheStats(c.cache.Metrics))
+	c.cache.Close()
+	c.cache = cache
+	c.generation++
+
+	return nil
+}
+
+func (c *valueCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+
+	return addCacheStats(c.retired, cacheStats(c.cache.Metrics))
+}
+
+func (c *valueCache) close() {
+	if c == nil {
+		return
+	}
+
+	c.cache.Close()
+}
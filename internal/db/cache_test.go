@@ -0,0 +1,98 @@
+package db
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pepol/databuddy/internal/config"
+)
+
+// Value read right after acknowledged write is the written one, even while
+// concurrent readers keep filling the cache with older values.
+func TestValueCacheReadAfterWrite(t *testing.T) {
+	db := openTestDatabase(t, func(cfg *config.Config) { cfg.ValueCacheSize = 1 << 20 })
+	bucket := createTestBucket(t, db, "cached", BucketOptions{})
+
+	const (
+		readers = 8
+		writes  = 2000
+	)
+
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		if err := bucket.Set(key, []byte("-1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				for _, key := range keys {
+					if _, err := bucket.Get(key); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < writes; i++ {
+		key := keys[i%len(keys)]
+		value := strconv.Itoa(i)
+
+		if err := bucket.Set(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := bucket.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != value {
+			close(stop)
+			wg.Wait()
+			t.Fatalf("read %q after write %d of %q", got, i, value)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	if stats := db.ValueCacheStats(); stats.Hits == 0 {
+		t.Fatalf("value cache not used: %+v", stats)
+	}
+}
+
+// Write of key with fill still pending in the cache must not be lost behind
+// the filled (older) value.
+func TestValueCacheWriteAfterPendingFill(t *testing.T) {
+	c, err := newValueCache(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	key := []byte("k")
+
+	c.fill(key, []byte("old"), c.current())
+	c.written([]*writeOp{{key: key, value: []byte("new")}})
+	c.cache.Wait()
+
+	if value, ok := c.get(key); ok && string(value) != "new" {
+		t.Fatalf("cached %q after write of %q", value, "new")
+	}
+}
@@ -0,0 +1,260 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pepol/databuddy/internal/crdt"
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Independent writes (Set and Delete) of concurrent clients are committed in
+// groups. Each write is queued to the committer of the bucket, which takes
+// all writes queued in the meantime and applies them in one batch, so that
+// concurrent writers share the cost of a commit.
+
+// Maximum number of writes committed in one group.
+const maxGroupCommitSize = 1024
+
+type writeOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+	done   chan error
+
+	// Version of the write in bucket with conflict policy, and clock of
+	// siblings it resolves (nil for all known ones). Value and delete are
+	// replaced by the resulting value of the key, the written one is kept
+	// in original, so that the write can be versioned again on retry.
+	meta     []byte
+	context  VectorClock
+	original *Sibling
+
+	// Change of data type of key in bucket with ConflictCRDT policy, nil
+	// for plain writes (of registers).
+	change func(current *crdt.Value, tag crdt.Tag) (*crdt.Value, error)
+}
+
+type committer struct {
+	engine Engine
+	cache  *valueCache
+	ops    chan *writeOp
+	closed chan struct{}
+
+	// Guards quota and usage; held while committing a group.
+	mutex      sync.Mutex
+	quota      Quota
+	usage      Usage
+	usageKnown bool
+
+	// Indexes maintained by writes, guarded by mutex. Writes to indexed
+	// bucket are committed in transactions instead of batches.
+	indexes []indexer
+
+	// Whether writes are recorded in replication log, in the same
+	// transaction. ID of the log and its last version are guarded by mutex.
+	logged  bool
+	logID   uint64
+	version uint64
+
+	// Versioning of writes, nil if the bucket has no conflict policy.
+	versions *versioner
+}
+
+func newCommitter(engine Engine, cache *valueCache, quota Quota, indexes []indexer, logged bool, versions *versioner) *committer {
+	c := &committer{
+		engine:   engine,
+		cache:    cache,
+		quota:    quota,
+		indexes:  indexes,
+		logged:   logged,
+		versions: versions,
+		ops:      make(chan *writeOp, maxGroupCommitSize),
+		closed:   make(chan struct{}),
+	}
+
+	if logged {
+		c.loadLog()
+	}
+
+	go c.run()
+
+	return c
+}
+
+// Queue write and wait until it is committed.
+func (c *committer) write(key, value []byte, del bool) error {
+	return c.queue(&writeOp{
+		key:    key,
+		value:  value,
+		delete: del,
+		done:   make(chan error, 1),
+	})
+}
+
+func (c *committer) queue(op *writeOp) error {
+	c.ops <- op
+	return <-op.done
+}
+
+// Stop the committer once all queued writes are committed. No writes may be
+// queued afterwards.
+func (c *committer) close() {
+	close(c.ops)
+	<-c.closed
+}
+
+func (c *committer) run() {
+	defer close(c.closed)
+
+	group := make([]*writeOp, 0, maxGroupCommitSize)
+
+	for op := range c.ops {
+		group = append(group[:0], op)
+
+	collect:
+		for len(group) < maxGroupCommitSize {
+			select {
+			case op, ok := <-c.ops:
+				if !ok {
+					break collect
+				}
+				group = append(group, op)
+			default:
+				break collect
+			}
+		}
+
+		c.commit(group)
+	}
+}
+
+func (c *committer) commit(group []*writeOp) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	group = c.admitLocked(group)
+
+	switch len(group) {
+	case 0:
+		return
+	case 1:
+		group[0].done <- c.apply(group[0])
+		return
+	}
+
+	err := c.commitBatch(group)
+	if err == nil {
+		c.cache.written(group)
+		for _, op := range group {
+			op.done <- nil
+		}
+		return
+	}
+
+	// Commit writes one by one, so that a single failing write doesn't fail
+	// the whole group. Part of the batch may have been applied, so usage
+	// is recomputed.
+	c.usageKnown = false
+	log.Debug(fmt.Sprintf("group commit of %d writes failed, retrying one by one: %v", len(group), err))
+	for _, op := range group {
+		op.done <- c.apply(op)
+	}
+}
+
+func (c *committer) commitBatch(group []*writeOp) error {
+	if c.transactional() {
+		return c.update(group)
+	}
+
+	batch := c.engine.NewBatch()
+	defer batch.Cancel()
+
+	for _, op := range group {
+		var err error
+		if op.delete {
+			err = batch.Delete(op.key)
+		} else {
+			err = batch.Set(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return batch.Flush()
+}
+
+func (c *committer) apply(op *writeOp) error {
+	var err error
+	if c.transactional() {
+		err = c.update([]*writeOp{op})
+	} else if op.delete {
+		err = c.engine.Delete(op.key)
+	} else {
+		err = c.engine.Set(op.key, op.value)
+	}
+
+	c.cache.written([]*writeOp{op})
+	if err != nil {
+		c.usageKnown = false
+	}
+
+	return err
+}
+
+// Whether writes must be committed in transactions.
+func (c *committer) transactional() bool {
+	return len(c.indexes) > 0 || c.logged || c.versions != nil
+}
+
+// Commit writes in a transaction, maintaining indexes, versions and
+// replication log.
+func (c *committer) update(group []*writeOp) error {
+	var (
+		version uint64
+		// Size change of internal data, tracked with usage.
+		internal int64
+		tracked  = c.quota.tracksUsage()
+	)
+
+	err := c.engine.Update(func(txn Txn) error {
+		sizing := &sizingTxn{Txn: txn}
+		if tracked {
+			txn = sizing
+		}
+		defer func() { internal = sizing.bytes }()
+
+		for _, op := range group {
+			if c.versions != nil {
+				if err := c.versions.local(txn, op); err != nil {
+					return err
+				}
+			}
+
+			if err := writeIndexed(txn, c.indexes, op); err != nil {
+				return err
+			}
+		}
+
+		if !c.logged {
+			return nil
+		}
+
+		var err error
+		version, err = c.logLocked(txn, group)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.logged {
+		c.version = version
+	}
+	if tracked {
+		c.usage.Bytes += internal
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// orderEngine records values written to keys, in the order the writes reach
+// the engine.
+type orderEngine struct {
+	Engine
+
+	mutex   sync.Mutex
+	written []string
+}
+
+func (e *orderEngine) record(value []byte) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.written = append(e.written, string(value))
+}
+
+func (e *orderEngine) Set(key, value []byte) error {
+	e.record(value)
+	return e.Engine.Set(key, value)
+}
+
+func (e *orderEngine) NewBatch() Batch {
+	return &orderBatch{Batch: e.Engine.NewBatch(), engine: e}
+}
+
+type orderBatch struct {
+	Batch
+	engine *orderEngine
+}
+
+func (b *orderBatch) Set(key, value []byte) error {
+	b.engine.record(value)
+	return b.Batch.Set(key, value)
+}
+
+// Writes queued without waiting are grouped, but applied in queue order.
+func TestCommitterQueueOrder(t *testing.T) {
+	engine := &orderEngine{Engine: newMemoryEngine()}
+	c := newCommitter(engine, nil, Quota{}, nil, false, nil)
+	defer c.close()
+
+	const count = 5000
+
+	ops := make([]*writeOp, count)
+	for i := range ops {
+		ops[i] = &writeOp{key: []byte("k"), value: []byte(strconv.Itoa(i)), done: make(chan error, 1)}
+	}
+
+	go func() {
+		for _, op := range ops {
+			c.ops <- op
+		}
+	}()
+
+	for i := range ops {
+		if err := <-ops[i].done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, value := range engine.written {
+		if value != strconv.Itoa(i) {
+			t.Fatalf("write %d applied as %s", i, value)
+		}
+	}
+	expectValue(t, engine, "k", strconv.Itoa(count-1))
+}
+
+// Writes of concurrent writers to the same key are applied in the order each
+// writer issued them, and the last applied one wins.
+func TestCommitterConcurrentOrder(t *testing.T) {
+	engine := &orderEngine{Engine: newMemoryEngine()}
+	c := newCommitter(engine, nil, Quota{}, nil, false, nil)
+	defer c.close()
+
+	const (
+		writers = 16
+		writes  = 500
+	)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := c.write([]byte("k"), []byte(fmt.Sprintf("%d:%d", w, i)), false); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if len(engine.written) != writers*writes {
+		t.Fatalf("applied %d writes, want %d", len(engine.written), writers*writes)
+	}
+
+	last := make(map[string]int)
+	for _, value := range engine.written {
+		parts := strings.SplitN(value, ":", 2)
+		i, _ := strconv.Atoi(parts[1])
+
+		if previous, ok := last[parts[0]]; ok && i != previous+1 {
+			t.Fatalf("write %d of writer %s applied after write %d", i, parts[0], previous)
+		}
+		last[parts[0]] = i
+	}
+
+	expectValue(t, engine, "k", engine.written[len(engine.written)-1])
+}
+
+// Throughput of bucket writes with increasing number of concurrent writers,
+// which share group commits.
+func BenchmarkBucketSet(b *testing.B) {
+	for _, parallelism := range []int{1, 2, 4, 8, 16, 32} {
+		parallelism := parallelism
+		writers := parallelism * runtime.GOMAXPROCS(0)
+
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			db := openTestDatabase(b, nil)
+			bucket := createTestBucket(b, db, "bench", BucketOptions{})
+
+			value := []byte(strings.Repeat("v", 128))
+
+			var n int64
+
+			b.SetParallelism(parallelism)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := fmt.Sprintf("key:%d", atomic.AddInt64(&n, 1))
+					if err := bucket.Set(key, value); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
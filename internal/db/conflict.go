@@ -0,0 +1,484 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pepol/databuddy/internal/crdt"
+)
+
+// Buckets with conflict policy keep version of every written key alongside
+// its value, under internal keys:
+//
+//	0xff 'm' <key> -> <JSON version>
+//
+// Version of local write is computed in the transaction of the write and
+// recorded with it in the replication log. Writes pulled from peers carry
+// their versions and are merged with the local one, so that members
+// applying the same writes in any order end with the same value:
+//
+//   - ConflictLWW keeps the write with the latest hybrid logical clock time
+//     (ties are broken by member name).
+//   - ConflictSiblings keeps all writes not superseded according to their
+//     vector clocks. Key with more siblings holds the greatest of their
+//     values (deterministically chosen), until siblings are resolved.
+//   - ConflictCRDT keeps state of conflict-free replicated data type of the
+//     key (see crdt.go), and the key holds its plain representation.
+//
+// Deleted keys keep their version as a tombstone, so that older writes
+// arriving later don't restore them.
+const versionKeyTag = 'm'
+
+// Conflict policies of buckets.
+const (
+	// Writes are applied in order of arrival.
+	ConflictNone = ""
+	// The latest write (by hybrid logical clock) wins.
+	ConflictLWW = "lww"
+	// Concurrent writes are kept as siblings until resolved.
+	ConflictSiblings = "siblings"
+	// Keys hold conflict-free replicated data types.
+	ConflictCRDT = "crdt"
+)
+
+// Bits of hybrid logical clock time used by logical counter.
+const hlcLogicalBits = 16
+
+// ErrNoConflictPolicy is returned for sibling operations on buckets without
+// the siblings conflict policy.
+var ErrNoConflictPolicy = errors.New("doesn't keep siblings")
+
+// ErrNoDataTypes is returned for data type operations on buckets without
+// the crdt conflict policy.
+var ErrNoDataTypes = errors.New("doesn't hold data types")
+
+// VectorClock counts writes of each member (by name) a value descends from.
+type VectorClock map[string]uint64
+
+// Sibling is one of concurrent values of key.
+type Sibling struct {
+	Value   []byte      `json:"v,omitempty"`
+	Deleted bool        `json:"d,omitempty"`
+	Clock   VectorClock `json:"c"`
+}
+
+// Version of key of bucket with conflict policy.
+type version struct {
+	// Hybrid logical clock time and member of the write (ConflictLWW).
+	Time    uint64 `json:"t,omitempty"`
+	Node    string `json:"n,omitempty"`
+	Deleted bool   `json:"d,omitempty"`
+	// Writes not superseded by others (ConflictSiblings), in canonical
+	// order.
+	Siblings []Sibling `json:"s,omitempty"`
+	// State of data type (ConflictCRDT).
+	Data *crdt.Value `json:"x,omitempty"`
+}
+
+// Hybrid logical clock of this member: physical time in milliseconds
+// shifted by hlcLogicalBits, advanced past times of observed writes.
+type hlc struct {
+	mutex sync.Mutex
+	last  uint64
+}
+
+func (c *hlc) now() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	wall := uint64(time.Now().UnixMilli()) << hlcLogicalBits
+	if wall > c.last {
+		c.last = wall
+	} else {
+		c.last++
+	}
+
+	return c.last
+}
+
+func (c *hlc) observe(t uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if t > c.last {
+		c.last = t
+	}
+}
+
+// Versioning of writes of bucket with conflict policy.
+type versioner struct {
+	policy string
+	// Name of this member.
+	node  string
+	clock *hlc
+}
+
+func versionKey(key []byte) []byte {
+	return append([]byte{internalKeyPrefix, versionKeyTag}, key...)
+}
+
+func (v version) encode() []byte {
+	// Marshalling struct of plain fields cannot fail.
+	value, _ := json.Marshal(v)
+	return value
+}
+
+func decodeVersion(value []byte) (version, error) {
+	var v version
+	err := json.Unmarshal(value, &v)
+	return v, err
+}
+
+// Current version of key, zero if it has none.
+func readVersion(txn Reader, key []byte) (version, bool, error) {
+	value, err := txn.Get(versionKey(key))
+	if err == ErrKeyNotFound {
+		return version{}, false, nil
+	}
+	if err != nil {
+		return version{}, false, err
+	}
+
+	v, err := decodeVersion(value)
+	if err != nil {
+		return version{}, false, fmt.Errorf("decoding version of key '%s': %v", key, err)
+	}
+
+	return v, true, nil
+}
+
+// Version local write, changing it to the resulting value of the key and
+// recording the version in op.
+func (v *versioner) local(txn Txn, op *writeOp) error {
+	var next version
+
+	switch v.policy {
+	case ConflictLWW:
+		next = version{Time: v.clock.now(), Node: v.node, Deleted: op.delete}
+	case ConflictSiblings:
+		current, _, err := readVersion(txn, op.key)
+		if err != nil {
+			return err
+		}
+
+		context := op.context
+		if context == nil {
+			// Plain writes supersede all known siblings.
+			context = VectorClock{}
+			for _, sibling := range current.Siblings {
+				context.merge(sibling.Clock)
+			}
+		}
+
+		// Counter of this member must exceed all its previous writes.
+		clock := VectorClock{}
+		clock.merge(context)
+		for _, sibling := range current.Siblings {
+			if n := sibling.Clock[v.node]; n > clock[v.node] {
+				clock[v.node] = n
+			}
+		}
+		clock[v.node]++
+
+		if op.original == nil {
+			op.original = &Sibling{Value: op.value, Deleted: op.delete}
+			if op.delete {
+				op.original.Value = nil
+			}
+		}
+
+		written := *op.original
+		written.Clock = clock
+
+		next = version{Siblings: mergeSiblings(current.Siblings, []Sibling{written})}
+		op.value, op.delete = next.resolved()
+	case ConflictCRDT:
+		data, err := v.change(txn, op)
+		if err != nil {
+			return err
+		}
+
+		next = version{Data: data}
+		op.value, op.delete = data.Bytes()
+	default:
+		return nil
+	}
+
+	op.meta = next.encode()
+	return txn.Set(versionKey(op.key), op.meta)
+}
+
+// Merge version of replicated write with the local one, changing the write
+// to the resulting value of the key. Returns false if the write is
+// superseded by the local version and must be skipped.
+func (v *versioner) replicated(txn Txn, op *writeOp) (bool, error) {
+	incoming, err := decodeVersion(op.meta)
+	if err != nil {
+		return false, fmt.Errorf("decoding version of key '%s': %v", op.key, err)
+	}
+
+	current, ok, err := readVersion(txn, op.key)
+	if err != nil {
+		return false, err
+	}
+
+	var next version
+
+	switch v.policy {
+	case ConflictLWW:
+		v.clock.observe(incoming.Time)
+
+		if ok && !current.before(incoming) {
+			return false, nil
+		}
+
+		next = incoming
+		op.delete = incoming.Deleted
+	case ConflictSiblings:
+		next = version{Siblings: mergeSiblings(current.Siblings, incoming.Siblings)}
+		if ok && bytes.Equal(next.encode(), current.encode()) {
+			return false, nil
+		}
+
+		op.value, op.delete = next.resolved()
+	case ConflictCRDT:
+		next = version{Data: crdt.Merge(current.Data, incoming.Data)}
+		if next.Data == nil || (ok && bytes.Equal(next.encode(), current.encode())) {
+			return false, nil
+		}
+
+		op.value, op.delete = next.Data.Bytes()
+	default:
+		return true, nil
+	}
+
+	if op.delete {
+		op.value = nil
+	}
+
+	op.meta = next.encode()
+	return true, txn.Set(versionKey(op.key), op.meta)
+}
+
+// Whether LWW version is older than other.
+func (v version) before(other version) bool {
+	if v.Time != other.Time {
+		return v.Time < other.Time
+	}
+
+	return v.Node < other.Node
+}
+
+// Value of key with given siblings: the greatest value of the siblings with
+// the most writes, deleted if all siblings are deletions.
+func (v version) resolved() ([]byte, bool) {
+	var (
+		best     *Sibling
+		bestSize uint64
+	)
+
+	for i := range v.Siblings {
+		sibling := &v.Siblings[i]
+		if sibling.Deleted {
+			continue
+		}
+
+		size := sibling.Clock.size()
+		if best == nil || size > bestSize || (size == bestSize && bytes.Compare(sibling.Value, best.Value) > 0) {
+			best, bestSize = sibling, size
+		}
+	}
+
+	if best == nil {
+		return nil, true
+	}
+
+	return best.Value, false
+}
+
+// Union of siblings without those superseded by others, in canonical order.
+func mergeSiblings(a, b []Sibling) []Sibling {
+	all := append(append([]Sibling(nil), a...), b...)
+	merged := make([]Sibling, 0, len(all))
+
+	for i, sibling := range all {
+		superseded := false
+
+		for j, other := range all {
+			if i == j {
+				continue
+			}
+
+			// Equal clocks identify the same write, only the first is kept.
+			if other.Clock.descends(sibling.Clock) && (!sibling.Clock.descends(other.Clock) || j < i) {
+				superseded = true
+				break
+			}
+		}
+
+		if !superseded {
+			merged = append(merged, sibling)
+		}
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return bytes.Compare(merged[i].Clock.encode(), merged[j].Clock.encode()) < 0
+	})
+
+	return merged
+}
+
+// Whether clock includes all writes counted by other.
+func (c VectorClock) descends(other VectorClock) bool {
+	for node, n := range other {
+		if c[node] < n {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Include writes counted by other.
+func (c VectorClock) merge(other VectorClock) {
+	for node, n := range other {
+		if n > c[node] {
+			c[node] = n
+		}
+	}
+}
+
+func (c VectorClock) size() uint64 {
+	var size uint64
+	for _, n := range c {
+		size += n
+	}
+
+	return size
+}
+
+// Canonical encoding of the clock (JSON with sorted keys).
+func (c VectorClock) encode() []byte {
+	// Marshalling map of plain values cannot fail.
+	value, _ := json.Marshal(c)
+	return value
+}
+
+// Conflict returns conflict policy of bucket, ConflictNone if it has none.
+func (b *Bucket) Conflict() string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.meta.Conflict
+}
+
+// Siblings returns concurrent values of key, together with clock including
+// all of them, to be passed to Resolve. Deleted key without siblings has
+// none.
+func (b *Bucket) Siblings(key string) ([]Sibling, VectorClock, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if b.meta.Conflict != ConflictSiblings {
+		return nil, nil, fmt.Errorf("bucket '%s' %w", b.Name, ErrNoConflictPolicy)
+	}
+
+	v, _, err := readVersion(b.engine, []byte(key))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	context := VectorClock{}
+	siblings := make([]Sibling, 0, len(v.Siblings))
+
+	for _, sibling := range v.Siblings {
+		context.merge(sibling.Clock)
+		if len(v.Siblings) > 1 || !sibling.Deleted {
+			siblings = append(siblings, sibling)
+		}
+	}
+
+	return siblings, context, nil
+}
+
+// Resolve siblings of key included in context (as returned by Siblings) by
+// setting its value, or deleting it if value is nil. Siblings written
+// concurrently with the context are kept.
+func (b *Bucket) Resolve(key string, value []byte, context VectorClock) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if b.meta.Conflict != ConflictSiblings {
+		return fmt.Errorf("bucket '%s' %w", b.Name, ErrNoConflictPolicy)
+	}
+
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	if isInternalKey([]byte(key)) {
+		return errReservedKey
+	}
+
+	if value != nil {
+		if err := b.validator.check([]byte(key), value); err != nil {
+			return err
+		}
+	}
+
+	if context == nil {
+		context = VectorClock{}
+	}
+
+	op := &writeOp{key: []byte(key), value: value, delete: value == nil, context: context, done: make(chan error, 1)}
+	if err := b.committer.queue(op); err != nil {
+		return err
+	}
+
+	b.touch()
+	return nil
+}
+
+// Versions of keys of bucket with conflict policy, nil for keys without
+// one.
+func (b *Bucket) readVersions(keys [][]byte) ([][]byte, error) {
+	versions := make([][]byte, len(keys))
+
+	for i, key := range keys {
+		value, err := b.engine.Get(versionKey(key))
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+
+		versions[i] = value
+	}
+
+	return versions, nil
+}
+
+// Versioner of writes of bucket with given conflict policy, nil for
+// ConflictNone.
+func (db *Database) versioner(policy string) *versioner {
+	if policy == ConflictNone {
+		return nil
+	}
+
+	return &versioner{policy: policy, node: db.node, clock: db.clock}
+}
+
+func isValidConflictPolicy(policy string) bool {
+	return policy == ConflictNone || policy == ConflictLWW || policy == ConflictSiblings || policy == ConflictCRDT
+}
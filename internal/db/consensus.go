@@ -0,0 +1,792 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pepol/databuddy/internal/raft"
+)
+
+// Consistency modes of buckets.
+const (
+	// ConsistencyEventual buckets accept writes on every member and
+	// replicate them asynchronously.
+	ConsistencyEventual = "eventual"
+	// ConsistencyStrong buckets replicate writes through Raft log, making
+	// reads and writes linearizable.
+	ConsistencyStrong = "strong"
+)
+
+// Writes to strongly consistent buckets are entries of Raft log, applied by
+// every member once committed. Log and state of the consensus are kept in
+// the bucket:
+//
+//	0xff 'c' 'h' -> <JSON hard state>
+//	0xff 'c' 'a' -> <8 bytes big-endian index> <8 bytes big-endian term>
+//	0xff 'c' 'c' -> <8 bytes big-endian index> <8 bytes big-endian term>
+//	0xff 'c' 'm' -> <JSON configuration>
+//	0xff 'c' 'l' <8 bytes big-endian index> -> <uvarint term> <command>
+//
+// Keys 'a' and 'c' hold the last applied and the last compacted entry, 'm'
+// the last applied configuration. Applied entries and the applied position
+// are written in one transaction, so the client data is the snapshot of the
+// state; compaction only removes entries from the log. Command is <1 byte
+// op> <uvarint key length> <key> <value>, entries without command (appended
+// by new leaders) change nothing. Configuration entries have command 'm'
+// <JSON list of members>.
+const consensusKeyTag = 'c'
+
+const (
+	raftHardStateTag     = 'h'
+	raftAppliedTag       = 'a'
+	raftCompactedTag     = 'c'
+	raftConfigurationTag = 'm'
+	raftEntryTag         = 'l'
+)
+
+// Op of commands of configuration entries.
+const raftConfigurationOp = 'm'
+
+// Maximum number of keys removed by single transaction when restoring
+// snapshot.
+const restoreBatchSize = 1024
+
+var (
+	// ErrConsensusRequired is returned for direct writes to strongly
+	// consistent buckets.
+	ErrConsensusRequired = errors.New("writes must go through consensus")
+
+	errMalformedCommand = errors.New("malformed raft command")
+)
+
+func consensusKey(tag byte, suffix []byte) []byte {
+	key := []byte{internalKeyPrefix, consensusKeyTag, tag}
+	return append(key, suffix...)
+}
+
+func raftEntryKey(index uint64) []byte {
+	return consensusKey(raftEntryTag, binary.BigEndian.AppendUint64(nil, index))
+}
+
+// EncodeCommand encodes write of key (or its deletion) into data of Raft log
+// entry.
+func EncodeCommand(key string, value []byte, del bool) []byte {
+	op := byte(logOpSet)
+	if del {
+		op = logOpDelete
+	}
+
+	data := binary.AppendUvarint([]byte{op}, uint64(len(key)))
+	data = append(data, key...)
+	return append(data, value...)
+}
+
+func decodeCommand(data []byte) (*writeOp, error) {
+	if len(data) < 2 || (data[0] != logOpSet && data[0] != logOpDelete) {
+		return nil, errMalformedCommand
+	}
+
+	keyLen, n := binary.Uvarint(data[1:])
+	if n <= 0 || keyLen > uint64(len(data)-1-n) {
+		return nil, errMalformedCommand
+	}
+
+	rest := data[1+n:]
+	op := &writeOp{key: rest[:keyLen], delete: data[0] == logOpDelete}
+	if !op.delete {
+		op.value = rest[keyLen:]
+	}
+
+	return op, nil
+}
+
+func encodeRaftPosition(index, term uint64) []byte {
+	value := binary.BigEndian.AppendUint64(nil, index)
+	return binary.BigEndian.AppendUint64(value, term)
+}
+
+// Read position stored under key, zeros if there is none.
+func readRaftPosition(reader Reader, key []byte) (index, term uint64, err error) {
+	value, err := reader.Get(key)
+	if err == ErrKeyNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(value) != 16 { //nolint:gomnd // Two 8-byte integers.
+		return 0, 0, fmt.Errorf("malformed raft position")
+	}
+
+	return binary.BigEndian.Uint64(value), binary.BigEndian.Uint64(value[8:]), nil
+}
+
+// Consistency returns consistency mode of bucket.
+func (b *Bucket) Consistency() string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.meta.consistency()
+}
+
+// ValidateWrite checks whether write of key (or its deletion) would be
+// accepted by the bucket, before it is proposed to consensus.
+func (b *Bucket) ValidateWrite(key string, value []byte, del bool) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if err := b.checkWritableState(); err != nil {
+		return err
+	}
+
+	if isInternalKey([]byte(key)) {
+		return errReservedKey
+	}
+
+	if del {
+		return nil
+	}
+
+	if err := b.meta.Quota.checkWrite([]byte(key), value); err != nil {
+		return err
+	}
+
+	return b.validator.check([]byte(key), value)
+}
+
+// StrongBuckets returns names of strongly consistent buckets.
+func (db *Database) StrongBuckets() []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var names []string
+
+	for name, bucket := range db.buckets {
+		if bucket.meta.Consistency == ConsistencyStrong {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// RaftStorage returns storage of Raft log and state of strongly consistent
+// bucket with given name. The bucket is acquired by each operation, so it
+// may be closed while idle.
+func (db *Database) RaftStorage(name string) (raft.Storage, error) {
+	db.mutex.RLock()
+	bucket, ok := db.buckets[name]
+	db.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("bucket '%s' not found", name)
+	}
+
+	if bucket.meta.Consistency != ConsistencyStrong {
+		return nil, fmt.Errorf("bucket '%s' is not strongly consistent", name)
+	}
+
+	if db.readOnly {
+		return nil, fmt.Errorf("database is %w", ErrReadOnly)
+	}
+
+	return &raftStorage{db: db, name: name}, nil
+}
+
+type raftStorage struct {
+	db   *Database
+	name string
+
+	// Index of the last entry of log, loaded on first use.
+	mutex     sync.Mutex
+	lastIndex uint64
+	lastKnown bool
+}
+
+// Run fn with engine of the bucket.
+func (s *raftStorage) with(fn func(b *Bucket) error) error {
+	bucket, err := s.db.Get(s.name)
+	if err != nil {
+		return err
+	}
+	defer s.db.Release(bucket)
+
+	bucket.mutex.RLock()
+	defer bucket.mutex.RUnlock()
+
+	if bucket.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", bucket.Name)
+	}
+
+	return fn(bucket)
+}
+
+func (s *raftStorage) HardState() (raft.HardState, error) {
+	var state raft.HardState
+
+	err := s.with(func(b *Bucket) error {
+		value, err := b.engine.Get(consensusKey(raftHardStateTag, nil))
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return json.Unmarshal(value, &state)
+	})
+
+	return state, err
+}
+
+func (s *raftStorage) SetHardState(state raft.HardState) error {
+	// Marshalling struct of plain fields cannot fail.
+	value, _ := json.Marshal(state)
+
+	return s.with(func(b *Bucket) error {
+		return b.committer.updateInternal(false, func(txn Txn) error {
+			return txn.Set(consensusKey(raftHardStateTag, nil), value)
+		})
+	})
+}
+
+func (s *raftStorage) Applied() (index, term uint64, err error) {
+	err = s.with(func(b *Bucket) error {
+		index, term, err = readRaftPosition(b.engine, consensusKey(raftAppliedTag, nil))
+		return err
+	})
+
+	return index, term, err
+}
+
+func (s *raftStorage) Compacted() (index, term uint64, err error) {
+	err = s.with(func(b *Bucket) error {
+		index, term, err = readRaftPosition(b.engine, consensusKey(raftCompactedTag, nil))
+		return err
+	})
+
+	return index, term, err
+}
+
+func (s *raftStorage) LastIndex() (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.lastKnown {
+		return s.lastIndex, nil
+	}
+
+	var last uint64
+
+	err := s.with(func(b *Bucket) error {
+		index, _, err := readRaftPosition(b.engine, consensusKey(raftCompactedTag, nil))
+		if err != nil {
+			return err
+		}
+		last = index
+
+		// Log is short thanks to compaction.
+		return b.engine.Iterate(consensusKey(raftEntryTag, nil), true, func(key, _ []byte) error {
+			last = binary.BigEndian.Uint64(key[len(key)-8:])
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.lastIndex, s.lastKnown = last, true
+	return last, nil
+}
+
+func (s *raftStorage) Term(index uint64) (uint64, error) {
+	var term uint64
+
+	err := s.with(func(b *Bucket) error {
+		compacted, compactedTerm, err := readRaftPosition(b.engine, consensusKey(raftCompactedTag, nil))
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case index == compacted:
+			term = compactedTerm
+			return nil
+		case index < compacted:
+			return raft.ErrCompacted
+		}
+
+		value, err := b.engine.Get(raftEntryKey(index))
+		if err == ErrKeyNotFound {
+			return fmt.Errorf("raft log entry %d not found", index)
+		}
+		if err != nil {
+			return err
+		}
+
+		entry, err := decodeRaftEntry(index, value)
+		term = entry.Term
+		return err
+	})
+
+	return term, err
+}
+
+func encodeRaftEntry(entry raft.Entry) []byte {
+	value := binary.AppendUvarint(nil, entry.Term)
+	if entry.Type == raft.EntryConfiguration {
+		value = append(value, raftConfigurationOp)
+	}
+
+	return append(value, entry.Data...)
+}
+
+func decodeRaftEntry(index uint64, value []byte) (raft.Entry, error) {
+	term, n := binary.Uvarint(value)
+	if n <= 0 {
+		return raft.Entry{}, fmt.Errorf("malformed raft log entry %d", index)
+	}
+
+	entry := raft.Entry{Index: index, Term: term, Data: value[n:]}
+	if len(entry.Data) > 0 && entry.Data[0] == raftConfigurationOp {
+		entry.Type, entry.Data = raft.EntryConfiguration, entry.Data[1:]
+	}
+
+	return entry, nil
+}
+
+// Read configuration stored under key, empty if there is none.
+func readRaftConfiguration(reader Reader) (raft.Configuration, error) {
+	var config raft.Configuration
+
+	value, err := reader.Get(consensusKey(raftConfigurationTag, nil))
+	if err == ErrKeyNotFound {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+
+	return config, json.Unmarshal(value, &config)
+}
+
+func (s *raftStorage) Entries(lo, hi uint64, maxBytes int) ([]raft.Entry, error) {
+	var entries []raft.Entry
+
+	err := s.with(func(b *Bucket) error {
+		size := 0
+		next := lo
+
+		err := b.engine.IterateFrom(consensusKey(raftEntryTag, nil), raftEntryKey(lo), false, func(key, value []byte) error {
+			index := binary.BigEndian.Uint64(key[len(key)-8:])
+			if index >= hi || index != next || (size > 0 && size+len(value) > maxBytes) {
+				return errStopIteration
+			}
+
+			entry, err := decodeRaftEntry(index, append([]byte(nil), value...))
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, entry)
+			size += len(value)
+			next++
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			return err
+		}
+
+		if len(entries) > 0 || lo >= hi {
+			return nil
+		}
+
+		compacted, _, err := readRaftPosition(b.engine, consensusKey(raftCompactedTag, nil))
+		if err == nil && lo <= compacted {
+			return raft.ErrCompacted
+		}
+		if err == nil {
+			err = fmt.Errorf("raft log entry %d not found", lo)
+		}
+		return err
+	})
+
+	return entries, err
+}
+
+func (s *raftStorage) Append(entries []raft.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Such command would be read back as configuration entry.
+	for _, entry := range entries {
+		if entry.Type == raft.EntryCommand && len(entry.Data) > 0 && entry.Data[0] == raftConfigurationOp {
+			return errMalformedCommand
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.with(func(b *Bucket) error {
+		return b.committer.updateInternal(false, func(txn Txn) error {
+			// Remove replaced entries.
+			var keys [][]byte
+
+			err := txn.IterateFrom(consensusKey(raftEntryTag, nil), raftEntryKey(entries[0].Index), true, func(key, _ []byte) error {
+				keys = append(keys, append([]byte(nil), key...))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, key := range keys {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+
+			for _, entry := range entries {
+				if err := txn.Set(raftEntryKey(entry.Index), encodeRaftEntry(entry)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+
+	// Cached index is reloaded after failure.
+	s.lastIndex = entries[len(entries)-1].Index
+	s.lastKnown = err == nil
+	return err
+}
+
+func (s *raftStorage) Apply(entries []raft.Entry) ([]error, error) {
+	results := make([]error, len(entries))
+
+	err := s.with(func(b *Bucket) error {
+		written := false
+
+		// Entries are applied one by one, so that entry rejected by index
+		// constraint doesn't affect the others.
+		for i, entry := range entries {
+			var (
+				group  []*writeOp
+				config []byte
+			)
+
+			switch {
+			case entry.Type == raft.EntryConfiguration:
+				value, err := entry.Configuration()
+				if err != nil {
+					return err
+				}
+
+				// Marshalling struct of plain fields cannot fail.
+				config, _ = json.Marshal(value)
+			case len(entry.Data) > 0:
+				op, err := decodeCommand(entry.Data)
+				if err == nil && isInternalKey(op.key) {
+					err = errReservedKey
+				}
+				if err != nil {
+					results[i] = err
+				} else {
+					group = append(group, op)
+				}
+			}
+
+			position := encodeRaftPosition(entry.Index, entry.Term)
+			err := b.committer.replicate(group, func(txn Txn) error {
+				if config != nil {
+					if err := txn.Set(consensusKey(raftConfigurationTag, nil), config); err != nil {
+						return err
+					}
+				}
+				return txn.Set(consensusKey(raftAppliedTag, nil), position)
+			})
+			if errors.Is(err, ErrUniqueViolation) {
+				results[i] = err
+				err = b.committer.replicate(nil, func(txn Txn) error {
+					return txn.Set(consensusKey(raftAppliedTag, nil), position)
+				})
+			}
+			if err != nil {
+				return err
+			}
+
+			written = written || len(group) > 0 && results[i] == nil
+		}
+
+		if written {
+			b.touch()
+		}
+		return nil
+	})
+
+	return results, err
+}
+
+func (s *raftStorage) Configuration() (config raft.Configuration, err error) {
+	err = s.with(func(b *Bucket) error {
+		config, err = readRaftConfiguration(b.engine)
+		return err
+	})
+
+	return config, err
+}
+
+func (s *raftStorage) Compact(index uint64) error {
+	return s.with(func(b *Bucket) error {
+		value, err := b.engine.Get(raftEntryKey(index))
+		if err != nil {
+			return fmt.Errorf("reading raft log entry %d: %v", index, err)
+		}
+
+		entry, err := decodeRaftEntry(index, value)
+		if err != nil {
+			return err
+		}
+
+		// Entries up to the compacted one are ignored even if their removal
+		// fails.
+		err = b.committer.updateInternal(false, func(txn Txn) error {
+			return txn.Set(consensusKey(raftCompactedTag, nil), encodeRaftPosition(index, entry.Term))
+		})
+		if err != nil {
+			return err
+		}
+
+		var keys [][]byte
+
+		err = b.engine.Iterate(consensusKey(raftEntryTag, nil), true, func(key, _ []byte) error {
+			if binary.BigEndian.Uint64(key[len(key)-8:]) > index {
+				return errStopIteration
+			}
+
+			keys = append(keys, append([]byte(nil), key...))
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			return err
+		}
+
+		return b.committer.deleteInternal(keys)
+	})
+}
+
+func (s *raftStorage) Snapshot() (raft.Snapshot, error) {
+	bucket, err := s.db.Get(s.name)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket.mutex.RLock()
+	defer bucket.mutex.RUnlock()
+
+	if bucket.engine == nil {
+		s.db.Release(bucket)
+		return nil, fmt.Errorf("bucket '%s' not opened", bucket.Name)
+	}
+
+	// Bucket stays acquired, so that the engine isn't closed.
+	view := bucket.engine.Snapshot()
+
+	index, term, err := readRaftPosition(view, consensusKey(raftAppliedTag, nil))
+	if err != nil {
+		view.Release()
+		s.db.Release(bucket)
+		return nil, err
+	}
+
+	config, err := readRaftConfiguration(view)
+	if err != nil {
+		view.Release()
+		s.db.Release(bucket)
+		return nil, err
+	}
+
+	return &raftSnapshot{db: s.db, bucket: bucket, view: view, index: index, term: term, config: config}, nil
+}
+
+// Snapshot is sent as client keys and values, each prefixed by uvarint
+// length.
+type raftSnapshot struct {
+	db     *Database
+	bucket *Bucket
+	view   Snapshot
+	index  uint64
+	term   uint64
+	config raft.Configuration
+}
+
+func (s *raftSnapshot) Index() uint64 {
+	return s.index
+}
+
+func (s *raftSnapshot) Term() uint64 {
+	return s.term
+}
+
+func (s *raftSnapshot) Configuration() raft.Configuration {
+	return s.config
+}
+
+func (s *raftSnapshot) Read(cursor []byte, maxBytes int) (chunk, next []byte, err error) {
+	chunk = []byte{}
+
+	err = s.view.IterateFrom(nil, cursor, false, func(key, value []byte) error {
+		if isInternalKey(key) {
+			return errStopIteration
+		}
+
+		if len(chunk) > 0 && len(chunk)+len(key)+len(value) > maxBytes {
+			next = append([]byte{}, key...)
+			return errStopIteration
+		}
+
+		chunk = binary.AppendUvarint(chunk, uint64(len(key)))
+		chunk = append(chunk, key...)
+		chunk = binary.AppendUvarint(chunk, uint64(len(value)))
+		chunk = append(chunk, value...)
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, nil, err
+	}
+
+	return chunk, next, nil
+}
+
+func (s *raftSnapshot) Release() {
+	s.view.Release()
+	s.db.Release(s.bucket)
+}
+
+func (s *raftStorage) Restore(index, term uint64, config raft.Configuration, chunk []byte, first, last bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Cached index is reloaded after failure.
+	s.lastKnown = false
+
+	err := s.with(func(b *Bucket) error {
+		if first {
+			if err := clearRaftState(b); err != nil {
+				return err
+			}
+		}
+
+		group, err := decodeSnapshotChunk(chunk)
+		if err != nil {
+			return err
+		}
+
+		var extra func(txn Txn) error
+		if last {
+			position := encodeRaftPosition(index, term)
+			// Marshalling struct of plain fields cannot fail.
+			value, _ := json.Marshal(config)
+
+			extra = func(txn Txn) error {
+				if err := txn.Set(consensusKey(raftAppliedTag, nil), position); err != nil {
+					return err
+				}
+				if err := txn.Set(consensusKey(raftConfigurationTag, nil), value); err != nil {
+					return err
+				}
+				return txn.Set(consensusKey(raftCompactedTag, nil), position)
+			}
+		}
+
+		if err := b.committer.replicate(group, extra); err != nil {
+			return err
+		}
+
+		b.touch()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if last {
+		s.lastIndex, s.lastKnown = index, true
+	}
+	return nil
+}
+
+func decodeSnapshotChunk(chunk []byte) ([]*writeOp, error) {
+	var group []*writeOp
+
+	for len(chunk) > 0 {
+		var fields [2][]byte
+
+		for i := range fields {
+			size, n := binary.Uvarint(chunk)
+			if n <= 0 || size > uint64(len(chunk)-n) {
+				return nil, errors.New("malformed snapshot chunk")
+			}
+
+			fields[i] = chunk[n : n+int(size)]
+			chunk = chunk[n+int(size):]
+		}
+
+		if isInternalKey(fields[0]) {
+			return nil, errReservedKey
+		}
+
+		group = append(group, &writeOp{key: fields[0], value: fields[1]})
+	}
+
+	return group, nil
+}
+
+// Remove client data (with their index entries) and all consensus state
+// except the hard state.
+func clearRaftState(b *Bucket) error {
+	for {
+		var group []*writeOp
+
+		err := b.engine.Iterate(nil, true, func(key, _ []byte) error {
+			if isInternalKey(key) || len(group) >= restoreBatchSize {
+				return errStopIteration
+			}
+
+			group = append(group, &writeOp{key: append([]byte(nil), key...), delete: true})
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			return err
+		}
+
+		if len(group) == 0 {
+			break
+		}
+
+		if err := b.committer.replicate(group, nil); err != nil {
+			return err
+		}
+	}
+
+	var keys [][]byte
+
+	err := b.engine.Iterate(consensusKey(raftEntryTag, nil), true, func(key, _ []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys = append(keys, consensusKey(raftAppliedTag, nil), consensusKey(raftCompactedTag, nil), consensusKey(raftConfigurationTag, nil))
+
+	return b.committer.deleteInternal(keys)
+}
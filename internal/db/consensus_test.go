@@ -0,0 +1,365 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/pepol/databuddy/internal/raft"
+)
+
+// Create strongly consistent bucket with given name and return its storage.
+func openTestRaftStorage(t *testing.T, db *Database, name string) raft.Storage {
+	t.Helper()
+
+	if err := db.Create(name, BucketOptions{Consistency: ConsistencyStrong}); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := db.RaftStorage(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage
+}
+
+func setEntry(index, term uint64, key, value string) raft.Entry {
+	return raft.Entry{Index: index, Term: term, Data: EncodeCommand(key, []byte(value), false)}
+}
+
+func deleteEntry(index, term uint64, key string) raft.Entry {
+	return raft.Entry{Index: index, Term: term, Data: EncodeCommand(key, nil, true)}
+}
+
+func configurationEntry(index, term uint64, members string) raft.Entry {
+	return raft.Entry{Index: index, Term: term, Type: raft.EntryConfiguration, Data: []byte(members)}
+}
+
+func mustAppend(t *testing.T, storage raft.Storage, entries ...raft.Entry) {
+	t.Helper()
+
+	if err := storage.Append(entries); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustApply(t *testing.T, storage raft.Storage, entries ...raft.Entry) []error {
+	t.Helper()
+
+	results, err := storage.Apply(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return results
+}
+
+func expectLastIndex(t *testing.T, storage raft.Storage, want uint64) {
+	t.Helper()
+
+	if last, err := storage.LastIndex(); err != nil || last != want {
+		t.Fatalf("last index is %d (error %v), want %d", last, err, want)
+	}
+}
+
+func expectTerm(t *testing.T, storage raft.Storage, index, want uint64) {
+	t.Helper()
+
+	if term, err := storage.Term(index); err != nil || term != want {
+		t.Fatalf("term of entry %d is %d (error %v), want %d", index, term, err, want)
+	}
+}
+
+func expectEntries(t *testing.T, storage raft.Storage, lo, hi uint64, want ...raft.Entry) {
+	t.Helper()
+
+	entries, err := storage.Entries(lo, hi, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	equal := len(entries) == len(want)
+	for i := 0; equal && i < len(want); i++ {
+		a, b := entries[i], want[i]
+		equal = a.Index == b.Index && a.Term == b.Term && a.Type == b.Type && bytes.Equal(a.Data, b.Data)
+	}
+
+	if !equal {
+		t.Fatalf("entries [%d, %d) are %v, want %v", lo, hi, entries, want)
+	}
+}
+
+func expectBucketValue(t *testing.T, db *Database, name, key, want string) {
+	t.Helper()
+
+	bucket, err := db.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Release(bucket)
+
+	value, err := bucket.Get(key)
+	switch {
+	case want == "" && !errors.Is(err, ErrKeyNotFound):
+		t.Fatalf("key '%s' is %q (error %v), want it missing", key, value, err)
+	case want != "" && (err != nil || string(value) != want):
+		t.Fatalf("key '%s' is %q (error %v), want %q", key, value, err, want)
+	}
+}
+
+func TestRaftStorageHardState(t *testing.T) {
+	db := openTestDatabase(t, nil)
+	storage := openTestRaftStorage(t, db, "strong")
+
+	if state, err := storage.HardState(); err != nil || state != (raft.HardState{}) {
+		t.Fatalf("initial hard state is %+v (error %v)", state, err)
+	}
+
+	want := raft.HardState{Term: 3, Vote: "b"}
+	if err := storage.SetHardState(want); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := storage.HardState(); err != nil || state != want {
+		t.Fatalf("hard state is %+v (error %v), want %+v", state, err, want)
+	}
+}
+
+func TestRaftStorageAppend(t *testing.T) {
+	db := openTestDatabase(t, nil)
+	storage := openTestRaftStorage(t, db, "strong")
+
+	expectLastIndex(t, storage, 0)
+
+	log := []raft.Entry{
+		configurationEntry(1, 1, `["a","b","c"]`),
+		{Index: 2, Term: 1},
+		setEntry(3, 1, "a", "1"),
+		setEntry(4, 1, "b", "2"),
+		deleteEntry(5, 1, "a"),
+	}
+	mustAppend(t, storage, log...)
+
+	expectLastIndex(t, storage, 5)
+	expectTerm(t, storage, 4, 1)
+	expectEntries(t, storage, 1, 6, log...)
+	expectEntries(t, storage, 2, 4, log[1:3]...)
+
+	// At least one entry is returned even if larger than the limit.
+	if entries, err := storage.Entries(3, 6, 1); err != nil || len(entries) != 1 {
+		t.Fatalf("got %d entries (error %v) limited to one byte, want one", len(entries), err)
+	}
+
+	if _, err := storage.Entries(6, 7, 1<<20); err == nil {
+		t.Fatal("got entries following the last one")
+	}
+
+	// Entries of new leader replace the conflicting ones and all following.
+	replaced := []raft.Entry{setEntry(3, 2, "c", "3"), setEntry(4, 2, "d", "4")}
+	mustAppend(t, storage, replaced...)
+
+	expectLastIndex(t, storage, 4)
+	expectTerm(t, storage, 3, 2)
+	expectEntries(t, storage, 1, 5, append(log[:2:2], replaced...)...)
+
+	// Log is read back by new storage, without the cached last index.
+	reopened, err := db.RaftStorage("strong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLastIndex(t, reopened, 4)
+
+	// Command would be read back as configuration entry.
+	if err := storage.Append([]raft.Entry{{Index: 5, Term: 2, Data: []byte("m[]")}}); err == nil {
+		t.Fatal("appended command with configuration op")
+	}
+}
+
+func TestRaftStorageApply(t *testing.T) {
+	db := openTestDatabase(t, nil)
+	storage := openTestRaftStorage(t, db, "strong")
+
+	entries := []raft.Entry{
+		configurationEntry(1, 1, `["a","b","c"]`),
+		{Index: 2, Term: 1},
+		setEntry(3, 1, "a", "1"),
+		setEntry(4, 1, "b", "2"),
+		deleteEntry(5, 1, "a"),
+		{Index: 6, Term: 1, Data: []byte{0}},
+		setEntry(7, 2, "\xff", "internal"),
+	}
+	mustAppend(t, storage, entries...)
+
+	results := mustApply(t, storage, entries...)
+	for i, err := range results {
+		if rejected := i >= 5; (err != nil) != rejected {
+			t.Errorf("result of entry %d is %v, want rejected: %v", entries[i].Index, err, rejected)
+		}
+	}
+
+	if index, term, err := storage.Applied(); err != nil || index != 7 || term != 2 {
+		t.Fatalf("applied entry %d of term %d (error %v), want 7 of term 2", index, term, err)
+	}
+
+	config, err := storage.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (raft.Configuration{Index: 1, Members: []string{"a", "b", "c"}}); !reflect.DeepEqual(config, want) {
+		t.Fatalf("configuration is %+v, want %+v", config, want)
+	}
+
+	expectBucketValue(t, db, "strong", "a", "")
+	expectBucketValue(t, db, "strong", "b", "2")
+
+	// Direct writes bypassing the log are refused.
+	bucket, err := db.Get("strong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Release(bucket)
+
+	if err := bucket.Set("c", []byte("3")); !errors.Is(err, ErrConsensusRequired) {
+		t.Fatalf("direct write returned %v, want %v", err, ErrConsensusRequired)
+	}
+}
+
+func TestRaftStorageCompact(t *testing.T) {
+	db := openTestDatabase(t, nil)
+	storage := openTestRaftStorage(t, db, "strong")
+
+	entries := []raft.Entry{
+		setEntry(1, 1, "a", "1"),
+		setEntry(2, 1, "b", "2"),
+		setEntry(3, 2, "c", "3"),
+		setEntry(4, 2, "d", "4"),
+		setEntry(5, 3, "e", "5"),
+	}
+	mustAppend(t, storage, entries...)
+	mustApply(t, storage, entries[:4]...)
+
+	if err := storage.Compact(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if index, term, err := storage.Compacted(); err != nil || index != 3 || term != 2 {
+		t.Fatalf("compacted entry %d of term %d (error %v), want 3 of term 2", index, term, err)
+	}
+
+	expectTerm(t, storage, 3, 2)
+	if _, err := storage.Term(2); !errors.Is(err, raft.ErrCompacted) {
+		t.Fatalf("term of compacted entry returned %v, want %v", err, raft.ErrCompacted)
+	}
+	if _, err := storage.Entries(2, 6, 1<<20); !errors.Is(err, raft.ErrCompacted) {
+		t.Fatalf("reading compacted entries returned %v, want %v", err, raft.ErrCompacted)
+	}
+	expectEntries(t, storage, 4, 6, entries[3:]...)
+
+	// State isn't changed by compaction.
+	expectBucketValue(t, db, "strong", "a", "1")
+
+	// Last index of empty log is the compacted one.
+	mustApply(t, storage, entries[4])
+	if err := storage.Compact(5); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := db.RaftStorage("strong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLastIndex(t, reopened, 5)
+	expectTerm(t, reopened, 5, 3)
+
+	// Log continues after the compacted entry.
+	mustAppend(t, reopened, setEntry(6, 3, "f", "6"))
+	expectLastIndex(t, reopened, 6)
+}
+
+func TestRaftStorageSnapshot(t *testing.T) {
+	db := openTestDatabase(t, nil)
+	source := openTestRaftStorage(t, db, "source")
+	target := openTestRaftStorage(t, db, "target")
+
+	entries := []raft.Entry{configurationEntry(1, 1, `["a","b"]`)}
+	for i := 0; i < 20; i++ {
+		entries = append(entries, setEntry(uint64(i+2), 1, string(rune('a'+i)), "value"))
+	}
+	mustAppend(t, source, entries...)
+	mustApply(t, source, entries...)
+
+	snapshot, err := source.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	// Snapshot isn't changed by entries applied later.
+	later := setEntry(22, 2, "later", "value")
+	mustAppend(t, source, later)
+	mustApply(t, source, later)
+
+	if snapshot.Index() != 21 || snapshot.Term() != 1 {
+		t.Fatalf("snapshot is at entry %d of term %d, want 21 of term 1", snapshot.Index(), snapshot.Term())
+	}
+
+	// Target state and log are replaced by the snapshot.
+	stale := []raft.Entry{setEntry(1, 1, "stale", "value"), setEntry(2, 1, "b", "stale")}
+	mustAppend(t, target, stale...)
+	mustApply(t, target, stale...)
+	if err := target.SetHardState(raft.HardState{Term: 2, Vote: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := 0
+	for cursor, first := []byte(nil), true; first || cursor != nil; first = false {
+		chunk, next, err := snapshot.Read(cursor, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = target.Restore(snapshot.Index(), snapshot.Term(), snapshot.Configuration(), chunk, first, next == nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cursor = next
+		chunks++
+	}
+
+	if chunks < 2 {
+		t.Fatalf("snapshot read in %d chunk(s), want several", chunks)
+	}
+
+	for i := 0; i < 20; i++ {
+		expectBucketValue(t, db, "target", string(rune('a'+i)), "value")
+	}
+	expectBucketValue(t, db, "target", "stale", "")
+	expectBucketValue(t, db, "target", "later", "")
+
+	for _, position := range []func() (uint64, uint64, error){target.Applied, target.Compacted} {
+		if index, term, err := position(); err != nil || index != 21 || term != 1 {
+			t.Fatalf("restored position is entry %d of term %d (error %v), want 21 of term 1", index, term, err)
+		}
+	}
+
+	expectLastIndex(t, target, 21)
+	if _, err := target.Entries(1, 3, 1<<20); !errors.Is(err, raft.ErrCompacted) {
+		t.Fatalf("reading entries of replaced log returned %v, want %v", err, raft.ErrCompacted)
+	}
+
+	config, err := target.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (raft.Configuration{Index: 1, Members: []string{"a", "b"}}); !reflect.DeepEqual(config, want) {
+		t.Fatalf("restored configuration is %+v, want %+v", config, want)
+	}
+
+	// Hard state survives restoring.
+	if state, err := target.HardState(); err != nil || state.Term != 2 {
+		t.Fatalf("hard state after restoring is %+v (error %v), want term 2", state, err)
+	}
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/pepol/databuddy/internal/crdt"
+)
+
+// Keys of buckets with ConflictCRDT policy hold conflict-free replicated
+// data types. State of the type is kept in version of the key, merged with
+// states of replicated writes, and the key holds its plain representation
+// (see crdt.Value.Bytes), so that it can be read by GET. Plain writes (SET
+// and DEL) write registers; deleting sets and maps removes their observed
+// contents.
+
+// Apply change of data type of key (or plain write of register if op has
+// no change) to its current state, returning the new state.
+func (v *versioner) change(txn Txn, op *writeOp) (*crdt.Value, error) {
+	current, _, err := readVersion(txn, op.key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Registers written later must win over the current ones.
+	if current.Data != nil {
+		v.clock.observe(current.Data.Time())
+	}
+
+	tag := crdt.Tag{Node: v.node, Time: v.clock.now()}
+
+	if op.change != nil {
+		return op.change(current.Data, tag)
+	}
+
+	if op.original == nil {
+		op.original = &Sibling{Value: op.value, Deleted: op.delete}
+	}
+
+	if op.original.Deleted {
+		return crdt.Delete(current.Data, tag)
+	}
+
+	register, err := crdt.AsRegister(current.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &crdt.Value{Register: register.Set(op.original.Value, false, tag)}, nil
+}
+
+// UpdateCRDT changes data type of key. Change gets the current state of the
+// key (nil if it has none) and tag identifying the change, and returns the
+// new state. It may be called more than once, if the write is retried.
+func (b *Bucket) UpdateCRDT(key string, change func(current *crdt.Value, tag crdt.Tag) (*crdt.Value, error)) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if b.meta.Conflict != ConflictCRDT {
+		return fmt.Errorf("bucket '%s' %w", b.Name, ErrNoDataTypes)
+	}
+
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	if isInternalKey([]byte(key)) {
+		return errReservedKey
+	}
+
+	op := &writeOp{key: []byte(key), change: change, done: make(chan error, 1)}
+	if err := b.committer.queue(op); err != nil {
+		return err
+	}
+
+	b.touch()
+	return nil
+}
+
+// CRDT returns state of data type of key, ErrKeyNotFound if it has none.
+func (b *Bucket) CRDT(key string) (*crdt.Value, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if b.meta.Conflict != ConflictCRDT {
+		return nil, fmt.Errorf("bucket '%s' %w", b.Name, ErrNoDataTypes)
+	}
+
+	v, ok, err := readVersion(b.engine, []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if !ok || v.Data == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return v.Data, nil
+}
@@ -1,19 +1,45 @@
 package db
 
 import (
+	"container/list"
+	"errors"
 	"fmt"
+	"os"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/pepol/databuddy/internal/config"
 	"github.com/pepol/databuddy/internal/log"
 )
 
 // Database is the implementation of local storage layer.
 type Database struct {
 	datadir       string
+	dropRetention time.Duration
+	idleTimeout   time.Duration
+	maxOpen       int
 	system        *Bucket
+	store         storage
 	buckets       map[string]*Bucket
-	DefaultBucket string
+	lru           *list.List // Opened buckets, most recently used first.
+	mutex         sync.RWMutex
+	defaultBucket string
+
+	valueCacheSize   int64
+	closedCacheStats CacheStats // Value cache metrics of closed buckets.
+
+	readOnly bool // Opened with read-only storage, all changes are rejected.
+
+	// Number of the latest writes kept in replication log of each bucket,
+	// zero if writes aren't logged.
+	replicationLogSize uint64
+
+	// Name of this member and its clock, versioning writes of buckets with
+	// conflict policy.
+	node  string
+	clock *hlc
 }
 
 const (
@@ -24,8 +50,8 @@ const (
 	systemBucketName   = "_system"
 )
 
-// InitDatabase creates the local database for use.
-func InitDatabase(datadir string, bucketName string) error {
+// InitDatabase creates the local database for use, using given storage layout.
+func InitDatabase(datadir, bucketName, layout string) error {
 	if err := checkDataDirectory(datadir); err != nil {
 		return err
 	}
@@ -38,13 +64,32 @@ func InitDatabase(datadir string, bucketName string) error {
 		return fmt.Errorf("directory '%s' not empty", datadir)
 	}
 
-	systemBucket, err := openBucketNoCheck(systemBucketName, datadir)
+	if !isValidBucketName(bucketName) {
+		return fmt.Errorf("bucket name '%s' does not match RFC1123 label requirements", bucketName)
+	}
+
+	systemBucket, err := openBucketNoCheck(systemBucketName, datadir, false)
 	if err != nil {
 		return err
 	}
 	log.Info("created system bucket")
 
-	if err := systemBucket.Set(bucketKeyPrefix+bucketName, []byte{1}); err != nil {
+	store, err := openStorage(layout, datadir, systemBucket, false)
+	if err != nil {
+		return err
+	}
+
+	if err := systemBucket.Set(layoutKey, []byte(layout)); err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("using '%s' storage layout", layout))
+
+	var meta bucketMeta
+	if err := store.create(bucketName, &meta); err != nil {
+		return err
+	}
+
+	if err := systemBucket.Set(bucketKeyPrefix+bucketName, meta.encode()); err != nil {
 		return err
 	}
 	log.Info(fmt.Sprintf("created bucket '%s'", bucketName))
@@ -58,16 +103,22 @@ func InitDatabase(datadir string, bucketName string) error {
 		return err
 	}
 
+	if err := store.shutdown(); err != nil {
+		return err
+	}
+
 	return systemBucket.Close()
 }
 
 // OpenDatabase opens the local database for use.
-func OpenDatabase(datadir string) (*Database, error) {
+func OpenDatabase(cfg *config.Config) (*Database, error) {
+	datadir := cfg.DataDir
+
 	if err := checkDataDirectory(datadir); err != nil {
 		return nil, err
 	}
 
-	systemBucket, err := openBucketNoCheck(systemBucketName, datadir)
+	systemBucket, err := openBucketNoCheck(systemBucketName, datadir, cfg.ReadOnly)
 	if err != nil {
 		return nil, err
 	}
@@ -77,11 +128,39 @@ func OpenDatabase(datadir string) (*Database, error) {
 		return nil, fmt.Errorf("validating db: %v", err)
 	}
 
+	layout, err := storageLayout(systemBucket)
+	if err != nil {
+		return nil, fmt.Errorf("getting storage layout: %v", err)
+	}
+
+	disk, err := openStorage(layout, datadir, systemBucket, cfg.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	store := newEngineStorage(disk)
+
+	if cfg.ReadOnly {
+		err = checkJournalEmpty(systemBucket)
+	} else {
+		err = recoverJournal(systemBucket, store, datadir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	defaultBucket, err := systemBucket.Get(defaultBucketKey)
 	if err != nil {
 		return nil, fmt.Errorf("getting default bucket name: %v", err)
 	}
 
+	node := cfg.NodeName
+	if node == "" {
+		if node, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("getting hostname: %v", err)
+		}
+	}
+
 	buckets := make(map[string]*Bucket)
 
 	keys, err := systemBucket.List(bucketKeyPrefix)
@@ -98,51 +177,140 @@ func OpenDatabase(datadir string) (*Database, error) {
 
 		bucketName := strings.TrimPrefix(key, bucketKeyPrefix)
 
-		bucket, err := openBucket(bucketName, datadir)
+		value, err := systemBucket.Get(key)
+		if err != nil {
+			return nil, err
+		}
+
+		meta, err := decodeMeta(value)
+		if err != nil {
+			log.Error(fmt.Sprintf("decoding metadata of bucket '%s'", bucketName), err)
+			continue
+		}
+
+		bucket, err := newBucket(bucketName, store, meta)
 		if err != nil {
-			log.Error(fmt.Sprintf("opening bucket '%s'", bucketName), err)
+			log.Error(fmt.Sprintf("registering bucket '%s'", bucketName), err)
 			continue
 		}
 
+		bucket.databaseReadOnly = cfg.ReadOnly
 		buckets[bucketName] = bucket
-		log.Info(fmt.Sprintf("opened bucket '%s'", bucketName))
 	}
 
 	return &Database{
-		datadir:       datadir,
-		system:        systemBucket,
-		buckets:       buckets,
-		DefaultBucket: string(defaultBucket),
+		datadir:        datadir,
+		dropRetention:  cfg.DropRetention,
+		idleTimeout:    cfg.BucketIdleTimeout,
+		maxOpen:        cfg.MaxOpenBuckets,
+		system:         systemBucket,
+		store:          store,
+		buckets:        buckets,
+		lru:            list.New(),
+		defaultBucket:  string(defaultBucket),
+		valueCacheSize: cfg.ValueCacheSize,
+		readOnly:       cfg.ReadOnly,
+
+		replicationLogSize: cfg.ReplicationLogSize,
+
+		node:  node,
+		clock: &hlc{},
 	}, nil
 }
 
-// Create creates a new database/bucket with given name.
-func (db *Database) Create(name string) error {
-	if err := db.system.Set(bucketKeyPrefix+name, []byte{1}); err != nil {
+// BucketOptions are settings of new bucket.
+type BucketOptions struct {
+	// Storage engine, EngineBadger if empty.
+	Engine string
+	// Consistency mode, ConsistencyEventual if empty.
+	Consistency string
+	// Conflict policy, ConflictNone if empty.
+	Conflict string
+}
+
+// Create creates a new database/bucket with given name and options.
+func (db *Database) Create(name string, opts BucketOptions) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if err := db.checkNewBucket(name); err != nil {
+		return err
+	}
+
+	if opts.Engine != "" && !isValidEngine(opts.Engine) {
+		return fmt.Errorf("unknown storage engine '%s'", opts.Engine)
+	}
+
+	consistency := opts.Consistency
+	switch consistency {
+	case ConsistencyEventual:
+		consistency = ""
+	case "", ConsistencyStrong:
+	default:
+		return fmt.Errorf("unknown consistency mode '%s'", consistency)
+	}
+
+	if !isValidConflictPolicy(opts.Conflict) {
+		return fmt.Errorf("unknown conflict policy '%s'", opts.Conflict)
+	}
+
+	if opts.Conflict != ConflictNone && consistency == ConsistencyStrong {
+		return errors.New("strongly consistent buckets have no conflicts to resolve")
+	}
+
+	meta := bucketMeta{Engine: opts.Engine, Consistency: consistency, Conflict: opts.Conflict}
+	if err := db.store.create(name, &meta); err != nil {
 		return err
 	}
 
-	bucket, err := openBucket(name, db.datadir)
+	if err := db.system.Set(bucketKeyPrefix+name, meta.encode()); err != nil {
+		return err
+	}
+
+	bucket, err := newBucket(name, db.store, meta)
+	if err == nil {
+		// Open the bucket right away to create its directory.
+		err = db.acquireLocked(bucket)
+	}
 	if err != nil {
+		if delErr := db.system.Delete(bucketKeyPrefix + name); delErr != nil {
+			log.Error(fmt.Sprintf("unregistering bucket '%s'", name), delErr)
+		}
 		return err
 	}
 
+	bucket.refs--
 	db.buckets[name] = bucket
 	return nil
 }
 
-// Get bucket with given name, or error if it doesn't exist.
+// Get bucket with given name, or error if it doesn't exist. The bucket is
+// opened if needed and must be released once no longer used.
 func (db *Database) Get(name string) (*Bucket, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	bucket, ok := db.buckets[name]
 	if !ok {
 		return nil, fmt.Errorf("bucket '%s' not found", name)
 	}
 
+	if err := db.acquireLocked(bucket); err != nil {
+		return nil, fmt.Errorf("opening bucket '%s': %w", name, err)
+	}
+
 	return bucket, nil
 }
 
 // List all available buckets (names only).
 func (db *Database) List(prefix string) []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
 	names := make([]string, 0, len(db.buckets))
 
 	for name := range db.buckets {
@@ -158,36 +326,222 @@ func (db *Database) List(prefix string) []string {
 
 // Count all available buckets.
 func (db *Database) Count() int {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
 	return len(db.buckets)
 }
 
-// Drop given bucket.
-func (db *Database) Drop(name string) error {
-	if name == db.DefaultBucket {
-		return fmt.Errorf("bucket '%s' is marked as default and cannot be deleted", name)
+// DefaultBucket returns name of the bucket used by new connections.
+func (db *Database) DefaultBucket() string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.defaultBucket
+}
+
+// SetDefaultBucket marks bucket with given name as default.
+func (db *Database) SetDefaultBucket(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
 	}
 
-	if err := db.system.Delete(bucketKeyPrefix + name); err != nil {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, ok := db.buckets[name]; !ok {
+		return fmt.Errorf("bucket '%s' not found", name)
+	}
+
+	if err := db.system.Set(defaultBucketKey, []byte(name)); err != nil {
 		return err
 	}
 
-	bucket, ok := db.buckets[name]
-	delete(db.buckets, name)
+	db.defaultBucket = name
+	return nil
+}
+
+// Rename bucket, keeping all its data. Waits for users of the bucket to
+// release it first, like Drop.
+func (db *Database) Rename(oldName, newName string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket, err := db.awaitReleaseLocked(oldName, func(bucket *Bucket) error {
+		if bucket.meta.ReadOnly {
+			return fmt.Errorf("bucket '%s' is %w", oldName, ErrReadOnly)
+		}
 
+		return db.checkNewBucket(newName)
+	})
+	if err != nil {
+		return err
+	}
+
+	entry := journalEntry{Target: newName, Meta: bucket.meta}
+	if err := db.system.Set(journalKey(journalRenameKind, oldName), entry.encode()); err != nil {
+		return err
+	}
+
+	if err := db.closeBucketLocked(bucket); err != nil {
+		return db.rollback(journalRenameKind, oldName, fmt.Errorf("closing bucket: %v", err))
+	}
+
+	if err := db.store.rename(oldName, newName, bucket.meta); err != nil {
+		return db.rollback(journalRenameKind, oldName, err)
+	}
+
+	if err := commitRename(db.system, oldName, newName); err != nil {
+		return err
+	}
+
+	if db.defaultBucket == oldName {
+		db.defaultBucket = newName
+	}
+
+	renamed, err := newBucket(newName, db.store, bucket.meta)
+	if err != nil {
+		return err
+	}
+
+	delete(db.buckets, oldName)
+	db.buckets[newName] = renamed
+	return nil
+}
+
+// Clone bucket into a new bucket, copying all its data.
+func (db *Database) Clone(srcName, dstName string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	src, ok := db.buckets[srcName]
 	if !ok {
-		return nil
+		return fmt.Errorf("bucket '%s' not found", srcName)
+	}
+
+	if err := db.checkNewBucket(dstName); err != nil {
+		return err
+	}
+
+	meta := src.meta
+	meta.ID = 0 // Assigned by storage.
+	meta.ReadOnly = false
+	if err := db.store.create(dstName, &meta); err != nil {
+		return err
+	}
+
+	entry := journalEntry{Target: srcName, Meta: meta}
+	if err := db.system.Set(journalKey(journalCloneKind, dstName), entry.encode()); err != nil {
+		return err
+	}
+
+	if err := db.acquireLocked(src); err != nil {
+		return db.rollbackClone(dstName, meta, err)
+	}
+
+	err := db.store.copy(src, dstName, meta)
+	src.refs--
+
+	if err != nil {
+		return db.rollbackClone(dstName, meta, err)
+	}
+
+	if err := commitClone(db.system, dstName, meta); err != nil {
+		return err
+	}
+
+	dst, err := newBucket(dstName, db.store, meta)
+	if err != nil {
+		return err
+	}
+
+	db.buckets[dstName] = dst
+	return nil
+}
+
+// Discard partial copy after failed clone and remove the journal entry.
+func (db *Database) rollbackClone(name string, meta bucketMeta, cause error) error {
+	if _, err := db.store.recoverCopy(name, meta); err != nil {
+		log.Error(fmt.Sprintf("removing partial copy of bucket '%s'", name), err)
+		return cause // Leave the journal entry, so that startup cleans up.
 	}
 
-	return bucket.Close()
+	return db.rollback(journalCloneKind, name, cause)
+}
+
+// Remove the journal entry after failed operation.
+func (db *Database) rollback(kind, name string, cause error) error {
+	if err := db.system.Delete(journalKey(kind, name)); err != nil {
+		log.Error(fmt.Sprintf("removing journal entry for bucket '%s'", name), err)
+	}
+
+	return cause
+}
+
+// Flush removes all data from given bucket, keeping the bucket itself.
+func (db *Database) Flush(name string) error {
+	bucket, err := db.Get(name)
+	if err != nil {
+		return err
+	}
+	defer db.Release(bucket)
+
+	return bucket.Flush()
+}
+
+// Check that bucket with given name can be created.
+func (db *Database) checkNewBucket(name string) error {
+	if !isValidBucketName(name) {
+		return fmt.Errorf("bucket name '%s' does not match RFC1123 label requirements", name)
+	}
+
+	if _, ok := db.buckets[name]; ok {
+		return fmt.Errorf("bucket '%s' already exists", name)
+	}
+
+	dropped, err := db.isDropped(name)
+	if err != nil {
+		return err
+	}
+
+	if dropped {
+		return fmt.Errorf("bucket '%s' was dropped and not purged yet", name)
+	}
+
+	occupied, err := db.store.occupied(name)
+	if err != nil {
+		return err
+	}
+
+	if occupied {
+		return fmt.Errorf("data for bucket '%s' already exists", name)
+	}
+
+	return nil
 }
 
 // Close the database.
 func (db *Database) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	for _, bucket := range db.buckets {
-		if err := bucket.Close(); err != nil {
+		if err := db.closeBucketLocked(bucket); err != nil {
 			log.Error(fmt.Sprintf("closing bucket '%s'", bucket.Name), err)
 		}
 	}
 
+	if err := db.store.shutdown(); err != nil {
+		log.Error("closing storage", err)
+	}
+
 	return db.system.Close()
 }
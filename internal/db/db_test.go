@@ -0,0 +1,97 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pepol/databuddy/internal/config"
+)
+
+// Open database initialized in temporary directory, closed at the end of
+// the test. Configure (if set) may change the configuration.
+func openTestDatabase(tb testing.TB, configure func(cfg *config.Config)) *Database {
+	tb.Helper()
+
+	// Data directory must be private, unlike the temporary one.
+	dir := filepath.Join(tb.TempDir(), "data")
+	if err := InitDatabase(dir, "default", LayoutDir); err != nil {
+		tb.Fatal(err)
+	}
+
+	cfg := &config.Config{DataDir: dir, NodeName: "test"}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	db, err := OpenDatabase(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			tb.Error(err)
+		}
+	})
+
+	return db
+}
+
+// Create bucket and acquire it until the end of the test.
+func createTestBucket(tb testing.TB, db *Database, name string, opts BucketOptions) *Bucket {
+	tb.Helper()
+
+	if err := db.Create(name, opts); err != nil {
+		tb.Fatal(err)
+	}
+
+	bucket, err := db.Get(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Release(bucket) })
+
+	return bucket
+}
+
+// Rename waits for users of the bucket, and the renamed bucket contains
+// their writes.
+func TestRenameWaitsForRelease(t *testing.T) {
+	db := openTestDatabase(t, nil)
+
+	if err := db.Create("old", BucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket, err := db.Get("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	released := make(chan error)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		err := bucket.Set("key", []byte("value"))
+		db.Release(bucket)
+		released <- err
+	}()
+
+	if err := db.Rename("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-released; err != nil {
+		t.Fatalf("writing bucket being renamed: %v", err)
+	}
+
+	renamed, err := db.Get("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Release(renamed)
+
+	if value, err := renamed.Get("key"); err != nil || string(value) != "value" {
+		t.Fatalf("got value %q (error %v) after rename, want the written one", value, err)
+	}
+}
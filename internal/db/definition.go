@@ -0,0 +1,154 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Definitions of buckets spread lifecycle changes of buckets (creation,
+// drop, rename, clone, read-only mode, quota and schema) to all members of
+// the cluster. They are
+// registered under definitionKeyPrefix in the system bucket, also for
+// buckets which don't exist locally (yet). Like replication policies,
+// every change has the time it was made and the latest change wins, and
+// dropped buckets keep their definitions as tombstones.
+
+const definitionKeyPrefix = "definition:"
+
+// BucketDefinition describes bucket as it should exist on all members.
+type BucketDefinition struct {
+	Engine      string `json:"engine,omitempty"`
+	Consistency string `json:"consistency,omitempty"`
+	Conflict    string `json:"conflict,omitempty"`
+	ReadOnly    bool   `json:"read_only,omitempty"`
+	Quota       Quota  `json:"quota"`
+	Schema      Schema `json:"schema"`
+	// Bucket which was renamed or cloned to create this one. Members which
+	// have it rename or clone it instead of creating empty bucket.
+	RenamedFrom string `json:"renamed_from,omitempty"`
+	ClonedFrom  string `json:"cloned_from,omitempty"`
+	// Name the dropped bucket was renamed to. Members which have the
+	// bucket rename it instead of dropping it.
+	RenamedTo string `json:"renamed_to,omitempty"`
+	// Time the bucket was created (Unix nanoseconds), distinguishing it
+	// from earlier buckets of the same name.
+	Created int64 `json:"created"`
+	// Time of the change (Unix nanoseconds).
+	Updated int64 `json:"updated"`
+	// Whether the bucket was dropped.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// Options returns options bucket is created with.
+func (d BucketDefinition) Options() BucketOptions {
+	return BucketOptions{Engine: d.Engine, Consistency: d.Consistency, Conflict: d.Conflict}
+}
+
+func (d BucketDefinition) encode() []byte {
+	// Marshalling struct of plain fields cannot fail.
+	value, _ := json.Marshal(d)
+	return value
+}
+
+// SetBucketDefinition stores definition of bucket with given name, unless
+// the stored one is newer. Returns whether the definition was stored.
+func (db *Database) SetBucketDefinition(name string, definition BucketDefinition) (bool, error) {
+	if err := db.checkWritable(); err != nil {
+		return false, err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	current, err := db.bucketDefinition(name)
+	if err != nil && err != ErrKeyNotFound {
+		return false, err
+	}
+	if err == nil && current.Updated >= definition.Updated {
+		return false, nil
+	}
+
+	if err := db.system.Set(definitionKeyPrefix+name, definition.encode()); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// LocalDefinition returns definition matching current state of local bucket
+// with given name, without opening it. Times of the definition are unset.
+func (db *Database) LocalDefinition(name string) (BucketDefinition, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	bucket, ok := db.buckets[name]
+	if !ok {
+		return BucketDefinition{}, fmt.Errorf("bucket '%s' not found", name)
+	}
+
+	bucket.mutex.RLock()
+	defer bucket.mutex.RUnlock()
+
+	meta := bucket.meta
+
+	return BucketDefinition{
+		Engine:      meta.engine(),
+		Consistency: meta.Consistency,
+		Conflict:    meta.Conflict,
+		ReadOnly:    meta.ReadOnly,
+		Quota:       meta.Quota,
+		Schema:      meta.Schema,
+	}, nil
+}
+
+// BucketDefinition returns definition of bucket with given name (including
+// dropped one), ErrKeyNotFound if it has none.
+func (db *Database) BucketDefinition(name string) (BucketDefinition, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.bucketDefinition(name)
+}
+
+// BucketDefinitions returns definitions of all buckets by bucket name,
+// including dropped ones.
+func (db *Database) BucketDefinitions() (map[string]BucketDefinition, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	keys, err := db.system.List(definitionKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := make(map[string]BucketDefinition, len(keys))
+
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, definitionKeyPrefix)
+
+		definition, err := db.bucketDefinition(name)
+		if err != nil {
+			return nil, err
+		}
+
+		definitions[name] = definition
+	}
+
+	return definitions, nil
+}
+
+func (db *Database) bucketDefinition(name string) (BucketDefinition, error) {
+	var definition BucketDefinition
+
+	value, err := db.system.Get(definitionKeyPrefix + name)
+	if err != nil {
+		return definition, err
+	}
+
+	if err := json.Unmarshal(value, &definition); err != nil {
+		return definition, fmt.Errorf("decoding definition of bucket '%s': %v", name, err)
+	}
+
+	return definition, nil
+}
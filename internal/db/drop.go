@@ -0,0 +1,288 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Dropped buckets are only removed from the bucket registry and kept on disk
+// (registered under droppedKeyPrefix along with the time of drop) until they
+// are purged, either explicitly or after the retention period passes.
+
+const droppedKeyPrefix = "dropped:"
+
+// droppedEntry is the registry value of dropped bucket.
+type droppedEntry struct {
+	DroppedAt int64      `json:"dropped_at"`
+	Meta      bucketMeta `json:"meta"`
+}
+
+func decodeDroppedEntry(value []byte) (droppedEntry, error) {
+	var entry droppedEntry
+
+	if len(value) == 8 { //nolint:gomnd // Size of uint64.
+		// Entries written before bucket metadata existed only contain
+		// the time of drop.
+		entry.DroppedAt = int64(binary.BigEndian.Uint64(value))
+		return entry, nil
+	}
+
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return entry, err
+	}
+
+	return entry, nil
+}
+
+func (e droppedEntry) encode() []byte {
+	// Marshalling struct of plain fields cannot fail.
+	value, _ := json.Marshal(e)
+	return value
+}
+
+// DroppedBucket describes bucket that was dropped, but not purged yet.
+type DroppedBucket struct {
+	Name      string
+	DroppedAt time.Time
+}
+
+// Drop given bucket. Data is kept on disk until the bucket is purged. Waits
+// for users of the bucket to release it first, failing with ErrBucketInUse
+// if they don't in time.
+func (db *Database) Drop(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket, err := db.awaitReleaseLocked(name, func(bucket *Bucket) error {
+		if name == db.defaultBucket {
+			return fmt.Errorf("bucket '%s' is marked as default and cannot be deleted", name)
+		}
+
+		if bucket.meta.ReadOnly {
+			return fmt.Errorf("bucket '%s' is %w", name, ErrReadOnly)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	entry := droppedEntry{DroppedAt: time.Now().Unix(), Meta: bucket.meta}
+
+	err = db.system.update(func(txn Txn) error {
+		if err := txn.Delete([]byte(bucketKeyPrefix + name)); err != nil {
+			return err
+		}
+
+		return txn.Set([]byte(droppedKeyPrefix+name), entry.encode())
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(db.buckets, name)
+
+	return db.closeBucketLocked(bucket)
+}
+
+// Undrop restores dropped bucket, including all data.
+func (db *Database) Undrop(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, ok := db.buckets[name]; ok {
+		return fmt.Errorf("bucket '%s' already exists", name)
+	}
+
+	entry, err := db.droppedEntry(name)
+	if err != nil {
+		return err
+	}
+
+	err = db.system.update(func(txn Txn) error {
+		if err := txn.Delete([]byte(droppedKeyPrefix + name)); err != nil {
+			return err
+		}
+
+		return txn.Set([]byte(bucketKeyPrefix+name), entry.Meta.encode())
+	})
+	if err != nil {
+		return err
+	}
+
+	bucket, err := newBucket(name, db.store, entry.Meta)
+	if err != nil {
+		return err
+	}
+
+	db.buckets[name] = bucket
+	return nil
+}
+
+// Purge removes all files of dropped bucket.
+func (db *Database) Purge(name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, err := db.droppedEntry(name); err != nil {
+		return err
+	}
+
+	return db.purge(name)
+}
+
+// PurgeExpired purges all dropped buckets older than the retention period.
+// Returns number of purged buckets.
+func (db *Database) PurgeExpired() (int, error) {
+	if db.dropRetention == 0 || db.readOnly {
+		return 0, nil
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	dropped, err := db.dropped()
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(-db.dropRetention)
+	purged := 0
+
+	for _, bucket := range dropped {
+		if bucket.DroppedAt.After(deadline) {
+			continue
+		}
+
+		if err := db.purge(bucket.Name); err != nil {
+			return purged, fmt.Errorf("purging bucket '%s': %v", bucket.Name, err)
+		}
+		log.Info(fmt.Sprintf("purged bucket '%s' dropped at %v", bucket.Name, bucket.DroppedAt))
+		purged++
+	}
+
+	return purged, nil
+}
+
+// Dropped returns all dropped buckets which are not purged yet.
+func (db *Database) Dropped() ([]DroppedBucket, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.dropped()
+}
+
+// DropRetention returns how long dropped buckets are kept before purging.
+func (db *Database) DropRetention() time.Duration {
+	return db.dropRetention
+}
+
+func (db *Database) dropped() ([]DroppedBucket, error) {
+	keys, err := db.system.List(droppedKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := make([]DroppedBucket, 0, len(keys))
+
+	for _, key := range keys {
+		value, err := db.system.Get(key)
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(key, droppedKeyPrefix)
+
+		entry, err := decodeDroppedEntry(value)
+		if err != nil {
+			return nil, fmt.Errorf("decoding dropped bucket '%s': %v", name, err)
+		}
+
+		dropped = append(dropped, DroppedBucket{
+			Name:      name,
+			DroppedAt: time.Unix(entry.DroppedAt, 0),
+		})
+	}
+
+	sort.Slice(dropped, func(i, j int) bool {
+		return dropped[i].Name < dropped[j].Name
+	})
+
+	return dropped, nil
+}
+
+func (db *Database) isDropped(name string) (bool, error) {
+	_, err := db.system.Get(droppedKeyPrefix + name)
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Get registry value of dropped bucket.
+func (db *Database) droppedEntry(name string) (droppedEntry, error) {
+	value, err := db.system.Get(droppedKeyPrefix + name)
+	if err == ErrKeyNotFound {
+		return droppedEntry{}, fmt.Errorf("bucket '%s' not dropped", name)
+	}
+	if err != nil {
+		return droppedEntry{}, err
+	}
+
+	return decodeDroppedEntry(value)
+}
+
+// Remove registry entry and data of dropped bucket (journaled).
+func (db *Database) purge(name string) error {
+	entry, err := db.droppedEntry(name)
+	if err != nil {
+		return err
+	}
+
+	journal := journalEntry{Meta: entry.Meta}
+
+	err = db.system.update(func(txn Txn) error {
+		if err := txn.Delete([]byte(droppedKeyPrefix + name)); err != nil {
+			return err
+		}
+
+		return txn.Set([]byte(journalKey(journalPurgeKind, name)), journal.encode())
+	})
+	if err != nil {
+		return err
+	}
+
+	return finishPurge(db.system, db.store, name, entry.Meta)
+}
+
+// Remove bucket data and finish the journal entry.
+func finishPurge(system *Bucket, store storage, name string, meta bucketMeta) error {
+	if err := store.remove(name, meta); err != nil {
+		return err
+	}
+
+	return system.Delete(journalKey(journalPurgeKind, name))
+}
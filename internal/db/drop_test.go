@@ -0,0 +1,52 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+// Drop waits for users of the bucket, which keep working with it until they
+// release it.
+func TestDropWaitsForRelease(t *testing.T) {
+	db := openTestDatabase(t, nil)
+
+	if err := db.Create("used", BucketOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket, err := db.Get("used")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	released := make(chan error)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		err := bucket.Set("key", []byte("value"))
+		db.Release(bucket)
+		released <- err
+	}()
+
+	if err := db.Drop("used"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-released; err != nil {
+		t.Fatalf("writing bucket being dropped: %v", err)
+	}
+
+	if err := db.Undrop("used"); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := db.Get("used")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Release(restored)
+
+	if value, err := restored.Get("key"); err != nil || string(value) != "value" {
+		t.Fatalf("got value %q (error %v) after undrop, want the written one", value, err)
+	}
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Storage engines keeping data of buckets.
+const (
+	// EngineBadger keeps data persistently on disk, using the storage
+	// layout of the database.
+	EngineBadger = "badger"
+	// EngineMemory keeps data in memory only. Data is lost on restart.
+	EngineMemory = "memory"
+)
+
+// ErrKeyNotFound is returned when the requested key does not exist.
+var ErrKeyNotFound = badger.ErrKeyNotFound
+
+// Reader reads data of a bucket.
+type Reader interface {
+	// Get copy of value stored under key, or ErrKeyNotFound.
+	Get(key []byte) ([]byte, error)
+	// Iterate over keys with given prefix in ascending order, calling fn
+	// for each one until it returns error. Key and value are only valid
+	// during the call. Values are not read if keysOnly is set.
+	Iterate(prefix []byte, keysOnly bool, fn func(key, value []byte) error) error
+	// IterateFrom is like Iterate, but starts at the first key with given
+	// prefix not less than start.
+	IterateFrom(prefix, start []byte, keysOnly bool, fn func(key, value []byte) error) error
+}
+
+// Txn is a read-write transaction.
+type Txn interface {
+	Reader
+	Set(key, value []byte) error
+	Delete(key []byte) error
+}
+
+// Batch collects independent writes, which are applied together on flush.
+// Batch is not atomic, part of the writes may be applied on failure.
+type Batch interface {
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	// Apply all collected writes.
+	Flush() error
+	// Discard all collected writes not flushed yet.
+	Cancel()
+}
+
+// Snapshot is a consistent read-only view of data, which must be released
+// once no longer used.
+type Snapshot interface {
+	Reader
+	Release()
+}
+
+// Engine stores data of a single bucket.
+type Engine interface {
+	Reader
+	Set(key, value []byte) error
+	Delete(key []byte) error
+
+	// Run read-write transaction. Changes are applied atomically if fn
+	// returns nil and discarded otherwise. Transaction conflicting with
+	// concurrent one is retried, so fn may be called multiple times.
+	Update(fn func(txn Txn) error) error
+	// NewBatch returns empty batch of independent writes.
+	NewBatch() Batch
+	// Run read-only transaction over consistent view of data.
+	View(fn func(txn Reader) error) error
+	// Snapshot returns consistent view of current data.
+	Snapshot() Snapshot
+
+	// Remove all data.
+	DropAll() error
+	// Release all resources held by engine.
+	Close() error
+}
+
+func isValidEngine(engine string) bool {
+	return engine == EngineBadger || engine == EngineMemory
+}
+
+// Copy all data from source into destination engine.
+func copyData(src Reader, dst Engine) error {
+	batch := dst.NewBatch()
+	defer batch.Cancel()
+
+	err := src.Iterate(nil, false, func(key, value []byte) error {
+		return batch.Set(append([]byte(nil), key...), append([]byte(nil), value...))
+	})
+	if err != nil {
+		return fmt.Errorf("copying data: %v", err)
+	}
+
+	return batch.Flush()
+}
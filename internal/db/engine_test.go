@@ -0,0 +1,395 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Every engine must pass the same conformance suite.
+func TestEngineConformance(t *testing.T) {
+	engines := []struct {
+		name string
+		open func(t *testing.T) Engine
+	}{
+		{"memory", func(t *testing.T) Engine { return newMemoryEngine() }},
+		{"badger", func(t *testing.T) Engine { return newBadgerEngine(openTestBadger(t), nil) }},
+		{"badger-prefixed", func(t *testing.T) Engine {
+			db := openTestBadger(t)
+
+			// Keys of neighbouring buckets must stay invisible.
+			for _, id := range []uint64{1, 3} {
+				if err := newBadgerEngine(db, bucketIDPrefix(id)).Set([]byte("a"), []byte("other")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			return newBadgerEngine(db, bucketIDPrefix(2))
+		}},
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, engine Engine)
+	}{
+		{"GetSetDelete", testEngineGetSetDelete},
+		{"Iterate", testEngineIterate},
+		{"IterateFrom", testEngineIterateFrom},
+		{"IterateStop", testEngineIterateStop},
+		{"Update", testEngineUpdate},
+		{"UpdateRollback", testEngineUpdateRollback},
+		{"Snapshot", testEngineSnapshot},
+		{"View", testEngineView},
+		{"Batch", testEngineBatch},
+		{"BatchCancel", testEngineBatchCancel},
+		{"DropAll", testEngineDropAll},
+	}
+
+	for _, e := range engines {
+		for _, test := range tests {
+			e, test := e, test
+			t.Run(e.name+"/"+test.name, func(t *testing.T) {
+				engine := e.open(t)
+				test.fn(t, engine)
+			})
+		}
+	}
+}
+
+func openTestBadger(t *testing.T) *badger.DB {
+	t.Helper()
+
+	db, err := openBadger(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+var errTestStop = errors.New("stop")
+
+func mustSet(t *testing.T, engine Engine, pairs ...string) {
+	t.Helper()
+
+	for i := 0; i < len(pairs); i += 2 {
+		if err := engine.Set([]byte(pairs[i]), []byte(pairs[i+1])); err != nil {
+			t.Fatalf("setting %q: %v", pairs[i], err)
+		}
+	}
+}
+
+func expectValue(t *testing.T, reader Reader, key, want string) {
+	t.Helper()
+
+	value, err := reader.Get([]byte(key))
+	if err != nil {
+		t.Fatalf("getting %q: %v", key, err)
+	}
+	if string(value) != want {
+		t.Fatalf("value of %q is %q, want %q", key, value, want)
+	}
+}
+
+func expectMissing(t *testing.T, reader Reader, key string) {
+	t.Helper()
+
+	if value, err := reader.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("getting %q returned %q, %v, want ErrKeyNotFound", key, value, err)
+	}
+}
+
+// Keys and values visited by iteration, as "key=value".
+func collect(t *testing.T, iterate func(fn func(key, value []byte) error) error) []string {
+	t.Helper()
+
+	var items []string
+	err := iterate(func(key, value []byte) error {
+		items = append(items, fmt.Sprintf("%s=%s", key, value))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iterating: %v", err)
+	}
+
+	return items
+}
+
+func expectItems(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got items %q, want %q", got, want)
+	}
+}
+
+func testEngineGetSetDelete(t *testing.T, engine Engine) {
+	expectMissing(t, engine, "a")
+
+	mustSet(t, engine, "a", "1")
+	expectValue(t, engine, "a", "1")
+
+	mustSet(t, engine, "a", "2")
+	expectValue(t, engine, "a", "2")
+
+	// Returned value is a copy.
+	value, _ := engine.Get([]byte("a"))
+	value[0] = 'x'
+	expectValue(t, engine, "a", "2")
+
+	// Set value may be reused by the caller.
+	buf := []byte("3")
+	if err := engine.Set([]byte("b"), buf); err != nil {
+		t.Fatal(err)
+	}
+	buf[0] = 'x'
+	expectValue(t, engine, "b", "3")
+
+	mustSet(t, engine, "empty", "")
+	expectValue(t, engine, "empty", "")
+
+	if err := engine.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	expectMissing(t, engine, "a")
+
+	// Deleting missing key is not an error.
+	if err := engine.Delete([]byte("missing")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testEngineIterate(t *testing.T, engine Engine) {
+	mustSet(t, engine, "b", "4", "ab", "2", "a", "1", "a\xff", "3", "abc", "5", "\xff\x00", "6")
+
+	all := collect(t, func(fn func(key, value []byte) error) error { return engine.Iterate(nil, false, fn) })
+	expectItems(t, all, "a=1", "ab=2", "abc=5", "a\xff=3", "b=4", "\xff\x00=6")
+
+	prefixed := collect(t, func(fn func(key, value []byte) error) error { return engine.Iterate([]byte("a"), false, fn) })
+	expectItems(t, prefixed, "a=1", "ab=2", "abc=5", "a\xff=3")
+
+	exact := collect(t, func(fn func(key, value []byte) error) error { return engine.Iterate([]byte("abc"), false, fn) })
+	expectItems(t, exact, "abc=5")
+
+	none := collect(t, func(fn func(key, value []byte) error) error { return engine.Iterate([]byte("c"), false, fn) })
+	expectItems(t, none)
+
+	var keys []string
+	err := engine.Iterate([]byte("a"), true, func(key, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectItems(t, keys, "a", "ab", "abc", "a\xff")
+}
+
+func testEngineIterateFrom(t *testing.T, engine Engine) {
+	mustSet(t, engine, "a", "1", "ab", "2", "abc", "3", "ac", "4", "b", "5")
+
+	from := func(prefix, start string) []string {
+		return collect(t, func(fn func(key, value []byte) error) error {
+			return engine.IterateFrom([]byte(prefix), []byte(start), false, fn)
+		})
+	}
+
+	expectItems(t, from("a", "ab"), "ab=2", "abc=3", "ac=4")
+	expectItems(t, from("a", "abb"), "abc=3", "ac=4")
+	expectItems(t, from("a", "b"))
+	expectItems(t, from("", "abc"), "abc=3", "ac=4", "b=5")
+	// Start before prefix starts at the prefix.
+	expectItems(t, from("ab", "a"), "ab=2", "abc=3")
+}
+
+func testEngineIterateStop(t *testing.T, engine Engine) {
+	mustSet(t, engine, "a", "1", "b", "2", "c", "3")
+
+	var visited int
+	err := engine.Iterate(nil, false, func(_, _ []byte) error {
+		visited++
+		if visited == 2 {
+			return errTestStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errTestStop) {
+		t.Fatalf("iteration returned %v, want %v", err, errTestStop)
+	}
+	if visited != 2 {
+		t.Fatalf("visited %d keys after stop, want 2", visited)
+	}
+}
+
+func testEngineUpdate(t *testing.T, engine Engine) {
+	mustSet(t, engine, "a", "1", "b", "2")
+
+	err := engine.Update(func(txn Txn) error {
+		if err := txn.Set([]byte("a"), []byte("10")); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte("b")); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("c"), []byte("3")); err != nil {
+			return err
+		}
+
+		// Transaction reads its own writes.
+		expectValue(t, txn, "a", "10")
+		expectMissing(t, txn, "b")
+		expectValue(t, txn, "c", "3")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, engine, "a", "10")
+	expectMissing(t, engine, "b")
+	expectValue(t, engine, "c", "3")
+}
+
+func testEngineUpdateRollback(t *testing.T, engine Engine) {
+	mustSet(t, engine, "a", "1", "b", "2")
+
+	err := engine.Update(func(txn Txn) error {
+		if err := txn.Set([]byte("a"), []byte("10")); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte("b")); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("c"), []byte("3")); err != nil {
+			return err
+		}
+		return errTestStop
+	})
+	if !errors.Is(err, errTestStop) {
+		t.Fatalf("update returned %v, want %v", err, errTestStop)
+	}
+
+	expectValue(t, engine, "a", "1")
+	expectValue(t, engine, "b", "2")
+	expectMissing(t, engine, "c")
+}
+
+func testEngineSnapshot(t *testing.T, engine Engine) {
+	mustSet(t, engine, "a", "1", "b", "2")
+
+	snapshot := engine.Snapshot()
+	defer snapshot.Release()
+
+	mustSet(t, engine, "a", "10", "c", "3")
+	if err := engine.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, snapshot, "a", "1")
+	expectValue(t, snapshot, "b", "2")
+	expectMissing(t, snapshot, "c")
+	expectItems(t, collect(t, func(fn func(key, value []byte) error) error { return snapshot.Iterate(nil, false, fn) }), "a=1", "b=2")
+	expectItems(t, collect(t, func(fn func(key, value []byte) error) error {
+		return snapshot.IterateFrom(nil, []byte("b"), false, fn)
+	}), "b=2")
+
+	expectValue(t, engine, "a", "10")
+	expectMissing(t, engine, "b")
+}
+
+func testEngineView(t *testing.T, engine Engine) {
+	mustSet(t, engine, "a", "1", "b", "2")
+
+	err := engine.View(func(txn Reader) error {
+		// Writes after the view started are not visible in it.
+		mustSet(t, engine, "a", "10")
+
+		expectValue(t, txn, "a", "1")
+		expectItems(t, collect(t, func(fn func(key, value []byte) error) error { return txn.Iterate(nil, false, fn) }), "a=1", "b=2")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := engine.View(func(Reader) error { return errTestStop }); !errors.Is(err, errTestStop) {
+		t.Fatalf("view returned %v, want %v", err, errTestStop)
+	}
+}
+
+func testEngineBatch(t *testing.T, engine Engine) {
+	mustSet(t, engine, "a", "1", "b", "2")
+
+	batch := engine.NewBatch()
+	defer batch.Cancel()
+
+	const count = 2000
+	for i := 0; i < count; i++ {
+		if err := batch.Set([]byte(fmt.Sprintf("k%04d", i)), bytes.Repeat([]byte{'v'}, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Set([]byte("a"), []byte("10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Delete([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is applied before flush.
+	expectValue(t, engine, "a", "1")
+
+	if err := batch.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, engine, "a", "10")
+	expectMissing(t, engine, "b")
+
+	var keys int
+	err := engine.Iterate([]byte("k"), true, func(_, _ []byte) error {
+		keys++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != count {
+		t.Fatalf("batch applied %d keys, want %d", keys, count)
+	}
+}
+
+func testEngineBatchCancel(t *testing.T, engine Engine) {
+	mustSet(t, engine, "a", "1")
+
+	batch := engine.NewBatch()
+	if err := batch.Set([]byte("a"), []byte("10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	batch.Cancel()
+
+	expectValue(t, engine, "a", "1")
+	expectMissing(t, engine, "b")
+}
+
+func testEngineDropAll(t *testing.T, engine Engine) {
+	mustSet(t, engine, "a", "1", "b", "2", "\xff\x00", "3")
+
+	if err := engine.DropAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMissing(t, engine, "a")
+	expectItems(t, collect(t, func(fn func(key, value []byte) error) error { return engine.Iterate(nil, false, fn) }))
+
+	// Engine stays usable.
+	mustSet(t, engine, "a", "4")
+	expectValue(t, engine, "a", "4")
+}
@@ -0,0 +1,535 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Full-text index is an inverted index of words of text field. Its entries
+// are stored under the index prefix:
+//
+//	's'                         document count and total length (uvarints)
+//	'd' <key>                   length of indexed document in words (uvarint)
+//	'p' <escaped word> <key>    positions of the word in document (uvarints)
+//
+// Documents without any words are not indexed.
+
+const (
+	textStatsTag    = 's'
+	textDocumentTag = 'd'
+	textPostingTag  = 'p'
+)
+
+// BM25 ranking parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// SearchHit is a document matching full-text query.
+type SearchHit struct {
+	Key   string
+	Score float64
+}
+
+// textIndex maintains inverted index of words of a text field.
+type textIndex struct {
+	prefix []byte
+	path   []string
+}
+
+// Words of the indexed field of value, nil if it isn't indexed.
+func (i *textIndex) words(value []byte) []string {
+	if len(i.path) == 0 {
+		return tokenize(string(value))
+	}
+
+	field, ok := extractField(value, i.path)
+	if !ok {
+		return nil
+	}
+
+	text, ok := field.(string)
+	if !ok {
+		return nil
+	}
+
+	return tokenize(text)
+}
+
+func (i *textIndex) key(tag byte, parts ...[]byte) []byte {
+	key := append(append([]byte(nil), i.prefix...), tag)
+	for _, part := range parts {
+		key = append(key, part...)
+	}
+
+	return key
+}
+
+func (i *textIndex) write(txn Txn, key, old, new []byte) error {
+	if err := i.remove(txn, key, old); err != nil {
+		return err
+	}
+
+	if new == nil {
+		return nil
+	}
+
+	return i.add(txn, key, i.words(new))
+}
+
+func (i *textIndex) build(txn Txn, key, value []byte) error {
+	_, err := txn.Get(i.key(textDocumentTag, key))
+	if err == nil {
+		return nil // Indexed by write.
+	}
+	if err != ErrKeyNotFound {
+		return err
+	}
+
+	return i.add(txn, key, i.words(value))
+}
+
+func (i *textIndex) add(txn Txn, key []byte, words []string) error {
+	if len(words) == 0 {
+		return nil
+	}
+
+	positions := make(map[string][]byte)
+	last := make(map[string]int)
+
+	for position, word := range words {
+		previous, ok := last[word]
+		if !ok {
+			previous = 0
+		}
+		positions[word] = binary.AppendUvarint(positions[word], uint64(position-previous))
+		last[word] = position
+	}
+
+	for word, encoded := range positions {
+		if err := txn.Set(i.key(textPostingTag, escapeTerm([]byte(word)), key), encoded); err != nil {
+			return err
+		}
+	}
+
+	length := uint64(len(words))
+	if err := txn.Set(i.key(textDocumentTag, key), binary.AppendUvarint(nil, length)); err != nil {
+		return err
+	}
+
+	return i.updateStats(txn, 1, int64(length))
+}
+
+// Remove document with old value stored under key from index, if it has
+// been indexed already.
+func (i *textIndex) remove(txn Txn, key, old []byte) error {
+	docKey := i.key(textDocumentTag, key)
+
+	value, err := txn.Get(docKey)
+	if err == ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	length, _ := binary.Uvarint(value)
+
+	for _, word := range uniqueWords(i.words(old)) {
+		if err := txn.Delete(i.key(textPostingTag, escapeTerm([]byte(word)), key)); err != nil {
+			return err
+		}
+	}
+
+	if err := txn.Delete(docKey); err != nil {
+		return err
+	}
+
+	return i.updateStats(txn, -1, -int64(length))
+}
+
+func (i *textIndex) stats(r Reader) (documents, length uint64, err error) {
+	value, err := r.Get(i.key(textStatsTag))
+	if err == ErrKeyNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	documents, n := binary.Uvarint(value)
+	length, _ = binary.Uvarint(value[n:])
+
+	return documents, length, nil
+}
+
+func (i *textIndex) updateStats(txn Txn, documents, length int64) error {
+	currentDocuments, currentLength, err := i.stats(txn)
+	if err != nil {
+		return err
+	}
+
+	value := binary.AppendUvarint(nil, uint64(int64(currentDocuments)+documents))
+	value = binary.AppendUvarint(value, uint64(int64(currentLength)+length))
+
+	return txn.Set(i.key(textStatsTag), value)
+}
+
+// Positions of word in all documents, by document key.
+func (i *textIndex) postings(r Reader, word string) (map[string][]int, error) {
+	prefix := i.key(textPostingTag, escapeTerm([]byte(word)))
+	postings := make(map[string][]int)
+
+	err := r.Iterate(prefix, false, func(key, value []byte) error {
+		var positions []int
+
+		position := 0
+		for len(value) > 0 {
+			delta, n := binary.Uvarint(value)
+			if n <= 0 {
+				return fmt.Errorf("malformed posting of word '%s'", word)
+			}
+			position += int(delta)
+			positions = append(positions, position)
+			value = value[n:]
+		}
+
+		postings[string(key[len(prefix):])] = positions
+		return nil
+	})
+
+	return postings, err
+}
+
+// Search documents matching query, ordered by BM25 score (and key for equal
+// scores), skipping offset hits and returning at most limit (0 is
+// unlimited).
+func (b *Bucket) Search(name, query string, offset, limit int) ([]SearchHit, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	index, ok := b.meta.Indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("index '%s' not found", name)
+	}
+
+	if index.State != IndexReady {
+		return nil, fmt.Errorf("index '%s' is not ready (%s)", name, index.State)
+	}
+
+	if index.Kind() != IndexFullText {
+		return nil, fmt.Errorf("index '%s' is not full-text index", name)
+	}
+
+	node, err := parseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("parsing query: %v", err)
+	}
+
+	var hits []SearchHit
+
+	err = b.engine.View(func(r Reader) error {
+		ti, _ := compileIndex(name, index).(*textIndex)
+
+		s, err := newTextSearcher(r, ti)
+		if err != nil {
+			return err
+		}
+
+		scores, err := s.eval(node)
+		if err != nil {
+			return err
+		}
+
+		hits = make([]SearchHit, 0, len(scores))
+		for key, score := range scores {
+			hits = append(hits, SearchHit{Key: key, Score: score})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Key < hits[j].Key
+	})
+
+	if offset >= len(hits) {
+		return []SearchHit{}, nil
+	}
+	hits = hits[offset:]
+
+	if limit > 0 && limit < len(hits) {
+		hits = hits[:limit]
+	}
+
+	return hits, nil
+}
+
+// textSearcher evaluates query over consistent view of the index.
+type textSearcher struct {
+	reader    Reader
+	index     *textIndex
+	documents float64
+	avgLength float64
+	lengths   map[string]float64
+}
+
+func newTextSearcher(r Reader, index *textIndex) (*textSearcher, error) {
+	documents, length, err := index.stats(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &textSearcher{
+		reader:    r,
+		index:     index,
+		documents: float64(documents),
+		lengths:   make(map[string]float64),
+	}
+
+	if documents > 0 {
+		s.avgLength = float64(length) / float64(documents)
+	}
+
+	return s, nil
+}
+
+// Evaluate query node into scores of matching documents.
+func (s *textSearcher) eval(node *queryNode) (map[string]float64, error) {
+	switch node.op {
+	case queryPhrase:
+		return s.phrase(node.words)
+	case queryOr:
+		scores := make(map[string]float64)
+
+		for _, child := range node.children {
+			if child.op == queryNot {
+				return nil, fmt.Errorf("negation must be combined with other terms using AND")
+			}
+
+			childScores, err := s.eval(child)
+			if err != nil {
+				return nil, err
+			}
+
+			for key, score := range childScores {
+				scores[key] += score
+			}
+		}
+
+		return scores, nil
+	case queryAnd:
+		return s.and(node.children)
+	default:
+		return nil, fmt.Errorf("negation must be combined with other terms using AND")
+	}
+}
+
+func (s *textSearcher) and(children []*queryNode) (map[string]float64, error) {
+	var (
+		scores   map[string]float64
+		excluded []map[string]float64
+	)
+
+	for _, child := range children {
+		if child.op == queryNot {
+			childScores, err := s.eval(child.children[0])
+			if err != nil {
+				return nil, err
+			}
+			excluded = append(excluded, childScores)
+			continue
+		}
+
+		childScores, err := s.eval(child)
+		if err != nil {
+			return nil, err
+		}
+
+		if scores == nil {
+			scores = childScores
+			continue
+		}
+
+		for key, score := range scores {
+			if childScore, ok := childScores[key]; ok {
+				scores[key] = score + childScore
+			} else {
+				delete(scores, key)
+			}
+		}
+	}
+
+	if scores == nil {
+		return nil, fmt.Errorf("query must contain terms which are not negated")
+	}
+
+	for _, childScores := range excluded {
+		for key := range childScores {
+			delete(scores, key)
+		}
+	}
+
+	return scores, nil
+}
+
+// Documents containing words at consecutive positions (single word is a
+// phrase too), scored by BM25 with phrase occurrences as term frequency.
+func (s *textSearcher) phrase(words []string) (map[string]float64, error) {
+	var matches map[string][]int // Positions of the last word of phrase.
+
+	for i, word := range words {
+		postings, err := s.index.postings(s.reader, word)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			matches = postings
+			continue
+		}
+
+		next := make(map[string][]int)
+		for key, previous := range matches {
+			positions, ok := postings[key]
+			if !ok {
+				continue
+			}
+
+			if found := followingPositions(previous, positions); len(found) > 0 {
+				next[key] = found
+			}
+		}
+		matches = next
+	}
+
+	frequency := float64(len(matches))
+	idf := math.Log(1 + (s.documents-frequency+0.5)/(frequency+0.5))
+
+	scores := make(map[string]float64, len(matches))
+	for key, positions := range matches {
+		length, err := s.length(key)
+		if err != nil {
+			return nil, err
+		}
+
+		tf := float64(len(positions))
+		norm := 1.0
+		if s.avgLength > 0 {
+			norm = 1 - bm25B + bm25B*length/s.avgLength
+		}
+
+		scores[key] = idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+	}
+
+	return scores, nil
+}
+
+func (s *textSearcher) length(key string) (float64, error) {
+	if length, ok := s.lengths[key]; ok {
+		return length, nil
+	}
+
+	value, err := s.reader.Get(s.index.key(textDocumentTag, []byte(key)))
+	if err != nil && err != ErrKeyNotFound {
+		return 0, err
+	}
+
+	length, _ := binary.Uvarint(value)
+	s.lengths[key] = float64(length)
+
+	return float64(length), nil
+}
+
+// Positions from next directly following any of previous positions. Both
+// are sorted in ascending order.
+func followingPositions(previous, next []int) []int {
+	var found []int
+
+	i := 0
+	for _, position := range next {
+		for i < len(previous) && previous[i] < position-1 {
+			i++
+		}
+		if i < len(previous) && previous[i] == position-1 {
+			found = append(found, position)
+		}
+	}
+
+	return found
+}
+
+// Split text into lowercased and stemmed words.
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	words := make([]string, 0, len(fields))
+	for _, field := range fields {
+		words = append(words, stem(strings.ToLower(field)))
+	}
+
+	return words
+}
+
+func uniqueWords(words []string) []string {
+	seen := make(map[string]struct{}, len(words))
+	unique := words[:0:0]
+
+	for _, word := range words {
+		if _, ok := seen[word]; !ok {
+			seen[word] = struct{}{}
+			unique = append(unique, word)
+		}
+	}
+
+	return unique
+}
+
+// Strip common English inflectional suffixes (plural, -ed, -ing), similar
+// to the first step of the Porter stemmer.
+func stem(word string) string {
+	const minStemLength = 3
+
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = strings.TrimSuffix(word, "es")
+	case strings.HasSuffix(word, "ies") && len(word) > minStemLength+1:
+		word = strings.TrimSuffix(word, "ies") + "y"
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"), strings.HasSuffix(word, "is"):
+	case strings.HasSuffix(word, "s") && len(word) > minStemLength:
+		word = strings.TrimSuffix(word, "s")
+	}
+
+	for _, suffix := range []string{"ing", "ed"} {
+		base := strings.TrimSuffix(word, suffix)
+		if base == word || len(base) < minStemLength || !strings.ContainsAny(base, "aeiouy") {
+			continue
+		}
+
+		// Undouble final consonant ("running" -> "run").
+		n := len(base)
+		if base[n-1] == base[n-2] && !strings.ContainsRune("aeiouslz", rune(base[n-1])) {
+			base = base[:n-1]
+		}
+
+		return base
+	}
+
+	return word
+}
@@ -0,0 +1,582 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// HNSW (hierarchical navigable small world) graph of vector index. Every
+// vector is a node on levels 0 to its top level, linked to nearby nodes in
+// different directions on each level. Search descends greedily from the entry point
+// (node with the highest level) and explores the bottom level using
+// candidate list of size ef.
+//
+// Nodes are stored as:
+//
+//	<uvarint top level> { <uvarint count> { <uvarint length> <key> } }
+//
+// with neighbour lists from level 0 up. The entry point is stored as
+// <uvarint level> <key>. Top levels are derived from hash of the key rather
+// than chosen randomly, so that the graph (and thus search results) only
+// depends on the sequence of writes.
+
+const hnswMaxLevel = 16
+
+type hnswNode struct {
+	neighbours [][]string // By level.
+}
+
+// hnswGraph accesses graph within transaction, caching decoded nodes and
+// vectors. Modified nodes are written by flush.
+type hnswGraph struct {
+	reader  Reader
+	index   *vectorIndex
+	nodes   map[string]*hnswNode
+	vectors map[string][]float32
+	dirty   map[string]bool
+}
+
+func newHNSWGraph(r Reader, index *vectorIndex) *hnswGraph {
+	return &hnswGraph{
+		reader:  r,
+		index:   index,
+		nodes:   make(map[string]*hnswNode),
+		vectors: make(map[string][]float32),
+		dirty:   make(map[string]bool),
+	}
+}
+
+// Top level of node with given key, exponentially distributed.
+func (g *hnswGraph) level(key []byte) int {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+
+	// High bits of FNV hash barely differ for similar keys, mix them first.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	// Uniform in (0, 1].
+	u := float64(x>>11+1) / (1 << 53)
+	level := int(-math.Log(u) / math.Log(float64(g.index.M)))
+
+	if level > hnswMaxLevel {
+		return hnswMaxLevel
+	}
+
+	return level
+}
+
+// Maximum number of neighbours of node on given level.
+func (g *hnswGraph) maxNeighbours(level int) int {
+	if level == 0 {
+		return 2 * g.index.M
+	}
+
+	return g.index.M
+}
+
+func (g *hnswGraph) node(key string) (*hnswNode, error) {
+	if node, ok := g.nodes[key]; ok {
+		return node, nil
+	}
+
+	value, err := g.reader.Get(g.index.key(vectorNodeTag, []byte(key)))
+	if err == ErrKeyNotFound {
+		g.nodes[key] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := decodeHNSWNode(value)
+	if err != nil {
+		return nil, fmt.Errorf("graph node '%s': %v", key, err)
+	}
+
+	g.nodes[key] = node
+	return node, nil
+}
+
+// Vector of node, nil if there is none.
+func (g *hnswGraph) vector(key string) ([]float32, error) {
+	if vector, ok := g.vectors[key]; ok {
+		return vector, nil
+	}
+
+	value, err := g.reader.Get(g.index.key(vectorVectorTag, []byte(key)))
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+
+	var vector []float32
+	if err == nil {
+		vector = decodeVector(value)
+	}
+
+	g.vectors[key] = vector
+	return vector, nil
+}
+
+func (g *hnswGraph) entry() (string, int, bool, error) {
+	value, err := g.reader.Get(g.index.key(vectorEntryTag, nil))
+	if err == ErrKeyNotFound {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	level, n := binary.Uvarint(value)
+	if n <= 0 {
+		return "", 0, false, fmt.Errorf("malformed graph entry point")
+	}
+
+	return string(value[n:]), int(level), true, nil
+}
+
+func (g *hnswGraph) txn() Txn {
+	// Graph is only modified by writes, which pass transaction.
+	return g.reader.(Txn)
+}
+
+func (g *hnswGraph) setEntry(key string, level int) error {
+	value := binary.AppendUvarint(nil, uint64(level))
+	return g.txn().Set(g.index.key(vectorEntryTag, nil), append(value, key...))
+}
+
+// Insert node with given key and vector.
+func (g *hnswGraph) insert(key []byte, vector []float32) error {
+	name := string(key)
+	level := g.level(key)
+
+	node := &hnswNode{neighbours: make([][]string, level+1)}
+	g.nodes[name] = node
+	g.vectors[name] = vector
+	g.dirty[name] = true
+
+	entry, entryLevel, ok, err := g.entry()
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if err := g.setEntry(name, level); err != nil {
+			return err
+		}
+		return g.flush()
+	}
+
+	entryVector, err := g.vector(entry)
+	if err != nil {
+		return err
+	}
+
+	nearest := []vectorCandidate{{key: entry, distance: g.index.distance(vector, entryVector)}}
+
+	for l := entryLevel; l > level; l-- {
+		if nearest, err = g.searchLevel(vector, nearest, 1, l); err != nil {
+			return err
+		}
+	}
+
+	top := level
+	if entryLevel < top {
+		top = entryLevel
+	}
+
+	for l := top; l >= 0; l-- {
+		if nearest, err = g.searchLevel(vector, nearest, g.index.EfConstruction, l); err != nil {
+			return err
+		}
+
+		candidates := make([]vectorCandidate, 0, len(nearest))
+		for _, candidate := range nearest {
+			if candidate.key != name { // Reached through stale link.
+				candidates = append(candidates, candidate)
+			}
+		}
+
+		if node.neighbours[l], err = g.diverse(candidates, g.index.M); err != nil {
+			return err
+		}
+
+		for _, neighbour := range node.neighbours[l] {
+			if err := g.link(neighbour, name, l); err != nil {
+				return err
+			}
+		}
+	}
+
+	if level > entryLevel {
+		if err := g.setEntry(name, level); err != nil {
+			return err
+		}
+	}
+
+	return g.flush()
+}
+
+// Add link from node to target on level, pruning the farthest neighbours
+// exceeding the limit.
+func (g *hnswGraph) link(from, to string, level int) error {
+	node, err := g.node(from)
+	if err != nil || node == nil || level >= len(node.neighbours) {
+		return err
+	}
+
+	for _, neighbour := range node.neighbours[level] {
+		if neighbour == to {
+			return nil
+		}
+	}
+
+	node.neighbours[level] = append(node.neighbours[level], to)
+	g.dirty[from] = true
+
+	if len(node.neighbours[level]) <= g.maxNeighbours(level) {
+		return nil
+	}
+
+	return g.selectNeighbours(from, node, level, node.neighbours[level])
+}
+
+// Set neighbours of node on level to diverse selection of candidates.
+func (g *hnswGraph) selectNeighbours(key string, node *hnswNode, level int, candidates []string) error {
+	vector, err := g.vector(key)
+	if err != nil {
+		return err
+	}
+
+	var sorted []vectorCandidate
+	for _, candidate := range candidates {
+		candidateVector, err := g.vector(candidate)
+		if err != nil {
+			return err
+		}
+		if candidateVector == nil {
+			continue
+		}
+
+		sorted = insertCandidate(sorted, vectorCandidate{
+			key:      candidate,
+			distance: g.index.distance(vector, candidateVector),
+		}, math.MaxInt)
+	}
+
+	if node.neighbours[level], err = g.diverse(sorted, g.maxNeighbours(level)); err != nil {
+		return err
+	}
+
+	g.dirty[key] = true
+	return nil
+}
+
+// Select up to limit neighbours from candidates sorted by distance from the
+// node, using the heuristic of the HNSW paper: candidate closer to an
+// already selected neighbour than to the node is skipped, so that links
+// lead in different directions (e.g. to other clusters) instead of only
+// to the closest ones. Skipped candidates fill the remaining places.
+func (g *hnswGraph) diverse(candidates []vectorCandidate, limit int) ([]string, error) {
+	var (
+		selected        = make([]string, 0, limit)
+		selectedVectors = make([][]float32, 0, limit)
+		skipped         []string
+	)
+
+	for _, candidate := range candidates {
+		if len(selected) == limit {
+			break
+		}
+
+		vector, err := g.vector(candidate.key)
+		if err != nil {
+			return nil, err
+		}
+
+		diverse := true
+		for _, other := range selectedVectors {
+			if g.index.distance(vector, other) < candidate.distance {
+				diverse = false
+				break
+			}
+		}
+
+		if diverse {
+			selected = append(selected, candidate.key)
+			selectedVectors = append(selectedVectors, vector)
+		} else {
+			skipped = append(skipped, candidate.key)
+		}
+	}
+
+	for _, key := range skipped {
+		if len(selected) == limit {
+			break
+		}
+		selected = append(selected, key)
+	}
+
+	return selected, nil
+}
+
+// Remove node with given key, reconnecting its neighbours with each other.
+func (g *hnswGraph) remove(key []byte) error {
+	name := string(key)
+
+	node, err := g.node(name)
+	if err != nil || node == nil {
+		return err
+	}
+
+	for level, neighbours := range node.neighbours {
+		for _, neighbour := range neighbours {
+			if err := g.unlink(neighbour, name, level, neighbours); err != nil {
+				return err
+			}
+		}
+	}
+
+	g.nodes[name] = nil
+	g.vectors[name] = nil
+	delete(g.dirty, name)
+
+	if err := g.txn().Delete(g.index.key(vectorNodeTag, key)); err != nil {
+		return err
+	}
+
+	entry, _, _, err := g.entry()
+	if err != nil {
+		return err
+	}
+
+	if entry == name {
+		if err := g.replaceEntry(); err != nil {
+			return err
+		}
+	}
+
+	return g.flush()
+}
+
+// Remove link from node to removed node on level, replacing it with
+// neighbours of the removed node.
+func (g *hnswGraph) unlink(from, removed string, level int, replacements []string) error {
+	node, err := g.node(from)
+	if err != nil || node == nil || level >= len(node.neighbours) {
+		return err
+	}
+
+	seen := map[string]bool{from: true, removed: true}
+	candidates := make([]string, 0, len(node.neighbours[level])+len(replacements))
+
+	for _, list := range [][]string{node.neighbours[level], replacements} {
+		for _, candidate := range list {
+			if !seen[candidate] {
+				seen[candidate] = true
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+
+	return g.selectNeighbours(from, node, level, candidates)
+}
+
+// Make node with the highest level (and the smallest key among those) the
+// entry point, after the entry point was removed.
+func (g *hnswGraph) replaceEntry() error {
+	var (
+		entry string
+		level = -1
+	)
+
+	prefix := g.index.key(vectorNodeTag, nil)
+
+	err := g.reader.Iterate(prefix, false, func(key, value []byte) error {
+		name := string(key[len(prefix):])
+		if node, ok := g.nodes[name]; ok && node == nil {
+			return nil // Removed in this transaction.
+		}
+
+		top, n := binary.Uvarint(value)
+		if n > 0 && int(top) > level {
+			entry, level = name, int(top)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if level < 0 {
+		return g.txn().Delete(g.index.key(vectorEntryTag, nil))
+	}
+
+	return g.setEntry(entry, level)
+}
+
+// Write modified nodes.
+func (g *hnswGraph) flush() error {
+	keys := make([]string, 0, len(g.dirty))
+	for key := range g.dirty {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if node := g.nodes[key]; node != nil {
+			if err := g.txn().Set(g.index.key(vectorNodeTag, []byte(key)), node.encode()); err != nil {
+				return err
+			}
+		}
+	}
+
+	g.dirty = make(map[string]bool)
+	return nil
+}
+
+// Search k nearest nodes using candidate list of size ef.
+func (g *hnswGraph) search(query []float32, k, ef int) ([]VectorHit, error) {
+	entry, entryLevel, ok, err := g.entry()
+	if err != nil || !ok {
+		return []VectorHit{}, err
+	}
+
+	entryVector, err := g.vector(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	nearest := []vectorCandidate{{key: entry, distance: g.index.distance(query, entryVector)}}
+
+	for l := entryLevel; l > 0; l-- {
+		if nearest, err = g.searchLevel(query, nearest, 1, l); err != nil {
+			return nil, err
+		}
+	}
+
+	if ef < k {
+		ef = k
+	}
+
+	if nearest, err = g.searchLevel(query, nearest, ef, 0); err != nil {
+		return nil, err
+	}
+
+	if len(nearest) > k {
+		nearest = nearest[:k]
+	}
+
+	return candidateHits(nearest), nil
+}
+
+// Search level starting from entry points, returning up to ef nearest nodes.
+func (g *hnswGraph) searchLevel(query []float32, entries []vectorCandidate, ef, level int) ([]vectorCandidate, error) {
+	visited := make(map[string]bool, len(entries))
+	candidates := make([]vectorCandidate, 0, len(entries))
+	var nearest []vectorCandidate
+
+	for _, entry := range entries {
+		visited[entry.key] = true
+		candidates = insertCandidate(candidates, entry, math.MaxInt)
+		nearest = insertCandidate(nearest, entry, ef)
+	}
+
+	for len(candidates) > 0 {
+		current := candidates[0]
+		candidates = candidates[1:]
+
+		if len(nearest) >= ef && nearest[len(nearest)-1].closer(current) {
+			break
+		}
+
+		node, err := g.node(current.key)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil || level >= len(node.neighbours) {
+			continue
+		}
+
+		for _, neighbour := range node.neighbours[level] {
+			if visited[neighbour] {
+				continue
+			}
+			visited[neighbour] = true
+
+			vector, err := g.vector(neighbour)
+			if err != nil {
+				return nil, err
+			}
+			if vector == nil {
+				continue // Stale link.
+			}
+
+			candidate := vectorCandidate{key: neighbour, distance: g.index.distance(query, vector)}
+			if len(nearest) < ef || candidate.closer(nearest[len(nearest)-1]) {
+				candidates = insertCandidate(candidates, candidate, math.MaxInt)
+				nearest = insertCandidate(nearest, candidate, ef)
+			}
+		}
+	}
+
+	return nearest, nil
+}
+
+func (n *hnswNode) encode() []byte {
+	value := binary.AppendUvarint(nil, uint64(len(n.neighbours)-1))
+
+	for _, neighbours := range n.neighbours {
+		value = binary.AppendUvarint(value, uint64(len(neighbours)))
+		for _, neighbour := range neighbours {
+			value = binary.AppendUvarint(value, uint64(len(neighbour)))
+			value = append(value, neighbour...)
+		}
+	}
+
+	return value
+}
+
+func decodeHNSWNode(value []byte) (*hnswNode, error) {
+	read := func() (uint64, error) {
+		x, n := binary.Uvarint(value)
+		if n <= 0 {
+			return 0, fmt.Errorf("malformed node")
+		}
+		value = value[n:]
+		return x, nil
+	}
+
+	top, err := read()
+	if err != nil || top > hnswMaxLevel {
+		return nil, fmt.Errorf("malformed node")
+	}
+
+	node := &hnswNode{neighbours: make([][]string, top+1)}
+
+	for level := range node.neighbours {
+		count, err := read()
+		if err != nil {
+			return nil, err
+		}
+
+		for i := uint64(0); i < count; i++ {
+			length, err := read()
+			if err != nil || length > uint64(len(value)) {
+				return nil, fmt.Errorf("malformed node")
+			}
+
+			node.neighbours[level] = append(node.neighbours[level], string(value[:length]))
+			value = value[length:]
+		}
+	}
+
+	return node, nil
+}
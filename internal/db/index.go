@@ -0,0 +1,759 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Secondary indexes map values of a field of JSON documents stored in bucket
+// to keys of the documents. Index entries are written in the same
+// transaction as the document, by the committer of the bucket. Entries for
+// data existing when the index is created are added by background build,
+// which scans the bucket in chunks, each one serialized with commits.
+
+// Index types.
+const (
+	IndexField    = "field"
+	IndexFullText = "fulltext"
+)
+
+// Index states.
+const (
+	IndexBuilding = "building"
+	IndexReady    = "ready"
+	IndexFailed   = "failed"
+)
+
+const (
+	// Number of keys indexed in one transaction of index build.
+	indexBuildChunkSize = 256
+	// Number of entries removed in one batch when dropping index.
+	indexDropChunkSize = 4096
+
+	indexNameMaxLength = 63
+)
+
+// ErrUniqueViolation is returned for writes duplicating value of unique index.
+var ErrUniqueViolation = errors.New("unique index violation")
+
+var (
+	indexNameRegex = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+	errIndexBuildInterrupted = errors.New("index build interrupted")
+	errIndexDropped          = errors.New("index dropped")
+)
+
+// Index describes secondary index of bucket.
+type Index struct {
+	ID     uint64 `json:"id"`
+	Type   string `json:"type,omitempty"`
+	Field  string `json:"field"`
+	Unique bool   `json:"unique,omitempty"`
+	State  string `json:"state"`
+	// Reason of failed build.
+	Error string `json:"error,omitempty"`
+}
+
+// IndexInfo describes index of bucket together with progress of its build.
+type IndexInfo struct {
+	Index
+	Name string
+	// Number of keys scanned by running build.
+	Scanned uint64
+}
+
+// IndexBound is a bound of range of indexed values. Value is bool, float64
+// or string.
+type IndexBound struct {
+	Value     any
+	Exclusive bool
+}
+
+// indexer maintains entries of a single index.
+type indexer interface {
+	// Update entries of document stored under key, which changed from old
+	// to new value (nil if not present).
+	write(txn Txn, key, old, new []byte) error
+	// Add entries of document existing before the index was created,
+	// unless they were added by a write already.
+	build(txn Txn, key, value []byte) error
+}
+
+// Kind returns type of index.
+func (i Index) Kind() string {
+	if i.Type == "" {
+		return IndexField
+	}
+
+	return i.Type
+}
+
+func compileIndex(name string, index Index) indexer {
+	if index.Kind() == IndexFullText {
+		return &textIndex{
+			prefix: indexPrefix(index.ID),
+			path:   splitFieldPath(index.Field),
+		}
+	}
+
+	return &fieldIndex{
+		name:   name,
+		field:  index.Field,
+		prefix: indexPrefix(index.ID),
+		path:   splitFieldPath(index.Field),
+		unique: index.Unique,
+	}
+}
+
+// fieldIndex maps values of a field to keys.
+type fieldIndex struct {
+	name   string
+	field  string
+	prefix []byte
+	path   []string
+	unique bool
+}
+
+// Compile indexes maintained on writes, ordered by name.
+func compileIndexes(indexes map[string]Index) []indexer {
+	names := make([]string, 0, len(indexes))
+	for name, index := range indexes {
+		if index.State != IndexFailed {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	compiled := make([]indexer, 0, len(names))
+	for _, name := range names {
+		compiled = append(compiled, compileIndex(name, indexes[name]))
+	}
+
+	return compiled
+}
+
+// Escaped term of the indexed field of value, or nil if it isn't indexed.
+func (i *fieldIndex) term(value []byte) []byte {
+	field, ok := extractField(value, i.path)
+	if !ok {
+		return nil
+	}
+
+	term, ok := encodeTerm(field)
+	if !ok {
+		return nil
+	}
+
+	return escapeTerm(term)
+}
+
+func (i *fieldIndex) entry(term, key []byte) []byte {
+	entry := make([]byte, 0, len(i.prefix)+len(term)+len(key))
+	entry = append(entry, i.prefix...)
+	entry = append(entry, term...)
+
+	return append(entry, key...)
+}
+
+// Add entry for key, checking uniqueness.
+func (i *fieldIndex) add(txn Txn, term, key []byte) error {
+	if i.unique {
+		err := txn.Iterate(i.entry(term, nil), true, func(entry, _ []byte) error {
+			if !bytes.Equal(entry[len(i.prefix)+len(term):], key) {
+				return fmt.Errorf(
+					"%w: value of field '%s' of key '%s' already used by key '%s' (index '%s')",
+					ErrUniqueViolation, i.field, key, entry[len(i.prefix)+len(term):], i.name,
+				)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.Set(i.entry(term, key), []byte{})
+}
+
+func (i *fieldIndex) write(txn Txn, key, old, new []byte) error {
+	var oldTerm, newTerm []byte
+	if old != nil {
+		oldTerm = i.term(old)
+	}
+	if new != nil {
+		newTerm = i.term(new)
+	}
+
+	if bytes.Equal(oldTerm, newTerm) {
+		return nil
+	}
+
+	if oldTerm != nil {
+		if err := txn.Delete(i.entry(oldTerm, key)); err != nil {
+			return err
+		}
+	}
+
+	if newTerm != nil {
+		return i.add(txn, newTerm, key)
+	}
+
+	return nil
+}
+
+func (i *fieldIndex) build(txn Txn, key, value []byte) error {
+	if term := i.term(value); term != nil {
+		return i.add(txn, term, key)
+	}
+
+	return nil
+}
+
+// Apply write to transaction, maintaining entries of all indexes.
+func writeIndexed(txn Txn, indexes []indexer, op *writeOp) error {
+	if len(indexes) == 0 {
+		if op.delete {
+			return txn.Delete(op.key)
+		}
+		return txn.Set(op.key, op.value)
+	}
+
+	old, err := txn.Get(op.key)
+	if err == ErrKeyNotFound {
+		old, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var value []byte
+	if !op.delete {
+		value = op.value
+	}
+
+	for _, index := range indexes {
+		if err := index.write(txn, op.key, old, value); err != nil {
+			return err
+		}
+	}
+
+	if op.delete {
+		return txn.Delete(op.key)
+	}
+
+	return txn.Set(op.key, op.value)
+}
+
+// CreateIndex creates index of given type (IndexField if empty) of values
+// of given field (dot-separated path, "$" for the whole value) in bucket
+// with given name. Entries for existing data are added in background.
+func (db *Database) CreateIndex(bucketName, name, kind, field string, unique bool) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	if len(name) > indexNameMaxLength || !indexNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid index name '%s'", name)
+	}
+
+	if field == "" {
+		return fmt.Errorf("no field specified")
+	}
+
+	switch kind {
+	case "", IndexField:
+		kind = ""
+	case IndexFullText:
+		if unique {
+			return fmt.Errorf("full-text index cannot be unique")
+		}
+	default:
+		return fmt.Errorf("unknown index type '%s'", kind)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket, ok := db.buckets[bucketName]
+	if !ok {
+		return fmt.Errorf("bucket '%s' not found", bucketName)
+	}
+
+	meta := bucket.meta
+	if _, ok := meta.Indexes[name]; ok {
+		return fmt.Errorf("index '%s' already exists", name)
+	}
+
+	meta.NextIndexID++
+	meta.Indexes = copyIndexes(meta.Indexes)
+	meta.Indexes[name] = Index{
+		ID:     meta.NextIndexID,
+		Type:   kind,
+		Field:  field,
+		Unique: unique,
+		State:  IndexBuilding,
+	}
+
+	if err := db.system.Set(bucketKeyPrefix+bucketName, meta.encode()); err != nil {
+		return err
+	}
+
+	bucket.setMeta(meta)
+
+	if bucket.lru != nil {
+		db.startIndexBuildLocked(bucket)
+	}
+
+	return nil
+}
+
+// DropIndex removes index and all its entries.
+func (db *Database) DropIndex(bucketName, name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	bucket, id, err := db.dropIndexMeta(bucketName, name)
+	if err != nil {
+		return err
+	}
+	defer db.Release(bucket)
+
+	// Entries are not visible anymore, so failing to remove them only
+	// wastes space.
+	if err := bucket.removeEntries(indexPrefix(id)); err != nil {
+		log.Error(fmt.Sprintf("removing entries of index '%s'", name), err)
+	}
+
+	return nil
+}
+
+// Remove index from bucket metadata. Returns acquired bucket and ID of the
+// removed index.
+func (db *Database) dropIndexMeta(bucketName, name string) (*Bucket, uint64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket, ok := db.buckets[bucketName]
+	if !ok {
+		return nil, 0, fmt.Errorf("bucket '%s' not found", bucketName)
+	}
+
+	meta := bucket.meta
+	index, ok := meta.Indexes[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("index '%s' not found", name)
+	}
+
+	if err := db.acquireLocked(bucket); err != nil {
+		return nil, 0, err
+	}
+
+	meta.Indexes = copyIndexes(meta.Indexes)
+	delete(meta.Indexes, name)
+
+	if err := db.system.Set(bucketKeyPrefix+bucketName, meta.encode()); err != nil {
+		bucket.refs--
+		return nil, 0, err
+	}
+
+	bucket.setMeta(meta)
+	return bucket, index.ID, nil
+}
+
+// Record result of index build. Entries of failed build are removed.
+func (db *Database) finishIndexBuild(bucket *Bucket, name string, id uint64, buildErr error) error {
+	recorded, err := db.recordIndexBuild(bucket, name, id, buildErr)
+	if err != nil || !recorded || buildErr == nil {
+		return err
+	}
+
+	return bucket.removeEntries(indexPrefix(id))
+}
+
+func (db *Database) recordIndexBuild(bucket *Bucket, name string, id uint64, buildErr error) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.buckets[bucket.Name] != bucket {
+		return false, nil // Bucket dropped or renamed meanwhile.
+	}
+
+	meta := bucket.meta
+	index, ok := meta.Indexes[name]
+	if !ok || index.ID != id {
+		return false, nil // Index dropped meanwhile.
+	}
+
+	index.State = IndexReady
+	if buildErr != nil {
+		index.State = IndexFailed
+		index.Error = buildErr.Error()
+	}
+
+	meta.Indexes = copyIndexes(meta.Indexes)
+	meta.Indexes[name] = index
+
+	if err := db.system.Set(bucketKeyPrefix+bucket.Name, meta.encode()); err != nil {
+		return false, err
+	}
+
+	bucket.setMeta(meta)
+	return true, nil
+}
+
+// Start background build of indexes of opened bucket, unless it's running
+// already or there is nothing to build.
+func (db *Database) startIndexBuildLocked(bucket *Bucket) {
+	if db.readOnly || bucket.building || !bucket.hasBuildingIndex() {
+		return
+	}
+
+	// The build holds reference, so that the bucket stays opened.
+	bucket.building = true
+	bucket.refs++
+
+	go db.buildIndexes(bucket)
+}
+
+func (db *Database) buildIndexes(bucket *Bucket) {
+	err := db.runIndexBuilds(bucket)
+
+	bucket.buildMutex.Lock()
+	bucket.buildIndex = ""
+	bucket.buildScanned = 0
+	bucket.buildMutex.Unlock()
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket.building = false
+	bucket.refs--
+
+	// Indexes created while the build was finishing.
+	if err == nil && bucket.lru != nil {
+		db.startIndexBuildLocked(bucket)
+	}
+}
+
+// Build all indexes being built, one by one.
+func (db *Database) runIndexBuilds(bucket *Bucket) error {
+	for {
+		name, index, ok := bucket.nextBuildingIndex()
+		if !ok {
+			return nil
+		}
+
+		log.Info(fmt.Sprintf("building index '%s' of bucket '%s'", name, bucket.Name))
+
+		err := bucket.build(name, index)
+		if errors.Is(err, errIndexDropped) {
+			continue
+		}
+
+		if errors.Is(err, errIndexBuildInterrupted) {
+			log.Info(fmt.Sprintf("build of index '%s' of bucket '%s' interrupted", name, bucket.Name))
+			return err
+		}
+
+		if err != nil {
+			log.Error(fmt.Sprintf("building index '%s' of bucket '%s'", name, bucket.Name), err)
+		} else {
+			log.Info(fmt.Sprintf("built index '%s' of bucket '%s'", name, bucket.Name))
+		}
+
+		if err := db.finishIndexBuild(bucket, name, index.ID, err); err != nil {
+			log.Error(fmt.Sprintf("recording build of index '%s' of bucket '%s'", name, bucket.Name), err)
+			return err
+		}
+	}
+}
+
+// Indexes returns all indexes of bucket, ordered by name.
+func (b *Bucket) Indexes() []IndexInfo {
+	b.mutex.RLock()
+	indexes := b.meta.Indexes
+	b.mutex.RUnlock()
+
+	b.buildMutex.Lock()
+	defer b.buildMutex.Unlock()
+
+	infos := make([]IndexInfo, 0, len(indexes))
+	for name, index := range indexes {
+		info := IndexInfo{Index: index, Name: name}
+		if name == b.buildIndex {
+			info.Scanned = b.buildScanned
+		}
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+// Find keys of documents with value of indexed field within given bounds
+// (nil bound is unbounded), in order of values. At most limit keys are
+// returned, unless limit is zero.
+func (b *Bucket) Find(name string, min, max *IndexBound, limit int) ([]string, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	index, ok := b.meta.Indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("index '%s' not found", name)
+	}
+
+	if index.State != IndexReady {
+		return nil, fmt.Errorf("index '%s' is not ready (%s)", name, index.State)
+	}
+
+	if index.Kind() != IndexField {
+		return nil, fmt.Errorf("index '%s' is %s index", name, index.Kind())
+	}
+
+	start, end, endExclusive, err := termRange(min, max)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := indexPrefix(index.ID)
+	keys := []string{}
+
+	err = b.engine.IterateFrom(prefix, append(prefix, start...), true, func(entry, _ []byte) error {
+		term, key, ok := splitEntry(entry[len(prefix):])
+		if !ok {
+			return nil // Malformed entry.
+		}
+
+		if min != nil && min.Exclusive && bytes.Equal(term, start) {
+			return nil
+		}
+
+		if end != nil {
+			cmp := bytes.Compare(term, end)
+			if cmp > 0 || (cmp == 0 && endExclusive) {
+				return errStopIteration
+			}
+		}
+
+		keys = append(keys, string(key))
+		if limit > 0 && len(keys) >= limit {
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Escaped terms of range bounds. If only one bound is given, the range is
+// limited to values of its type. Nil end means unbounded.
+func termRange(min, max *IndexBound) (start, end []byte, endExclusive bool, err error) {
+	var minTerm, maxTerm []byte
+
+	if min != nil {
+		if minTerm, err = boundTerm(min); err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	if max != nil {
+		if maxTerm, err = boundTerm(max); err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	switch {
+	case min != nil && max != nil:
+		return escapeTerm(minTerm), escapeTerm(maxTerm), max.Exclusive, nil
+	case min != nil:
+		// All values of the type sort before the tag of the next type.
+		return escapeTerm(minTerm), []byte{minTerm[0] + 1}, true, nil
+	case max != nil:
+		return []byte{maxTerm[0]}, escapeTerm(maxTerm), max.Exclusive, nil
+	default:
+		return nil, nil, false, nil
+	}
+}
+
+func boundTerm(bound *IndexBound) ([]byte, error) {
+	term, ok := encodeTerm(bound.Value)
+	if !ok {
+		return nil, fmt.Errorf("value of type %T cannot be searched", bound.Value)
+	}
+
+	return term, nil
+}
+
+func (b *Bucket) hasBuildingIndex() bool {
+	_, _, ok := b.nextBuildingIndex()
+	return ok
+}
+
+// First index being built, by name.
+func (b *Bucket) nextBuildingIndex() (string, Index, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	var (
+		found string
+		index Index
+	)
+
+	for name, candidate := range b.meta.Indexes {
+		if candidate.State == IndexBuilding && (found == "" || name < found) {
+			found, index = name, candidate
+		}
+	}
+
+	return found, index, found != ""
+}
+
+// Add entries of index for all existing data. Each chunk of keys is indexed
+// in a transaction serialized with commits, so that writes to keys already
+// indexed maintain their entries.
+func (b *Bucket) build(name string, index Index) error {
+	b.buildMutex.Lock()
+	b.buildIndex = name
+	b.buildScanned = 0
+	b.buildMutex.Unlock()
+
+	var next []byte
+
+	for {
+		scanned, last, err := b.buildChunk(name, index, next)
+		if err != nil {
+			return err
+		}
+
+		b.buildMutex.Lock()
+		b.buildScanned += uint64(scanned)
+		b.buildMutex.Unlock()
+
+		if scanned < indexBuildChunkSize {
+			return nil
+		}
+
+		next = append(last, 0x00) // Smallest key after the last one.
+	}
+}
+
+func (b *Bucket) buildChunk(name string, index Index, start []byte) (int, []byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return 0, nil, errIndexBuildInterrupted
+	}
+
+	if current, ok := b.meta.Indexes[name]; !ok || current.ID != index.ID {
+		return 0, nil, errIndexDropped
+	}
+
+	ix := compileIndex(name, index)
+
+	c := b.committer
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var (
+		scanned int
+		last    []byte
+	)
+
+	err := c.updateInternalLocked(false, func(txn Txn) error {
+		var keys, values [][]byte
+
+		err := txn.IterateFrom(nil, start, false, func(key, value []byte) error {
+			if isInternalKey(key) {
+				return errStopIteration
+			}
+
+			keys = append(keys, append([]byte(nil), key...))
+			values = append(values, append([]byte(nil), value...))
+
+			if len(keys) >= indexBuildChunkSize {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			return err
+		}
+
+		// Entries are added after the scan, so that it doesn't see them.
+		for i, key := range keys {
+			if err := ix.build(txn, key, values[i]); err != nil {
+				return err
+			}
+		}
+
+		scanned = len(keys)
+		if scanned > 0 {
+			last = keys[scanned-1]
+		}
+
+		return nil
+	})
+
+	return scanned, last, err
+}
+
+// Remove all entries of index with given prefix.
+func (b *Bucket) removeEntries(prefix []byte) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	for {
+		var keys [][]byte
+
+		err := b.engine.Iterate(prefix, true, func(key, _ []byte) error {
+			keys = append(keys, append([]byte(nil), key...))
+			if len(keys) >= indexDropChunkSize {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			return err
+		}
+
+		if len(keys) == 0 {
+			return nil
+		}
+
+		if err := b.committer.deleteInternal(keys); err != nil {
+			return err
+		}
+	}
+}
+
+func copyIndexes(indexes map[string]Index) map[string]Index {
+	copied := make(map[string]Index, len(indexes)+1)
+	for name, index := range indexes {
+		copied[name] = index
+	}
+
+	return copied
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Keys starting with internalKeyPrefix are reserved for data maintained by
+// the database itself and hidden from clients. The prefix sorts after all
+// other keys, so iteration over client data stops at the first internal key.
+const internalKeyPrefix = 0xff
+
+// Index entries are stored as internal keys:
+//
+//	0xff 'i' <uvarint index ID> <escaped term> 0x00 0x01 <primary key>
+//
+// Term is the type tag followed by order-preserving encoding of the indexed
+// value. Zero bytes of the term are escaped as 0x00 0xff, so that the
+// terminator sorts before any continuation and entries are ordered by value
+// first and by primary key second.
+const indexKeyTag = 'i'
+
+// Type tags of indexed values, in sort order.
+const (
+	termBool   = 0x01
+	termNumber = 0x02
+	termString = 0x03
+)
+
+var (
+	termTerminator = []byte{0x00, 0x01}
+
+	errStopIteration = errors.New("stop iteration")
+	errReservedKey   = errors.New("keys starting with byte 0xff are reserved")
+)
+
+func isInternalKey(key []byte) bool {
+	return len(key) > 0 && key[0] == internalKeyPrefix
+}
+
+// Prefix of all entries of index with given ID.
+func indexPrefix(id uint64) []byte {
+	prefix := []byte{internalKeyPrefix, indexKeyTag}
+	return binary.AppendUvarint(prefix, id)
+}
+
+// Encode scalar JSON value (bool, float64 or string) into term. Returns
+// false for values which are not indexed.
+func encodeTerm(value any) ([]byte, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return []byte{termBool, 1}, true
+		}
+		return []byte{termBool, 0}, true
+	case float64:
+		bits := math.Float64bits(v)
+		if v >= 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+
+		return binary.BigEndian.AppendUint64([]byte{termNumber}, bits), true
+	case string:
+		return append([]byte{termString}, v...), true
+	default:
+		return nil, false
+	}
+}
+
+// Escape term and append the terminator.
+func escapeTerm(term []byte) []byte {
+	escaped := make([]byte, 0, len(term)+len(termTerminator))
+
+	for _, c := range term {
+		escaped = append(escaped, c)
+		if c == 0x00 {
+			escaped = append(escaped, 0xff)
+		}
+	}
+
+	return append(escaped, termTerminator...)
+}
+
+// Split index entry key (without the index prefix) into escaped term
+// (including the terminator) and primary key.
+func splitEntry(entry []byte) (term, key []byte, ok bool) {
+	for i := 0; i+1 < len(entry); i++ {
+		if entry[i] != 0x00 {
+			continue
+		}
+
+		if entry[i+1] == termTerminator[1] {
+			end := i + len(termTerminator)
+			return entry[:end], entry[end:], true
+		}
+
+		i++ // Skip escaped zero.
+	}
+
+	return nil, nil, false
+}
+
+// Extract value at dot-separated path from JSON document. Numeric segments
+// index arrays. Returns false if there is no such value.
+func extractField(document []byte, path []string) (any, bool) {
+	var value any
+	if err := json.Unmarshal(document, &value); err != nil {
+		return nil, false
+	}
+
+	for _, segment := range path {
+		switch v := value.(type) {
+		case map[string]any:
+			var ok bool
+			if value, ok = v[segment]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// Split dot-separated field path into segments. Field "$" is the whole
+// document (empty path).
+func splitFieldPath(field string) []string {
+	if field == "$" {
+		return nil
+	}
+
+	return strings.Split(field, ".")
+}
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Operations changing both the bucket registry and the bucket storage
+// cannot be done atomically. Each such operation first records its intent
+// in the system bucket journal, then changes the storage and finally
+// updates the registry and removes the journal entry in one transaction.
+// On startup, unfinished operations are either completed or rolled back
+// depending on the state of the storage, so the registry always points
+// to existing buckets.
+
+const (
+	journalKeyPrefix  = "journal:"
+	journalRenameKind = "rename"
+	journalCloneKind  = "clone"
+	journalPurgeKind  = "purge"
+
+	// Prefix of directories containing partially copied buckets.
+	cloneTmpPrefix = ".clone-"
+)
+
+func journalKey(kind, name string) string {
+	return journalKeyPrefix + kind + ":" + name
+}
+
+// journalEntry describes unfinished operation on bucket.
+type journalEntry struct {
+	// Other bucket involved in the operation (new name on rename, source
+	// bucket on clone).
+	Target string `json:"target,omitempty"`
+	// Metadata of the bucket being created or removed.
+	Meta bucketMeta `json:"meta"`
+}
+
+func decodeJournalEntry(value []byte) (journalEntry, error) {
+	var entry journalEntry
+
+	if len(value) == 0 || value[0] != '{' {
+		// Entries written before bucket metadata existed only contain
+		// the target name.
+		entry.Target = string(value)
+		return entry, nil
+	}
+
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return entry, err
+	}
+
+	return entry, nil
+}
+
+func (e journalEntry) encode() []byte {
+	// Marshalling struct of plain fields cannot fail.
+	value, _ := json.Marshal(e)
+	return value
+}
+
+// Replay unfinished operations from the journal.
+func recoverJournal(system *Bucket, store storage, datadir string) error {
+	keys, err := system.List(journalKeyPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		kind, name, found := strings.Cut(strings.TrimPrefix(key, journalKeyPrefix), ":")
+		if !found {
+			log.Warn(fmt.Sprintf("ignoring malformed journal entry '%s'", key))
+			continue
+		}
+
+		value, err := system.Get(key)
+		if err != nil {
+			return err
+		}
+
+		entry, err := decodeJournalEntry(value)
+		if err != nil {
+			return fmt.Errorf("decoding journal entry '%s': %v", key, err)
+		}
+
+		switch kind {
+		case journalRenameKind:
+			err = recoverRename(system, store, name, entry.Target, entry.Meta)
+		case journalCloneKind:
+			err = recoverClone(system, store, entry.Target, name, entry.Meta)
+		case journalPurgeKind:
+			log.Info(fmt.Sprintf("completing purge of bucket '%s'", name))
+			err = finishPurge(system, store, name, entry.Meta)
+		case journalMigrateKind:
+			log.Info(fmt.Sprintf("removing data of '%s' storage layout", name))
+			err = finishMigrate(system, datadir, name)
+		default:
+			log.Warn(fmt.Sprintf("ignoring unknown journal entry '%s'", key))
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("recovering %s of bucket '%s': %v", kind, name, err)
+		}
+	}
+
+	return nil
+}
+
+func recoverRename(system *Bucket, store storage, oldName, newName string, meta bucketMeta) error {
+	renamed, err := store.renamed(oldName, newName, meta)
+	if err != nil {
+		return err
+	}
+
+	if renamed {
+		log.Info(fmt.Sprintf("completing rename of bucket '%s' to '%s'", oldName, newName))
+		return commitRename(system, oldName, newName)
+	}
+
+	log.Info(fmt.Sprintf("rolling back rename of bucket '%s' to '%s'", oldName, newName))
+	return system.Delete(journalKey(journalRenameKind, oldName))
+}
+
+func recoverClone(system *Bucket, store storage, srcName, dstName string, meta bucketMeta) error {
+	complete, err := store.recoverCopy(dstName, meta)
+	if err != nil {
+		return err
+	}
+
+	if complete {
+		log.Info(fmt.Sprintf("completing clone of bucket '%s' to '%s'", srcName, dstName))
+		return commitClone(system, dstName, meta)
+	}
+
+	log.Info(fmt.Sprintf("rolling back clone of bucket '%s' to '%s'", srcName, dstName))
+	return system.Delete(journalKey(journalCloneKind, dstName))
+}
+
+// Move registry entry of renamed bucket and finish the journal entry.
+func commitRename(system *Bucket, oldName, newName string) error {
+	return system.update(func(txn Txn) error {
+		defaultBucket, err := txnGetString(txn, defaultBucketKey)
+		if err != nil {
+			return err
+		}
+
+		if defaultBucket == oldName {
+			if err := txn.Set([]byte(defaultBucketKey), []byte(newName)); err != nil {
+				return err
+			}
+		}
+
+		meta, err := txnGetString(txn, bucketKeyPrefix+oldName)
+		if err != nil {
+			return err
+		}
+
+		if err := txn.Delete([]byte(bucketKeyPrefix + oldName)); err != nil {
+			return err
+		}
+
+		if err := txn.Set([]byte(bucketKeyPrefix+newName), []byte(meta)); err != nil {
+			return err
+		}
+
+		return txn.Delete([]byte(journalKey(journalRenameKind, oldName)))
+	})
+}
+
+// Register cloned bucket and finish the journal entry.
+func commitClone(system *Bucket, dstName string, meta bucketMeta) error {
+	return system.update(func(txn Txn) error {
+		if err := txn.Set([]byte(bucketKeyPrefix+dstName), meta.encode()); err != nil {
+			return err
+		}
+
+		return txn.Delete([]byte(journalKey(journalCloneKind, dstName)))
+	})
+}
+
+func txnGetString(txn Txn, key string) (string, error) {
+	value, err := txn.Get([]byte(key))
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+func bucketDirExists(datadir, name string) (bool, error) {
+	path, err := bucketPath(datadir, name)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,223 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Buckets are opened lazily on first use and reference counted: each Get
+// must be paired with Release once the caller stops using the bucket.
+// Buckets without references are closed once idle for the configured period,
+// or earlier if the limit of simultaneously opened buckets is reached, in
+// least-recently-used order.
+
+var errTooManyOpenBuckets = errors.New("too many open buckets")
+
+// ErrBucketInUse is returned when bucket can't be closed for drop or rename,
+// because it's still used (e.g. by replication or a running command).
+var ErrBucketInUse = errors.New("bucket in use")
+
+const (
+	// How long dropping or renaming bucket waits for its users to
+	// release it.
+	bucketReleaseTimeout = 10 * time.Second
+	// How often the waiting checks references of the bucket.
+	bucketReleasePoll = 10 * time.Millisecond
+)
+
+// Release bucket previously returned by Get.
+func (db *Database) Release(bucket *Bucket) {
+	if bucket == nil {
+		return
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if bucket.refs == 0 {
+		log.Warn(fmt.Sprintf("releasing unused bucket '%s'", bucket.Name))
+		return
+	}
+
+	bucket.refs--
+	bucket.lastUsed = time.Now()
+}
+
+// CloseIdle closes all unused buckets which were idle for longer than the
+// configured idle timeout. Returns number of closed buckets.
+func (db *Database) CloseIdle() int {
+	if db.idleTimeout == 0 {
+		return 0
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	deadline := time.Now().Add(-db.idleTimeout)
+	closed := 0
+
+	for elem := db.lru.Back(); elem != nil; {
+		bucket, _ := elem.Value.(*Bucket)
+		elem = elem.Prev()
+
+		if bucket.refs > 0 || bucket.lastUsed.After(deadline) {
+			continue
+		}
+
+		if err := db.closeBucketLocked(bucket); err != nil {
+			log.Error(fmt.Sprintf("closing idle bucket '%s'", bucket.Name), err)
+			continue
+		}
+		closed++
+	}
+
+	return closed
+}
+
+// OpenCount returns number of currently opened buckets.
+func (db *Database) OpenCount() int {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.lru.Len()
+}
+
+// ValueCacheStats returns value cache metrics summed over all buckets since
+// start.
+func (db *Database) ValueCacheStats() CacheStats {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	stats := db.closedCacheStats
+
+	for elem := db.lru.Front(); elem != nil; elem = elem.Next() {
+		bucket, _ := elem.Value.(*Bucket)
+		stats = addCacheStats(stats, bucket.valueCacheStats())
+	}
+
+	return stats
+}
+
+// Take references to all currently opened buckets, which must be released.
+func (db *Database) acquireOpened() []*Bucket {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	buckets := make([]*Bucket, 0, db.lru.Len())
+	for elem := db.lru.Front(); elem != nil; elem = elem.Next() {
+		bucket, _ := elem.Value.(*Bucket)
+		bucket.refs++
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets
+}
+
+// Open bucket if needed and take reference to it.
+func (db *Database) acquireLocked(bucket *Bucket) error {
+	if bucket.lru == nil {
+		if err := db.evictLocked(); err != nil {
+			return err
+		}
+
+		logged := db.replicationLogSize > 0 && bucket.meta.Consistency != ConsistencyStrong
+		if err := bucket.open(db.valueCacheSize, logged, db.versioner(bucket.meta.Conflict)); err != nil {
+			return err
+		}
+
+		bucket.lru = db.lru.PushFront(bucket)
+		log.Debug(fmt.Sprintf("opened bucket '%s'", bucket.Name))
+
+		// Builds interrupted by closing the bucket continue once reopened.
+		db.startIndexBuildLocked(bucket)
+	} else {
+		db.lru.MoveToFront(bucket.lru)
+	}
+
+	bucket.refs++
+	bucket.lastUsed = time.Now()
+
+	return nil
+}
+
+// Close least recently used buckets to make room for opening another one.
+func (db *Database) evictLocked() error {
+	if db.maxOpen == 0 {
+		return nil
+	}
+
+	for elem := db.lru.Back(); elem != nil && db.lru.Len() >= db.maxOpen; {
+		bucket, _ := elem.Value.(*Bucket)
+		elem = elem.Prev()
+
+		if bucket.refs > 0 {
+			continue
+		}
+
+		if err := db.closeBucketLocked(bucket); err != nil {
+			return fmt.Errorf("closing bucket '%s': %v", bucket.Name, err)
+		}
+	}
+
+	if db.lru.Len() >= db.maxOpen {
+		return fmt.Errorf("%w (%d buckets in use)", errTooManyOpenBuckets, db.lru.Len())
+	}
+
+	return nil
+}
+
+// Wait until registered bucket with given name is released by all users,
+// so that it can be closed, and return it. Running index build is the only
+// reference allowed, as it stops once the bucket is closed. The database
+// lock is released while waiting, so check (e.g. that bucket may be dropped)
+// runs again each time the lock is taken.
+func (db *Database) awaitReleaseLocked(name string, check func(bucket *Bucket) error) (*Bucket, error) {
+	deadline := time.Now().Add(bucketReleaseTimeout)
+
+	for {
+		bucket, ok := db.buckets[name]
+		if !ok {
+			return nil, fmt.Errorf("bucket '%s' not found", name)
+		}
+
+		if err := check(bucket); err != nil {
+			return nil, err
+		}
+
+		refs := bucket.refs
+		if bucket.building {
+			refs--
+		}
+
+		if refs == 0 {
+			return bucket, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("bucket '%s' %w (%d references)", name, ErrBucketInUse, refs)
+		}
+
+		db.mutex.Unlock()
+		time.Sleep(bucketReleasePoll)
+		db.mutex.Lock()
+	}
+}
+
+// Close bucket regardless of its references (they become invalid).
+func (db *Database) closeBucketLocked(bucket *Bucket) error {
+	if bucket.lru == nil {
+		return nil
+	}
+
+	db.lru.Remove(bucket.lru)
+	bucket.lru = nil
+
+	// Keep metrics of the closed cache for ValueCacheStats.
+	db.closedCacheStats = addCacheStats(db.closedCacheStats, bucket.valueCacheStats())
+
+	log.Debug(fmt.Sprintf("closing bucket '%s'", bucket.Name))
+	return bucket.Close()
+}
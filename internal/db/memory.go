@@ -0,0 +1,232 @@
+package db
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/tidwall/btree"
+)
+
+// memoryEngine stores bucket data in copy-on-write B-tree. Transactions and
+// snapshots work on cheap copies of the tree; committed transaction replaces
+// the tree with its copy.
+type memoryEngine struct {
+	mutex sync.RWMutex // Guards replacing the tree and serializes writers.
+	tree  *btree.BTree
+}
+
+type memoryItem struct {
+	key   []byte
+	value []byte
+}
+
+func lessMemoryItem(a, b interface{}) bool {
+	return bytes.Compare(a.(*memoryItem).key, b.(*memoryItem).key) < 0
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{tree: btree.New(lessMemoryItem)}
+}
+
+func (e *memoryEngine) Get(key []byte) ([]byte, error) {
+	return memoryGet(e.current(), key)
+}
+
+func (e *memoryEngine) Iterate(prefix []byte, keysOnly bool, fn func(key, value []byte) error) error {
+	snapshot := e.Snapshot()
+	defer snapshot.Release()
+
+	return snapshot.Iterate(prefix, keysOnly, fn)
+}
+
+func (e *memoryEngine) IterateFrom(prefix, start []byte, keysOnly bool, fn func(key, value []byte) error) error {
+	snapshot := e.Snapshot()
+	defer snapshot.Release()
+
+	return snapshot.IterateFrom(prefix, start, keysOnly, fn)
+}
+
+func (e *memoryEngine) Set(key, value []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	memorySet(e.tree, key, value)
+	return nil
+}
+
+func (e *memoryEngine) Delete(key []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.tree.Delete(&memoryItem{key: key})
+	return nil
+}
+
+func (e *memoryEngine) Update(fn func(txn Txn) error) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	txn := &memoryTxn{tree: e.tree.Copy()}
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	e.tree = txn.tree
+	return nil
+}
+
+func (e *memoryEngine) NewBatch() Batch {
+	return &memoryBatch{engine: e}
+}
+
+func (e *memoryEngine) View(fn func(txn Reader) error) error {
+	snapshot := e.Snapshot()
+	defer snapshot.Release()
+
+	return fn(snapshot)
+}
+
+func (e *memoryEngine) Snapshot() Snapshot {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return &memoryTxn{tree: e.tree.Copy()}
+}
+
+func (e *memoryEngine) DropAll() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.tree = btree.New(lessMemoryItem)
+	return nil
+}
+
+func (e *memoryEngine) Close() error {
+	return nil
+}
+
+// Count of keys and total size of keys and values (in bytes).
+func (e *memoryEngine) size() (keys uint64, size int64) {
+	e.current().Walk(func(items []interface{}) {
+		for _, i := range items {
+			item := i.(*memoryItem)
+			keys++
+			size += int64(len(item.key) + len(item.value))
+		}
+	})
+
+	return keys, size
+}
+
+func (e *memoryEngine) current() *btree.BTree {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return e.tree
+}
+
+// memoryBatch collects writes, which are applied in one transaction.
+type memoryBatch struct {
+	engine *memoryEngine
+	items  []*memoryItem // Items without value are deletions.
+}
+
+func (b *memoryBatch) Set(key, value []byte) error {
+	b.items = append(b.items, &memoryItem{
+		key:   append([]byte(nil), key...),
+		value: append([]byte{}, value...),
+	})
+	return nil
+}
+
+func (b *memoryBatch) Delete(key []byte) error {
+	b.items = append(b.items, &memoryItem{key: append([]byte(nil), key...)})
+	return nil
+}
+
+func (b *memoryBatch) Flush() error {
+	b.engine.mutex.Lock()
+	defer b.engine.mutex.Unlock()
+
+	for _, item := range b.items {
+		if item.value == nil {
+			b.engine.tree.Delete(item)
+		} else {
+			b.engine.tree.Set(item)
+		}
+	}
+
+	b.items = nil
+	return nil
+}
+
+func (b *memoryBatch) Cancel() {
+	b.items = nil
+}
+
+// memoryTxn implements both Txn and Snapshot over private copy of the tree.
+type memoryTxn struct {
+	tree *btree.BTree
+}
+
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+	return memoryGet(t.tree, key)
+}
+
+func (t *memoryTxn) Iterate(prefix []byte, _ bool, fn func(key, value []byte) error) error {
+	return memoryIterate(t.tree, prefix, nil, fn)
+}
+
+func (t *memoryTxn) IterateFrom(prefix, start []byte, _ bool, fn func(key, value []byte) error) error {
+	return memoryIterate(t.tree, prefix, start, fn)
+}
+
+func (t *memoryTxn) Set(key, value []byte) error {
+	memorySet(t.tree, key, value)
+	return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	t.tree.Delete(&memoryItem{key: key})
+	return nil
+}
+
+func (t *memoryTxn) Release() {}
+
+func memoryGet(tree *btree.BTree, key []byte) ([]byte, error) {
+	item := tree.Get(&memoryItem{key: key})
+	if item == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return append([]byte(nil), item.(*memoryItem).value...), nil
+}
+
+// Key and value are copied, as items are shared by copies of the tree.
+func memorySet(tree *btree.BTree, key, value []byte) {
+	tree.Set(&memoryItem{
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+}
+
+func memoryIterate(tree *btree.BTree, prefix, start []byte, fn func(key, value []byte) error) error {
+	var err error
+
+	pivot := prefix
+	if bytes.Compare(start, prefix) > 0 {
+		pivot = start
+	}
+
+	tree.Ascend(&memoryItem{key: pivot}, func(i interface{}) bool {
+		item := i.(*memoryItem)
+		if !bytes.HasPrefix(item.key, prefix) {
+			return false
+		}
+
+		err = fn(item.key, item.value)
+		return err == nil
+	})
+
+	return err
+}
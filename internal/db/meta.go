@@ -0,0 +1,67 @@
+package db
+
+import "encoding/json"
+
+// bucketMeta contains bucket metadata stored in the bucket registry.
+type bucketMeta struct {
+	// ID of the bucket, used as key prefix by shared storage layout.
+	ID uint64 `json:"id,omitempty"`
+	// Storage engine of the bucket, EngineBadger if empty.
+	Engine string `json:"engine,omitempty"`
+	// Limits of the bucket.
+	Quota Quota `json:"quota"`
+	// Constraints of keys and values.
+	Schema Schema `json:"schema"`
+	// Whether all writes to the bucket are rejected.
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Consistency mode, ConsistencyEventual if empty.
+	Consistency string `json:"consistency,omitempty"`
+	// Conflict policy of replicated writes, ConflictNone if empty.
+	Conflict string `json:"conflict,omitempty"`
+	// Secondary indexes by name.
+	Indexes map[string]Index `json:"indexes,omitempty"`
+	// Vector indexes by name, sharing IDs with secondary indexes.
+	Vectors map[string]VectorIndex `json:"vectors,omitempty"`
+	// Last ID assigned to index, IDs are never reused.
+	NextIndexID uint64 `json:"next_index_id,omitempty"`
+}
+
+// legacyRegistryValue is registry value written by versions without bucket
+// metadata.
+var legacyRegistryValue = []byte{1}
+
+func decodeMeta(value []byte) (bucketMeta, error) {
+	var meta bucketMeta
+
+	if len(value) == len(legacyRegistryValue) && value[0] == legacyRegistryValue[0] {
+		return meta, nil
+	}
+
+	if err := json.Unmarshal(value, &meta); err != nil {
+		return meta, err
+	}
+
+	return meta, nil
+}
+
+func (m bucketMeta) encode() []byte {
+	// Marshalling struct of plain fields cannot fail.
+	value, _ := json.Marshal(m)
+	return value
+}
+
+func (m bucketMeta) engine() string {
+	if m.Engine == "" {
+		return EngineBadger
+	}
+
+	return m.Engine
+}
+
+func (m bucketMeta) consistency() string {
+	if m.Consistency == "" {
+		return ConsistencyEventual
+	}
+
+	return m.Consistency
+}
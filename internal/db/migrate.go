@@ -0,0 +1,236 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Migration copies all buckets (including dropped ones) into the storage of
+// the new layout, then switches the layout in one transaction together with
+// the updated bucket metadata. Data of the old layout is removed afterwards
+// (journaled, so that an interrupted removal is finished on startup). Data
+// left over by an interrupted copy is discarded by the next migration.
+
+const journalMigrateKind = "migrate"
+
+// migratedBucket is a bucket (registered or dropped) being migrated.
+type migratedBucket struct {
+	name    string
+	key     string
+	meta    bucketMeta
+	dropped *droppedEntry
+}
+
+// Migrate moves all buckets in given data directory into storage of given
+// layout. The database must not be opened by anyone else during migration.
+func Migrate(datadir, layout string) error {
+	if err := checkDataDirectory(datadir); err != nil {
+		return err
+	}
+
+	system, err := openBucketNoCheck(systemBucketName, datadir, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := system.Close(); err != nil {
+			log.Error("closing system bucket", err)
+		}
+	}()
+
+	if _, err := system.Get(initKey); err != nil {
+		return fmt.Errorf("validating db: %v", err)
+	}
+
+	from, err := storageLayout(system)
+	if err != nil {
+		return fmt.Errorf("getting storage layout: %v", err)
+	}
+
+	if from == layout {
+		return fmt.Errorf("database already uses '%s' storage layout", layout)
+	}
+
+	src, err := openStorage(from, datadir, system, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := src.shutdown(); err != nil {
+			log.Error("closing source storage", err)
+		}
+	}()
+
+	if err := recoverJournal(system, src, datadir); err != nil {
+		return err
+	}
+
+	buckets, err := migratedBuckets(system)
+	if err != nil {
+		return err
+	}
+
+	// Leftovers of previous interrupted migration.
+	if err := discardLayout(datadir, layout); err != nil {
+		return err
+	}
+
+	dst, err := openStorage(layout, datadir, system, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dst.shutdown(); err != nil {
+			log.Error("closing target storage", err)
+		}
+	}()
+
+	for i := range buckets {
+		if err := migrateBucket(src, dst, &buckets[i]); err != nil {
+			return fmt.Errorf("migrating bucket '%s': %v", buckets[i].name, err)
+		}
+		log.Info(fmt.Sprintf("copied bucket '%s'", buckets[i].name))
+	}
+
+	err = system.update(func(txn Txn) error {
+		for i := range buckets {
+			value := buckets[i].meta.encode()
+			if buckets[i].dropped != nil {
+				buckets[i].dropped.Meta = buckets[i].meta
+				value = buckets[i].dropped.encode()
+			}
+
+			if err := txn.Set([]byte(buckets[i].key), value); err != nil {
+				return err
+			}
+		}
+
+		if err := txn.Set([]byte(layoutKey), []byte(layout)); err != nil {
+			return err
+		}
+
+		return txn.Set([]byte(journalKey(journalMigrateKind, from)), []byte{1})
+	})
+	if err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("switched storage layout from '%s' to '%s'", from, layout))
+
+	return finishMigrate(system, datadir, from)
+}
+
+// Collect all registered and dropped buckets.
+func migratedBuckets(system *Bucket) ([]migratedBucket, error) {
+	var buckets []migratedBucket
+
+	for _, prefix := range []string{bucketKeyPrefix, droppedKeyPrefix} {
+		keys, err := system.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			value, err := system.Get(key)
+			if err != nil {
+				return nil, err
+			}
+
+			bucket := migratedBucket{
+				name: strings.TrimPrefix(key, prefix),
+				key:  key,
+			}
+
+			if prefix == droppedKeyPrefix {
+				entry, err := decodeDroppedEntry(value)
+				if err != nil {
+					return nil, fmt.Errorf("decoding dropped bucket '%s': %v", bucket.name, err)
+				}
+				bucket.meta = entry.Meta
+				bucket.dropped = &entry
+			} else {
+				bucket.meta, err = decodeMeta(value)
+				if err != nil {
+					return nil, fmt.Errorf("decoding metadata of bucket '%s': %v", bucket.name, err)
+				}
+			}
+
+			if bucket.meta.Engine == EngineMemory {
+				continue // Not stored by any layout.
+			}
+
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	return buckets, nil
+}
+
+// Copy bucket data from source to target storage, updating its metadata.
+func migrateBucket(src, dst storage, bucket *migratedBucket) error {
+	from, err := newBucket(bucket.name, src, bucket.meta)
+	if err != nil {
+		return err
+	}
+
+	if err := from.open(0, false, nil); err != nil {
+		return err
+	}
+	defer func() {
+		if err := from.Close(); err != nil {
+			log.Error(fmt.Sprintf("closing bucket '%s'", bucket.name), err)
+		}
+	}()
+
+	meta := bucket.meta
+	meta.ID = 0 // Assigned by storage.
+	if err := dst.create(bucket.name, &meta); err != nil {
+		return err
+	}
+
+	if err := dst.copy(from, bucket.name, meta); err != nil {
+		return err
+	}
+
+	bucket.meta = meta
+	return nil
+}
+
+// Remove old layout data and finish the journal entry.
+func finishMigrate(system *Bucket, datadir, layout string) error {
+	if err := discardLayout(datadir, layout); err != nil {
+		return err
+	}
+
+	return system.Delete(journalKey(journalMigrateKind, layout))
+}
+
+// Remove all bucket data stored by given layout.
+func discardLayout(datadir, layout string) error {
+	switch layout {
+	case LayoutDir:
+		entries, err := os.ReadDir(filepath.Join(datadir, "buckets"))
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.Name() == systemBucketName {
+				continue
+			}
+
+			if err := os.RemoveAll(filepath.Join(datadir, "buckets", entry.Name())); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case LayoutShared:
+		return os.RemoveAll(filepath.Join(datadir, sharedDirName))
+	default:
+		return fmt.Errorf("unknown storage layout '%s'", layout)
+	}
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Replication policies extend replication of buckets beyond the region of
+// the member writing them. Policies are registered under policyKeyPrefix in
+// the system bucket, also for buckets which don't exist locally (yet), as
+// they are spread to all members of the cluster. Every change has the time
+// it was made, the latest change wins, and removed policies are kept as
+// tombstones, so that changes can be exchanged in any order.
+
+const policyKeyPrefix = "policy:"
+
+// Replication modes of policies.
+const (
+	// Writes are acknowledged once applied locally.
+	ReplicationAsync = "async"
+	// Writes are acknowledged once applied in all regions of the policy.
+	ReplicationSync = "sync"
+)
+
+// ReplicationPolicy describes regions bucket is replicated between.
+type ReplicationPolicy struct {
+	Regions []string `json:"regions,omitempty"`
+	Mode    string   `json:"mode,omitempty"`
+	// Time of the change (Unix nanoseconds).
+	Updated int64 `json:"updated"`
+	// Whether the policy was removed.
+	Removed bool `json:"removed,omitempty"`
+}
+
+// Validate checks that policy has regions and known mode.
+func (p ReplicationPolicy) Validate() error {
+	if p.Removed {
+		return nil
+	}
+
+	if len(p.Regions) == 0 {
+		return errors.New("policy has no regions")
+	}
+
+	for _, region := range p.Regions {
+		if region == "" {
+			return errors.New("empty region name")
+		}
+	}
+
+	if p.Mode != ReplicationAsync && p.Mode != ReplicationSync {
+		return fmt.Errorf("unknown replication mode '%s'", p.Mode)
+	}
+
+	return nil
+}
+
+// Includes returns whether policy replicates bucket to given region.
+func (p ReplicationPolicy) Includes(region string) bool {
+	if p.Removed {
+		return false
+	}
+
+	for _, r := range p.Regions {
+		if r == region {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p ReplicationPolicy) encode() []byte {
+	// Marshalling struct of plain fields cannot fail.
+	value, _ := json.Marshal(p)
+	return value
+}
+
+// SetReplicationPolicy stores policy of bucket with given name, unless the
+// stored one is newer. Returns whether the policy was stored.
+func (db *Database) SetReplicationPolicy(name string, policy ReplicationPolicy) (bool, error) {
+	if err := db.checkWritable(); err != nil {
+		return false, err
+	}
+
+	if err := policy.Validate(); err != nil {
+		return false, err
+	}
+
+	policy.Regions = uniqueSorted(policy.Regions)
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	current, err := db.replicationPolicy(name)
+	if err != nil && err != ErrKeyNotFound {
+		return false, err
+	}
+	if err == nil && current.Updated >= policy.Updated {
+		return false, nil
+	}
+
+	if err := db.system.Set(policyKeyPrefix+name, policy.encode()); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ReplicationPolicy returns policy of bucket with given name, ErrKeyNotFound
+// if it has none (including a removed one).
+func (db *Database) ReplicationPolicy(name string) (ReplicationPolicy, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	policy, err := db.replicationPolicy(name)
+	if err == nil && policy.Removed {
+		return ReplicationPolicy{}, ErrKeyNotFound
+	}
+
+	return policy, err
+}
+
+// ReplicationPolicies returns policies of all buckets by bucket name,
+// including removed ones.
+func (db *Database) ReplicationPolicies() (map[string]ReplicationPolicy, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	keys, err := db.system.List(policyKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string]ReplicationPolicy, len(keys))
+
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, policyKeyPrefix)
+
+		policy, err := db.replicationPolicy(name)
+		if err != nil {
+			return nil, err
+		}
+
+		policies[name] = policy
+	}
+
+	return policies, nil
+}
+
+func (db *Database) replicationPolicy(name string) (ReplicationPolicy, error) {
+	var policy ReplicationPolicy
+
+	value, err := db.system.Get(policyKeyPrefix + name)
+	if err != nil {
+		return policy, err
+	}
+
+	if err := json.Unmarshal(value, &policy); err != nil {
+		return policy, fmt.Errorf("decoding replication policy of bucket '%s': %v", name, err)
+	}
+
+	return policy, nil
+}
+
+func uniqueSorted(values []string) []string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+
+	unique := sorted[:0]
+	for i, value := range sorted {
+		if i == 0 || value != sorted[i-1] {
+			unique = append(unique, value)
+		}
+	}
+
+	return unique
+}
@@ -0,0 +1,413 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Quotas are enforced by the committer of the bucket, which sees all writes
+// in order. Limits on key count and total size require knowing the size of
+// the value being replaced, so with these limits set each write reads the
+// previous value first. Usage is computed by scanning the bucket when first
+// needed, and recomputed after writes the committer doesn't see
+// (transactions).
+//
+// Total size includes internal data (indexes, logs, versions, time series and
+// vectors), the key count only includes plain keys. Internal data is written
+// under the committer mutex, tracking its size change, and time series and
+// vector writes exceeding the size limit are rejected.
+
+// ErrQuotaExceeded is returned for writes rejected by bucket quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota contains limits of a bucket. Zero means no limit.
+type Quota struct {
+	// Total size of keys and values (in bytes).
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// Number of keys.
+	MaxKeys int64 `json:"max_keys,omitempty"`
+	// Length of a single key (in bytes).
+	MaxKeyLength int64 `json:"max_key_length,omitempty"`
+	// Size of a single value (in bytes).
+	MaxValueSize int64 `json:"max_value_size,omitempty"`
+}
+
+// Usage contains resources used by bucket, as limited by Quota.
+type Usage struct {
+	Bytes int64
+	Keys  int64
+}
+
+// Whether usage needs to be tracked to enforce the quota.
+func (q Quota) tracksUsage() bool {
+	return q.MaxBytes > 0 || q.MaxKeys > 0
+}
+
+// Check limits of a single write.
+func (q Quota) checkWrite(key, value []byte) error {
+	if q.MaxKeyLength > 0 && int64(len(key)) > q.MaxKeyLength {
+		return fmt.Errorf("%w: key length %d exceeds %d bytes", ErrQuotaExceeded, len(key), q.MaxKeyLength)
+	}
+
+	if q.MaxValueSize > 0 && int64(len(value)) > q.MaxValueSize {
+		return fmt.Errorf("%w: value size %d exceeds %d bytes", ErrQuotaExceeded, len(value), q.MaxValueSize)
+	}
+
+	return nil
+}
+
+// Check limits of usage changed by a write.
+func (q Quota) checkUsage(usage Usage, delta Usage) error {
+	if q.MaxKeys > 0 && delta.Keys > 0 && usage.Keys+delta.Keys > q.MaxKeys {
+		return fmt.Errorf("%w: bucket holds %d of %d keys", ErrQuotaExceeded, usage.Keys, q.MaxKeys)
+	}
+
+	if q.MaxBytes > 0 && delta.Bytes > 0 && usage.Bytes+delta.Bytes > q.MaxBytes {
+		return fmt.Errorf("%w: bucket holds %d of %d bytes", ErrQuotaExceeded, usage.Bytes, q.MaxBytes)
+	}
+
+	return nil
+}
+
+// SetQuota changes quota of bucket with given name.
+func (db *Database) SetQuota(name string, quota Quota) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket, ok := db.buckets[name]
+	if !ok {
+		return fmt.Errorf("bucket '%s' not found", name)
+	}
+
+	meta := bucket.meta
+	meta.Quota = quota
+
+	if err := db.system.Set(bucketKeyPrefix+name, meta.encode()); err != nil {
+		return err
+	}
+
+	bucket.setMeta(meta)
+	return nil
+}
+
+// Quota returns quota of bucket.
+func (b *Bucket) Quota() Quota {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.meta.Quota
+}
+
+// Usage returns resources used by bucket, computing them if not known yet.
+func (b *Bucket) Usage() (Usage, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return Usage{}, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	c := b.committer
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Usage of bucket without limits isn't kept up to date.
+	if !c.quota.tracksUsage() {
+		c.usageKnown = false
+	}
+
+	if err := c.computeUsageLocked(); err != nil {
+		return Usage{}, err
+	}
+
+	return c.usage, nil
+}
+
+// Change bucket metadata (used by database, which persists it). Schema of
+// the metadata must be valid.
+func (b *Bucket) setMeta(meta bucketMeta) {
+	validator, err := compileSchema(meta.Schema)
+	if err != nil {
+		log.Error(fmt.Sprintf("compiling schema of bucket '%s'", b.Name), err)
+	}
+
+	b.lock()
+	defer b.mutex.Unlock()
+
+	b.meta = meta
+	b.validator = validator
+
+	if b.committer != nil {
+		b.committer.setMeta(meta.Quota, compileIndexes(meta.Indexes))
+	}
+}
+
+func (c *committer) setMeta(quota Quota, indexes []indexer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Usage isn't kept up to date while it's not limited.
+	if !c.quota.tracksUsage() {
+		c.usageKnown = false
+	}
+
+	c.quota = quota
+	c.indexes = indexes
+}
+
+// Forget usage, so that it is recomputed when needed.
+func (c *committer) invalidateUsage() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.usageKnown = false
+}
+
+// Set usage of empty bucket.
+func (c *committer) resetUsage() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.usage = Usage{}
+	c.usageKnown = true
+}
+
+func (c *committer) computeUsageLocked() error {
+	if c.usageKnown {
+		return nil
+	}
+
+	var usage Usage
+
+	err := c.engine.Iterate(nil, false, func(key, value []byte) error {
+		if !isInternalKey(key) {
+			usage.Keys++
+		}
+
+		usage.Bytes += int64(len(key) + len(value))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("computing bucket usage: %v", err)
+	}
+
+	c.usage = usage
+	c.usageKnown = true
+	return nil
+}
+
+// Run transaction writing internal data of bucket, keeping usage up to date.
+// With check set, transaction growing the bucket over its size limit is
+// rolled back with ErrQuotaExceeded.
+func (c *committer) updateInternal(check bool, fn func(txn Txn) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.updateInternalLocked(check, fn)
+}
+
+func (c *committer) updateInternalLocked(check bool, fn func(txn Txn) error) error {
+	if !c.quota.tracksUsage() {
+		return c.engine.Update(fn)
+	}
+
+	if err := c.computeUsageLocked(); err != nil {
+		return err
+	}
+
+	var bytes int64
+
+	err := c.engine.Update(func(txn Txn) error {
+		sizing := &sizingTxn{Txn: txn}
+		if err := fn(sizing); err != nil {
+			return err
+		}
+
+		bytes = sizing.bytes
+		if check {
+			return c.quota.checkUsage(c.usage, Usage{Bytes: bytes})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.usage.Bytes += bytes
+	return nil
+}
+
+// Delete internal keys of bucket in batch, keeping usage up to date.
+func (c *committer) deleteInternal(keys [][]byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tracked := c.quota.tracksUsage() && c.usageKnown
+
+	var removed int64
+
+	batch := c.engine.NewBatch()
+	defer batch.Cancel()
+
+	for _, key := range keys {
+		if tracked {
+			size, err := txnEntrySize(c.engine, key)
+			if err != nil {
+				return err
+			}
+			if size > 0 {
+				removed += size
+			}
+		}
+
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	if err := batch.Flush(); err != nil {
+		// Part of the batch may have been applied.
+		c.usageKnown = false
+		return err
+	}
+
+	c.usage.Bytes -= removed
+	return nil
+}
+
+// sizingTxn tracks change of total size of internal keys written in
+// transaction. Sizes of plain keys are tracked by the committer.
+type sizingTxn struct {
+	Txn
+	bytes int64
+}
+
+func (t *sizingTxn) Set(key, value []byte) error {
+	if err := t.resize(key, int64(len(key)+len(value))); err != nil {
+		return err
+	}
+
+	return t.Txn.Set(key, value)
+}
+
+func (t *sizingTxn) Delete(key []byte) error {
+	if err := t.resize(key, 0); err != nil {
+		return err
+	}
+
+	return t.Txn.Delete(key)
+}
+
+func (t *sizingTxn) resize(key []byte, newSize int64) error {
+	if !isInternalKey(key) {
+		return nil
+	}
+
+	oldSize, err := txnEntrySize(t.Txn, key)
+	if err != nil {
+		return err
+	}
+	if oldSize > 0 {
+		t.bytes -= oldSize
+	}
+
+	t.bytes += newSize
+	return nil
+}
+
+// Check writes of the group against the quota, updating the usage. Returns
+// admitted writes, rejected ones are completed with error.
+func (c *committer) admitLocked(group []*writeOp) []*writeOp {
+	admitted := group[:0]
+
+	tracked := c.quota.tracksUsage()
+	if tracked {
+		if err := c.computeUsageLocked(); err != nil {
+			for _, op := range group {
+				op.done <- err
+			}
+			return admitted
+		}
+	}
+
+	// Sizes of keys written by admitted writes (-1 if deleted).
+	pending := make(map[string]int64)
+
+	for _, op := range group {
+		if !op.delete {
+			if err := c.quota.checkWrite(op.key, op.value); err != nil {
+				op.done <- err
+				continue
+			}
+		}
+
+		if !tracked {
+			admitted = append(admitted, op)
+			continue
+		}
+
+		oldSize, err := c.entrySize(op.key, pending)
+		if err != nil {
+			op.done <- err
+			continue
+		}
+
+		newSize := int64(-1)
+		if !op.delete {
+			newSize = int64(len(op.key) + len(op.value))
+		}
+
+		delta := usageDelta(oldSize, newSize)
+		if err := c.quota.checkUsage(c.usage, delta); err != nil {
+			op.done <- err
+			continue
+		}
+
+		c.usage.Keys += delta.Keys
+		c.usage.Bytes += delta.Bytes
+		pending[string(op.key)] = newSize
+		admitted = append(admitted, op)
+	}
+
+	return admitted
+}
+
+// Size of key and value currently stored under key (-1 if not present).
+func (c *committer) entrySize(key []byte, pending map[string]int64) (int64, error) {
+	if size, ok := pending[string(key)]; ok {
+		return size, nil
+	}
+
+	value, err := c.engine.Get(key)
+	if err == ErrKeyNotFound {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(key) + len(value)), nil
+}
+
+func usageDelta(oldSize, newSize int64) Usage {
+	var delta Usage
+
+	if oldSize >= 0 {
+		delta.Keys--
+		delta.Bytes -= oldSize
+	}
+
+	if newSize >= 0 {
+		delta.Keys++
+		delta.Bytes += newSize
+	}
+
+	return delta
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Usage tracked by the committer matches usage computed by scanning the
+// bucket.
+func expectTrackedUsage(t *testing.T, bucket *Bucket) {
+	t.Helper()
+
+	c := bucket.committer
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.usageKnown {
+		t.Fatal("usage not tracked")
+	}
+	tracked := c.usage
+
+	c.usageKnown = false
+	if err := c.computeUsageLocked(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.usage != tracked {
+		t.Fatalf("tracked usage %+v, computed %+v", tracked, c.usage)
+	}
+}
+
+func TestQuotaTimeSeries(t *testing.T) {
+	db := openTestDatabase(t, nil)
+	bucket := createTestBucket(t, db, "series", BucketOptions{})
+
+	if err := db.SetQuota("series", Quota{MaxBytes: 4096}); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	for i := int64(0); i < 100000 && err == nil; i++ {
+		err = bucket.AddSample("temp", Sample{Timestamp: i * 1000, Value: float64(i)}, &TimeSeries{})
+	}
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("got error %v, want quota exceeded", err)
+	}
+
+	usage, err := bucket.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes > 4096 {
+		t.Fatalf("bucket holds %d bytes over quota", usage.Bytes)
+	}
+	if usage.Keys != 0 {
+		t.Fatalf("time series counted as %d keys", usage.Keys)
+	}
+}
+
+func TestQuotaVectors(t *testing.T) {
+	db := openTestDatabase(t, nil)
+	bucket := createTestBucket(t, db, "vectors", BucketOptions{})
+
+	if err := db.CreateVectorIndex("vectors", "idx", VectorIndex{Dim: testVectorDim, Metric: VectorL2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetQuota("vectors", Quota{MaxBytes: 8192}); err != nil {
+		t.Fatal(err)
+	}
+
+	vectors := testVectors()
+
+	var err error
+	for i := 0; i < testVectorCount && err == nil; i++ {
+		key := fmt.Sprintf("v%04d", i)
+		err = bucket.VectorAdd("idx", key, vectors[key])
+	}
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("got error %v, want quota exceeded", err)
+	}
+
+	usage, err := bucket.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Bytes > 8192 {
+		t.Fatalf("bucket holds %d bytes over quota", usage.Bytes)
+	}
+
+	// Deleting vectors frees space again.
+	if _, err := bucket.VectorDelete("idx", "v0000"); err != nil {
+		t.Fatal(err)
+	}
+	expectTrackedUsage(t, bucket)
+}
+
+// Writes of plain keys, indexes, time series and vectors keep tracked usage
+// exact.
+func TestQuotaUsageTracking(t *testing.T) {
+	db := openTestDatabase(t, nil)
+	bucket := createTestBucket(t, db, "mixed", BucketOptions{})
+
+	if err := db.CreateIndex("mixed", "name", IndexField, "name", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateVectorIndex("mixed", "idx", VectorIndex{Dim: testVectorDim, Metric: VectorCosine}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetQuota("mixed", Quota{MaxBytes: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compute usage, so that following writes are tracked.
+	if _, err := bucket.Usage(); err != nil {
+		t.Fatal(err)
+	}
+
+	vectors := testVectors()
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%02d", i%20)
+		if err := bucket.Set(key, []byte(fmt.Sprintf(`{"name":"n%d"}`, i))); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := bucket.AddSample("series", Sample{Timestamp: int64(i), Value: float64(i)}, &TimeSeries{Retention: 10}); err != nil {
+			t.Fatal(err)
+		}
+
+		vector := fmt.Sprintf("v%04d", i)
+		if err := bucket.VectorAdd("idx", vector, vectors[vector]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectTrackedUsage(t, bucket)
+
+	for i := 0; i < 10; i++ {
+		if err := bucket.Delete(fmt.Sprintf("k%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := bucket.VectorDelete("idx", fmt.Sprintf("v%04d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectTrackedUsage(t, bucket)
+}
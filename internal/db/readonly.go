@@ -0,0 +1,97 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrReadOnly is returned for writes to read-only bucket or database.
+var ErrReadOnly = errors.New("read-only")
+
+// SetReadOnly changes whether bucket with given name rejects all writes.
+func (db *Database) SetReadOnly(name string, readOnly bool) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket, ok := db.buckets[name]
+	if !ok {
+		return fmt.Errorf("bucket '%s' not found", name)
+	}
+
+	meta := bucket.meta
+	meta.ReadOnly = readOnly
+
+	if err := db.system.Set(bucketKeyPrefix+name, meta.encode()); err != nil {
+		return err
+	}
+
+	bucket.setMeta(meta)
+	return nil
+}
+
+// ReadOnly returns whether database was opened read-only.
+func (db *Database) ReadOnly() bool {
+	return db.readOnly
+}
+
+func (db *Database) checkWritable() error {
+	if db.readOnly {
+		return fmt.Errorf("database is %w", ErrReadOnly)
+	}
+
+	return nil
+}
+
+// ReadOnly returns whether bucket rejects all writes.
+func (b *Bucket) ReadOnly() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.meta.ReadOnly || b.databaseReadOnly
+}
+
+// Must be called with the bucket mutex held. Writes to strongly consistent
+// buckets are only applied from consensus.
+func (b *Bucket) checkWritable() error {
+	if err := b.checkWritableState(); err != nil {
+		return err
+	}
+
+	if b.meta.Consistency == ConsistencyStrong {
+		return fmt.Errorf("bucket '%s' is strongly consistent, %w", b.Name, ErrConsensusRequired)
+	}
+
+	return nil
+}
+
+// Check that neither the database nor the bucket is read-only.
+func (b *Bucket) checkWritableState() error {
+	if b.databaseReadOnly {
+		return fmt.Errorf("database is %w", ErrReadOnly)
+	}
+
+	if b.meta.ReadOnly {
+		return fmt.Errorf("bucket '%s' is %w", b.Name, ErrReadOnly)
+	}
+
+	return nil
+}
+
+// Unfinished operations cannot be recovered without writing, so read-only
+// database must not have any.
+func checkJournalEmpty(system *Bucket) error {
+	keys, err := system.List(journalKeyPrefix)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) > 0 {
+		return fmt.Errorf("database has %d unfinished operation(s), open it read-write first", len(keys))
+	}
+
+	return nil
+}
@@ -0,0 +1,743 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/pepol/databuddy/internal/merkle"
+)
+
+// Writes of clients are recorded in the replication log of the bucket, from
+// which peers pull the writes they haven't applied yet. Every logged write
+// gets version, the commit sequence number of the bucket:
+//
+//	0xff 'r' 'l' <8 bytes big-endian version> -> <entry>
+//	0xff 'r' 'v' -> <8 bytes big-endian last version> <8 bytes log ID>
+//	0xff 'r' 'a' <origin> -> <8 bytes big-endian version> <8 bytes log ID>
+//
+// Entry is <1 byte op> <varint commit time> <uvarint key length> <key>
+// <value>. Versioned writes (of buckets with conflict policy) use upper-case
+// ops and have <uvarint version length> <version> following the key. Log
+// gets new random ID when it is started and when the bucket is
+// flushed, so that versions of its previous incarnation (e.g. of memory
+// bucket before restart) aren't mistaken for current ones.
+//
+// Writes applied from peers aren't logged again, every member pulls writes
+// of all other members directly. Old entries are trimmed; peer falling
+// behind the oldest entry copies all data of the bucket and continues with
+// the version current when the copy started.
+const replicationKeyTag = 'r'
+
+const (
+	logEntryTag   = 'l'
+	logVersionTag = 'v'
+	logAppliedTag = 'a'
+)
+
+// Operations of log entries.
+const (
+	logOpSet             = 's'
+	logOpDelete          = 'd'
+	logOpSetVersioned    = 'S'
+	logOpDeleteVersioned = 'D'
+)
+
+// Maximum size of keys and values returned by single log read.
+const maxLogReadBytes = 4 << 20
+
+var (
+	// ErrLogTruncated is returned when replication log no longer contains
+	// entries following requested position.
+	ErrLogTruncated = errors.New("replication log truncated")
+
+	errMalformedLogEntry = errors.New("malformed replication log entry")
+)
+
+// LogPosition identifies entry of replication log.
+type LogPosition struct {
+	ID      uint64
+	Version uint64
+}
+
+// LogEntry is a write recorded in replication log.
+type LogEntry struct {
+	Version uint64
+	Time    int64 // Unix time of commit (in nanoseconds).
+	Key     []byte
+	Value   []byte
+	Delete  bool
+	// Version of the key in bucket with conflict policy, nil otherwise.
+	Meta []byte
+}
+
+func replicationKey(tag byte, suffix []byte) []byte {
+	key := []byte{internalKeyPrefix, replicationKeyTag, tag}
+	return append(key, suffix...)
+}
+
+func logEntryKey(version uint64) []byte {
+	return replicationKey(logEntryTag, binary.BigEndian.AppendUint64(nil, version))
+}
+
+func encodePosition(position LogPosition) []byte {
+	value := binary.BigEndian.AppendUint64(nil, position.Version)
+	return binary.BigEndian.AppendUint64(value, position.ID)
+}
+
+func decodePosition(value []byte) (LogPosition, error) {
+	const positionSize = 16
+
+	if len(value) != positionSize {
+		return LogPosition{}, errMalformedLogEntry
+	}
+
+	return LogPosition{
+		Version: binary.BigEndian.Uint64(value),
+		ID:      binary.BigEndian.Uint64(value[8:]),
+	}, nil
+}
+
+func encodeLogEntry(op *writeOp, now int64) []byte {
+	var value []byte
+
+	switch {
+	case op.meta != nil && op.delete:
+		value = []byte{logOpDeleteVersioned}
+	case op.meta != nil:
+		value = []byte{logOpSetVersioned}
+	case op.delete:
+		value = []byte{logOpDelete}
+	default:
+		value = []byte{logOpSet}
+	}
+
+	value = binary.AppendVarint(value, now)
+	value = binary.AppendUvarint(value, uint64(len(op.key)))
+	value = append(value, op.key...)
+
+	if op.meta != nil {
+		value = binary.AppendUvarint(value, uint64(len(op.meta)))
+		value = append(value, op.meta...)
+	}
+
+	if !op.delete {
+		value = append(value, op.value...)
+	}
+
+	return value
+}
+
+func decodeLogEntry(version uint64, value []byte) (LogEntry, error) {
+	entry := LogEntry{Version: version}
+
+	if len(value) == 0 {
+		return entry, errMalformedLogEntry
+	}
+
+	var versioned bool
+
+	switch value[0] {
+	case logOpSet:
+	case logOpDelete:
+		entry.Delete = true
+	case logOpSetVersioned:
+		versioned = true
+	case logOpDeleteVersioned:
+		entry.Delete, versioned = true, true
+	default:
+		return entry, errMalformedLogEntry
+	}
+	value = value[1:]
+
+	now, n := binary.Varint(value)
+	if n <= 0 {
+		return entry, errMalformedLogEntry
+	}
+	entry.Time = now
+	value = value[n:]
+
+	size, n := binary.Uvarint(value)
+	if n <= 0 || size > uint64(len(value)-n) {
+		return entry, errMalformedLogEntry
+	}
+	value = value[n:]
+
+	entry.Key = append([]byte(nil), value[:size]...)
+	value = value[size:]
+
+	if versioned {
+		size, n := binary.Uvarint(value)
+		if n <= 0 || size > uint64(len(value)-n) {
+			return entry, errMalformedLogEntry
+		}
+
+		entry.Meta = append([]byte(nil), value[n:n+int(size)]...)
+		value = value[n+int(size):]
+	}
+
+	if !entry.Delete {
+		entry.Value = append([]byte{}, value...)
+	}
+
+	return entry, nil
+}
+
+// Start the log at last logged version, or with new ID if there is none.
+func (c *committer) loadLog() {
+	value, err := c.engine.Get(replicationKey(logVersionTag, nil))
+	if err == nil {
+		position, err := decodePosition(value)
+		if err == nil {
+			c.logID = position.ID
+			c.version = position.Version
+			return
+		}
+	}
+	if err != nil && err != ErrKeyNotFound {
+		log.Error("reading replication log version", err)
+	}
+
+	c.resetLog()
+}
+
+// Start new log, e.g. after all data was removed.
+func (c *committer) resetLog() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		binary.BigEndian.PutUint64(id[:], uint64(time.Now().UnixNano()))
+	}
+
+	c.logID = binary.BigEndian.Uint64(id[:])
+	c.version = 0
+}
+
+// Record writes of the group following the last logged version. Returns
+// the version of the last one.
+func (c *committer) logLocked(txn Txn, group []*writeOp) (uint64, error) {
+	version := c.version
+	now := time.Now().UnixNano()
+
+	for _, op := range group {
+		version++
+		if err := txn.Set(logEntryKey(version), encodeLogEntry(op, now)); err != nil {
+			return 0, err
+		}
+	}
+
+	position := encodePosition(LogPosition{ID: c.logID, Version: version})
+	return version, txn.Set(replicationKey(logVersionTag, nil), position)
+}
+
+// Apply writes replicated from peer, running extra (unless nil) in the same
+// transaction, e.g. to record applied position. Writes bypass the quota, so
+// that replicas don't diverge. Versioned writes are merged with the local
+// versions of their keys.
+func (c *committer) replicate(group []*writeOp, extra func(txn Txn) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var (
+		delta   Usage
+		applied []*writeOp
+		tracked = c.quota.tracksUsage()
+	)
+
+	err := c.engine.Update(func(txn Txn) error {
+		delta = Usage{}
+		applied = applied[:0]
+
+		// Size change of internal data (indexes, versions and position).
+		sizing := &sizingTxn{Txn: txn}
+		if tracked {
+			txn = sizing
+		}
+		defer func() { delta.Bytes += sizing.bytes }()
+
+		for _, op := range group {
+			if c.versions != nil && op.meta != nil {
+				if ok, err := c.versions.replicated(txn, op); err != nil {
+					return err
+				} else if !ok {
+					continue
+				}
+			}
+			applied = append(applied, op)
+
+			oldSize, err := txnEntrySize(txn, op.key)
+			if err != nil {
+				return err
+			}
+
+			newSize := int64(-1)
+			if !op.delete {
+				newSize = int64(len(op.key) + len(op.value))
+			}
+
+			change := usageDelta(oldSize, newSize)
+			delta.Keys += change.Keys
+			delta.Bytes += change.Bytes
+
+			if err := writeIndexed(txn, c.indexes, op); err != nil {
+				return err
+			}
+		}
+
+		if extra == nil {
+			return nil
+		}
+
+		return extra(txn)
+	})
+
+	c.cache.written(applied)
+	if err != nil {
+		c.usageKnown = false
+		return err
+	}
+
+	c.usage.Keys += delta.Keys
+	c.usage.Bytes += delta.Bytes
+	return nil
+}
+
+// Size of key and value stored under key (-1 if not present).
+func txnEntrySize(txn Reader, key []byte) (int64, error) {
+	value, err := txn.Get(key)
+	if err == ErrKeyNotFound {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(key) + len(value)), nil
+}
+
+// LogPosition returns position of the last write recorded in replication
+// log of the bucket. Zero position is returned if the log is disabled.
+func (b *Bucket) LogPosition() (LogPosition, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return LogPosition{}, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	return b.committer.position(), nil
+}
+
+// Position of replication log, known if the bucket was opened with the log
+// enabled.
+func (b *Bucket) logPosition() (LogPosition, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	position := b.closedPosition
+	if b.engine != nil {
+		position = b.committer.position()
+	}
+
+	return position, position.ID != 0
+}
+
+// LogPositions returns positions of replication logs by bucket name, for
+// buckets opened since the database was opened. Other buckets weren't
+// written since then.
+func (db *Database) LogPositions() map[string]LogPosition {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	positions := make(map[string]LogPosition)
+
+	for name, bucket := range db.buckets {
+		if position, ok := bucket.logPosition(); ok {
+			positions[name] = position
+		}
+	}
+
+	return positions
+}
+
+func (c *committer) position() LogPosition {
+	if !c.logged {
+		return LogPosition{}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return LogPosition{ID: c.logID, Version: c.version}
+}
+
+// ReadLog returns up to limit entries of replication log following given
+// position, together with position of the last logged write. Returns
+// ErrLogTruncated if the entries following the position are no longer
+// available (or the position belongs to another log).
+func (b *Bucket) ReadLog(after LogPosition, limit int) ([]LogEntry, LogPosition, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, LogPosition{}, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if !b.committer.logged {
+		return nil, LogPosition{}, fmt.Errorf("replication log of bucket '%s' is disabled", b.Name)
+	}
+
+	// Entries up to the current version are committed, later ones may be
+	// written concurrently.
+	current := b.committer.position()
+	if after.ID != current.ID || after.Version > current.Version {
+		return nil, current, ErrLogTruncated
+	}
+
+	var entries []LogEntry
+
+	if after.Version == current.Version {
+		return entries, current, nil
+	}
+
+	size := 0
+	next := after.Version + 1
+
+	err := b.engine.IterateFrom(replicationKey(logEntryTag, nil), logEntryKey(next), false, func(key, value []byte) error {
+		version := binary.BigEndian.Uint64(key[len(key)-8:])
+		if version != next {
+			return ErrLogTruncated
+		}
+
+		if version > current.Version || len(entries) >= limit || (size > 0 && size+len(value) > maxLogReadBytes) {
+			return errStopIteration
+		}
+
+		entry, err := decodeLogEntry(version, value)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, entry)
+		size += len(value)
+		next++
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, current, err
+	}
+
+	if len(entries) == 0 && limit > 0 {
+		return nil, current, ErrLogTruncated
+	}
+
+	return entries, current, nil
+}
+
+// ReadRange returns up to limit client keys (with values, and versions in
+// bucket with conflict policy) starting at given key, together with key to
+// continue with (nil after the last one).
+func (b *Bucket) ReadRange(start []byte, limit int) ([]LogEntry, []byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	var (
+		entries []LogEntry
+		next    []byte
+	)
+
+	size := 0
+
+	err := b.engine.IterateFrom(nil, start, false, func(key, value []byte) error {
+		if isInternalKey(key) {
+			return errStopIteration
+		}
+
+		if len(entries) >= limit || (size > 0 && size+len(key)+len(value) > maxLogReadBytes) {
+			next = append([]byte{}, key...)
+			return errStopIteration
+		}
+
+		entries = append(entries, LogEntry{
+			Key:   append([]byte(nil), key...),
+			Value: append([]byte{}, value...),
+		})
+		size += len(key) + len(value)
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, nil, err
+	}
+
+	if b.meta.Conflict != ConflictNone {
+		keys := make([][]byte, len(entries))
+		for i, entry := range entries {
+			keys[i] = entry.Key
+		}
+
+		versions, err := b.readVersions(keys)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i := range entries {
+			entries[i].Meta = versions[i]
+		}
+	}
+
+	return entries, next, nil
+}
+
+// HashRanges splits client keys accepted by filter (all if nil) into
+// consecutive ranges of up to size keys, returning the first key of each
+// range (nil for the first one) and hashes of keys and values (and
+// versions in bucket with conflict policy) of the ranges. Used to compare
+// contents of the bucket with peers.
+func (b *Bucket) HashRanges(size int, filter func(key []byte) bool) ([][]byte, [][]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	boundaries := [][]byte{nil}
+	leaves := []*merkle.Leaf{merkle.NewLeaf()}
+	count := 0
+
+	err := b.engine.View(func(txn Reader) error {
+		return txn.IterateFrom(nil, nil, false, func(key, value []byte) error {
+			if isInternalKey(key) {
+				return errStopIteration
+			}
+
+			if filter != nil && !filter(key) {
+				return nil
+			}
+
+			if count == size {
+				boundaries = append(boundaries, append([]byte(nil), key...))
+				leaves = append(leaves, merkle.NewLeaf())
+				count = 0
+			}
+
+			count++
+			return b.addLeaf(txn, leaves[len(leaves)-1], key, value)
+		})
+	})
+	if err != nil && err != errStopIteration {
+		return nil, nil, err
+	}
+
+	return boundaries, sumLeaves(leaves), nil
+}
+
+// RangeHashes returns hashes of keys and values (and versions) of ranges
+// starting at given boundaries (as returned by HashRanges), including only
+// client keys accepted by filter (all if nil).
+func (b *Bucket) RangeHashes(boundaries [][]byte, filter func(key []byte) bool) ([][]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if len(boundaries) == 0 {
+		return nil, nil
+	}
+
+	leaves := make([]*merkle.Leaf, len(boundaries))
+	for i := range leaves {
+		leaves[i] = merkle.NewLeaf()
+	}
+
+	current := 0
+
+	err := b.engine.View(func(txn Reader) error {
+		return txn.IterateFrom(nil, boundaries[0], false, func(key, value []byte) error {
+			if isInternalKey(key) {
+				return errStopIteration
+			}
+
+			for current+1 < len(boundaries) && bytes.Compare(key, boundaries[current+1]) >= 0 {
+				current++
+			}
+
+			if filter != nil && !filter(key) {
+				return nil
+			}
+
+			return b.addLeaf(txn, leaves[current], key, value)
+		})
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+
+	return sumLeaves(leaves), nil
+}
+
+// Add key with value to leaf, together with its version in bucket with
+// conflict policy.
+func (b *Bucket) addLeaf(txn Reader, leaf *merkle.Leaf, key, value []byte) error {
+	if b.meta.Conflict == ConflictNone {
+		leaf.Add(key, value)
+		return nil
+	}
+
+	version, err := txn.Get(versionKey(key))
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+
+	leaf.AddVersioned(key, value, version)
+	return nil
+}
+
+func sumLeaves(leaves []*merkle.Leaf) [][]byte {
+	sums := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		sums[i] = leaf.Sum()
+	}
+
+	return sums
+}
+
+// AppliedPosition returns position in replication log of origin (peer name)
+// up to which its writes were applied to the bucket, zero if none were.
+func (b *Bucket) AppliedPosition(origin string) (LogPosition, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return LogPosition{}, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	value, err := b.engine.Get(replicationKey(logAppliedTag, []byte(origin)))
+	if err == ErrKeyNotFound {
+		return LogPosition{}, nil
+	}
+	if err != nil {
+		return LogPosition{}, err
+	}
+
+	return decodePosition(value)
+}
+
+// ApplyReplicated applies writes of origin (peer name) pulled from its
+// replication log or copied from its data, and records given position of
+// its log (unless zero) as applied, so that pulling continues after it.
+// Entries with versions are merged with local versions of their keys.
+func (b *Bucket) ApplyReplicated(origin string, entries []LogEntry, applied LogPosition) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	group := make([]*writeOp, 0, len(entries))
+	for _, entry := range entries {
+		if isInternalKey(entry.Key) {
+			return errReservedKey
+		}
+
+		group = append(group, &writeOp{key: entry.Key, value: entry.Value, delete: entry.Delete, meta: entry.Meta})
+	}
+
+	var record func(txn Txn) error
+	if applied != (LogPosition{}) {
+		record = func(txn Txn) error {
+			return txn.Set(replicationKey(logAppliedTag, []byte(origin)), encodePosition(applied))
+		}
+	}
+
+	if err := b.committer.replicate(group, record); err != nil {
+		return err
+	}
+
+	if len(group) > 0 {
+		b.touch()
+	}
+	return nil
+}
+
+// Remove log entries except the latest keep ones. Returns number of removed
+// entries.
+func (b *Bucket) trimLog(keep uint64) (int, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return 0, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	current := b.committer.position()
+	if current.Version <= keep {
+		return 0, nil
+	}
+	last := current.Version - keep
+
+	var keys [][]byte
+
+	err := b.engine.Iterate(replicationKey(logEntryTag, nil), true, func(key, _ []byte) error {
+		if binary.BigEndian.Uint64(key[len(key)-8:]) > last {
+			return errStopIteration
+		}
+
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return 0, err
+	}
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	if err := b.committer.deleteInternal(keys); err != nil {
+		return 0, err
+	}
+
+	return len(keys), nil
+}
+
+// TrimReplicationLogs removes old entries from replication logs of opened
+// buckets, keeping the configured number of the latest ones. Closed buckets
+// aren't written, so their logs don't grow. Returns number of removed
+// entries.
+func (db *Database) TrimReplicationLogs() (int, error) {
+	if db.readOnly || db.replicationLogSize == 0 {
+		return 0, nil
+	}
+
+	removed := 0
+
+	for _, bucket := range db.acquireOpened() {
+		n, err := bucket.trimLog(db.replicationLogSize)
+		db.Release(bucket)
+
+		removed += n
+		if err != nil {
+			log.Error(fmt.Sprintf("trimming replication log of bucket '%s'", bucket.Name), err)
+		}
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,280 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/pepol/databuddy/internal/schema"
+)
+
+// Simple value types of bucket schema.
+const (
+	ValueTypeInt  = "int"
+	ValueTypeUTF8 = "utf8"
+	ValueTypeJSON = "json"
+)
+
+// Maximum number of invalid keys reported by schema validation.
+const maxReportedInvalidKeys = 10
+
+// ErrSchemaViolation is returned for writes not conforming to bucket schema.
+var ErrSchemaViolation = errors.New("schema violation")
+
+var errValidationInterrupted = errors.New("interrupted by bucket maintenance")
+
+// Schema constrains keys and values written to a bucket.
+type Schema struct {
+	// Simple type of values (ValueTypeInt, ValueTypeUTF8 or ValueTypeJSON).
+	ValueType string `json:"value_type,omitempty"`
+	// JSON Schema of values (implies ValueTypeJSON).
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+	// Regular expression keys must match.
+	KeyPattern string `json:"key_pattern,omitempty"`
+}
+
+// IsEmpty returns whether schema has no constraints.
+func (s Schema) IsEmpty() bool {
+	return s.ValueType == "" && len(s.JSONSchema) == 0 && s.KeyPattern == ""
+}
+
+// SchemaValidation describes validation of existing bucket data against the
+// bucket schema.
+type SchemaValidation struct {
+	Running  bool
+	Started  time.Time
+	Finished time.Time
+	Checked  uint64
+	Invalid  uint64
+	// First invalid keys found, up to maxReportedInvalidKeys.
+	InvalidKeys []string
+	// Error which stopped the validation, if any.
+	Error string
+}
+
+// validator checks writes against compiled schema. Nil validator accepts
+// everything.
+type validator struct {
+	valueType  string
+	jsonSchema *schema.Schema
+	keyPattern *regexp.Regexp
+}
+
+func compileSchema(s Schema) (*validator, error) {
+	if s.IsEmpty() {
+		return nil, nil
+	}
+
+	v := &validator{valueType: s.ValueType}
+
+	switch s.ValueType {
+	case "", ValueTypeInt, ValueTypeUTF8, ValueTypeJSON:
+	default:
+		return nil, fmt.Errorf("unknown value type '%s'", s.ValueType)
+	}
+
+	if len(s.JSONSchema) > 0 {
+		if s.ValueType != "" && s.ValueType != ValueTypeJSON {
+			return nil, fmt.Errorf("JSON schema cannot be combined with value type '%s'", s.ValueType)
+		}
+
+		var err error
+		if v.jsonSchema, err = schema.Compile(s.JSONSchema); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.KeyPattern != "" {
+		var err error
+		if v.keyPattern, err = regexp.Compile(s.KeyPattern); err != nil {
+			return nil, fmt.Errorf("compiling key pattern: %v", err)
+		}
+	}
+
+	return v, nil
+}
+
+func (v *validator) check(key, value []byte) error {
+	if v == nil {
+		return nil
+	}
+
+	if v.keyPattern != nil && !v.keyPattern.Match(key) {
+		return fmt.Errorf("%w: key does not match pattern '%s'", ErrSchemaViolation, v.keyPattern)
+	}
+
+	switch {
+	case v.jsonSchema != nil:
+		if err := v.jsonSchema.Validate(value); err != nil {
+			return fmt.Errorf("%w: %v", ErrSchemaViolation, err)
+		}
+	case v.valueType == ValueTypeInt:
+		if _, err := strconv.ParseInt(string(value), 10, 64); err != nil {
+			return fmt.Errorf("%w: value is not a 64-bit integer", ErrSchemaViolation)
+		}
+	case v.valueType == ValueTypeUTF8:
+		if !utf8.Valid(value) {
+			return fmt.Errorf("%w: value is not valid UTF-8", ErrSchemaViolation)
+		}
+	case v.valueType == ValueTypeJSON:
+		if !json.Valid(value) {
+			return fmt.Errorf("%w: value is not valid JSON", ErrSchemaViolation)
+		}
+	}
+
+	return nil
+}
+
+// SetSchema changes schema of bucket with given name. Empty schema removes
+// all constraints. Existing data is not checked, see ValidateSchema.
+func (db *Database) SetSchema(name string, s Schema) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	if _, err := compileSchema(s); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket, ok := db.buckets[name]
+	if !ok {
+		return fmt.Errorf("bucket '%s' not found", name)
+	}
+
+	meta := bucket.meta
+	meta.Schema = s
+
+	if err := db.system.Set(bucketKeyPrefix+name, meta.encode()); err != nil {
+		return err
+	}
+
+	bucket.setMeta(meta)
+	return nil
+}
+
+// ValidateSchema starts validation of all data of bucket with given name
+// against its schema in background. Progress and results are available
+// through Bucket.SchemaValidation.
+func (db *Database) ValidateSchema(name string) error {
+	bucket, err := db.Get(name)
+	if err != nil {
+		return err
+	}
+
+	if !bucket.startValidation() {
+		db.Release(bucket)
+		return fmt.Errorf("validation of bucket '%s' already running", name)
+	}
+
+	go func() {
+		defer db.Release(bucket)
+
+		bucket.validateData()
+	}()
+
+	return nil
+}
+
+// Schema returns schema of bucket.
+func (b *Bucket) Schema() Schema {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.meta.Schema
+}
+
+// SchemaValidation returns state of the last validation of bucket data.
+func (b *Bucket) SchemaValidation() SchemaValidation {
+	b.validationMutex.Lock()
+	defer b.validationMutex.Unlock()
+
+	validation := b.validation
+	validation.InvalidKeys = append([]string(nil), b.validation.InvalidKeys...)
+
+	return validation
+}
+
+func (b *Bucket) startValidation() bool {
+	b.validationMutex.Lock()
+	defer b.validationMutex.Unlock()
+
+	if b.validation.Running {
+		return false
+	}
+
+	b.validation = SchemaValidation{Running: true, Started: time.Now()}
+	return true
+}
+
+// Check all values against the schema. The scan holds the bucket opened, so
+// it is interrupted by anyone waiting for exclusive access to the bucket.
+func (b *Bucket) validateData() {
+	err := b.scanValidate()
+
+	b.validationMutex.Lock()
+	defer b.validationMutex.Unlock()
+
+	b.validation.Running = false
+	b.validation.Finished = time.Now()
+	if err != nil {
+		b.validation.Error = err.Error()
+	}
+
+	log.Info(fmt.Sprintf(
+		"validated bucket '%s': %d keys checked, %d invalid",
+		b.Name, b.validation.Checked, b.validation.Invalid,
+	))
+}
+
+func (b *Bucket) scanValidate() error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	validator := b.validator
+
+	snapshot := b.engine.Snapshot()
+	defer snapshot.Release()
+
+	err := snapshot.Iterate(nil, false, func(key, value []byte) error {
+		if isInternalKey(key) {
+			return errStopIteration
+		}
+
+		if atomic.LoadInt32(&b.exclusiveWaiters) > 0 {
+			return errValidationInterrupted
+		}
+
+		err := validator.check(key, value)
+
+		b.validationMutex.Lock()
+		defer b.validationMutex.Unlock()
+
+		b.validation.Checked++
+		if err != nil {
+			b.validation.Invalid++
+			if len(b.validation.InvalidKeys) < maxReportedInvalidKeys {
+				b.validation.InvalidKeys = append(b.validation.InvalidKeys, string(key))
+			}
+		}
+
+		return nil
+	})
+	if err == errStopIteration {
+		return nil
+	}
+
+	return err
+}
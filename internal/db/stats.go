@@ -0,0 +1,184 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/ristretto"
+)
+
+// BucketStats contains storage statistics of a single bucket.
+type BucketStats struct {
+	Name        string
+	Engine      string
+	Consistency string
+	Conflict    string
+	ReadOnly    bool
+
+	// Size of LSM tree and value log files (in bytes). With shared storage
+	// layout, LSM size is estimated from tables containing only keys of the
+	// bucket and value log size is not known. For in-memory buckets, LSM
+	// size is the total size of keys and values.
+	LSMSize  int64
+	VLogSize int64
+
+	// Approximate count of keys, summed from SST table indexes. Includes
+	// older versions and deletion markers not yet removed by compaction,
+	// and excludes keys still held in memtables. Exact for in-memory
+	// buckets.
+	Keys   uint64
+	Tables int
+	Levels []LevelStats
+
+	BlockCache CacheStats
+	IndexCache CacheStats
+	ValueCache CacheStats
+
+	LastWrite time.Time
+}
+
+// LevelStats contains statistics of a single LSM tree level.
+type LevelStats struct {
+	Level      int
+	Tables     int
+	Size       int64
+	TargetSize int64
+	Score      float64
+}
+
+// CacheStats contains metrics of a single cache.
+type CacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	KeysAdded   uint64
+	KeysEvicted uint64
+	CostAdded   uint64
+	CostEvicted uint64
+	HitRatio    float64
+}
+
+// Stats returns storage statistics of bucket.
+func (b *Bucket) Stats() (*BucketStats, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	stats := &BucketStats{
+		Name:        b.Name,
+		Engine:      b.meta.engine(),
+		Consistency: b.meta.consistency(),
+		Conflict:    b.meta.Conflict,
+		ReadOnly:    b.meta.ReadOnly || b.databaseReadOnly,
+		ValueCache:  b.cache.stats(),
+		LastWrite:   b.LastWrite(),
+	}
+
+	switch engine := b.engine.(type) {
+	case *badgerEngine:
+		engine.stats(stats)
+	case *memoryEngine:
+		stats.Keys, stats.LSMSize = engine.size()
+	}
+
+	return stats, nil
+}
+
+func (b *Bucket) valueCacheStats() CacheStats {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.cache.stats()
+}
+
+func (e *badgerEngine) stats(stats *BucketStats) {
+	stats.BlockCache = cacheStats(e.db.BlockCacheMetrics())
+	stats.IndexCache = cacheStats(e.db.IndexCacheMetrics())
+
+	tables := e.db.Tables()
+	levels := e.db.Levels()
+
+	if len(e.prefix) == 0 {
+		stats.LSMSize, stats.VLogSize = e.db.Size()
+	} else {
+		// Only count tables of the shared instance holding bucket keys.
+		tables = bucketTables(tables, e.prefix)
+
+		size, _ := e.db.EstimateSize(e.prefix)
+		stats.LSMSize = int64(size)
+	}
+
+	stats.Tables = len(tables)
+	for i := range tables {
+		stats.Keys += uint64(tables[i].KeyCount)
+	}
+
+	for _, level := range levels {
+		levelStats := LevelStats{
+			Level:      level.Level,
+			Tables:     level.NumTables,
+			Size:       level.Size,
+			TargetSize: level.TargetSize,
+			Score:      level.Score,
+		}
+
+		if len(e.prefix) > 0 {
+			levelStats.Tables, levelStats.Size = 0, 0
+			for i := range tables {
+				if tables[i].Level == level.Level {
+					levelStats.Tables++
+					levelStats.Size += int64(tables[i].OnDiskSize)
+				}
+			}
+		}
+
+		stats.Levels = append(stats.Levels, levelStats)
+	}
+}
+
+// Filter tables containing only keys with given prefix.
+func bucketTables(tables []badger.TableInfo, prefix []byte) []badger.TableInfo {
+	filtered := make([]badger.TableInfo, 0, len(tables))
+
+	for i := range tables {
+		if bytes.HasPrefix(tables[i].Left, prefix) && bytes.HasPrefix(tables[i].Right, prefix) {
+			filtered = append(filtered, tables[i])
+		}
+	}
+
+	return filtered
+}
+
+func cacheStats(metrics *ristretto.Metrics) CacheStats {
+	// All ristretto.Metrics getters are safe to call on nil (disabled cache).
+	return CacheStats{
+		Hits:        metrics.Hits(),
+		Misses:      metrics.Misses(),
+		KeysAdded:   metrics.KeysAdded(),
+		KeysEvicted: metrics.KeysEvicted(),
+		CostAdded:   metrics.CostAdded(),
+		CostEvicted: metrics.CostEvicted(),
+		HitRatio:    metrics.Ratio(),
+	}
+}
+
+func addCacheStats(a, b CacheStats) CacheStats {
+	sum := CacheStats{
+		Hits:        a.Hits + b.Hits,
+		Misses:      a.Misses + b.Misses,
+		KeysAdded:   a.KeysAdded + b.KeysAdded,
+		KeysEvicted: a.KeysEvicted + b.KeysEvicted,
+		CostAdded:   a.CostAdded + b.CostAdded,
+		CostEvicted: a.CostEvicted + b.CostEvicted,
+	}
+
+	if sum.Hits+sum.Misses > 0 {
+		sum.HitRatio = float64(sum.Hits) / float64(sum.Hits+sum.Misses)
+	}
+
+	return sum
+}
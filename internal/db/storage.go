@@ -0,0 +1,502 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Storage layouts decide where data of buckets is kept:
+//
+//   - LayoutDir keeps every bucket in its own Badger instance in
+//     "buckets/<name>" directory.
+//   - LayoutShared keeps all buckets in one Badger instance in "shared"
+//     directory, with keys of each bucket prefixed by its compact ID.
+//
+// The system bucket is always kept in its own Badger instance. Layout is
+// chosen on initialization and stored in the system bucket.
+const (
+	LayoutDir    = "dir"
+	LayoutShared = "shared"
+
+	layoutKey       = "system:layout"
+	nextBucketIDKey = "system:nextbucketid"
+	sharedDirName   = "shared"
+)
+
+// storage implements one storage layout.
+type storage interface {
+	// Layout name.
+	layout() string
+
+	// Open engine containing data of bucket.
+	open(name string, meta bucketMeta) (Engine, error)
+	// Close engine returned by open.
+	close(engine Engine) error
+
+	// Prepare storage for new bucket, filling layout-specific metadata.
+	create(name string, meta *bucketMeta) error
+	// Check whether storage contains data for bucket with given name,
+	// which would conflict with creating a new bucket of that name.
+	occupied(name string) (bool, error)
+
+	// Move data of closed bucket under new name.
+	rename(oldName, newName string, meta bucketMeta) error
+	// Check whether data was moved by interrupted rename.
+	renamed(oldName, newName string, meta bucketMeta) (bool, error)
+
+	// Copy data of source bucket into new bucket. Copy is not visible
+	// under the new name (as per occupied) until complete.
+	copy(src *Bucket, dstName string, dstMeta bucketMeta) error
+	// Clean up after interrupted copy, returning whether it was complete.
+	recoverCopy(dstName string, dstMeta bucketMeta) (bool, error)
+
+	// Remove all data of bucket.
+	remove(name string, meta bucketMeta) error
+
+	// Release all resources held by storage.
+	shutdown() error
+}
+
+// Open storage of given layout.
+func openStorage(layout, datadir string, system *Bucket, readOnly bool) (storage, error) {
+	switch layout {
+	case LayoutDir:
+		return &dirStorage{datadir: datadir, readOnly: readOnly}, nil
+	case LayoutShared:
+		path, err := filepath.Abs(filepath.Join(datadir, sharedDirName))
+		if err != nil {
+			return nil, err
+		}
+
+		db, err := openBadger(path, readOnly)
+		if err != nil {
+			return nil, err
+		}
+
+		return &sharedStorage{system: system, db: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage layout '%s'", layout)
+	}
+}
+
+// Read storage layout stored in the system bucket.
+func storageLayout(system *Bucket) (string, error) {
+	layout, err := system.Get(layoutKey)
+	if err == ErrKeyNotFound {
+		return LayoutDir, nil // Databases created before layouts existed.
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return string(layout), nil
+}
+
+func openBadger(path string, readOnly bool) (*badger.DB, error) {
+	logger := log.GetBadgerLogger()
+
+	opt := badger.DefaultOptions(path).
+		WithCompactL0OnClose(true).
+		WithMetricsEnabled(true).
+		WithReadOnly(readOnly).
+		WithLogger(logger)
+
+	return badger.Open(opt)
+}
+
+// dirStorage keeps every bucket in its own Badger instance.
+type dirStorage struct {
+	datadir  string
+	readOnly bool
+}
+
+func (s *dirStorage) layout() string {
+	return LayoutDir
+}
+
+func (s *dirStorage) open(name string, _ bucketMeta) (Engine, error) {
+	path, err := bucketPath(s.datadir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openBadger(path, s.readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBadgerEngine(db, nil), nil
+}
+
+func (s *dirStorage) close(engine Engine) error {
+	return engine.Close()
+}
+
+func (s *dirStorage) create(_ string, _ *bucketMeta) error {
+	return nil
+}
+
+func (s *dirStorage) occupied(name string) (bool, error) {
+	return bucketDirExists(s.datadir, name)
+}
+
+func (s *dirStorage) rename(oldName, newName string, _ bucketMeta) error {
+	oldPath, err := bucketPath(s.datadir, oldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := bucketPath(s.datadir, newName)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(oldPath, newPath)
+}
+
+func (s *dirStorage) renamed(oldName, newName string, _ bucketMeta) (bool, error) {
+	oldExists, err := bucketDirExists(s.datadir, oldName)
+	if err != nil {
+		return false, err
+	}
+
+	newExists, err := bucketDirExists(s.datadir, newName)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case oldExists && !newExists:
+		return false, nil
+	case !oldExists && newExists:
+		return true, nil
+	default:
+		return false, fmt.Errorf("inconsistent directories for '%s' and '%s'", oldName, newName)
+	}
+}
+
+// Data is copied into temporary directory first, so that the destination
+// directory only exists once the copy is complete.
+func (s *dirStorage) copy(src *Bucket, dstName string, _ bucketMeta) error {
+	tmpPath, err := bucketPath(s.datadir, cloneTmpPrefix+dstName)
+	if err != nil {
+		return err
+	}
+
+	dstPath, err := bucketPath(s.datadir, dstName)
+	if err != nil {
+		return err
+	}
+
+	if err := s.copyToPath(src, tmpPath); err != nil {
+		if rmErr := os.RemoveAll(tmpPath); rmErr != nil {
+			log.Error(fmt.Sprintf("removing partial copy of bucket '%s'", dstName), rmErr)
+		}
+		return err
+	}
+
+	return os.Rename(tmpPath, dstPath)
+}
+
+func (s *dirStorage) copyToPath(src *Bucket, path string) error {
+	dst, err := openBadger(path, false)
+	if err != nil {
+		return err
+	}
+
+	if err := src.copyTo(newBadgerEngine(dst, nil)); err != nil {
+		if closeErr := dst.Close(); closeErr != nil {
+			log.Error(fmt.Sprintf("closing '%s'", path), closeErr)
+		}
+		return err
+	}
+
+	return dst.Close()
+}
+
+func (s *dirStorage) recoverCopy(dstName string, _ bucketMeta) (bool, error) {
+	tmpPath, err := bucketPath(s.datadir, cloneTmpPrefix+dstName)
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return false, err
+	}
+
+	return bucketDirExists(s.datadir, dstName)
+}
+
+func (s *dirStorage) remove(name string, _ bucketMeta) error {
+	path, err := bucketPath(s.datadir, name)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(path)
+}
+
+func (s *dirStorage) shutdown() error {
+	return nil
+}
+
+// sharedStorage keeps all buckets in one Badger instance.
+type sharedStorage struct {
+	system *Bucket
+	db     *badger.DB
+}
+
+func (s *sharedStorage) layout() string {
+	return LayoutShared
+}
+
+func (s *sharedStorage) open(_ string, meta bucketMeta) (Engine, error) {
+	if meta.ID == 0 {
+		return nil, fmt.Errorf("bucket has no ID assigned")
+	}
+
+	return newBadgerEngine(s.db, bucketIDPrefix(meta.ID)), nil
+}
+
+func (s *sharedStorage) close(_ Engine) error {
+	return nil // Shared instance is closed on shutdown.
+}
+
+// Assign new unique ID to the bucket. IDs are never reused, so leftovers of
+// interrupted operations can never become visible in another bucket.
+func (s *sharedStorage) create(_ string, meta *bucketMeta) error {
+	return s.system.update(func(txn Txn) error {
+		id := uint64(1)
+
+		value, err := txn.Get([]byte(nextBucketIDKey))
+		switch {
+		case err == ErrKeyNotFound:
+		case err != nil:
+			return err
+		default:
+			id = binary.BigEndian.Uint64(value)
+		}
+
+		next := make([]byte, 8) //nolint:gomnd // Size of uint64.
+		binary.BigEndian.PutUint64(next, id+1)
+
+		meta.ID = id
+		return txn.Set([]byte(nextBucketIDKey), next)
+	})
+}
+
+func (s *sharedStorage) occupied(_ string) (bool, error) {
+	return false, nil // Data is addressed by ID, not by name.
+}
+
+func (s *sharedStorage) rename(_, _ string, _ bucketMeta) error {
+	return nil // Data is addressed by ID, not by name.
+}
+
+func (s *sharedStorage) renamed(_, _ string, _ bucketMeta) (bool, error) {
+	return false, nil // Renames are finished by the registry update only.
+}
+
+func (s *sharedStorage) copy(src *Bucket, _ string, dstMeta bucketMeta) error {
+	return src.copyTo(newBadgerEngine(s.db, bucketIDPrefix(dstMeta.ID)))
+}
+
+// Copy becomes visible only with the registry update, so interrupted copy
+// is always discarded.
+func (s *sharedStorage) recoverCopy(_ string, dstMeta bucketMeta) (bool, error) {
+	return false, s.remove("", dstMeta)
+}
+
+func (s *sharedStorage) remove(_ string, meta bucketMeta) error {
+	if meta.ID == 0 {
+		return fmt.Errorf("bucket has no ID assigned")
+	}
+
+	return badgerDeletePrefix(s.db, bucketIDPrefix(meta.ID))
+}
+
+func (s *sharedStorage) shutdown() error {
+	return s.db.Close()
+}
+
+// Key prefix of bucket in shared layout. Varint encoding is compact and
+// no encoded ID is a prefix of another one.
+func bucketIDPrefix(id uint64) []byte {
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, id)
+
+	return prefix[:n]
+}
+
+// memoryStorage keeps engines of in-memory buckets, so that their data
+// survives closing of the bucket (until the bucket is purged or the process
+// exits).
+type memoryStorage struct {
+	mutex   sync.Mutex
+	engines map[string]*memoryEngine
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{engines: make(map[string]*memoryEngine)}
+}
+
+func (s *memoryStorage) layout() string {
+	return EngineMemory
+}
+
+func (s *memoryStorage) open(name string, _ bucketMeta) (Engine, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	engine, ok := s.engines[name]
+	if !ok {
+		engine = newMemoryEngine()
+		s.engines[name] = engine
+	}
+
+	return engine, nil
+}
+
+func (s *memoryStorage) close(_ Engine) error {
+	return nil // Data is kept until removed.
+}
+
+func (s *memoryStorage) create(name string, _ *bucketMeta) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.engines[name] = newMemoryEngine()
+	return nil
+}
+
+func (s *memoryStorage) occupied(_ string) (bool, error) {
+	return false, nil // Leftovers are replaced by create.
+}
+
+func (s *memoryStorage) rename(oldName, newName string, _ bucketMeta) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if engine, ok := s.engines[oldName]; ok {
+		s.engines[newName] = engine
+		delete(s.engines, oldName)
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) renamed(_, _ string, _ bucketMeta) (bool, error) {
+	return false, nil // Nothing survives restart.
+}
+
+func (s *memoryStorage) copy(src *Bucket, dstName string, _ bucketMeta) error {
+	dst := newMemoryEngine()
+	if err := src.copyTo(dst); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.engines[dstName] = dst
+	return nil
+}
+
+func (s *memoryStorage) recoverCopy(_ string, _ bucketMeta) (bool, error) {
+	return false, nil // Nothing survives restart.
+}
+
+func (s *memoryStorage) remove(name string, _ bucketMeta) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.engines, name)
+	return nil
+}
+
+func (s *memoryStorage) shutdown() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.engines = make(map[string]*memoryEngine)
+	return nil
+}
+
+// engineStorage dispatches buckets to storage of their engine: in-memory
+// buckets to memory storage, all other to storage of the database layout.
+type engineStorage struct {
+	disk   storage
+	memory *memoryStorage
+}
+
+func newEngineStorage(disk storage) *engineStorage {
+	return &engineStorage{disk: disk, memory: newMemoryStorage()}
+}
+
+func (s *engineStorage) of(meta bucketMeta) storage {
+	if meta.Engine == EngineMemory {
+		return s.memory
+	}
+
+	return s.disk
+}
+
+func (s *engineStorage) layout() string {
+	return s.disk.layout()
+}
+
+func (s *engineStorage) open(name string, meta bucketMeta) (Engine, error) {
+	return s.of(meta).open(name, meta)
+}
+
+func (s *engineStorage) close(engine Engine) error {
+	if _, ok := engine.(*memoryEngine); ok {
+		return s.memory.close(engine)
+	}
+
+	return s.disk.close(engine)
+}
+
+func (s *engineStorage) create(name string, meta *bucketMeta) error {
+	return s.of(*meta).create(name, meta)
+}
+
+// Only data on disk can conflict, as memory storage replaces leftovers on
+// create.
+func (s *engineStorage) occupied(name string) (bool, error) {
+	return s.disk.occupied(name)
+}
+
+func (s *engineStorage) rename(oldName, newName string, meta bucketMeta) error {
+	return s.of(meta).rename(oldName, newName, meta)
+}
+
+func (s *engineStorage) renamed(oldName, newName string, meta bucketMeta) (bool, error) {
+	return s.of(meta).renamed(oldName, newName, meta)
+}
+
+func (s *engineStorage) copy(src *Bucket, dstName string, dstMeta bucketMeta) error {
+	return s.of(dstMeta).copy(src, dstName, dstMeta)
+}
+
+func (s *engineStorage) recoverCopy(dstName string, dstMeta bucketMeta) (bool, error) {
+	return s.of(dstMeta).recoverCopy(dstName, dstMeta)
+}
+
+func (s *engineStorage) remove(name string, meta bucketMeta) error {
+	return s.of(meta).remove(name, meta)
+}
+
+func (s *engineStorage) shutdown() error {
+	if err := s.memory.shutdown(); err != nil {
+		return err
+	}
+
+	return s.disk.shutdown()
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Full-text query syntax:
+//
+//	query  = or
+//	or     = and { "OR" and }
+//	and    = unary { [ "AND" ] unary }
+//	unary  = ( "NOT" | "-" ) unary | "(" or ")" | '"' words '"' | word
+//
+// Words are tokenized the same way as indexed text, so a single query word
+// might result in a phrase ("e-mail").
+
+// Query node operations.
+const (
+	queryPhrase = iota
+	queryAnd
+	queryOr
+	queryNot
+)
+
+type queryNode struct {
+	op       int
+	words    []string
+	children []*queryNode
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+// Parse full-text query.
+func parseQuery(query string) (*queryNode, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens}
+
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos].text)
+	}
+
+	return node, nil
+}
+
+func lexQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, queryToken{text: string(r)})
+			i++
+		case r == '-' && (i == 0 || unicode.IsSpace(runes[i-1]) || runes[i-1] == '('):
+			tokens = append(tokens, queryToken{text: "-"})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated phrase")
+			}
+
+			tokens = append(tokens, queryToken{text: string(runes[i+1 : end]), quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`()"`, runes[end]) {
+				end++
+			}
+
+			tokens = append(tokens, queryToken{text: string(runes[i:end])})
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+
+	return p.tokens[p.pos], true
+}
+
+func (p *queryParser) isOperator(text string) bool {
+	token, ok := p.peek()
+	return ok && !token.quoted && token.text == text
+}
+
+func (p *queryParser) or() (*queryNode, error) {
+	node, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*queryNode{node}
+	for p.isOperator("OR") {
+		p.pos++
+
+		node, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+
+	return &queryNode{op: queryOr, children: children}, nil
+}
+
+func (p *queryParser) and() (*queryNode, error) {
+	var children []*queryNode
+
+	for {
+		if p.isOperator("AND") {
+			if len(children) == 0 {
+				return nil, fmt.Errorf("unexpected 'AND'")
+			}
+			p.pos++
+		} else if _, ok := p.peek(); !ok || p.isOperator("OR") || p.isOperator(")") {
+			break
+		}
+
+		node, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			children = append(children, node)
+		}
+	}
+
+	switch len(children) {
+	case 0:
+		return nil, fmt.Errorf("empty query")
+	case 1:
+		return children[0], nil
+	default:
+		return &queryNode{op: queryAnd, children: children}, nil
+	}
+}
+
+// Parse unary expression, nil if it contains no words.
+func (p *queryParser) unary() (*queryNode, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	p.pos++
+
+	if token.quoted {
+		return phraseNode(token.text), nil
+	}
+
+	switch token.text {
+	case "NOT", "-":
+		node, err := p.unary()
+		if err != nil || node == nil {
+			return nil, err
+		}
+		return &queryNode{op: queryNot, children: []*queryNode{node}}, nil
+	case "(":
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOperator(")") {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return node, nil
+	case ")", "AND", "OR":
+		return nil, fmt.Errorf("unexpected '%s'", token.text)
+	default:
+		return phraseNode(token.text), nil
+	}
+}
+
+// Phrase of words of text, nil if there are none.
+func phraseNode(text string) *queryNode {
+	words := tokenize(text)
+	if len(words) == 0 {
+		return nil
+	}
+
+	return &queryNode{op: queryPhrase, words: words}
+}
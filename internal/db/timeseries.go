@@ -0,0 +1,791 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Time series are sequences of samples stored in bucket separately from its
+// values, under internal keys:
+//
+//	0xff 't' 'n'                              last assigned series ID
+//	0xff 't' 'm' <series key>                 series metadata (JSON)
+//	0xff 't' 'c' <series ID> <start>          chunk of samples
+//
+// Series ID and chunk start (timestamp of the first sample when the chunk
+// was created) are big-endian, start with flipped sign bit, so that chunks
+// of series are ordered by time. Compaction rules aggregate samples of
+// source series into time buckets stored as samples of destination series.
+// Retention is enforced relative to the latest sample of series: older
+// samples are hidden from reads and removed by TrimTimeSeries.
+const tsKeyTag = 't'
+
+const (
+	tsLastIDTag = 'n'
+	tsMetaTag   = 'm'
+	tsChunkTag  = 'c'
+)
+
+// Aggregation types.
+const (
+	AggregationAvg   = "avg"
+	AggregationMin   = "min"
+	AggregationMax   = "max"
+	AggregationSum   = "sum"
+	AggregationCount = "count"
+)
+
+var errSeriesNotFound = errors.New("time series not found")
+
+// TimeSeries contains options of time series.
+type TimeSeries struct {
+	// Samples older than Retention milliseconds before the latest sample
+	// are removed, zero keeps all samples.
+	Retention int64             `json:"retention,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// Aggregation of samples within time buckets of given duration (in
+// milliseconds), aligned to Unix epoch.
+type Aggregation struct {
+	Type     string `json:"type"`
+	Duration int64  `json:"duration"`
+}
+
+// TimeSeriesRule is a compaction rule writing aggregated samples of series
+// into destination series.
+type TimeSeriesRule struct {
+	Dest        string      `json:"dest"`
+	Aggregation Aggregation `json:"aggregation"`
+}
+
+// TimeSeriesInfo describes time series.
+type TimeSeriesInfo struct {
+	TimeSeries
+	Key   string
+	Rules []TimeSeriesRule
+	// Series compacted into this one, if any.
+	Source  string
+	Samples uint64
+	Chunks  int
+	// Timestamps of the first and the last stored sample.
+	First, Last int64
+}
+
+type seriesMeta struct {
+	ID uint64 `json:"id"`
+	TimeSeries
+	Rules  []TimeSeriesRule `json:"rules,omitempty"`
+	Source string           `json:"source,omitempty"`
+	// Start of the last chunk, nil if there are no samples.
+	LastChunk *int64 `json:"last_chunk,omitempty"`
+}
+
+func tsKey(tag byte, key []byte) []byte {
+	return append([]byte{internalKeyPrefix, tsKeyTag, tag}, key...)
+}
+
+func tsChunkPrefix(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(tsKey(tsChunkTag, nil), id)
+}
+
+func tsChunkKey(id uint64, start int64) []byte {
+	return binary.BigEndian.AppendUint64(tsChunkPrefix(id), uint64(start)^(1<<63))
+}
+
+func tsChunkStart(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[len(key)-8:]) ^ (1 << 63))
+}
+
+func validAggregation(aggregation Aggregation) error {
+	switch aggregation.Type {
+	case AggregationAvg, AggregationMin, AggregationMax, AggregationSum, AggregationCount:
+	default:
+		return fmt.Errorf("unknown aggregation '%s'", aggregation.Type)
+	}
+
+	if aggregation.Duration <= 0 {
+		return fmt.Errorf("aggregation duration must be positive")
+	}
+
+	return nil
+}
+
+func getSeries(r Reader, key string) (*seriesMeta, error) {
+	value, err := r.Get(tsKey(tsMetaTag, []byte(key)))
+	if err == ErrKeyNotFound {
+		return nil, fmt.Errorf("%w: '%s'", errSeriesNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta seriesMeta
+	if err := json.Unmarshal(value, &meta); err != nil {
+		return nil, fmt.Errorf("time series '%s': %v", key, err)
+	}
+
+	return &meta, nil
+}
+
+func putSeries(txn Txn, key string, meta *seriesMeta) error {
+	// Marshalling struct of plain fields cannot fail.
+	value, _ := json.Marshal(meta)
+	return txn.Set(tsKey(tsMetaTag, []byte(key)), value)
+}
+
+func createSeries(txn Txn, key string, options TimeSeries) (*seriesMeta, error) {
+	if key == "" {
+		return nil, fmt.Errorf("empty time series key")
+	}
+
+	if options.Retention < 0 {
+		return nil, fmt.Errorf("retention must not be negative")
+	}
+
+	var id uint64
+
+	value, err := txn.Get(tsKey(tsLastIDTag, nil))
+	switch {
+	case err == nil:
+		id, _ = binary.Uvarint(value)
+	case err != ErrKeyNotFound:
+		return nil, err
+	}
+
+	id++
+	if err := txn.Set(tsKey(tsLastIDTag, nil), binary.AppendUvarint(nil, id)); err != nil {
+		return nil, err
+	}
+
+	meta := &seriesMeta{ID: id, TimeSeries: options}
+	return meta, putSeries(txn, key, meta)
+}
+
+func loadChunk(r Reader, id uint64, start int64) ([]Sample, error) {
+	value, err := r.Get(tsChunkKey(id, start))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeChunk(value)
+}
+
+// Start of the chunk where sample with given timestamp belongs: the last
+// one starting at or before it, or the first one if there is none.
+func findChunk(r Reader, meta *seriesMeta, timestamp int64) (int64, error) {
+	if timestamp >= *meta.LastChunk {
+		return *meta.LastChunk, nil
+	}
+
+	prefix := tsChunkPrefix(meta.ID)
+	found, first := *meta.LastChunk, true
+
+	err := r.Iterate(prefix, true, func(key, _ []byte) error {
+		start := tsChunkStart(key)
+		if start > timestamp && !first {
+			return errStopIteration
+		}
+
+		found, first = start, false
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return 0, err
+	}
+
+	return found, nil
+}
+
+// Store sample, replacing sample with the same timestamp. Metadata of series
+// is updated if it changes.
+func insertSample(txn Txn, key string, meta *seriesMeta, sample Sample) error {
+	if meta.LastChunk == nil {
+		start := sample.Timestamp
+		meta.LastChunk = &start
+
+		if err := txn.Set(tsChunkKey(meta.ID, start), encodeChunk([]Sample{sample})); err != nil {
+			return err
+		}
+		return putSeries(txn, key, meta)
+	}
+
+	start, err := findChunk(txn, meta, sample.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	samples, err := loadChunk(txn, meta.ID, start)
+	if err != nil {
+		return err
+	}
+
+	i := sort.Search(len(samples), func(i int) bool {
+		return samples[i].Timestamp >= sample.Timestamp
+	})
+
+	if i < len(samples) && samples[i].Timestamp == sample.Timestamp {
+		samples[i] = sample
+		return txn.Set(tsChunkKey(meta.ID, start), encodeChunk(samples))
+	}
+
+	samples = append(samples, Sample{})
+	copy(samples[i+1:], samples[i:])
+	samples[i] = sample
+
+	last := start == *meta.LastChunk
+
+	if sample.Timestamp < start {
+		// Sample precedes all chunks, the first one is moved.
+		if err := txn.Delete(tsChunkKey(meta.ID, start)); err != nil {
+			return err
+		}
+		start = sample.Timestamp
+	}
+
+	var next []Sample
+
+	if len(samples) > tsChunkSize {
+		split := len(samples) / 2
+		if i == len(samples)-1 {
+			split = i // Appended sample starts a new chunk.
+		}
+
+		samples, next = samples[:split], samples[split:]
+	}
+
+	if err := txn.Set(tsChunkKey(meta.ID, start), encodeChunk(samples)); err != nil {
+		return err
+	}
+
+	if next != nil {
+		if err := txn.Set(tsChunkKey(meta.ID, next[0].Timestamp), encodeChunk(next)); err != nil {
+			return err
+		}
+	}
+
+	if !last {
+		return nil
+	}
+
+	if next != nil {
+		start = next[0].Timestamp
+	}
+
+	if start != *meta.LastChunk {
+		meta.LastChunk = &start
+		return putSeries(txn, key, meta)
+	}
+
+	return nil
+}
+
+// Timestamp of the latest sample of series.
+func lastTimestamp(r Reader, meta *seriesMeta) (int64, bool, error) {
+	if meta.LastChunk == nil {
+		return 0, false, nil
+	}
+
+	samples, err := loadChunk(r, meta.ID, *meta.LastChunk)
+	if err != nil || len(samples) == 0 {
+		return 0, false, err
+	}
+
+	return samples[len(samples)-1].Timestamp, true, nil
+}
+
+// Samples of series with timestamps between from and to (inclusive).
+func readSamples(r Reader, meta *seriesMeta, from, to int64) ([]Sample, error) {
+	if meta.LastChunk == nil || from > to {
+		return []Sample{}, nil
+	}
+
+	start, err := findChunk(r, meta, from)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := tsChunkPrefix(meta.ID)
+	samples := []Sample{}
+
+	err = r.IterateFrom(prefix, tsChunkKey(meta.ID, start), false, func(key, value []byte) error {
+		if tsChunkStart(key) > to {
+			return errStopIteration
+		}
+
+		chunk, err := decodeChunk(value)
+		if err != nil {
+			return err
+		}
+
+		for _, sample := range chunk {
+			if sample.Timestamp > to {
+				return errStopIteration
+			}
+			if sample.Timestamp >= from {
+				samples = append(samples, sample)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
+// Start of time bucket of given duration containing timestamp.
+func bucketStart(timestamp, duration int64) int64 {
+	start := timestamp - timestamp%duration
+	if timestamp < 0 && timestamp%duration != 0 {
+		start -= duration
+	}
+
+	return start
+}
+
+func aggregate(samples []Sample, kind string) float64 {
+	result := samples[0].Value
+
+	switch kind {
+	case AggregationCount:
+		return float64(len(samples))
+	case AggregationMin:
+		for _, sample := range samples[1:] {
+			result = math.Min(result, sample.Value)
+		}
+	case AggregationMax:
+		for _, sample := range samples[1:] {
+			result = math.Max(result, sample.Value)
+		}
+	default:
+		for _, sample := range samples[1:] {
+			result += sample.Value
+		}
+
+		if kind == AggregationAvg {
+			result /= float64(len(samples))
+		}
+	}
+
+	return result
+}
+
+// Aggregate samples ordered by time into time buckets.
+func aggregateSamples(samples []Sample, aggregation Aggregation) []Sample {
+	aggregated := []Sample{}
+
+	for i := 0; i < len(samples); {
+		start := bucketStart(samples[i].Timestamp, aggregation.Duration)
+
+		j := i
+		for j < len(samples) && samples[j].Timestamp < start+aggregation.Duration {
+			j++
+		}
+
+		aggregated = append(aggregated, Sample{Timestamp: start, Value: aggregate(samples[i:j], aggregation.Type)})
+		i = j
+	}
+
+	return aggregated
+}
+
+// Store sample into series and update time buckets of its compaction rules.
+func addSample(txn Txn, key string, meta *seriesMeta, sample Sample) error {
+	if err := insertSample(txn, key, meta, sample); err != nil {
+		return err
+	}
+
+	for _, rule := range meta.Rules {
+		start := bucketStart(sample.Timestamp, rule.Aggregation.Duration)
+
+		samples, err := readSamples(txn, meta, start, start+rule.Aggregation.Duration-1)
+		if err != nil {
+			return err
+		}
+
+		dest, err := getSeries(txn, rule.Dest)
+		if err != nil {
+			return err
+		}
+
+		compacted := Sample{Timestamp: start, Value: aggregate(samples, rule.Aggregation.Type)}
+		if err := insertSample(txn, rule.Dest, dest, compacted); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove samples of series outside its retention. Returns number of removed
+// samples.
+func trimSeries(txn Txn, meta *seriesMeta) (int, error) {
+	last, ok, err := lastTimestamp(txn, meta)
+	if err != nil || !ok || meta.Retention == 0 {
+		return 0, err
+	}
+
+	cutoff := last - meta.Retention
+
+	var (
+		removed int
+		expired [][]byte // Chunks with all samples outside retention.
+		trimmed []byte   // Key of chunk with some samples outside retention.
+		kept    []Sample
+	)
+
+	err = txn.Iterate(tsChunkPrefix(meta.ID), false, func(key, value []byte) error {
+		samples, err := decodeChunk(value)
+		if err != nil {
+			return err
+		}
+
+		i := sort.Search(len(samples), func(i int) bool {
+			return samples[i].Timestamp >= cutoff
+		})
+
+		removed += i
+
+		if i == len(samples) {
+			expired = append(expired, append([]byte(nil), key...))
+			return nil
+		}
+
+		if i > 0 {
+			trimmed, kept = append([]byte(nil), key...), samples[i:]
+		}
+		return errStopIteration
+	})
+	if err != nil && err != errStopIteration {
+		return 0, err
+	}
+
+	for _, key := range expired {
+		if err := txn.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+
+	if trimmed != nil {
+		if err := txn.Set(trimmed, encodeChunk(kept)); err != nil {
+			return 0, err
+		}
+	}
+
+	return removed, nil
+}
+
+// CreateTimeSeries creates empty time series with given key.
+func (b *Bucket) CreateTimeSeries(key string, options TimeSeries) error {
+	return b.updateSeries(func(txn Txn) error {
+		if _, err := getSeries(txn, key); !errors.Is(err, errSeriesNotFound) {
+			if err == nil {
+				return fmt.Errorf("time series '%s' already exists", key)
+			}
+			return err
+		}
+
+		_, err := createSeries(txn, key, options)
+		return err
+	})
+}
+
+// AddSample stores sample into time series, replacing sample with the same
+// timestamp. Missing series is created with given options, unless they are
+// nil.
+func (b *Bucket) AddSample(key string, sample Sample, create *TimeSeries) error {
+	if math.IsNaN(sample.Value) {
+		return fmt.Errorf("value is not a number")
+	}
+
+	return b.updateSeries(func(txn Txn) error {
+		meta, err := getSeries(txn, key)
+		if errors.Is(err, errSeriesNotFound) && create != nil {
+			meta, err = createSeries(txn, key, *create)
+		}
+		if err != nil {
+			return err
+		}
+
+		return addSample(txn, key, meta, sample)
+	})
+}
+
+// CreateTimeSeriesRule creates compaction rule aggregating samples written
+// to source series into destination series. Existing samples are not
+// compacted. Destination of a rule can be neither source nor destination of
+// another one.
+func (b *Bucket) CreateTimeSeriesRule(source, dest string, aggregation Aggregation) error {
+	if err := validAggregation(aggregation); err != nil {
+		return err
+	}
+
+	if source == dest {
+		return fmt.Errorf("source and destination must differ")
+	}
+
+	return b.updateSeries(func(txn Txn) error {
+		sourceMeta, err := getSeries(txn, source)
+		if err != nil {
+			return err
+		}
+
+		destMeta, err := getSeries(txn, dest)
+		if err != nil {
+			return err
+		}
+
+		if sourceMeta.Source != "" {
+			return fmt.Errorf("source '%s' is destination of compaction rule", source)
+		}
+
+		if destMeta.Source != "" || len(destMeta.Rules) > 0 {
+			return fmt.Errorf("destination '%s' already has compaction rule", dest)
+		}
+
+		sourceMeta.Rules = append(sourceMeta.Rules, TimeSeriesRule{Dest: dest, Aggregation: aggregation})
+		destMeta.Source = source
+
+		if err := putSeries(txn, source, sourceMeta); err != nil {
+			return err
+		}
+
+		return putSeries(txn, dest, destMeta)
+	})
+}
+
+// DeleteTimeSeriesRule removes compaction rule from source to destination
+// series, keeping already compacted samples.
+func (b *Bucket) DeleteTimeSeriesRule(source, dest string) error {
+	return b.updateSeries(func(txn Txn) error {
+		sourceMeta, err := getSeries(txn, source)
+		if err != nil {
+			return err
+		}
+
+		rules := sourceMeta.Rules[:0:0]
+		for _, rule := range sourceMeta.Rules {
+			if rule.Dest != dest {
+				rules = append(rules, rule)
+			}
+		}
+
+		if len(rules) == len(sourceMeta.Rules) {
+			return fmt.Errorf("compaction rule from '%s' to '%s' not found", source, dest)
+		}
+		sourceMeta.Rules = rules
+
+		if err := putSeries(txn, source, sourceMeta); err != nil {
+			return err
+		}
+
+		destMeta, err := getSeries(txn, dest)
+		if err != nil {
+			return err
+		}
+
+		destMeta.Source = ""
+		return putSeries(txn, dest, destMeta)
+	})
+}
+
+// Range returns samples of time series with timestamps between from and to
+// (inclusive) in order of time, aggregated if aggregation is given. At most
+// count samples are returned, unless count is zero.
+func (b *Bucket) Range(key string, from, to int64, aggregation *Aggregation, count int) ([]Sample, error) {
+	if aggregation != nil {
+		if err := validAggregation(*aggregation); err != nil {
+			return nil, err
+		}
+	}
+
+	var samples []Sample
+
+	err := b.viewSeries(func(r Reader) error {
+		meta, err := getSeries(r, key)
+		if err != nil {
+			return err
+		}
+
+		if meta.Retention > 0 {
+			last, ok, err := lastTimestamp(r, meta)
+			if err != nil {
+				return err
+			}
+			if ok && from < last-meta.Retention {
+				from = last - meta.Retention
+			}
+		}
+
+		samples, err = readSamples(r, meta, from, to)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if aggregation != nil {
+		samples = aggregateSamples(samples, *aggregation)
+	}
+
+	if count > 0 && len(samples) > count {
+		samples = samples[:count]
+	}
+
+	return samples, nil
+}
+
+// TimeSeriesInfo returns description of time series.
+func (b *Bucket) TimeSeriesInfo(key string) (TimeSeriesInfo, error) {
+	var info TimeSeriesInfo
+
+	err := b.viewSeries(func(r Reader) error {
+		meta, err := getSeries(r, key)
+		if err != nil {
+			return err
+		}
+
+		info = TimeSeriesInfo{
+			TimeSeries: meta.TimeSeries,
+			Key:        key,
+			Rules:      meta.Rules,
+			Source:     meta.Source,
+		}
+
+		first := true
+		err = r.Iterate(tsChunkPrefix(meta.ID), false, func(_, value []byte) error {
+			info.Samples += chunkCount(value)
+			info.Chunks++
+
+			if first {
+				samples, err := decodeChunk(value)
+				if err != nil || len(samples) == 0 {
+					return err
+				}
+				info.First, first = samples[0].Timestamp, false
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		info.Last, _, err = lastTimestamp(r, meta)
+		return err
+	})
+
+	return info, err
+}
+
+// Remove samples of all time series of bucket outside their retention.
+// Returns number of removed samples.
+func (b *Bucket) trimTimeSeries() (int, error) {
+	var keys []string
+
+	err := b.viewSeries(func(r Reader) error {
+		prefix := tsKey(tsMetaTag, nil)
+
+		return r.Iterate(prefix, false, func(key, value []byte) error {
+			var meta seriesMeta
+			if err := json.Unmarshal(value, &meta); err == nil && meta.Retention > 0 {
+				keys = append(keys, string(key[len(prefix):]))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+
+	for _, key := range keys {
+		err := b.updateSeries(func(txn Txn) error {
+			meta, err := getSeries(txn, key)
+			if err != nil {
+				return err
+			}
+
+			n, err := trimSeries(txn, meta)
+			removed += n
+			return err
+		})
+		if err != nil && !errors.Is(err, errSeriesNotFound) {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// Update time series in transaction serialized with other time series
+// writes, rejected if it grows the bucket over its quota.
+func (b *Bucket) updateSeries(fn func(Txn) error) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	b.seriesMutex.Lock()
+	defer b.seriesMutex.Unlock()
+
+	if err := b.committer.updateInternal(true, fn); err != nil {
+		return err
+	}
+
+	b.touch()
+	return nil
+}
+
+func (b *Bucket) viewSeries(fn func(Reader) error) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	return b.engine.View(fn)
+}
+
+// TrimTimeSeries removes samples outside retention of time series in all
+// opened buckets. Samples are only added to opened buckets, so closed ones
+// don't need trimming. Returns number of removed samples.
+func (db *Database) TrimTimeSeries() (int, error) {
+	if db.readOnly {
+		return 0, nil
+	}
+
+	removed := 0
+
+	for _, bucket := range db.acquireOpened() {
+		if bucket.ReadOnly() {
+			db.Release(bucket)
+			continue
+		}
+
+		n, err := bucket.trimTimeSeries()
+		db.Release(bucket)
+
+		removed += n
+		if err != nil {
+			log.Error(fmt.Sprintf("trimming time series of bucket '%s'", bucket.Name), err)
+		}
+	}
+
+	return removed, nil
+}
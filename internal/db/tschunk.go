@@ -0,0 +1,131 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Samples of time series are stored in chunks of up to tsChunkSize samples
+// ordered by timestamp. Chunk is encoded as:
+//
+//	<uvarint count> <varint first timestamp> <8 bytes first value>
+//	{ <varint delta of timestamp delta> <xor of value> }
+//
+// Timestamps of regular series have constant deltas, so their deltas of
+// deltas are zeros taking single byte. Value is XORed with the previous
+// one; equal value is a single zero byte, otherwise a byte with the high
+// bit set and counts of leading (bits 4-6) and trailing (bits 0-3) zero
+// bytes of the XOR, followed by its remaining bytes. Close values share
+// sign, exponent and high bits of mantissa, so the XOR has leading zero
+// bytes.
+
+const (
+	tsChunkSize = 256
+	tsXORFlag   = 0x80
+)
+
+var errMalformedChunk = errors.New("malformed time series chunk")
+
+// Sample is a value of time series at given time (Unix milliseconds).
+type Sample struct {
+	Timestamp int64
+	Value     float64
+}
+
+func encodeChunk(samples []Sample) []byte {
+	value := binary.AppendUvarint(nil, uint64(len(samples)))
+	if len(samples) == 0 {
+		return value
+	}
+
+	value = binary.AppendVarint(value, samples[0].Timestamp)
+	value = binary.BigEndian.AppendUint64(value, math.Float64bits(samples[0].Value))
+
+	var delta int64
+
+	for i := 1; i < len(samples); i++ {
+		current := samples[i].Timestamp - samples[i-1].Timestamp
+		value = binary.AppendVarint(value, current-delta)
+		delta = current
+
+		xor := math.Float64bits(samples[i].Value) ^ math.Float64bits(samples[i-1].Value)
+		if xor == 0 {
+			value = append(value, 0)
+			continue
+		}
+
+		leading := bits.LeadingZeros64(xor) / 8
+		trailing := bits.TrailingZeros64(xor) / 8
+		value = append(value, byte(tsXORFlag|leading<<4|trailing))
+
+		for j := 7 - leading; j >= trailing; j-- {
+			value = append(value, byte(xor>>(8*j)))
+		}
+	}
+
+	return value
+}
+
+func decodeChunk(value []byte) ([]Sample, error) {
+	count, n := binary.Uvarint(value)
+	if n <= 0 || count > uint64(len(value)) {
+		return nil, errMalformedChunk
+	}
+	value = value[n:]
+
+	samples := make([]Sample, 0, count)
+	if count == 0 {
+		return samples, nil
+	}
+
+	timestamp, n := binary.Varint(value)
+	if n <= 0 || len(value) < n+8 {
+		return nil, errMalformedChunk
+	}
+	previous := binary.BigEndian.Uint64(value[n:])
+	value = value[n+8:]
+
+	samples = append(samples, Sample{Timestamp: timestamp, Value: math.Float64frombits(previous)})
+
+	var delta int64
+
+	for i := uint64(1); i < count; i++ {
+		deltaOfDelta, n := binary.Varint(value)
+		if n <= 0 || len(value) <= n {
+			return nil, errMalformedChunk
+		}
+		value = value[n:]
+
+		delta += deltaOfDelta
+		timestamp += delta
+
+		header := value[0]
+		value = value[1:]
+
+		if header != 0 {
+			leading, trailing := int((header&^tsXORFlag)>>4), int(header&0x0f)
+			if leading+trailing > 7 || len(value) < 8-leading-trailing {
+				return nil, errMalformedChunk
+			}
+
+			var xor uint64
+			for j := 7 - leading; j >= trailing; j-- {
+				xor |= uint64(value[0]) << (8 * j)
+				value = value[1:]
+			}
+			previous ^= xor
+		}
+
+		samples = append(samples, Sample{Timestamp: timestamp, Value: math.Float64frombits(previous)})
+	}
+
+	return samples, nil
+}
+
+// Number of samples in encoded chunk.
+func chunkCount(value []byte) uint64 {
+	count, _ := binary.Uvarint(value)
+	return count
+}
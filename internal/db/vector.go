@@ -0,0 +1,584 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Vector indexes store vectors (embeddings) under keys of bucket and answer
+// nearest-neighbour queries. Vectors are added explicitly, independently of
+// values stored under the same keys. Search is exact (brute force) unless
+// the index maintains HNSW graph, which gives approximate results.
+//
+// Vector index data is stored as internal keys:
+//
+//	0xff 'v' <uvarint index ID> 'c'          number of vectors (uvarint)
+//	0xff 'v' <uvarint index ID> 'e' <key>    vector (little-endian float32s)
+//	0xff 'v' <uvarint index ID> 'g'          graph entry point
+//	0xff 'v' <uvarint index ID> 'n' <key>    graph node
+const vectorKeyTag = 'v'
+
+const (
+	vectorCountTag  = 'c'
+	vectorVectorTag = 'e'
+	vectorEntryTag  = 'g'
+	vectorNodeTag   = 'n'
+)
+
+// Vector distance metrics.
+const (
+	VectorCosine = "cosine"
+	VectorL2     = "l2"
+	VectorDot    = "dot"
+)
+
+const (
+	vectorMaxDim = 65536
+
+	// Default number of neighbours of graph node per level.
+	VectorDefaultM = 16
+	// Default size of candidate list when inserting into graph.
+	VectorDefaultEfConstruction = 200
+	// Default size of candidate list when searching graph.
+	VectorDefaultEfSearch = 64
+)
+
+// VectorIndex describes vector index of bucket.
+type VectorIndex struct {
+	ID     uint64 `json:"id"`
+	Dim    int    `json:"dim"`
+	Metric string `json:"metric"`
+	// Number of neighbours of HNSW graph node per level (twice as many on
+	// the bottom level), no graph is maintained if zero.
+	M int `json:"m,omitempty"`
+	// Size of candidate list when inserting into HNSW graph.
+	EfConstruction int `json:"ef_construction,omitempty"`
+}
+
+// VectorInfo describes vector index of bucket together with its size.
+type VectorInfo struct {
+	VectorIndex
+	Name string
+	Size uint64
+}
+
+// VectorHit is a vector found by search. Distance is Euclidean distance for
+// l2 metric, cosine distance (1 - cosine similarity) for cosine metric and
+// negated inner product for dot metric, so that smaller is always closer.
+type VectorHit struct {
+	Key      string
+	Distance float64
+}
+
+// VectorSearch contains options of vector search.
+type VectorSearch struct {
+	// Only keys with this prefix are searched. Filtered search is exact.
+	Prefix string
+	// Search exhaustively even if the index maintains graph.
+	Exact bool
+	// Size of candidate list of graph search, VectorDefaultEfSearch if
+	// zero.
+	Ef int
+}
+
+// Compiled vector index.
+type vectorIndex struct {
+	prefix []byte
+	VectorIndex
+}
+
+func compileVectorIndex(index VectorIndex) *vectorIndex {
+	prefix := []byte{internalKeyPrefix, vectorKeyTag}
+
+	return &vectorIndex{
+		prefix:      binary.AppendUvarint(prefix, index.ID),
+		VectorIndex: index,
+	}
+}
+
+func (i *vectorIndex) key(tag byte, key []byte) []byte {
+	return append(append(append([]byte(nil), i.prefix...), tag), key...)
+}
+
+// Check dimension and values of vector and normalize it for cosine metric.
+func (i *vectorIndex) prepare(vector []float32) ([]float32, error) {
+	if len(vector) != i.Dim {
+		return nil, fmt.Errorf("vector has %d dimensions, index has %d", len(vector), i.Dim)
+	}
+
+	var norm float64
+	for _, x := range vector {
+		if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) {
+			return nil, fmt.Errorf("vector contains non-finite value")
+		}
+		norm += float64(x) * float64(x)
+	}
+
+	if i.Metric != VectorCosine {
+		return vector, nil
+	}
+
+	if norm == 0 {
+		return nil, fmt.Errorf("zero vector has no direction")
+	}
+
+	norm = math.Sqrt(norm)
+	normalized := make([]float32, len(vector))
+	for j, x := range vector {
+		normalized[j] = float32(float64(x) / norm)
+	}
+
+	return normalized, nil
+}
+
+func (i *vectorIndex) distance(a, b []float32) float64 {
+	var sum float64
+
+	switch i.Metric {
+	case VectorL2:
+		for j := range a {
+			d := float64(a[j]) - float64(b[j])
+			sum += d * d
+		}
+		return math.Sqrt(sum)
+	case VectorCosine:
+		for j := range a {
+			sum += float64(a[j]) * float64(b[j])
+		}
+		return 1 - sum
+	default:
+		for j := range a {
+			sum += float64(a[j]) * float64(b[j])
+		}
+		return -sum
+	}
+}
+
+func encodeVector(vector []float32) []byte {
+	value := make([]byte, 0, len(vector)*4)
+	for _, x := range vector {
+		value = binary.LittleEndian.AppendUint32(value, math.Float32bits(x))
+	}
+
+	return value
+}
+
+func decodeVector(value []byte) []float32 {
+	vector := make([]float32, len(value)/4)
+	for j := range vector {
+		vector[j] = math.Float32frombits(binary.LittleEndian.Uint32(value[j*4:]))
+	}
+
+	return vector
+}
+
+func (i *vectorIndex) size(r Reader) (uint64, error) {
+	value, err := r.Get(i.key(vectorCountTag, nil))
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	size, _ := binary.Uvarint(value)
+	return size, nil
+}
+
+func (i *vectorIndex) add(txn Txn, key []byte, vector []float32) error {
+	vectorKey := i.key(vectorVectorTag, key)
+
+	_, err := txn.Get(vectorKey)
+	switch {
+	case err == ErrKeyNotFound:
+		if err := i.updateSize(txn, 1); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case i.M > 0:
+		// Replaced vector is reinserted into graph.
+		if err := newHNSWGraph(txn, i).remove(key); err != nil {
+			return err
+		}
+	}
+
+	if err := txn.Set(vectorKey, encodeVector(vector)); err != nil {
+		return err
+	}
+
+	if i.M > 0 {
+		return newHNSWGraph(txn, i).insert(key, vector)
+	}
+
+	return nil
+}
+
+func (i *vectorIndex) remove(txn Txn, key []byte) (bool, error) {
+	vectorKey := i.key(vectorVectorTag, key)
+
+	_, err := txn.Get(vectorKey)
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if i.M > 0 {
+		if err := newHNSWGraph(txn, i).remove(key); err != nil {
+			return false, err
+		}
+	}
+
+	if err := txn.Delete(vectorKey); err != nil {
+		return false, err
+	}
+
+	return true, i.updateSize(txn, -1)
+}
+
+func (i *vectorIndex) updateSize(txn Txn, delta int64) error {
+	size, err := i.size(txn)
+	if err != nil {
+		return err
+	}
+
+	return txn.Set(i.key(vectorCountTag, nil), binary.AppendUvarint(nil, uint64(int64(size)+delta)))
+}
+
+// Exact search of k nearest vectors with key prefix.
+func (i *vectorIndex) scan(r Reader, query []float32, k int, prefix []byte) ([]VectorHit, error) {
+	vectorPrefix := i.key(vectorVectorTag, prefix)
+	keyStart := len(vectorPrefix) - len(prefix)
+
+	var nearest []vectorCandidate
+
+	err := r.Iterate(vectorPrefix, false, func(key, value []byte) error {
+		candidate := vectorCandidate{
+			key:      string(key[keyStart:]),
+			distance: i.distance(query, decodeVector(value)),
+		}
+
+		if len(nearest) < k || candidate.closer(nearest[len(nearest)-1]) {
+			nearest = insertCandidate(nearest, candidate, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return candidateHits(nearest), nil
+}
+
+// vectorCandidate is a key with its distance from query, candidates with
+// equal distances are ordered by key, so that results are deterministic.
+type vectorCandidate struct {
+	key      string
+	distance float64
+}
+
+func (c vectorCandidate) closer(other vectorCandidate) bool {
+	if c.distance != other.distance {
+		return c.distance < other.distance
+	}
+
+	return c.key < other.key
+}
+
+// Insert candidate into sorted list, keeping at most limit closest ones.
+func insertCandidate(list []vectorCandidate, candidate vectorCandidate, limit int) []vectorCandidate {
+	i := sort.Search(len(list), func(i int) bool {
+		return candidate.closer(list[i])
+	})
+
+	list = append(list, vectorCandidate{})
+	copy(list[i+1:], list[i:])
+	list[i] = candidate
+
+	if len(list) > limit {
+		list = list[:limit]
+	}
+
+	return list
+}
+
+func candidateHits(candidates []vectorCandidate) []VectorHit {
+	hits := make([]VectorHit, 0, len(candidates))
+	for _, candidate := range candidates {
+		hits = append(hits, VectorHit{Key: candidate.key, Distance: candidate.distance})
+	}
+
+	return hits
+}
+
+// CreateVectorIndex creates empty vector index in bucket with given name.
+// ID of the index is assigned, zero M means no graph is maintained.
+func (db *Database) CreateVectorIndex(bucketName, name string, index VectorIndex) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	if len(name) > indexNameMaxLength || !indexNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid index name '%s'", name)
+	}
+
+	if index.Dim < 1 || index.Dim > vectorMaxDim {
+		return fmt.Errorf("dimension must be between 1 and %d", vectorMaxDim)
+	}
+
+	switch index.Metric {
+	case VectorCosine, VectorL2, VectorDot:
+	default:
+		return fmt.Errorf("unknown metric '%s'", index.Metric)
+	}
+
+	if index.M < 0 || index.M == 1 || index.EfConstruction < 0 {
+		return fmt.Errorf("invalid graph parameters")
+	}
+
+	if index.M > 0 && index.EfConstruction == 0 {
+		index.EfConstruction = VectorDefaultEfConstruction
+	}
+
+	if index.M == 0 {
+		index.EfConstruction = 0
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket, ok := db.buckets[bucketName]
+	if !ok {
+		return fmt.Errorf("bucket '%s' not found", bucketName)
+	}
+
+	meta := bucket.meta
+	if _, ok := meta.Vectors[name]; ok {
+		return fmt.Errorf("vector index '%s' already exists", name)
+	}
+
+	meta.NextIndexID++
+	index.ID = meta.NextIndexID
+
+	meta.Vectors = copyVectorIndexes(meta.Vectors)
+	meta.Vectors[name] = index
+
+	if err := db.system.Set(bucketKeyPrefix+bucketName, meta.encode()); err != nil {
+		return err
+	}
+
+	bucket.setMeta(meta)
+	return nil
+}
+
+// DropVectorIndex removes vector index and all its vectors.
+func (db *Database) DropVectorIndex(bucketName, name string) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	bucket, id, err := db.dropVectorIndexMeta(bucketName, name)
+	if err != nil {
+		return err
+	}
+	defer db.Release(bucket)
+
+	prefix := compileVectorIndex(VectorIndex{ID: id}).prefix
+	if err := bucket.removeEntries(prefix); err != nil {
+		log.Error(fmt.Sprintf("removing vectors of index '%s'", name), err)
+	}
+
+	return nil
+}
+
+// Remove vector index from bucket metadata. Returns acquired bucket and ID
+// of the removed index.
+func (db *Database) dropVectorIndexMeta(bucketName, name string) (*Bucket, uint64, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	bucket, ok := db.buckets[bucketName]
+	if !ok {
+		return nil, 0, fmt.Errorf("bucket '%s' not found", bucketName)
+	}
+
+	meta := bucket.meta
+	index, ok := meta.Vectors[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("vector index '%s' not found", name)
+	}
+
+	if err := db.acquireLocked(bucket); err != nil {
+		return nil, 0, err
+	}
+
+	meta.Vectors = copyVectorIndexes(meta.Vectors)
+	delete(meta.Vectors, name)
+
+	if err := db.system.Set(bucketKeyPrefix+bucketName, meta.encode()); err != nil {
+		bucket.refs--
+		return nil, 0, err
+	}
+
+	bucket.setMeta(meta)
+	return bucket, index.ID, nil
+}
+
+// VectorIndexes returns all vector indexes of bucket, ordered by name.
+func (b *Bucket) VectorIndexes() ([]VectorInfo, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	infos := make([]VectorInfo, 0, len(b.meta.Vectors))
+
+	err := b.engine.View(func(r Reader) error {
+		for name, index := range b.meta.Vectors {
+			size, err := compileVectorIndex(index).size(r)
+			if err != nil {
+				return err
+			}
+
+			infos = append(infos, VectorInfo{VectorIndex: index, Name: name, Size: size})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos, nil
+}
+
+// VectorAdd stores vector under key in vector index, replacing the previous
+// one.
+func (b *Bucket) VectorAdd(name, key string, vector []float32) error {
+	return b.updateVectors(name, func(txn Txn, index *vectorIndex) error {
+		vector, err := index.prepare(vector)
+		if err != nil {
+			return err
+		}
+
+		return index.add(txn, []byte(key), vector)
+	})
+}
+
+// VectorDelete removes vector stored under key from vector index. Returns
+// false if there was none.
+func (b *Bucket) VectorDelete(name, key string) (bool, error) {
+	var removed bool
+
+	err := b.updateVectors(name, func(txn Txn, index *vectorIndex) error {
+		var err error
+		removed, err = index.remove(txn, []byte(key))
+		return err
+	})
+
+	return removed, err
+}
+
+// Update vector index in transaction serialized with other vector writes,
+// rejected if it grows the bucket over its quota.
+func (b *Bucket) updateVectors(name string, fn func(Txn, *vectorIndex) error) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	index, ok := b.meta.Vectors[name]
+	if !ok {
+		return fmt.Errorf("vector index '%s' not found", name)
+	}
+
+	b.vectorMutex.Lock()
+	defer b.vectorMutex.Unlock()
+
+	compiled := compileVectorIndex(index)
+	if err := b.committer.updateInternal(true, func(txn Txn) error {
+		return fn(txn, compiled)
+	}); err != nil {
+		return err
+	}
+
+	b.touch()
+	return nil
+}
+
+// VectorSearch returns k vectors of vector index nearest to query, closest
+// first.
+func (b *Bucket) VectorSearch(name string, query []float32, k int, options VectorSearch) ([]VectorHit, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.engine == nil {
+		return nil, fmt.Errorf("bucket '%s' not opened", b.Name)
+	}
+
+	index, ok := b.meta.Vectors[name]
+	if !ok {
+		return nil, fmt.Errorf("vector index '%s' not found", name)
+	}
+
+	compiled := compileVectorIndex(index)
+
+	query, err := compiled.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if k < 1 {
+		return []VectorHit{}, nil
+	}
+
+	var hits []VectorHit
+
+	err = b.engine.View(func(r Reader) error {
+		var err error
+
+		if compiled.M == 0 || options.Exact || options.Prefix != "" {
+			hits, err = compiled.scan(r, query, k, []byte(options.Prefix))
+			return err
+		}
+
+		ef := options.Ef
+		if ef == 0 {
+			ef = VectorDefaultEfSearch
+		}
+
+		hits, err = newHNSWGraph(r, compiled).search(query, k, ef)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hits, nil
+}
+
+func copyVectorIndexes(indexes map[string]VectorIndex) map[string]VectorIndex {
+	copied := make(map[string]VectorIndex, len(indexes)+1)
+	for name, index := range indexes {
+		copied[name] = index
+	}
+
+	return copied
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+const (
+	testVectorDim   = 16
+	testVectorCount = 600
+)
+
+// Fixed dataset of clustered vectors, so that nearest neighbours are
+// meaningful.
+func testVectors() map[string][]float32 {
+	r := rand.New(rand.NewSource(42))
+
+	centers := make([][]float32, 8)
+	for i := range centers {
+		centers[i] = make([]float32, testVectorDim)
+		for j := range centers[i] {
+			centers[i][j] = float32(r.NormFloat64() * 4)
+		}
+	}
+
+	vectors := make(map[string][]float32, testVectorCount)
+	for i := 0; i < testVectorCount; i++ {
+		center := centers[r.Intn(len(centers))]
+
+		vector := make([]float32, testVectorDim)
+		for j := range vector {
+			vector[j] = center[j] + float32(r.NormFloat64())
+		}
+		vectors[fmt.Sprintf("v%04d", i)] = vector
+	}
+
+	return vectors
+}
+
+// Bucket with HNSW vector index "idx" built from test vectors in key order,
+// with every tenth vector deleted again.
+func buildTestVectorIndex(t *testing.T, metric string) *Bucket {
+	t.Helper()
+
+	db := openTestDatabase(t, nil)
+	bucket := createTestBucket(t, db, "vectors", BucketOptions{})
+
+	if err := db.CreateVectorIndex("vectors", "idx", VectorIndex{Dim: testVectorDim, Metric: metric, M: 8, EfConstruction: 64}); err != nil {
+		t.Fatal(err)
+	}
+
+	vectors := testVectors()
+	for i := 0; i < testVectorCount; i++ {
+		key := fmt.Sprintf("v%04d", i)
+		if err := bucket.VectorAdd("idx", key, vectors[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < testVectorCount; i += 10 {
+		if _, err := bucket.VectorDelete("idx", fmt.Sprintf("v%04d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return bucket
+}
+
+func testQueries() [][]float32 {
+	r := rand.New(rand.NewSource(7))
+
+	queries := make([][]float32, 50)
+	for i := range queries {
+		queries[i] = make([]float32, testVectorDim)
+		for j := range queries[i] {
+			queries[i][j] = float32(r.NormFloat64() * 4)
+		}
+	}
+
+	return queries
+}
+
+// Graph (and thus search results) only depends on the sequence of writes.
+func TestHNSWReproducible(t *testing.T) {
+	a := buildTestVectorIndex(t, VectorL2)
+	b := buildTestVectorIndex(t, VectorL2)
+
+	graph := func(bucket *Bucket) []string {
+		return collect(t, func(fn func(key, value []byte) error) error {
+			return bucket.engine.Iterate([]byte{internalKeyPrefix, vectorKeyTag}, false, fn)
+		})
+	}
+	if !reflect.DeepEqual(graph(a), graph(b)) {
+		t.Fatal("graphs built from the same writes differ")
+	}
+
+	for i, query := range testQueries() {
+		hitsA, err := a.VectorSearch("idx", query, 10, VectorSearch{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hitsB, err := b.VectorSearch("idx", query, 10, VectorSearch{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(hitsA, hitsB) {
+			t.Fatalf("query %d returned %v and %v", i, hitsA, hitsB)
+		}
+	}
+}
+
+// Approximate search finds most of the exact nearest neighbours. Inner
+// product is not a metric, so graph search is less accurate for it.
+func TestHNSWRecall(t *testing.T) {
+	const (
+		k  = 10
+		ef = 128
+	)
+
+	for metric, minRecall := range map[string]float64{VectorL2: 0.95, VectorCosine: 0.95, VectorDot: 0.9} {
+		metric, minRecall := metric, minRecall
+		t.Run(metric, func(t *testing.T) {
+			bucket := buildTestVectorIndex(t, metric)
+
+			var found, total int
+			for _, query := range testQueries() {
+				exact, err := bucket.VectorSearch("idx", query, k, VectorSearch{Exact: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				approximate, err := bucket.VectorSearch("idx", query, k, VectorSearch{Ef: ef})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(approximate) != k {
+					t.Fatalf("approximate search returned %d hits, want %d", len(approximate), k)
+				}
+
+				expected := make(map[string]bool, len(exact))
+				for _, hit := range exact {
+					expected[hit.Key] = true
+				}
+
+				for _, hit := range approximate {
+					if expected[hit.Key] {
+						found++
+					}
+				}
+				total += len(exact)
+			}
+
+			if recall := float64(found) / float64(total); recall < minRecall {
+				t.Fatalf("recall %.3f is less than %.2f", recall, minRecall)
+			}
+		})
+	}
+}
+
+// Exact search returns the nearest vectors in order, excluding deleted ones.
+func TestVectorExactSearch(t *testing.T) {
+	db := openTestDatabase(t, nil)
+	bucket := createTestBucket(t, db, "vectors", BucketOptions{})
+
+	if err := db.CreateVectorIndex("vectors", "idx", VectorIndex{Dim: 2, Metric: VectorL2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, vector := range map[string][]float32{
+		"a": {0, 0},
+		"b": {1, 0},
+		"c": {0, 2},
+		"d": {3, 3},
+	} {
+		if err := bucket.VectorAdd("idx", key, vector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bucket.VectorDelete("idx", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := bucket.VectorSearch("idx", []float32{1, 1}, 2, VectorSearch{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []VectorHit{{Key: "a", Distance: 1.4142135623730951}, {Key: "c", Distance: 1.4142135623730951}}
+	if !reflect.DeepEqual(hits, want) {
+		t.Fatalf("got hits %v, want %v", hits, want)
+	}
+}
@@ -0,0 +1,135 @@
+// Package merkle implements hash trees over ranges of keys, used to find
+// ranges whose contents differ between replicas without transferring them.
+//
+// Leaves are hashes of all keys and values of consecutive ranges, in key
+// order. Inner nodes hash pairs of their children (a node without sibling
+// is carried to the next level unchanged), so that trees with equal leaves
+// have equal roots and differing leaves are found by descending only into
+// differing subtrees.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+)
+
+// Leaf accumulates hash of keys and values of a range.
+type Leaf struct {
+	h hash.Hash
+}
+
+// NewLeaf returns hash of an empty range.
+func NewLeaf() *Leaf {
+	return &Leaf{h: sha256.New()}
+}
+
+// Add key with value to the range. Keys must be added in order.
+func (l *Leaf) Add(key, value []byte) {
+	// Lengths separate keys from values.
+	l.write(key)
+	l.write(value)
+}
+
+// AddVersioned adds key with value and its version (e.g. metadata of
+// conflict resolution) to the range. Keys must be added in order.
+func (l *Leaf) AddVersioned(key, value, version []byte) {
+	l.write(key)
+	l.write(value)
+	l.write(version)
+}
+
+func (l *Leaf) write(data []byte) {
+	var size [binary.MaxVarintLen64]byte
+
+	l.h.Write(size[:binary.PutUvarint(size[:], uint64(len(data)))]) //nolint:errcheck // Hash writes never fail.
+	l.h.Write(data)                                                 //nolint:errcheck // Hash writes never fail.
+}
+
+// Sum returns hash of the range.
+func (l *Leaf) Sum() []byte {
+	return l.h.Sum(nil)
+}
+
+// Tree of hashes built from leaves.
+type Tree struct {
+	// Levels of nodes, leaves first and the root last.
+	levels [][][]byte
+}
+
+// New builds tree from hashes of leaves.
+func New(leaves [][]byte) *Tree {
+	t := &Tree{levels: [][][]byte{leaves}}
+
+	for level := leaves; len(level) > 1; {
+		parents := make([][]byte, 0, (len(level)+1)/2)
+
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				parents = append(parents, level[i])
+				continue
+			}
+
+			h := sha256.New()
+			h.Write(level[i])   //nolint:errcheck // Hash writes never fail.
+			h.Write(level[i+1]) //nolint:errcheck // Hash writes never fail.
+			parents = append(parents, h.Sum(nil))
+		}
+
+		t.levels = append(t.levels, parents)
+		level = parents
+	}
+
+	return t
+}
+
+// Root returns hash of the root, nil if the tree has no leaves.
+func (t *Tree) Root() []byte {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		return nil
+	}
+
+	return top[0]
+}
+
+// Leaves returns number of leaves.
+func (t *Tree) Leaves() int {
+	return len(t.levels[0])
+}
+
+// Diff returns indexes of leaves differing between trees with the same
+// number of leaves, in ascending order. Returns nil for trees of different
+// shape.
+func Diff(a, b *Tree) []int {
+	if len(a.levels) != len(b.levels) || a.Leaves() != b.Leaves() || a.Leaves() == 0 {
+		return nil
+	}
+
+	// Indexes of differing nodes of the current level, from the root down.
+	differing := []int{0}
+
+	for level := len(a.levels) - 1; level >= 0 && len(differing) > 0; level-- {
+		var next []int
+
+		for _, i := range differing {
+			if bytes.Equal(a.levels[level][i], b.levels[level][i]) {
+				continue
+			}
+
+			if level == 0 {
+				next = append(next, i)
+				continue
+			}
+
+			for child := 2 * i; child <= 2*i+1 && child < len(a.levels[level-1]); child++ {
+				next = append(next, child)
+			}
+		}
+
+		differing = next
+	}
+
+	return differing
+}
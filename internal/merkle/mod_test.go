@@ -0,0 +1,182 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type entry struct {
+	key, value, version string
+}
+
+// Ranges of entries, each range a leaf. Entries with version are added as
+// versioned.
+type ranges [][]entry
+
+func (r ranges) tree() *Tree {
+	leaves := make([][]byte, 0, len(r))
+
+	for _, entries := range r {
+		leaf := NewLeaf()
+		for _, e := range entries {
+			if e.version != "" {
+				leaf.AddVersioned([]byte(e.key), []byte(e.value), []byte(e.version))
+			} else {
+				leaf.Add([]byte(e.key), []byte(e.value))
+			}
+		}
+		leaves = append(leaves, leaf.Sum())
+	}
+
+	return New(leaves)
+}
+
+// Copy of ranges with entries of range i changed.
+func (r ranges) with(i int, entries ...entry) ranges {
+	changed := append(ranges(nil), r...)
+	changed[i] = entries
+	return changed
+}
+
+// Ranges of count keys each, with one range per leaf.
+func testRanges(leaves, count int) ranges {
+	r := make(ranges, 0, leaves)
+	for i := 0; i < leaves; i++ {
+		var entries []entry
+		for j := 0; j < count; j++ {
+			key := fmt.Sprintf("k%02d-%02d", i, j)
+			entries = append(entries, entry{key: key, value: "v" + key, version: "1"})
+		}
+		r = append(r, entries)
+	}
+
+	return r
+}
+
+func TestDiff(t *testing.T) {
+	base := testRanges(7, 3)
+
+	tests := []struct {
+		name string
+		a, b ranges
+		want []int
+	}{
+		{
+			name: "equal",
+			a:    base,
+			b:    testRanges(7, 3),
+		},
+		{
+			name: "changed value",
+			a:    base,
+			b:    base.with(2, base[2][0], entry{key: base[2][1].key, value: "other", version: "1"}, base[2][2]),
+			want: []int{2},
+		},
+		{
+			name: "changed version",
+			a:    base,
+			b:    base.with(6, base[6][0], base[6][1], entry{key: base[6][2].key, value: base[6][2].value, version: "2"}),
+			want: []int{6},
+		},
+		{
+			name: "missing key",
+			a:    base,
+			b:    base.with(0, base[0][1:]...),
+			want: []int{0},
+		},
+		{
+			name: "added key",
+			a:    base,
+			b:    base.with(4, append(append([]entry(nil), base[4]...), entry{key: "k04-99", value: "v"})...),
+			want: []int{4},
+		},
+		{
+			name: "unversioned key",
+			a:    base,
+			b:    base.with(3, base[3][0], base[3][1], entry{key: base[3][2].key, value: base[3][2].value}),
+			want: []int{3},
+		},
+		{
+			name: "several ranges",
+			a:    base,
+			b:    base.with(1).with(5),
+			want: []int{1, 5},
+		},
+		{
+			name: "empty ranges",
+			a:    ranges{nil, nil, nil},
+			b:    ranges{nil, nil, nil},
+		},
+		{
+			name: "empty and non-empty range",
+			a:    ranges{nil, {{key: "a", value: "b"}}, nil},
+			b:    ranges{nil, nil, nil},
+			want: []int{1},
+		},
+		{
+			name: "boundary between key and value",
+			a:    ranges{{{key: "ab", value: "c"}}},
+			b:    ranges{{{key: "a", value: "bc"}}},
+			want: []int{0},
+		},
+		{
+			name: "boundary between keys",
+			a:    ranges{{{key: "a", value: "b"}, {key: "c", value: "d"}}},
+			b:    ranges{{{key: "a", value: "bc"}, {key: "", value: "d"}}},
+			want: []int{0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := test.a.tree(), test.b.tree()
+
+			got := Diff(a, b)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got differing ranges %v, want %v", got, test.want)
+			}
+
+			if equal := bytes.Equal(a.Root(), b.Root()); equal != (len(test.want) == 0) {
+				t.Fatalf("roots equal: %v, want %v", equal, len(test.want) == 0)
+			}
+		})
+	}
+}
+
+// Every single changed range is found, whatever its position in the tree.
+func TestDiffEachLeaf(t *testing.T) {
+	for leaves := 1; leaves <= 9; leaves++ {
+		base := testRanges(leaves, 1)
+
+		for i := 0; i < leaves; i++ {
+			changed := base.with(i, entry{key: base[i][0].key, value: "other"})
+
+			if got := Diff(base.tree(), changed.tree()); !reflect.DeepEqual(got, []int{i}) {
+				t.Fatalf("%d leaves, range %d changed: got differing ranges %v", leaves, i, got)
+			}
+		}
+	}
+}
+
+func TestEmptyTree(t *testing.T) {
+	empty := New(nil)
+
+	if root := empty.Root(); root != nil {
+		t.Fatalf("root of empty tree is %x", root)
+	}
+
+	if got := Diff(empty, New(nil)); got != nil {
+		t.Fatalf("empty trees differ in %v", got)
+	}
+
+	// Trees of different shape can't be compared.
+	if got := Diff(testRanges(3, 1).tree(), testRanges(4, 1).tree()); got != nil {
+		t.Fatalf("trees of different shape differ in %v", got)
+	}
+
+	if !bytes.Equal(NewLeaf().Sum(), NewLeaf().Sum()) {
+		t.Fatal("empty ranges have different hashes")
+	}
+}
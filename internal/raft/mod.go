@@ -0,0 +1,224 @@
+// Package raft implements Raft consensus (leader election, log replication
+// and log compaction) replicating a state machine among cluster members.
+//
+// Voting members form configuration, which is changed by entries of the log
+// one member at a time. Each node uses the latest configuration in its log,
+// committed or not; the initial one is given by the node config until the
+// first leader appends it to the log.
+//
+// Storage keeps the log together with the state built by applying its
+// entries, so the state is the snapshot: compaction only removes applied
+// entries, and followers missing removed entries receive a copy of the
+// state instead.
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrStopped is returned by operations of stopped node.
+	ErrStopped = errors.New("raft node stopped")
+	// ErrTimeout is returned when operation doesn't complete in time.
+	ErrTimeout = errors.New("timed out waiting for consensus")
+	// ErrLeadershipLost is returned when proposed entry was replaced by
+	// entry of another leader.
+	ErrLeadershipLost = errors.New("leadership lost before entry was committed")
+	// ErrCompacted is returned by storage for entries removed by compaction.
+	ErrCompacted = errors.New("log entry compacted")
+	// ErrConfigurationPending is returned for configuration change proposed
+	// before the previous one is committed.
+	ErrConfigurationPending = errors.New("previous configuration change not committed yet")
+)
+
+// NotLeaderError is returned by operations which need to be run on leader.
+type NotLeaderError struct {
+	// Leader known to the node, empty if there is none.
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "no leader elected"
+	}
+
+	return fmt.Sprintf("not leader, leader is '%s'", e.Leader)
+}
+
+// EntryType distinguishes entries changing the state from entries changing
+// configuration.
+type EntryType int
+
+// Types of log entries.
+const (
+	EntryCommand EntryType = iota
+	// Entry with data holding JSON list of members of new configuration.
+	EntryConfiguration
+)
+
+// Entry is an entry of replicated log. Commands with empty data are
+// appended by new leaders and don't change the state.
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type,omitempty"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+// Configuration returns configuration set by configuration entry.
+func (e Entry) Configuration() (Configuration, error) {
+	config := Configuration{Index: e.Index}
+	if e.Type != EntryConfiguration {
+		return config, fmt.Errorf("raft log entry %d doesn't change configuration", e.Index)
+	}
+
+	if err := json.Unmarshal(e.Data, &config.Members); err != nil {
+		return config, fmt.Errorf("malformed configuration in raft log entry %d: %v", e.Index, err)
+	}
+
+	return config, nil
+}
+
+// Configuration is set of voting members.
+type Configuration struct {
+	// Index of entry setting the configuration, zero for the initial one.
+	Index   uint64   `json:"index"`
+	Members []string `json:"members"`
+}
+
+func (c Configuration) contains(id string) bool {
+	for _, member := range c.Members {
+		if member == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HardState is state of node, which must be persisted before responding to
+// any request.
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// Storage persists log, state built from its entries and hard state of
+// node. Log contains entries following the last compacted one.
+type Storage interface {
+	HardState() (HardState, error)
+	SetHardState(state HardState) error
+
+	// Applied returns index and term of the last entry applied to the
+	// state, zeros if there is none.
+	Applied() (index, term uint64, err error)
+	// Compacted returns index and term of the last entry removed from log
+	// (not greater than applied), zeros if there is none.
+	Compacted() (index, term uint64, err error)
+	// LastIndex returns index of the last entry of log, compacted index if
+	// log is empty.
+	LastIndex() (uint64, error)
+	// Term returns term of entry with given index (including the last
+	// compacted one), or ErrCompacted.
+	Term(index uint64) (uint64, error)
+	// Entries returns entries with indexes in [lo, hi), limited to about
+	// maxBytes of data (at least one entry is returned).
+	Entries(lo, hi uint64, maxBytes int) ([]Entry, error)
+	// Append entries, replacing existing ones with the same or following
+	// indexes.
+	Append(entries []Entry) error
+	// Apply committed entries to the state, recording the last one as
+	// applied. Entry rejected by the state (e.g. for violating constraint)
+	// doesn't change it, its error is returned in results and applying
+	// continues with the following entries. Configuration entries are
+	// recorded as the applied configuration.
+	Apply(entries []Entry) (results []error, err error)
+	// Configuration returns the last applied configuration, empty if there
+	// is none.
+	Configuration() (Configuration, error)
+	// Compact removes entries up to given applied index from log.
+	Compact(index uint64) error
+
+	// Snapshot returns consistent view of the state, which must be
+	// released once no longer used.
+	Snapshot() (Snapshot, error)
+	// Restore replaces the state with snapshot received in chunks. First
+	// chunk clears the state and log, the last one records index and term
+	// of the snapshot as applied and compacted, and its configuration as
+	// applied.
+	Restore(index, term uint64, config Configuration, chunk []byte, first, last bool) error
+}
+
+// Snapshot is consistent view of the state after applying entry with given
+// index and term.
+type Snapshot interface {
+	Index() uint64
+	Term() uint64
+	// Configuration applied at the snapshot.
+	Configuration() Configuration
+	// Read chunk of about maxBytes starting at given cursor (nil for the
+	// first chunk). Returns cursor of the next chunk, nil after the last.
+	Read(cursor []byte, maxBytes int) (chunk, next []byte, err error)
+	Release()
+}
+
+// Transport sends requests to other members.
+type Transport interface {
+	RequestVote(peer string, req *VoteRequest) (*VoteResponse, error)
+	AppendEntries(peer string, req *AppendRequest) (*AppendResponse, error)
+	InstallSnapshot(peer string, req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// VoteRequest is sent by candidates to collect votes.
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+// VoteResponse grants or refuses the vote.
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest is sent by leader to replicate entries and as heartbeat.
+type AppendRequest struct {
+	Term      uint64  `json:"term"`
+	Leader    string  `json:"leader"`
+	PrevIndex uint64  `json:"prev_index"`
+	PrevTerm  uint64  `json:"prev_term"`
+	Entries   []Entry `json:"entries,omitempty"`
+	Commit    uint64  `json:"commit"`
+}
+
+// AppendResponse reports whether entries were appended. LastIndex is the
+// index of the last matching entry on success, and the last index of log
+// of the follower otherwise.
+type AppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"last_index"`
+}
+
+// SnapshotRequest sends chunk of the state to follower missing compacted
+// entries.
+type SnapshotRequest struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+	Index  uint64 `json:"index"`
+	// Term of the last entry included in the snapshot.
+	IndexTerm     uint64        `json:"index_term"`
+	Configuration Configuration `json:"configuration"`
+	Data          []byte        `json:"data,omitempty"`
+	First         bool          `json:"first,omitempty"`
+	Last          bool          `json:"last,omitempty"`
+}
+
+// SnapshotResponse acknowledges chunk of snapshot.
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
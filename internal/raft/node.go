@@ -0,0 +1,1120 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// Maximum size of entries sent in single request, and of snapshot chunks.
+const (
+	maxAppendBytes = 1 << 20
+	maxChunkBytes  = 1 << 20
+)
+
+var (
+	errStale     = errors.New("stale leader")
+	errUnchanged = errors.New("configuration unchanged")
+)
+
+type role int
+
+const (
+	roleFollower role = iota
+	roleCandidate
+	roleLeader
+)
+
+func (r role) String() string {
+	switch r {
+	case roleLeader:
+		return "leader"
+	case roleCandidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+// Config of Raft node.
+type Config struct {
+	// ID of the node, used by transport to reach it.
+	ID string
+	// IDs of voting members of the initial configuration, used until log
+	// contains a configuration.
+	Bootstrap []string
+	Storage   Storage
+	Transport Transport
+
+	HeartbeatInterval time.Duration
+	// Minimal election timeout, the actual one is random and up to twice
+	// as long.
+	ElectionTimeout time.Duration
+	// Number of applied entries kept in log before it is compacted.
+	CompactionThreshold uint64
+}
+
+// Status of node.
+type Status struct {
+	ID        string
+	Role      string
+	Leader    string
+	Term      uint64
+	Commit    uint64
+	Applied   uint64
+	LastIndex uint64
+	Compacted uint64
+	// Latest configuration in log and whether it is committed.
+	Members   []string
+	Committed bool
+	// Index of the last entry replicated to each peer (on leader only).
+	Match map[string]uint64
+}
+
+// Node is member of Raft group.
+type Node struct {
+	cfg   Config
+	mutex sync.Mutex
+
+	role      role
+	term      uint64
+	vote      string
+	leader    string
+	commit    uint64
+	applied   uint64
+	lastIndex uint64
+	deadline  time.Time // Of election timeout.
+	// Latest configuration in log, and time of the last message of
+	// leader.
+	config      Configuration
+	lastContact time.Time
+
+	// State of leader: replication progress of peers, time of their last
+	// response and index of the entry starting the term.
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	inFlight    map[string]bool
+	contacted   map[string]time.Time
+	termStart   uint64
+	readRound   uint64
+	ackedRounds map[string]uint64
+
+	// Terms of proposed entries waiting to be applied, and results of
+	// applied ones, by index.
+	waiters map[uint64]uint64
+	results map[uint64]error
+
+	// Closed and replaced on every change of state, to wake up waiters.
+	changed chan struct{}
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped bool
+}
+
+// NewNode starts node with state loaded from storage.
+func NewNode(cfg Config) (*Node, error) {
+	state, err := cfg.Storage.HardState()
+	if err != nil {
+		return nil, fmt.Errorf("loading hard state: %v", err)
+	}
+
+	applied, _, err := cfg.Storage.Applied()
+	if err != nil {
+		return nil, fmt.Errorf("loading applied index: %v", err)
+	}
+
+	lastIndex, err := cfg.Storage.LastIndex()
+	if err != nil {
+		return nil, fmt.Errorf("loading last index: %v", err)
+	}
+
+	n := &Node{
+		cfg:       cfg,
+		term:      state.Term,
+		vote:      state.Vote,
+		commit:    applied,
+		applied:   applied,
+		lastIndex: lastIndex,
+		waiters:   make(map[uint64]uint64),
+		results:   make(map[uint64]error),
+		changed:   make(chan struct{}),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	if err := n.loadConfigLocked(); err != nil {
+		return nil, err
+	}
+	n.resetDeadlineLocked()
+
+	go n.run()
+
+	return n, nil
+}
+
+// Stop the node. Pending operations fail with ErrStopped.
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stopped {
+		return
+	}
+
+	n.stopped = true
+	close(n.stop)
+	n.broadcastLocked()
+}
+
+// Leader returns ID of the current leader, empty if unknown.
+func (n *Node) Leader() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.leader
+}
+
+// Status returns current state of the node.
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	compacted, _, err := n.cfg.Storage.Compacted()
+	if err != nil {
+		log.Error("reading compacted index", err)
+	}
+
+	status := Status{
+		ID:        n.cfg.ID,
+		Role:      n.role.String(),
+		Leader:    n.leader,
+		Term:      n.term,
+		Commit:    n.commit,
+		Applied:   n.applied,
+		LastIndex: n.lastIndex,
+		Compacted: compacted,
+		Members:   append([]string(nil), n.config.Members...),
+		Committed: n.config.Index <= n.commit,
+	}
+
+	if n.role == roleLeader {
+		status.Match = make(map[string]uint64)
+		for peer, match := range n.matchIndex {
+			status.Match[peer] = match
+		}
+	}
+
+	return status
+}
+
+// Propose appends entry with given data to the log and waits until it is
+// applied. Only leader accepts proposals.
+func (n *Node) Propose(data []byte, timeout time.Duration) error {
+	return n.propose(timeout, func() (Entry, error) {
+		return Entry{Data: data}, nil
+	})
+}
+
+// AddMember adds voting member to configuration and waits until the change
+// is applied. Only leader accepts changes, one at a time.
+func (n *Node) AddMember(id string, timeout time.Duration) error {
+	return n.changeConfiguration(timeout, func(members []string) []string {
+		for _, member := range members {
+			if member == id {
+				return members
+			}
+		}
+
+		return append(members, id)
+	})
+}
+
+// RemoveMember removes voting member from configuration and waits until the
+// change is applied. Only leader accepts changes, one at a time. Leader
+// removing itself steps down once the change is committed.
+func (n *Node) RemoveMember(id string, timeout time.Duration) error {
+	return n.changeConfiguration(timeout, func(members []string) []string {
+		var changed []string
+		for _, member := range members {
+			if member != id {
+				changed = append(changed, member)
+			}
+		}
+
+		return changed
+	})
+}
+
+// Configuration returns the latest configuration in log, and whether it is
+// committed.
+func (n *Node) Configuration() (Configuration, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	config := Configuration{Index: n.config.Index, Members: append([]string(nil), n.config.Members...)}
+	return config, n.config.Index <= n.commit
+}
+
+// Propose configuration with members changed by change. Configuration
+// changes only once the previous change and the entry starting the term are
+// committed, so that configurations of any two leaders share majority.
+func (n *Node) changeConfiguration(timeout time.Duration, change func(members []string) []string) error {
+	err := n.propose(timeout, func() (Entry, error) {
+		if n.config.Index > n.commit || n.termStart > n.commit {
+			return Entry{}, ErrConfigurationPending
+		}
+
+		members := change(append([]string(nil), n.config.Members...))
+		if len(members) == len(n.config.Members) {
+			return Entry{}, errUnchanged
+		}
+		if len(members) == 0 {
+			return Entry{}, errors.New("configuration must contain a member")
+		}
+
+		// Marshalling list of strings cannot fail.
+		data, _ := json.Marshal(members)
+		return Entry{Type: EntryConfiguration, Data: data}, nil
+	})
+	if err == errUnchanged {
+		return nil
+	}
+
+	return err
+}
+
+// Append entry built by build (called with the mutex held) to the log and
+// wait until it is applied.
+func (n *Node) propose(timeout time.Duration, build func() (Entry, error)) error {
+	n.mutex.Lock()
+
+	if n.role != roleLeader {
+		defer n.mutex.Unlock()
+		return &NotLeaderError{Leader: n.leader}
+	}
+
+	entry, err := build()
+	if err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+
+	entry.Index, entry.Term = n.lastIndex+1, n.term
+	if err := n.appendEntryLocked(entry); err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+
+	n.waiters[entry.Index] = entry.Term
+	n.advanceCommitLocked()
+	n.mutex.Unlock()
+
+	n.triggerReplication()
+
+	err = n.waitFor(timeout, func() (bool, error) {
+		result, ok := n.results[entry.Index]
+		return ok, result
+	})
+
+	n.mutex.Lock()
+	delete(n.waiters, entry.Index)
+	delete(n.results, entry.Index)
+	n.mutex.Unlock()
+
+	return err
+}
+
+// Append entry of leader to the log, switching to configuration set by it.
+func (n *Node) appendEntryLocked(entry Entry) error {
+	var config Configuration
+
+	if entry.Type == EntryConfiguration {
+		var err error
+		if config, err = entry.Configuration(); err != nil {
+			return err
+		}
+	}
+
+	if err := n.cfg.Storage.Append([]Entry{entry}); err != nil {
+		return err
+	}
+
+	n.lastIndex = entry.Index
+	if entry.Type == EntryConfiguration {
+		n.setConfigLocked(config)
+	}
+
+	return nil
+}
+
+// Switch to configuration, tracking progress of added peers on leader.
+func (n *Node) setConfigLocked(config Configuration) {
+	n.config = config
+
+	if n.role != roleLeader {
+		return
+	}
+
+	now := time.Now()
+	for _, peer := range config.Members {
+		if _, ok := n.contacted[peer]; !ok {
+			n.contacted[peer] = now
+		}
+	}
+}
+
+// Load the latest configuration in log: the applied one, replaced by
+// configuration entries following it.
+func (n *Node) loadConfigLocked() error {
+	config, err := n.cfg.Storage.Configuration()
+	if err != nil {
+		return fmt.Errorf("loading raft configuration: %v", err)
+	}
+
+	for next := n.applied + 1; next <= n.lastIndex; {
+		entries, err := n.cfg.Storage.Entries(next, n.lastIndex+1, maxAppendBytes)
+		if err != nil {
+			return fmt.Errorf("loading raft configuration: %v", err)
+		}
+
+		for _, entry := range entries {
+			if entry.Type != EntryConfiguration {
+				continue
+			}
+
+			if config, err = entry.Configuration(); err != nil {
+				return err
+			}
+		}
+
+		next = entries[len(entries)-1].Index + 1
+	}
+
+	if len(config.Members) == 0 && config.Index == 0 {
+		config.Members = append([]string(nil), n.cfg.Bootstrap...)
+	}
+
+	n.config = config
+	return nil
+}
+
+// ReadBarrier waits until the state reflects all entries committed before
+// the call, after confirming that the node is still the leader. Reads of the
+// state following it are linearizable.
+func (n *Node) ReadBarrier(timeout time.Duration) error {
+	n.mutex.Lock()
+
+	if n.role != roleLeader {
+		defer n.mutex.Unlock()
+		return &NotLeaderError{Leader: n.leader}
+	}
+
+	term := n.term
+	n.readRound++
+	round := n.readRound
+	n.mutex.Unlock()
+
+	n.triggerReplication()
+
+	// Entry starting the term must be committed, so that commit index
+	// covers entries of previous leaders.
+	var readIndex uint64
+
+	return n.waitFor(timeout, func() (bool, error) {
+		if n.role != roleLeader || n.term != term {
+			return false, &NotLeaderError{Leader: n.leader}
+		}
+
+		if readIndex == 0 {
+			if n.commit < n.termStart || !n.confirmedLocked(round) {
+				return false, nil
+			}
+			readIndex = n.commit
+		}
+
+		return n.applied >= readIndex, nil
+	})
+}
+
+// Whether majority of members acknowledged the read round.
+func (n *Node) confirmedLocked(round uint64) bool {
+	return n.countLocked(func(peer string) bool {
+		return n.ackedRounds[peer] >= round
+	}) >= quorum(n.config.Members)
+}
+
+// Number of members (including this node, if it is one) for which counts
+// returns true for peers.
+func (n *Node) countLocked(counts func(peer string) bool) int {
+	count := 0
+
+	for _, member := range n.config.Members {
+		if member == n.cfg.ID || counts(member) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Wait until cond (called with the mutex held) is done or fails.
+func (n *Node) waitFor(timeout time.Duration, cond func() (bool, error)) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		n.mutex.Lock()
+		if n.stopped {
+			n.mutex.Unlock()
+			return ErrStopped
+		}
+		done, err := cond()
+		changed := n.changed
+		n.mutex.Unlock()
+
+		if done || err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
+}
+
+func (n *Node) broadcastLocked() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *Node) triggerReplication() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) run() {
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+			n.tick()
+		case <-n.wake:
+			n.mutex.Lock()
+			if n.role == roleLeader {
+				n.replicateLocked()
+			}
+			n.mutex.Unlock()
+		}
+	}
+}
+
+func (n *Node) tick() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.role != roleLeader {
+		// Node outside of configuration waits to be added.
+		if time.Now().After(n.deadline) && n.config.contains(n.cfg.ID) {
+			n.startElectionLocked()
+		}
+		return
+	}
+
+	// Leader which can't reach majority steps down, so that clients are
+	// not left waiting for it.
+	if !n.reachesQuorumLocked() {
+		log.Warn("raft node '%s' lost contact with majority, stepping down", n.cfg.ID)
+		n.becomeFollowerLocked(n.term, "")
+		return
+	}
+
+	n.replicateLocked()
+}
+
+func (n *Node) reachesQuorumLocked() bool {
+	since := time.Now().Add(-2 * n.cfg.ElectionTimeout)
+
+	return n.countLocked(func(peer string) bool {
+		return n.contacted[peer].After(since)
+	}) >= quorum(n.config.Members)
+}
+
+func quorum(members []string) int {
+	return len(members)/2 + 1
+}
+
+func (n *Node) resetDeadlineLocked() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout))) //nolint:gosec // Randomizes timeouts only.
+	n.deadline = time.Now().Add(timeout)
+}
+
+func (n *Node) saveHardStateLocked() {
+	if err := n.cfg.Storage.SetHardState(HardState{Term: n.term, Vote: n.vote}); err != nil {
+		log.Error("persisting raft hard state", err)
+	}
+}
+
+func (n *Node) becomeFollowerLocked(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		n.saveHardStateLocked()
+	}
+
+	n.role = roleFollower
+	n.leader = leader
+	n.resetDeadlineLocked()
+	n.broadcastLocked()
+}
+
+func (n *Node) startElectionLocked() {
+	members := n.config.Members
+
+	n.role = roleCandidate
+	n.term++
+	n.vote = n.cfg.ID
+	n.leader = ""
+	n.saveHardStateLocked()
+	n.resetDeadlineLocked()
+	n.broadcastLocked()
+
+	lastTerm, err := n.cfg.Storage.Term(n.lastIndex)
+	if err != nil {
+		log.Error("reading term of the last raft entry", err)
+		return
+	}
+
+	votes := 1
+	if votes >= quorum(members) {
+		n.becomeLeaderLocked()
+		return
+	}
+
+	req := &VoteRequest{Term: n.term, Candidate: n.cfg.ID, LastIndex: n.lastIndex, LastTerm: lastTerm}
+
+	for _, peer := range members {
+		if peer == n.cfg.ID {
+			continue
+		}
+
+		go func(peer string) {
+			resp, err := n.cfg.Transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+
+			if resp.Term > n.term {
+				n.becomeFollowerLocked(resp.Term, "")
+				return
+			}
+
+			if n.role != roleCandidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+
+			votes++
+			if votes >= quorum(members) {
+				n.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+func (n *Node) becomeLeaderLocked() {
+	log.Info("raft node '%s' elected leader for term %d", n.cfg.ID, n.term)
+
+	n.role = roleLeader
+	n.leader = n.cfg.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.inFlight = make(map[string]bool)
+	n.contacted = make(map[string]time.Time)
+	n.ackedRounds = make(map[string]uint64)
+
+	now := time.Now()
+	for _, peer := range n.config.Members {
+		n.contacted[peer] = now
+	}
+
+	// Empty entry of the new term commits entries of previous terms. The
+	// first leader appends the initial configuration instead.
+	entry := Entry{Index: n.lastIndex + 1, Term: n.term}
+	if n.config.Index == 0 {
+		// Marshalling list of strings cannot fail.
+		entry.Type = EntryConfiguration
+		entry.Data, _ = json.Marshal(n.config.Members)
+	}
+
+	if err := n.appendEntryLocked(entry); err != nil {
+		log.Error("appending raft entry", err)
+		n.becomeFollowerLocked(n.term, "")
+		return
+	}
+
+	n.termStart = entry.Index
+	n.advanceCommitLocked()
+	n.replicateLocked()
+	n.broadcastLocked()
+}
+
+// Send entries (or heartbeat) to all peers without request in flight.
+func (n *Node) replicateLocked() {
+	for _, peer := range n.config.Members {
+		if peer == n.cfg.ID || n.inFlight[peer] {
+			continue
+		}
+
+		n.inFlight[peer] = true
+		go n.replicateTo(peer)
+	}
+}
+
+func (n *Node) replicateTo(peer string) {
+	for {
+		n.mutex.Lock()
+		if n.role != roleLeader || n.stopped {
+			n.inFlight[peer] = false
+			n.mutex.Unlock()
+			return
+		}
+
+		term, round := n.term, n.readRound
+		req, snapshot, err := n.appendRequestLocked(peer)
+		n.mutex.Unlock()
+
+		var more bool
+		if err == nil && snapshot {
+			err = n.sendSnapshot(peer, term)
+			more = true
+		} else if err == nil {
+			var resp *AppendResponse
+			if resp, err = n.cfg.Transport.AppendEntries(peer, req); err == nil {
+				more = n.handleAppendResponse(peer, term, round, resp)
+			}
+		}
+
+		if err != nil || !more {
+			n.mutex.Lock()
+			n.inFlight[peer] = false
+			n.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// Request replicating entries following the ones matched by peer. Returns
+// whether snapshot is needed instead, as the entries were compacted.
+func (n *Node) appendRequestLocked(peer string) (*AppendRequest, bool, error) {
+	next, ok := n.nextIndex[peer]
+	if !ok {
+		next = n.lastIndex + 1
+		n.nextIndex[peer] = next
+	}
+
+	compacted, _, err := n.cfg.Storage.Compacted()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if next <= compacted {
+		return nil, true, nil
+	}
+
+	prevTerm, err := n.cfg.Storage.Term(next - 1)
+	if err == ErrCompacted {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	req := &AppendRequest{
+		Term:      n.term,
+		Leader:    n.cfg.ID,
+		PrevIndex: next - 1,
+		PrevTerm:  prevTerm,
+		Commit:    n.commit,
+	}
+
+	if next <= n.lastIndex {
+		req.Entries, err = n.cfg.Storage.Entries(next, n.lastIndex+1, maxAppendBytes)
+		if err == ErrCompacted {
+			return nil, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return req, false, nil
+}
+
+// Update progress of peer. Returns whether there is more to send to it.
+func (n *Node) handleAppendResponse(peer string, term, round uint64, resp *AppendResponse) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if resp.Term > n.term {
+		n.becomeFollowerLocked(resp.Term, "")
+		return false
+	}
+
+	if n.role != roleLeader || n.term != term {
+		return false
+	}
+
+	n.contacted[peer] = time.Now()
+	if round > n.ackedRounds[peer] {
+		n.ackedRounds[peer] = round
+		n.broadcastLocked()
+	}
+
+	if !resp.Success {
+		next := n.nextIndex[peer] - 1
+		if resp.LastIndex+1 < next {
+			next = resp.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[peer] = next
+		return true
+	}
+
+	if resp.LastIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = resp.LastIndex
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommitLocked()
+
+	return n.nextIndex[peer] <= n.lastIndex || n.readRound > round
+}
+
+// Send snapshot of the state to peer missing compacted entries.
+func (n *Node) sendSnapshot(peer string, term uint64) error {
+	snapshot, err := n.cfg.Storage.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	log.Info("raft node '%s' sending snapshot at index %d to '%s'", n.cfg.ID, snapshot.Index(), peer)
+
+	var cursor []byte
+
+	for first := true; ; first = false {
+		chunk, next, err := snapshot.Read(cursor, maxChunkBytes)
+		if err != nil {
+			return err
+		}
+
+		req := &SnapshotRequest{
+			Term:          term,
+			Leader:        n.cfg.ID,
+			Index:         snapshot.Index(),
+			IndexTerm:     snapshot.Term(),
+			Configuration: snapshot.Configuration(),
+			Data:          chunk,
+			First:         first,
+			Last:          next == nil,
+		}
+
+		resp, err := n.cfg.Transport.InstallSnapshot(peer, req)
+		if err != nil {
+			return err
+		}
+
+		n.mutex.Lock()
+		if resp.Term > n.term {
+			n.becomeFollowerLocked(resp.Term, "")
+		}
+		stale := n.role != roleLeader || n.term != term
+		if !stale {
+			n.contacted[peer] = time.Now()
+		}
+		n.mutex.Unlock()
+
+		if stale {
+			return errStale
+		}
+
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if snapshot.Index() > n.matchIndex[peer] {
+		n.matchIndex[peer] = snapshot.Index()
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+
+	return nil
+}
+
+// Commit entries of the current term replicated to majority. Leader
+// removed from configuration doesn't count itself, and steps down once the
+// removal is committed.
+func (n *Node) advanceCommitLocked() {
+	members := n.config.Members
+	if len(members) == 0 {
+		return
+	}
+
+	matches := make([]uint64, 0, len(members))
+
+	for _, peer := range members {
+		if peer == n.cfg.ID {
+			matches = append(matches, n.lastIndex)
+		} else {
+			matches = append(matches, n.matchIndex[peer])
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[quorum(members)-1]
+
+	if index <= n.commit {
+		return
+	}
+
+	term, err := n.cfg.Storage.Term(index)
+	if err != nil || term != n.term {
+		return
+	}
+
+	n.commit = index
+	n.applyLocked()
+
+	if n.role == roleLeader && n.config.Index <= n.commit && !n.config.contains(n.cfg.ID) {
+		log.Info("raft node '%s' removed from configuration, stepping down", n.cfg.ID)
+		n.becomeFollowerLocked(n.term, "")
+	}
+}
+
+// Apply committed entries and compact the log if needed.
+func (n *Node) applyLocked() {
+	for n.applied < n.commit {
+		entries, err := n.cfg.Storage.Entries(n.applied+1, n.commit+1, maxAppendBytes)
+
+		var results []error
+		if err == nil {
+			results, err = n.cfg.Storage.Apply(entries)
+		}
+		if err != nil {
+			log.Error(fmt.Sprintf("raft node '%s' applying entries", n.cfg.ID), err)
+			return
+		}
+
+		for i, entry := range entries {
+			if term, ok := n.waiters[entry.Index]; ok {
+				if term == entry.Term {
+					n.results[entry.Index] = results[i]
+				} else {
+					n.results[entry.Index] = ErrLeadershipLost
+				}
+				delete(n.waiters, entry.Index)
+			}
+		}
+
+		n.applied = entries[len(entries)-1].Index
+	}
+
+	n.broadcastLocked()
+
+	compacted, _, err := n.cfg.Storage.Compacted()
+	if err != nil || n.applied-compacted < n.cfg.CompactionThreshold {
+		return
+	}
+
+	if err := n.cfg.Storage.Compact(n.applied); err != nil {
+		log.Error(fmt.Sprintf("raft node '%s' compacting log", n.cfg.ID), err)
+	}
+}
+
+// HandleVote handles vote request of candidate. Request is refused while
+// leader is known to be alive, so that members removed from configuration
+// (which don't learn about it) can't disrupt the others.
+func (n *Node) HandleVote(req *VoteRequest) *VoteResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.role == roleLeader || (n.leader != "" && time.Since(n.lastContact) < n.cfg.ElectionTimeout) {
+		return &VoteResponse{Term: n.term}
+	}
+
+	if req.Term > n.term {
+		n.becomeFollowerLocked(req.Term, "")
+	}
+
+	resp := &VoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+
+	lastTerm, err := n.cfg.Storage.Term(n.lastIndex)
+	if err != nil {
+		log.Error("reading term of the last raft entry", err)
+		return resp
+	}
+
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastIndex >= n.lastIndex)
+	if upToDate && (n.vote == "" || n.vote == req.Candidate) {
+		n.vote = req.Candidate
+		n.saveHardStateLocked()
+		n.resetDeadlineLocked()
+		resp.Granted = true
+	}
+
+	return resp
+}
+
+// HandleAppend handles entries (or heartbeat) sent by leader.
+func (n *Node) HandleAppend(req *AppendRequest) (*AppendResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if req.Term < n.term {
+		return &AppendResponse{Term: n.term, LastIndex: n.lastIndex}, nil
+	}
+
+	n.becomeFollowerLocked(req.Term, req.Leader)
+	n.lastContact = time.Now()
+
+	resp := &AppendResponse{Term: n.term, LastIndex: n.lastIndex}
+
+	// Entries up to the applied one are committed, so they match.
+	prev, entries := req.PrevIndex, req.Entries
+	if prev < n.applied {
+		for len(entries) > 0 && entries[0].Index <= n.applied {
+			entries = entries[1:]
+		}
+		prev = n.applied
+	} else {
+		if prev > n.lastIndex {
+			return resp, nil
+		}
+
+		term, err := n.cfg.Storage.Term(prev)
+		if err != nil {
+			return nil, err
+		}
+		if term != req.PrevTerm {
+			resp.LastIndex = prev - 1
+			return resp, nil
+		}
+	}
+
+	if err := n.appendLocked(entries); err != nil {
+		return nil, err
+	}
+
+	match := prev
+	if len(entries) > 0 {
+		match = entries[len(entries)-1].Index
+	}
+
+	if commit := req.Commit; commit > n.commit {
+		if commit > match {
+			commit = match
+		}
+		if commit > n.commit {
+			n.commit = commit
+			n.applyLocked()
+		}
+	}
+
+	resp.Success = true
+	resp.LastIndex = match
+	return resp, nil
+}
+
+// Append entries following matching ones, replacing conflicting ones, and
+// switch to the latest configuration among them.
+func (n *Node) appendLocked(entries []Entry) error {
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex {
+			term, err := n.cfg.Storage.Term(entry.Index)
+			if err != nil {
+				return err
+			}
+			if term == entry.Term {
+				continue
+			}
+		}
+
+		if err := n.cfg.Storage.Append(entries[i:]); err != nil {
+			return err
+		}
+		n.lastIndex = entries[len(entries)-1].Index
+
+		// Configuration of replaced entry is no longer valid.
+		if entry.Index <= n.config.Index {
+			return n.loadConfigLocked()
+		}
+
+		for _, appended := range entries[i:] {
+			if appended.Type != EntryConfiguration {
+				continue
+			}
+
+			config, err := appended.Configuration()
+			if err != nil {
+				return err
+			}
+			n.config = config
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// HandleSnapshot handles chunk of snapshot sent by leader.
+func (n *Node) HandleSnapshot(req *SnapshotRequest) (*SnapshotResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if req.Term < n.term {
+		return &SnapshotResponse{Term: n.term}, nil
+	}
+
+	n.becomeFollowerLocked(req.Term, req.Leader)
+	n.lastContact = time.Now()
+
+	if err := n.cfg.Storage.Restore(req.Index, req.IndexTerm, req.Configuration, req.Data, req.First, req.Last); err != nil {
+		return nil, err
+	}
+
+	if req.First {
+		log.Info("raft node '%s' restoring snapshot at index %d from '%s'", n.cfg.ID, req.Index, req.Leader)
+		n.applied, n.commit, n.lastIndex = 0, 0, 0
+	}
+
+	if req.Last {
+		n.applied, n.commit, n.lastIndex = req.Index, req.Index, req.Index
+		n.config = req.Configuration
+		n.broadcastLocked()
+	}
+
+	return &SnapshotResponse{Term: n.term}, nil
+}
@@ -0,0 +1,667 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testHeartbeatInterval = 10 * time.Millisecond
+	testElectionTimeout   = 100 * time.Millisecond
+	testTimeout           = 5 * time.Second
+)
+
+var errUnreachable = errors.New("peer unreachable")
+
+// memStorage keeps log and state (map set by "key=value" commands) in
+// memory.
+type memStorage struct {
+	mutex sync.Mutex
+
+	hardState      HardState
+	applied        uint64
+	appliedTerm    uint64
+	compacted      uint64
+	compactedTerm  uint64
+	entries        []Entry // Following the compacted one.
+	state          map[string]string
+	config         Configuration
+	restoredChunks int
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{state: make(map[string]string)}
+}
+
+func (s *memStorage) HardState() (HardState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.hardState, nil
+}
+
+func (s *memStorage) SetHardState(state HardState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.hardState = state
+	return nil
+}
+
+func (s *memStorage) Applied() (index, term uint64, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.applied, s.appliedTerm, nil
+}
+
+func (s *memStorage) Compacted() (index, term uint64, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.compacted, s.compactedTerm, nil
+}
+
+func (s *memStorage) LastIndex() (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.compacted + uint64(len(s.entries)), nil
+}
+
+func (s *memStorage) Term(index uint64) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch {
+	case index == s.compacted:
+		return s.compactedTerm, nil
+	case index < s.compacted:
+		return 0, ErrCompacted
+	case index > s.compacted+uint64(len(s.entries)):
+		return 0, fmt.Errorf("raft log entry %d not found", index)
+	}
+
+	return s.entries[index-s.compacted-1].Term, nil
+}
+
+func (s *memStorage) Entries(lo, hi uint64, maxBytes int) ([]Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if lo <= s.compacted {
+		return nil, ErrCompacted
+	}
+	if hi > s.compacted+uint64(len(s.entries))+1 || lo >= hi {
+		return nil, fmt.Errorf("raft log entries [%d, %d) not found", lo, hi)
+	}
+
+	var (
+		entries []Entry
+		size    int
+	)
+
+	for _, entry := range s.entries[lo-s.compacted-1 : hi-s.compacted-1] {
+		if size > 0 && size+len(entry.Data) > maxBytes {
+			break
+		}
+
+		entries = append(entries, entry)
+		size += len(entry.Data)
+	}
+
+	return entries, nil
+}
+
+func (s *memStorage) Append(entries []Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	first := entries[0].Index
+	if first <= s.compacted || first > s.compacted+uint64(len(s.entries))+1 {
+		return fmt.Errorf("appending raft log entry %d out of order", first)
+	}
+
+	s.entries = append(s.entries[:first-s.compacted-1:first-s.compacted-1], entries...)
+	return nil
+}
+
+func (s *memStorage) Apply(entries []Entry) ([]error, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, entry := range entries {
+		if entry.Index != s.applied+1 {
+			return nil, fmt.Errorf("applying raft log entry %d after %d", entry.Index, s.applied)
+		}
+
+		switch {
+		case entry.Type == EntryConfiguration:
+			config, err := entry.Configuration()
+			if err != nil {
+				return nil, err
+			}
+			s.config = config
+		case len(entry.Data) > 0:
+			parts := strings.SplitN(string(entry.Data), "=", 2)
+			s.state[parts[0]] = parts[1]
+		}
+
+		s.applied, s.appliedTerm = entry.Index, entry.Term
+	}
+
+	return make([]error, len(entries)), nil
+}
+
+func (s *memStorage) Configuration() (Configuration, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.config, nil
+}
+
+func (s *memStorage) Compact(index uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if index <= s.compacted || index > s.applied {
+		return fmt.Errorf("compacting raft log up to %d", index)
+	}
+
+	s.compactedTerm = s.entries[index-s.compacted-1].Term
+	s.entries = append([]Entry(nil), s.entries[index-s.compacted:]...)
+	s.compacted = index
+	return nil
+}
+
+func (s *memStorage) Snapshot() (Snapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Marshalling map of strings cannot fail.
+	data, _ := json.Marshal(s.state)
+
+	return &memSnapshot{index: s.applied, term: s.appliedTerm, config: s.config, data: data}, nil
+}
+
+func (s *memStorage) Restore(index, term uint64, config Configuration, chunk []byte, first, last bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if first {
+		s.state = make(map[string]string)
+		s.entries = nil
+		s.applied, s.appliedTerm, s.compacted, s.compactedTerm = 0, 0, 0, 0
+	}
+
+	if err := json.Unmarshal(chunk, &s.state); err != nil {
+		return err
+	}
+	s.restoredChunks++
+
+	if last {
+		s.applied, s.appliedTerm, s.compacted, s.compactedTerm = index, term, index, term
+		s.config = config
+	}
+
+	return nil
+}
+
+func (s *memStorage) snapshotState() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := make(map[string]string, len(s.state))
+	for key, value := range s.state {
+		state[key] = value
+	}
+
+	return state
+}
+
+func (s *memStorage) restored() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.restoredChunks
+}
+
+// memSnapshot is sent as single chunk holding the state as JSON.
+type memSnapshot struct {
+	index  uint64
+	term   uint64
+	config Configuration
+	data   []byte
+}
+
+func (s *memSnapshot) Index() uint64 {
+	return s.index
+}
+
+func (s *memSnapshot) Term() uint64 {
+	return s.term
+}
+
+func (s *memSnapshot) Configuration() Configuration {
+	return s.config
+}
+
+func (s *memSnapshot) Read(cursor []byte, maxBytes int) (chunk, next []byte, err error) {
+	return s.data, nil, nil
+}
+
+func (s *memSnapshot) Release() {}
+
+// testCluster connects nodes in-process, delivering requests by calling
+// handlers of the peer. Partitioned node neither sends nor receives.
+type testCluster struct {
+	t         *testing.T
+	threshold uint64
+
+	mutex       sync.Mutex
+	nodes       map[string]*Node
+	storages    map[string]*memStorage
+	partitioned map[string]bool
+}
+
+func newTestCluster(t *testing.T, threshold uint64, ids ...string) *testCluster {
+	c := &testCluster{
+		t:           t,
+		threshold:   threshold,
+		nodes:       make(map[string]*Node),
+		storages:    make(map[string]*memStorage),
+		partitioned: make(map[string]bool),
+	}
+	t.Cleanup(c.stop)
+
+	for _, id := range ids {
+		c.start(id, ids)
+	}
+
+	return c
+}
+
+// Start node with empty storage and given initial configuration.
+func (c *testCluster) start(id string, bootstrap []string) {
+	c.t.Helper()
+
+	storage := newMemStorage()
+
+	node, err := NewNode(Config{
+		ID:                  id,
+		Bootstrap:           bootstrap,
+		Storage:             storage,
+		Transport:           &loopbackTransport{cluster: c, from: id},
+		HeartbeatInterval:   testHeartbeatInterval,
+		ElectionTimeout:     testElectionTimeout,
+		CompactionThreshold: c.threshold,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nodes[id] = node
+	c.storages[id] = storage
+}
+
+func (c *testCluster) stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, node := range c.nodes {
+		node.Stop()
+	}
+}
+
+func (c *testCluster) node(id string) *Node {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.nodes[id]
+}
+
+func (c *testCluster) storage(id string) *memStorage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.storages[id]
+}
+
+func (c *testCluster) partition(id string, partitioned bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.partitioned[id] = partitioned
+}
+
+// Node handling requests sent from one node to another.
+func (c *testCluster) route(from, to string) (*Node, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	node, ok := c.nodes[to]
+	if !ok || c.partitioned[from] || c.partitioned[to] {
+		return nil, errUnreachable
+	}
+
+	return node, nil
+}
+
+// Wait until all reachable nodes among ids agree on leader elected among
+// them.
+func (c *testCluster) waitLeader(ids ...string) string {
+	c.t.Helper()
+
+	var leader string
+
+	c.eventually(func() bool {
+		leader = ""
+
+		for _, id := range ids {
+			status := c.node(id).Status()
+			if status.Role == roleLeader.String() {
+				leader = id
+			}
+		}
+		if leader == "" {
+			return false
+		}
+
+		for _, id := range ids {
+			if c.node(id).Leader() != leader {
+				return false
+			}
+		}
+
+		return true
+	}, "no leader agreed by %v", ids)
+
+	return leader
+}
+
+// Propose command to leader elected among ids, retrying until it is
+// applied.
+func (c *testCluster) propose(ids []string, key, value string) {
+	c.t.Helper()
+
+	c.eventually(func() bool {
+		return c.node(c.waitLeader(ids...)).Propose([]byte(key+"="+value), testTimeout) == nil
+	}, "proposing %s=%s", key, value)
+}
+
+// Wait until state of all given nodes equals want.
+func (c *testCluster) waitState(want map[string]string, ids ...string) {
+	c.t.Helper()
+
+	for _, id := range ids {
+		storage := c.storage(id)
+		c.eventually(func() bool {
+			return reflect.DeepEqual(storage.snapshotState(), want)
+		}, "state of node '%s' is %v, want %v", id, storage.snapshotState(), want)
+	}
+}
+
+func (c *testCluster) eventually(cond func() bool, format string, args ...any) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf(format, args...)
+		}
+		time.Sleep(testHeartbeatInterval)
+	}
+}
+
+type loopbackTransport struct {
+	cluster *testCluster
+	from    string
+}
+
+func (t *loopbackTransport) RequestVote(peer string, req *VoteRequest) (*VoteResponse, error) {
+	node, err := t.cluster.route(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.HandleVote(req), nil
+}
+
+func (t *loopbackTransport) AppendEntries(peer string, req *AppendRequest) (*AppendResponse, error) {
+	node, err := t.cluster.route(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.HandleAppend(req)
+}
+
+func (t *loopbackTransport) InstallSnapshot(peer string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	node, err := t.cluster.route(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.HandleSnapshot(req)
+}
+
+func others(ids []string, id string) []string {
+	var rest []string
+	for _, other := range ids {
+		if other != id {
+			rest = append(rest, other)
+		}
+	}
+
+	return rest
+}
+
+func sorted(ids []string) []string {
+	ids = append([]string(nil), ids...)
+	sort.Strings(ids)
+	return ids
+}
+
+// Single leader is elected, and it commits the initial configuration.
+func TestElection(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, 1000, ids...)
+
+	leader := c.waitLeader(ids...)
+
+	for _, id := range ids {
+		id := id
+		c.eventually(func() bool {
+			config, committed := c.node(id).Configuration()
+			return committed && config.Index > 0 && reflect.DeepEqual(sorted(config.Members), ids)
+		}, "initial configuration not committed on node '%s'", id)
+	}
+
+	term := c.node(leader).Status().Term
+	for _, id := range others(ids, leader) {
+		if status := c.node(id).Status(); status.Role != roleFollower.String() || status.Term != term {
+			t.Fatalf("node '%s' is %s in term %d, leader '%s' in term %d", id, status.Role, status.Term, leader, term)
+		}
+	}
+}
+
+// Partitioned leader is replaced, and catches up once reachable again.
+func TestLeaderFailover(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, 1000, ids...)
+
+	c.propose(ids, "x", "1")
+
+	old := c.waitLeader(ids...)
+	c.partition(old, true)
+
+	rest := others(ids, old)
+	leader := c.waitLeader(rest...)
+	if leader == old {
+		t.Fatalf("partitioned node '%s' still leads", old)
+	}
+
+	c.propose(rest, "y", "2")
+
+	// Old leader can't reach majority.
+	c.eventually(func() bool {
+		return c.node(old).Status().Role != roleLeader.String()
+	}, "partitioned leader '%s' didn't step down", old)
+
+	if err := c.node(old).Propose([]byte("z=3"), testElectionTimeout); err == nil {
+		t.Fatal("partitioned node accepted proposal")
+	}
+
+	c.partition(old, false)
+	c.waitState(map[string]string{"x": "1", "y": "2"}, ids...)
+	c.waitLeader(ids...)
+}
+
+// Applied entries are removed from log of every node.
+func TestLogCompaction(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, 10, ids...)
+
+	want := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%d", i)
+		c.propose(ids, key, "v")
+		want[key] = "v"
+	}
+
+	c.waitState(want, ids...)
+
+	for _, id := range ids {
+		id := id
+		c.eventually(func() bool {
+			status := c.node(id).Status()
+			return status.Compacted > 0 && status.LastIndex-status.Compacted <= 10
+		}, "log of node '%s' not compacted", id)
+	}
+}
+
+// Follower missing compacted entries receives snapshot of the state.
+func TestSnapshotInstall(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, 5, ids...)
+
+	c.propose(ids, "k", "0")
+
+	lagging := others(ids, c.waitLeader(ids...))[0]
+	c.partition(lagging, true)
+
+	rest := others(ids, lagging)
+	want := map[string]string{"k": "0"}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("k%d", i)
+		c.propose(rest, key, "v")
+		want[key] = "v"
+	}
+
+	c.partition(lagging, false)
+	c.waitState(want, ids...)
+
+	if c.storage(lagging).restored() == 0 {
+		t.Fatalf("node '%s' caught up without snapshot", lagging)
+	}
+
+	c.propose(ids, "after", "snapshot")
+	want["after"] = "snapshot"
+	c.waitState(want, ids...)
+}
+
+// Members are added and removed through the log, including the leader.
+func TestMembershipChange(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, 5, ids...)
+
+	want := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%d", i)
+		c.propose(ids, key, "v")
+		want[key] = "v"
+	}
+
+	// New node without configuration waits to be added.
+	c.start("d", nil)
+	all := []string{"a", "b", "c", "d"}
+
+	if err := c.node(c.waitLeader(ids...)).AddMember("d", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	c.waitState(want, all...)
+
+	c.eventually(func() bool {
+		config, committed := c.node("d").Configuration()
+		return committed && reflect.DeepEqual(sorted(config.Members), all)
+	}, "added node didn't learn configuration")
+
+	// Configuration of four members needs three of them.
+	leader := c.waitLeader(all...)
+	removed := others(all, leader)[0]
+
+	if err := c.node(leader).RemoveMember(removed, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	c.partition(removed, true)
+
+	rest := others(all, removed)
+	c.propose(rest, "removed", removed)
+	want["removed"] = removed
+
+	// Leader removing itself steps down for the remaining members.
+	leader = c.waitLeader(rest...)
+	if err := c.node(leader).RemoveMember(leader, testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	rest = others(rest, leader)
+	c.eventually(func() bool {
+		elected := c.waitLeader(rest...)
+		config, committed := c.node(elected).Configuration()
+		return elected != leader && committed && reflect.DeepEqual(sorted(config.Members), sorted(rest))
+	}, "no leader elected after leader '%s' was removed", leader)
+
+	c.propose(rest, "leader", leader)
+	want["leader"] = leader
+	c.waitState(want, rest...)
+}
+
+// Configuration changes one member at a time.
+func TestConfigurationPending(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, 1000, ids...)
+
+	leader := c.waitLeader(ids...)
+	c.eventually(func() bool {
+		_, committed := c.node(leader).Configuration()
+		return committed
+	}, "initial configuration not committed")
+
+	for _, id := range others(ids, leader) {
+		c.partition(id, true)
+	}
+
+	if err := c.node(leader).AddMember("d", testHeartbeatInterval); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got error %v, want timeout", err)
+	}
+
+	if err := c.node(leader).RemoveMember("d", testHeartbeatInterval); !errors.Is(err, ErrConfigurationPending) {
+		t.Fatalf("got error %v, want pending configuration", err)
+	}
+
+	config, committed := c.node(leader).Configuration()
+	if committed || len(config.Members) != 4 {
+		t.Fatalf("got configuration %v (committed %t), want uncommitted one of four members", config.Members, committed)
+	}
+}
@@ -0,0 +1,231 @@
+// Package resp implements minimal RESP client used for communication between
+// members of the cluster.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum size of bulk string or array accepted in reply.
+	maxReplySize = 512 << 20
+	// Maximum number of array items allocated before they are read, so
+	// that announced size of array doesn't allocate memory by itself.
+	maxArrayPrealloc = 1024
+)
+
+var errMalformedReply = errors.New("malformed reply")
+
+// Error is error reply of the server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Client is connection to RESP server. Commands are sent one at a time, so
+// the client may be shared by multiple goroutines.
+type Client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	timeout time.Duration
+	mutex   sync.Mutex
+	broken  bool
+}
+
+// Dial connects to server on given address. Timeout applies to connecting
+// and to each command.
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		timeout: timeout,
+	}, nil
+}
+
+// Do sends command and returns its reply: string for simple strings,
+// []byte for bulk strings, int64 for integers, []any for arrays and nil for
+// null replies. Error replies are returned as Error.
+func (c *Client) Do(args ...[]byte) (any, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.broken {
+		return nil, fmt.Errorf("connection to %s broken", c.conn.RemoteAddr())
+	}
+
+	reply, err := c.do(args)
+
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) {
+		// Reply may have been read only partially.
+		c.broken = true
+	}
+
+	return reply, err
+}
+
+// Broken returns whether the connection failed and must be replaced.
+func (c *Client) Broken() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.broken
+}
+
+// Close the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) do(args [][]byte) (any, error) {
+	if c.timeout > 0 {
+		if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.writer, "$%d\r\n", len(arg))
+		c.writer.Write(arg)          //nolint:errcheck // Error is sticky, returned by Flush.
+		c.writer.WriteString("\r\n") //nolint:errcheck // Error is sticky, returned by Flush.
+	}
+
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	return c.read()
+}
+
+func (c *Client) read() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errMalformedReply
+	}
+
+	kind, text := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return text, nil
+	case '-':
+		return nil, Error(text)
+	case ':':
+		return strconv.ParseInt(text, 10, 64)
+	case '$':
+		return c.readBulk(text)
+	case '*':
+		return c.readArray(text)
+	default:
+		return nil, errMalformedReply
+	}
+}
+
+func (c *Client) readBulk(text string) (any, error) {
+	size, err := strconv.Atoi(text)
+	if err != nil || size > maxReplySize {
+		return nil, errMalformedReply
+	}
+
+	if size < 0 {
+		return nil, nil
+	}
+
+	value := make([]byte, size+2)
+	if _, err := io.ReadFull(c.reader, value); err != nil {
+		return nil, err
+	}
+
+	return value[:size], nil
+}
+
+func (c *Client) readArray(text string) (any, error) {
+	count, err := strconv.Atoi(text)
+	if err != nil || count > maxReplySize {
+		return nil, errMalformedReply
+	}
+
+	if count < 0 {
+		return nil, nil
+	}
+
+	capacity := count
+	if capacity > maxArrayPrealloc {
+		capacity = maxArrayPrealloc
+	}
+
+	// Error replies of nested elements are kept as values, so that the rest
+	// of the array is still read.
+	items := make([]any, 0, capacity)
+	for i := 0; i < count; i++ {
+		item, err := c.read()
+
+		var replyErr Error
+		if errors.As(err, &replyErr) {
+			item, err = replyErr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// Int converts integer reply (or integer in string reply) into int64.
+func Int(reply any) (int64, error) {
+	switch value := reply.(type) {
+	case int64:
+		return value, nil
+	case string:
+		return strconv.ParseInt(value, 10, 64)
+	case []byte:
+		return strconv.ParseInt(string(value), 10, 64)
+	default:
+		return 0, fmt.Errorf("%w: expected integer, got %T", errMalformedReply, reply)
+	}
+}
+
+// Bytes converts simple or bulk string reply into bytes.
+func Bytes(reply any) ([]byte, error) {
+	switch value := reply.(type) {
+	case []byte:
+		return value, nil
+	case string:
+		return []byte(value), nil
+	default:
+		return nil, fmt.Errorf("%w: expected string, got %T", errMalformedReply, reply)
+	}
+}
+
+// Array converts array reply into its elements.
+func Array(reply any) ([]any, error) {
+	items, ok := reply.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected array, got %T", errMalformedReply, reply)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,565 @@
+// Package schema implements validation of JSON documents against a subset
+// of JSON Schema.
+//
+// Supported keywords are type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, uniqueItems, minimum,
+// maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, minLength,
+// maxLength, pattern, allOf, anyOf, oneOf and not. Other keywords (e.g.
+// $schema, title or description) are ignored. References ($ref) are not
+// supported.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled JSON Schema.
+type Schema struct {
+	types []string
+	enum  []any
+	konst *any
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+
+	items       *Schema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	allOf []*Schema
+	anyOf []*Schema
+	oneOf []*Schema
+	not   *Schema
+
+	// Boolean schema, only set for "true" and "false" schemas.
+	always *bool
+}
+
+var knownTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// Compile JSON Schema definition.
+func Compile(definition []byte) (*Schema, error) {
+	var raw any
+	if err := decode(definition, &raw); err != nil {
+		return nil, fmt.Errorf("parsing schema: %v", err)
+	}
+
+	return compile(raw, "")
+}
+
+// Validate JSON document against the schema.
+func (s *Schema) Validate(document []byte) error {
+	var value any
+	if err := decode(document, &value); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	return s.validate(value, "")
+}
+
+func decode(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+
+	if decoder.More() {
+		return fmt.Errorf("unexpected data after JSON value")
+	}
+
+	return nil
+}
+
+//nolint:gocyclo,funlen // Keywords are compiled one by one.
+func compile(raw any, path string) (*Schema, error) {
+	if b, ok := raw.(bool); ok {
+		return &Schema{always: &b}, nil
+	}
+
+	def, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be object or boolean", pointer(path))
+	}
+
+	s := &Schema{}
+	var err error
+
+	switch t := def["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []any:
+		for _, item := range t {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/type: type names must be strings", pointer(path))
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("%s/type: must be string or array", pointer(path))
+	}
+	for _, t := range s.types {
+		if !knownTypes[t] {
+			return nil, fmt.Errorf("%s/type: unknown type '%s'", pointer(path), t)
+		}
+	}
+
+	if enum, ok := def["enum"]; ok {
+		if s.enum, ok = enum.([]any); !ok {
+			return nil, fmt.Errorf("%s/enum: must be array", pointer(path))
+		}
+	}
+
+	if konst, ok := def["const"]; ok {
+		s.konst = &konst
+	}
+
+	if props, ok := def["properties"]; ok {
+		propsMap, ok := props.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s/properties: must be object", pointer(path))
+		}
+
+		s.properties = make(map[string]*Schema, len(propsMap))
+		for name, prop := range propsMap {
+			if s.properties[name], err = compile(prop, path+"/properties/"+escape(name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if required, ok := def["required"]; ok {
+		list, ok := required.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s/required: must be array", pointer(path))
+		}
+		for _, item := range list {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s/required: property names must be strings", pointer(path))
+			}
+			s.required = append(s.required, name)
+		}
+	}
+
+	if additional, ok := def["additionalProperties"]; ok {
+		if s.additionalProperties, err = compile(additional, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+
+	if items, ok := def["items"]; ok {
+		if s.items, err = compile(items, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.uniqueItems, err = boolKeyword(def, "uniqueItems", path); err != nil {
+		return nil, err
+	}
+
+	for keyword, target := range map[string]**int{
+		"minItems":  &s.minItems,
+		"maxItems":  &s.maxItems,
+		"minLength": &s.minLength,
+		"maxLength": &s.maxLength,
+	} {
+		if *target, err = intKeyword(def, keyword, path); err != nil {
+			return nil, err
+		}
+	}
+
+	for keyword, target := range map[string]**float64{
+		"minimum":          &s.minimum,
+		"maximum":          &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMinimum,
+		"exclusiveMaximum": &s.exclusiveMaximum,
+		"multipleOf":       &s.multipleOf,
+	} {
+		if *target, err = numberKeyword(def, keyword, path); err != nil {
+			return nil, err
+		}
+	}
+	if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return nil, fmt.Errorf("%s/multipleOf: must be greater than 0", pointer(path))
+	}
+
+	if pattern, ok := def["pattern"]; ok {
+		expr, ok := pattern.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s/pattern: must be string", pointer(path))
+		}
+		if s.pattern, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("%s/pattern: %v", pointer(path), err)
+		}
+	}
+
+	for keyword, target := range map[string]*[]*Schema{
+		"allOf": &s.allOf,
+		"anyOf": &s.anyOf,
+		"oneOf": &s.oneOf,
+	} {
+		if *target, err = schemaListKeyword(def, keyword, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if not, ok := def["not"]; ok {
+		if s.not, err = compile(not, path+"/not"); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func boolKeyword(def map[string]any, keyword, path string) (bool, error) {
+	raw, ok := def[keyword]
+	if !ok {
+		return false, nil
+	}
+
+	value, ok := raw.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s/%s: must be boolean", pointer(path), keyword)
+	}
+
+	return value, nil
+}
+
+func intKeyword(def map[string]any, keyword, path string) (*int, error) {
+	number, err := numberKeyword(def, keyword, path)
+	if number == nil || err != nil {
+		return nil, err
+	}
+
+	if *number < 0 || *number != math.Trunc(*number) {
+		return nil, fmt.Errorf("%s/%s: must be non-negative integer", pointer(path), keyword)
+	}
+
+	value := int(*number)
+	return &value, nil
+}
+
+func numberKeyword(def map[string]any, keyword, path string) (*float64, error) {
+	raw, ok := def[keyword]
+	if !ok {
+		return nil, nil
+	}
+
+	number, ok := raw.(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("%s/%s: must be number", pointer(path), keyword)
+	}
+
+	value, err := number.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: %v", pointer(path), keyword, err)
+	}
+
+	return &value, nil
+}
+
+func schemaListKeyword(def map[string]any, keyword, path string) ([]*Schema, error) {
+	raw, ok := def[keyword]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := raw.([]any)
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%s/%s: must be non-empty array", pointer(path), keyword)
+	}
+
+	schemas := make([]*Schema, 0, len(list))
+	for i, item := range list {
+		s, err := compile(item, fmt.Sprintf("%s/%s/%d", path, keyword, i))
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, s)
+	}
+
+	return schemas, nil
+}
+
+//nolint:gocyclo,funlen // Keywords are validated one by one.
+func (s *Schema) validate(value any, path string) error {
+	if s.always != nil {
+		if !*s.always {
+			return fmt.Errorf("%s: no value allowed", pointer(path))
+		}
+		return nil
+	}
+
+	if len(s.types) > 0 && !matchesType(value, s.types) {
+		return fmt.Errorf("%s: expected %s, got %s", pointer(path), strings.Join(s.types, " or "), typeOf(value))
+	}
+
+	if s.enum != nil {
+		found := false
+		for _, allowed := range s.enum {
+			if equal(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", pointer(path))
+		}
+	}
+
+	if s.konst != nil && !equal(value, *s.konst) {
+		return fmt.Errorf("%s: value does not match const", pointer(path))
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property '%s'", pointer(path), name)
+			}
+		}
+
+		for name, item := range v {
+			itemPath := path + "/" + escape(name)
+
+			if prop, ok := s.properties[name]; ok {
+				if err := prop.validate(item, itemPath); err != nil {
+					return err
+				}
+			} else if s.additionalProperties != nil {
+				if a := s.additionalProperties.always; a != nil && !*a {
+					return fmt.Errorf("%s: unexpected property '%s'", pointer(path), name)
+				}
+				if err := s.additionalProperties.validate(item, itemPath); err != nil {
+					return err
+				}
+			}
+		}
+	case []any:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return fmt.Errorf("%s: expected at least %d items, got %d", pointer(path), *s.minItems, len(v))
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return fmt.Errorf("%s: expected at most %d items, got %d", pointer(path), *s.maxItems, len(v))
+		}
+
+		if s.uniqueItems {
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if equal(v[i], v[j]) {
+						return fmt.Errorf("%s: items %d and %d are equal", pointer(path), i, j)
+					}
+				}
+			}
+		}
+
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.validate(item, fmt.Sprintf("%s/%d", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case json.Number:
+		if err := s.validateNumber(v, path); err != nil {
+			return err
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			return fmt.Errorf("%s: expected at least %d characters, got %d", pointer(path), *s.minLength, length)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			return fmt.Errorf("%s: expected at most %d characters, got %d", pointer(path), *s.maxLength, length)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: does not match pattern '%s'", pointer(path), s.pattern)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.validate(value, path); err != nil {
+			return err
+		}
+	}
+
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.validate(value, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: does not match any schema of anyOf", pointer(path))
+		}
+	}
+
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(value, path) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: matches %d schemas of oneOf, expected exactly one", pointer(path), matched)
+		}
+	}
+
+	if s.not != nil && s.not.validate(value, path) == nil {
+		return fmt.Errorf("%s: matches schema of not", pointer(path))
+	}
+
+	return nil
+}
+
+func (s *Schema) validateNumber(number json.Number, path string) error {
+	value, err := number.Float64()
+	if err != nil {
+		return fmt.Errorf("%s: %v", pointer(path), err)
+	}
+
+	switch {
+	case s.minimum != nil && value < *s.minimum:
+		return fmt.Errorf("%s: %v is less than minimum %v", pointer(path), number, *s.minimum)
+	case s.maximum != nil && value > *s.maximum:
+		return fmt.Errorf("%s: %v is greater than maximum %v", pointer(path), number, *s.maximum)
+	case s.exclusiveMinimum != nil && value <= *s.exclusiveMinimum:
+		return fmt.Errorf("%s: %v is not greater than %v", pointer(path), number, *s.exclusiveMinimum)
+	case s.exclusiveMaximum != nil && value >= *s.exclusiveMaximum:
+		return fmt.Errorf("%s: %v is not less than %v", pointer(path), number, *s.exclusiveMaximum)
+	case s.multipleOf != nil && !isMultiple(value, *s.multipleOf):
+		return fmt.Errorf("%s: %v is not multiple of %v", pointer(path), number, *s.multipleOf)
+	}
+
+	return nil
+}
+
+// Whether value is multiple of divisor. Decimal fractions (e.g. 0.1) aren't
+// exact in binary floating point, so the quotient is compared with nearest
+// integer with tolerance relative to the divisor, not to the value.
+func isMultiple(value, divisor float64) bool {
+	const tolerance = 1e-9
+
+	quotient := value / divisor
+	if math.IsInf(quotient, 0) {
+		return false
+	}
+
+	return math.Abs(quotient-math.Round(quotient)) <= tolerance
+}
+
+func matchesType(value any, types []string) bool {
+	actual := typeOf(value)
+
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func typeOf(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// Compare JSON values, treating numbers by value.
+func equal(a, b any) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, aerr := an.Float64()
+		bf, berr := bn.Float64()
+		return aerr == nil && berr == nil && af == bf
+	}
+
+	switch av := a.(type) {
+	case []any:
+		bv, ok := b.([]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for key, item := range av {
+			other, ok := bv[key]
+			if !ok || !equal(item, other) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+// JSON pointer of the document root is empty, show it as "/" in errors.
+func pointer(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	return path
+}
+
+func escape(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,344 @@
+package schema
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		keyword  string
+		schema   string
+		accepted []string
+		rejected []string
+	}{
+		{
+			keyword:  "boolean schema true",
+			schema:   `true`,
+			accepted: []string{`null`, `1`, `"a"`, `{"a":[]}`},
+		},
+		{
+			keyword:  "boolean schema false",
+			schema:   `false`,
+			rejected: []string{`null`, `1`, `{}`},
+		},
+		{
+			keyword:  "empty schema",
+			schema:   `{}`,
+			accepted: []string{`null`, `true`, `1.5`, `"a"`, `[]`, `{}`},
+		},
+		{
+			keyword:  "type null",
+			schema:   `{"type":"null"}`,
+			accepted: []string{`null`},
+			rejected: []string{`false`, `0`, `""`, `[]`, `{}`},
+		},
+		{
+			keyword:  "type boolean",
+			schema:   `{"type":"boolean"}`,
+			accepted: []string{`true`, `false`},
+			rejected: []string{`null`, `0`, `"true"`},
+		},
+		{
+			keyword:  "type object",
+			schema:   `{"type":"object"}`,
+			accepted: []string{`{}`, `{"a":1}`},
+			rejected: []string{`[]`, `null`, `"{}"`},
+		},
+		{
+			keyword:  "type array",
+			schema:   `{"type":"array"}`,
+			accepted: []string{`[]`, `[1,"a"]`},
+			rejected: []string{`{}`, `"[]"`},
+		},
+		{
+			keyword:  "type number",
+			schema:   `{"type":"number"}`,
+			accepted: []string{`1`, `-1.5`, `1e3`, `0`},
+			rejected: []string{`"1"`, `null`, `true`},
+		},
+		{
+			keyword:  "type integer",
+			schema:   `{"type":"integer"}`,
+			accepted: []string{`1`, `-7`, `1.0`, `1e3`},
+			rejected: []string{`1.5`, `"1"`, `1e-3`},
+		},
+		{
+			keyword:  "type string",
+			schema:   `{"type":"string"}`,
+			accepted: []string{`""`, `"a"`},
+			rejected: []string{`1`, `null`, `["a"]`},
+		},
+		{
+			keyword:  "type list",
+			schema:   `{"type":["string","null"]}`,
+			accepted: []string{`"a"`, `null`},
+			rejected: []string{`1`, `{}`},
+		},
+		{
+			keyword:  "enum",
+			schema:   `{"enum":["a",1,null,[1,2],{"b":true}]}`,
+			accepted: []string{`"a"`, `1`, `1.0`, `null`, `[1,2]`, `{"b":true}`},
+			rejected: []string{`"b"`, `2`, `[2,1]`, `{"b":false}`, `true`},
+		},
+		{
+			keyword:  "const",
+			schema:   `{"const":{"a":[1,"x"]}}`,
+			accepted: []string{`{"a":[1,"x"]}`, `{"a":[1.0,"x"]}`},
+			rejected: []string{`{"a":[1]}`, `{"a":[1,"x"],"b":1}`, `{"a":["x",1]}`},
+		},
+		{
+			keyword:  "const null",
+			schema:   `{"const":null}`,
+			accepted: []string{`null`},
+			rejected: []string{`0`, `false`, `""`},
+		},
+		{
+			keyword:  "properties",
+			schema:   `{"properties":{"a":{"type":"integer"},"b/c":{"type":"string"}}}`,
+			accepted: []string{`{}`, `{"a":1}`, `{"b/c":"x"}`, `{"other":null}`, `[]`, `1`},
+			rejected: []string{`{"a":"1"}`, `{"b/c":1}`},
+		},
+		{
+			keyword:  "required",
+			schema:   `{"required":["a","b"]}`,
+			accepted: []string{`{"a":1,"b":null}`, `{"a":1,"b":2,"c":3}`, `"not an object"`},
+			rejected: []string{`{}`, `{"a":1}`, `{"b":1}`},
+		},
+		{
+			keyword:  "additionalProperties false",
+			schema:   `{"properties":{"a":{}},"additionalProperties":false}`,
+			accepted: []string{`{}`, `{"a":1}`},
+			rejected: []string{`{"b":1}`, `{"a":1,"b":1}`},
+		},
+		{
+			keyword:  "additionalProperties schema",
+			schema:   `{"properties":{"a":{}},"additionalProperties":{"type":"number"}}`,
+			accepted: []string{`{"a":"x"}`, `{"b":1,"c":2.5}`},
+			rejected: []string{`{"b":"x"}`},
+		},
+		{
+			keyword:  "items",
+			schema:   `{"items":{"type":"string"}}`,
+			accepted: []string{`[]`, `["a","b"]`, `{"a":1}`},
+			rejected: []string{`["a",1]`, `[null]`},
+		},
+		{
+			keyword:  "minItems and maxItems",
+			schema:   `{"minItems":1,"maxItems":2}`,
+			accepted: []string{`[1]`, `[1,2]`, `"abc"`},
+			rejected: []string{`[]`, `[1,2,3]`},
+		},
+		{
+			keyword: "uniqueItems",
+			schema:  `{"uniqueItems":true}`,
+			accepted: []string{
+				`[]`,
+				`[1,2,3]`,
+				`[1,"1"]`,
+				`[true,1]`,
+				`[false,0,null,""]`,
+				`[[1,2],[2,1]]`,
+				`[{"a":1},{"a":2}]`,
+				`[{"a":1},{"a":1,"b":1}]`,
+				`[[1],[[1]]]`,
+			},
+			rejected: []string{
+				`[1,1]`,
+				`[1,1.0]`,
+				`[1,1e0]`,
+				`["a","b","a"]`,
+				`[null,null]`,
+				`[[1,2],[1,2]]`,
+				`[{"a":1,"b":2},{"b":2,"a":1}]`,
+				`[{"a":[1,{"b":1}]},{"a":[1.0,{"b":1e0}]}]`,
+			},
+		},
+		{
+			keyword:  "uniqueItems false",
+			schema:   `{"uniqueItems":false}`,
+			accepted: []string{`[1,1]`},
+		},
+		{
+			keyword:  "minimum and maximum",
+			schema:   `{"minimum":1,"maximum":10}`,
+			accepted: []string{`1`, `5.5`, `10`, `"0"`},
+			rejected: []string{`0.999`, `10.001`, `-1`},
+		},
+		{
+			keyword:  "exclusiveMinimum and exclusiveMaximum",
+			schema:   `{"exclusiveMinimum":1,"exclusiveMaximum":10}`,
+			accepted: []string{`1.001`, `9.999`},
+			rejected: []string{`1`, `10`},
+		},
+		{
+			keyword:  "multipleOf integer",
+			schema:   `{"multipleOf":3}`,
+			accepted: []string{`0`, `3`, `-9`, `3e10`, `"1"`},
+			rejected: []string{`1`, `4.5`, `-10`},
+		},
+		{
+			keyword:  "multipleOf decimal fraction",
+			schema:   `{"multipleOf":0.1}`,
+			accepted: []string{`0.3`, `0.7`, `1.1`, `-2.3`, `4`, `1e10`, `123456.7`},
+			rejected: []string{`0.35`, `0.01`, `1.05`},
+		},
+		{
+			keyword:  "multipleOf small",
+			schema:   `{"multipleOf":0.0001}`,
+			accepted: []string{`0.0003`, `19.99`, `1`},
+			rejected: []string{`0.00015`, `0.00001`},
+		},
+		{
+			keyword:  "multipleOf tiny",
+			schema:   `{"multipleOf":1e-10}`,
+			accepted: []string{`3e-10`, `0`},
+			rejected: []string{`1.5e-10`, `1e-11`},
+		},
+		{
+			keyword:  "multipleOf overflow",
+			schema:   `{"multipleOf":1e-300}`,
+			rejected: []string{`1e300`},
+		},
+		{
+			keyword:  "minLength and maxLength",
+			schema:   `{"minLength":2,"maxLength":3}`,
+			accepted: []string{`"ab"`, `"abc"`, `"žľť"`, `1`},
+			rejected: []string{`"a"`, `"abcd"`, `""`, `"žľťč"`},
+		},
+		{
+			keyword:  "pattern",
+			schema:   `{"pattern":"^[a-z]+-[0-9]+$"}`,
+			accepted: []string{`"abc-12"`, `12`},
+			rejected: []string{`"abc"`, `"ABC-12"`, `"abc-12x"`},
+		},
+		{
+			keyword:  "pattern unanchored",
+			schema:   `{"pattern":"x"}`,
+			accepted: []string{`"axb"`},
+			rejected: []string{`"ab"`},
+		},
+		{
+			keyword:  "allOf",
+			schema:   `{"allOf":[{"type":"integer"},{"minimum":5}]}`,
+			accepted: []string{`5`, `100`},
+			rejected: []string{`4`, `5.5`, `"5"`},
+		},
+		{
+			keyword:  "anyOf",
+			schema:   `{"anyOf":[{"type":"string"},{"minimum":5}]}`,
+			accepted: []string{`"a"`, `5`, `6.5`},
+			rejected: []string{`4`},
+		},
+		{
+			keyword:  "oneOf",
+			schema:   `{"oneOf":[{"type":"integer"},{"minimum":5}]}`,
+			accepted: []string{`4`, `5.5`},
+			rejected: []string{`5`, `4.5`},
+		},
+		{
+			keyword:  "not",
+			schema:   `{"not":{"type":"string"}}`,
+			accepted: []string{`1`, `null`, `[]`},
+			rejected: []string{`"a"`},
+		},
+		{
+			keyword:  "nested",
+			schema:   `{"type":"object","required":["tags"],"properties":{"tags":{"type":"array","items":{"type":"object","required":["name"],"properties":{"name":{"type":"string","minLength":1}},"additionalProperties":false}}}}`,
+			accepted: []string{`{"tags":[]}`, `{"tags":[{"name":"a"}]}`},
+			rejected: []string{`{"tags":[{"name":""}]}`, `{"tags":[{"name":"a","x":1}]}`, `{"tags":[{}]}`, `{"tags":{}}`},
+		},
+		{
+			keyword:  "ignored keywords",
+			schema:   `{"$schema":"https://json-schema.org/draft/2020-12/schema","title":"t","description":"d","type":"string"}`,
+			accepted: []string{`"a"`},
+			rejected: []string{`1`},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.keyword, func(t *testing.T) {
+			s, err := Compile([]byte(test.schema))
+			if err != nil {
+				t.Fatalf("compiling %s: %v", test.schema, err)
+			}
+
+			for _, document := range test.accepted {
+				if err := s.Validate([]byte(document)); err != nil {
+					t.Errorf("%s rejected by %s: %v", document, test.schema, err)
+				}
+			}
+
+			for _, document := range test.rejected {
+				if err := s.Validate([]byte(document)); err == nil {
+					t.Errorf("%s accepted by %s", document, test.schema)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateInvalidDocument(t *testing.T) {
+	s, err := Compile([]byte(`true`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, document := range []string{``, `{`, `{"a":1}x`, `{"a":1} {}`, `'a'`} {
+		if err := s.Validate([]byte(document)); err == nil {
+			t.Errorf("invalid JSON %q accepted", document)
+		}
+	}
+}
+
+func TestValidateErrorPath(t *testing.T) {
+	s, err := Compile([]byte(`{"properties":{"a/b":{"items":{"type":"string"}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Validate([]byte(`{"a/b":["x",1]}`))
+	if err == nil || !strings.HasPrefix(err.Error(), "/a~1b/1:") {
+		t.Fatalf("got error %v, want one at /a~1b/1", err)
+	}
+}
+
+func TestCompileInvalid(t *testing.T) {
+	tests := []struct {
+		schema string
+		error  string
+	}{
+		{`not json`, "parsing schema"},
+		{`1`, "schema must be object or boolean"},
+		{`{"type":"float"}`, "unknown type 'float'"},
+		{`{"type":1}`, "must be string or array"},
+		{`{"type":["string",1]}`, "type names must be strings"},
+		{`{"enum":"a"}`, "/enum: must be array"},
+		{`{"properties":[]}`, "/properties: must be object"},
+		{`{"properties":{"a":1}}`, "/properties/a: schema must be object or boolean"},
+		{`{"required":"a"}`, "/required: must be array"},
+		{`{"required":[1]}`, "property names must be strings"},
+		{`{"additionalProperties":"no"}`, "/additionalProperties: schema must be object"},
+		{`{"items":[]}`, "/items: schema must be object"},
+		{`{"uniqueItems":1}`, "/uniqueItems: must be boolean"},
+		{`{"minItems":-1}`, "/minItems: must be non-negative integer"},
+		{`{"maxLength":1.5}`, "/maxLength: must be non-negative integer"},
+		{`{"minimum":"1"}`, "/minimum: must be number"},
+		{`{"multipleOf":0}`, "/multipleOf: must be greater than 0"},
+		{`{"multipleOf":-1}`, "/multipleOf: must be greater than 0"},
+		{`{"pattern":1}`, "/pattern: must be string"},
+		{`{"pattern":"("}`, "/pattern:"},
+		{`{"allOf":[]}`, "/allOf: must be non-empty array"},
+		{`{"anyOf":{}}`, "/anyOf: must be non-empty array"},
+		{`{"oneOf":[{"type":"x"}]}`, "/oneOf/0/type: unknown type"},
+		{`{"not":[]}`, "/not: schema must be object"},
+	}
+
+	for _, test := range tests {
+		_, err := Compile([]byte(test.schema))
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("compiling %s returned %v, want error containing %q", test.schema, err, test.error)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Package shard implements partitioning of keys among cluster members.
+//
+// Keys are hashed into fixed number of slots (compatible with Redis Cluster,
+// including hash tags). Slots are assigned to members by consistent hashing:
+// every member has a number of virtual nodes placed on a hash ring, and each
+// slot is owned by the members of the first virtual nodes following the
+// position of the slot on the ring. Slots are spread evenly over the ring in
+// order, so that consecutive slots mostly share owners. Adding or removing
+// a member only moves the slots adjacent to its virtual nodes, and every
+// member computes the same table from the same membership.
+package shard
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// SlotCount is the number of slots keys are hashed into.
+const SlotCount = 16384
+
+// Member of the cluster owning slots.
+type Member struct {
+	// Unique name of the member.
+	Name string
+	// Address of RESP server of the member.
+	Addr string
+	// Whether the member is unreachable. Failed members keep their slots,
+	// which are served by the other owners meanwhile.
+	Failed bool
+}
+
+// Range of slots with the same owners.
+type Range struct {
+	Start, End int // Inclusive.
+	// Owners of the slots, the primary first.
+	Owners []Member
+}
+
+// Table assigns slots to members.
+type Table struct {
+	members []Member
+	// Indexes of owners of each slot into members, the primary first.
+	slots [SlotCount][]int
+}
+
+type vnode struct {
+	hash   uint64
+	member int
+}
+
+// NewTable assigns slots to members, with given number of virtual nodes per
+// member and number of owners (replicas) of each slot. Slots have fewer
+// owners if there aren't enough members.
+func NewTable(members []Member, vnodes, replicas int) *Table {
+	t := &Table{members: append([]Member(nil), members...)}
+
+	sort.Slice(t.members, func(i, j int) bool { return t.members[i].Name < t.members[j].Name })
+
+	if len(t.members) == 0 {
+		return t
+	}
+
+	ring := make([]vnode, 0, len(t.members)*vnodes)
+	for i, member := range t.members {
+		for v := 0; v < vnodes; v++ {
+			ring = append(ring, vnode{hash: hashString(member.Name + "#" + strconv.Itoa(v)), member: i})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	if replicas > len(t.members) {
+		replicas = len(t.members)
+	}
+
+	for slot := range t.slots {
+		position := uint64(slot) * (1 << 64 / SlotCount)
+		start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= position })
+
+		owners := make([]int, 0, replicas)
+		for i := 0; len(owners) < replicas; i++ {
+			member := ring[(start+i)%len(ring)].member
+			if !containsInt(owners, member) {
+				owners = append(owners, member)
+			}
+		}
+
+		t.slots[slot] = owners
+	}
+
+	return t
+}
+
+// Members returns members of the table, ordered by name.
+func (t *Table) Members() []Member {
+	return t.members
+}
+
+// Owners returns owners of slot, the primary first.
+func (t *Table) Owners(slot int) []Member {
+	owners := make([]Member, 0, len(t.slots[slot]))
+	for _, i := range t.slots[slot] {
+		owners = append(owners, t.members[i])
+	}
+
+	return owners
+}
+
+// Owns returns whether member with given name owns slot.
+func (t *Table) Owns(name string, slot int) bool {
+	for _, i := range t.slots[slot] {
+		if t.members[i].Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Ranges returns consecutive ranges of slots with the same owners.
+func (t *Table) Ranges() []Range {
+	var ranges []Range
+
+	for slot := 0; slot < SlotCount; {
+		end := slot
+		for end+1 < SlotCount && equalInts(t.slots[end+1], t.slots[slot]) {
+			end++
+		}
+
+		if len(t.slots[slot]) > 0 {
+			ranges = append(ranges, Range{Start: slot, End: end, Owners: t.Owners(slot)})
+		}
+
+		slot = end + 1
+	}
+
+	return ranges
+}
+
+// KeySlot returns slot of key. If key contains non-empty hash tag (part
+// between the first '{' and the following '}'), only the tag is hashed, so
+// that related keys can be placed into the same slot.
+func KeySlot(key []byte) int {
+	for i, c := range key {
+		if c != '{' {
+			continue
+		}
+
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j > i+1 {
+					key = key[i+1 : j]
+				}
+				break
+			}
+		}
+		break
+	}
+
+	return int(crc16(key)) % SlotCount
+}
+
+// CRC16-CCITT (XMODEM), as used by Redis Cluster.
+func crc16(data []byte) uint16 {
+	var crc uint16
+
+	for _, b := range data {
+		crc ^= uint16(b) << 8 //nolint:gomnd // Part of the CRC algorithm.
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s)) //nolint:errcheck // Hash writes never fail.
+	return mix(h.Sum64())
+}
+
+// Finalizer of SplitMix64, spreading similar inputs over the ring.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,127 @@
+package shard
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	// Slots reported by CLUSTER KEYSLOT of Redis Cluster.
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 12739},
+		{"foo", 12182},
+		{"somekey", 11058},
+		{"foo{hash_tag}", 2515},
+		{"{hash_tag}", 2515},
+		{"", 0},
+	}
+
+	for _, test := range tests {
+		if slot := KeySlot([]byte(test.key)); slot != test.slot {
+			t.Errorf("slot of '%s' is %d, want %d", test.key, slot, test.slot)
+		}
+	}
+}
+
+func TestKeySlotHashTags(t *testing.T) {
+	// Keys hashed as the other key.
+	tests := []struct {
+		key, hashed string
+	}{
+		{"{user1000}.following", "user1000"},
+		{"{user1000}.followers", "user1000"},
+		{"foo{bar}{zap}", "bar"},
+		{"foo{{bar}}zap", "{bar"},
+		{"foo{}{bar}", "foo{}{bar}"},
+		{"{}", "{}"},
+		{"{", "{"},
+		{"foo{bar", "foo{bar"},
+		{"}foo{bar}", "bar"},
+	}
+
+	for _, test := range tests {
+		if slot, want := KeySlot([]byte(test.key)), int(crc16([]byte(test.hashed)))%SlotCount; slot != want {
+			t.Errorf("slot of '%s' is %d, want slot of '%s' (%d)", test.key, slot, test.hashed, want)
+		}
+	}
+}
+
+func testMembers(count int) []Member {
+	members := make([]Member, 0, count)
+	for i := 0; i < count; i++ {
+		members = append(members, Member{Name: fmt.Sprintf("m%d", i), Addr: fmt.Sprintf("10.0.0.%d:6379", i)})
+	}
+
+	return members
+}
+
+// Every member computes the same table, regardless of the order it knows
+// the members in.
+func TestNewTableDeterministic(t *testing.T) {
+	members := testMembers(5)
+	want := NewTable(members, 64, 2).Ranges()
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		shuffled := append([]Member(nil), members...)
+		r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+
+		if got := NewTable(shuffled, 64, 2).Ranges(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("table of members %v differs", shuffled)
+		}
+	}
+}
+
+func TestNewTableOwners(t *testing.T) {
+	table := NewTable(testMembers(2), 64, 3)
+
+	for slot := 0; slot < SlotCount; slot++ {
+		if owners := table.Owners(slot); len(owners) != 2 || owners[0].Name == owners[1].Name {
+			t.Fatalf("slot %d has owners %v, want both members", slot, owners)
+		}
+	}
+
+	if ranges := NewTable(nil, 64, 2).Ranges(); len(ranges) != 0 {
+		t.Fatalf("table without members has ranges %v", ranges)
+	}
+}
+
+// Adding a member only moves slots to the new member, about its share of
+// them.
+func TestNewTableAddMember(t *testing.T) {
+	const replicas = 2
+
+	members := testMembers(5)
+	before := NewTable(members[:4], 64, replicas)
+	after := NewTable(members, 64, replicas)
+
+	added := members[4].Name
+	moved := 0
+
+	for slot := 0; slot < SlotCount; slot++ {
+		changed := false
+
+		for _, owner := range after.Owners(slot) {
+			if !before.Owns(owner.Name, slot) {
+				if owner.Name != added {
+					t.Fatalf("slot %d moved to existing member %s", slot, owner.Name)
+				}
+				changed = true
+			}
+		}
+
+		if changed {
+			moved++
+		}
+	}
+
+	// The new member owns replicas/5 of slots on average.
+	if share := SlotCount * replicas / len(members); moved == 0 || moved > share*3/2 {
+		t.Fatalf("%d slots moved, expected about %d", moved, share)
+	}
+}
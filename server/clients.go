@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pepol/databuddy/internal/context"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains tracking of connected clients and buckets they use.
+//
+// Changing bucket used by a client holds the clients lock for reading, while
+// operations that must not race with bucket users (drop, rename) hold it for
+// writing, so no client can start using a bucket that is being removed.
+
+var errBucketInUse = errors.New("bucket in use")
+
+// Create context for new connection, using the default bucket.
+func (h *Handler) newClientContext(conn redcon.Conn) error {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+
+	bucket, err := h.db.Get(h.db.DefaultBucket())
+	if err != nil {
+		return err
+	}
+
+	ctx := context.New(bucket)
+	conn.SetContext(ctx)
+	h.clients[conn] = ctx
+
+	return nil
+}
+
+// Set connection context and track it among connected clients.
+func (h *Handler) setClientContext(conn redcon.Conn, ctx *context.Context) {
+	conn.SetContext(ctx)
+
+	h.clientsMutex.Lock()
+	h.clients[conn] = ctx
+	h.clientsMutex.Unlock()
+}
+
+// Forget connection context on connection close.
+func (h *Handler) closeConnection(conn redcon.Conn, _err error) {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+
+	ctx, ok := h.clients[conn]
+	if !ok {
+		return
+	}
+
+	delete(h.clients, conn)
+	h.db.Release(ctx.Bucket())
+}
+
+// Return count of connected clients currently using given bucket.
+func (h *Handler) bucketClients(name string) int {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+
+	return len(h.bucketContextsLocked(name))
+}
+
+// Switch client to bucket with given name.
+func (h *Handler) useBucket(ctx *context.Context, name string) error {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		return err
+	}
+
+	previous := ctx.Bucket()
+	ctx.SetBucket(bucket)
+	h.db.Release(previous)
+
+	return nil
+}
+
+// Drop bucket unless it is used by any client. If force is set, clients
+// using the bucket are switched to the default bucket instead. Clients are
+// switched before the drop, so that they release the bucket, and back if the
+// drop fails.
+func (h *Handler) dropBucket(name string, force bool) error {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+
+	clients := h.bucketContextsLocked(name)
+	if len(clients) > 0 && !force {
+		return fmt.Errorf("%w by %d client(s)", errBucketInUse, len(clients))
+	}
+
+	if err := h.switchClientsLocked(clients, h.db.DefaultBucket()); err != nil {
+		h.restoreClientsLocked(clients, name)
+		return err
+	}
+
+	if err := h.db.Drop(name); err != nil {
+		h.restoreClientsLocked(clients, name)
+		return err
+	}
+
+	return nil
+}
+
+// Rename bucket unless it is used by any client other than the caller (nil
+// if none). If force is set, the bucket is renamed regardless. Clients
+// using the bucket release it during the rename and use the renamed bucket
+// afterwards.
+func (h *Handler) renameBucket(caller *context.Context, oldName, newName string, force bool) error {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+
+	clients := h.bucketContextsLocked(oldName)
+	others := len(clients)
+	if caller != nil && caller.Bucket().Name == oldName {
+		others--
+	}
+
+	if others > 0 && !force {
+		return fmt.Errorf("%w by %d other client(s)", errBucketInUse, others)
+	}
+
+	for _, ctx := range clients {
+		h.db.Release(ctx.Bucket())
+	}
+
+	err := h.db.Rename(oldName, newName)
+
+	target := newName
+	if err != nil {
+		target = oldName
+	}
+
+	for _, ctx := range clients {
+		bucket, getErr := h.db.Get(target)
+		if getErr != nil {
+			log.Error(fmt.Sprintf("switching client to bucket '%s'", target), getErr)
+			continue
+		}
+
+		ctx.SetBucket(bucket)
+	}
+
+	return err
+}
+
+// Return contexts of clients currently using given bucket.
+func (h *Handler) bucketContextsLocked(name string) []*context.Context {
+	var clients []*context.Context
+	for _, ctx := range h.clients {
+		if ctx.Bucket().Name == name {
+			clients = append(clients, ctx)
+		}
+	}
+
+	return clients
+}
+
+// Switch clients to bucket with given name. Clients already using the
+// bucket are left as they are.
+func (h *Handler) switchClientsLocked(clients []*context.Context, to string) error {
+	for _, ctx := range clients {
+		previous := ctx.Bucket()
+		if previous.Name == to {
+			continue
+		}
+
+		bucket, err := h.db.Get(to)
+		if err != nil {
+			return fmt.Errorf("switching clients to bucket '%s': %v", to, err)
+		}
+
+		ctx.SetBucket(bucket)
+		h.db.Release(previous)
+	}
+
+	return nil
+}
+
+// Switch clients back to bucket they used before a failed change.
+func (h *Handler) restoreClientsLocked(clients []*context.Context, to string) {
+	if err := h.switchClientsLocked(clients, to); err != nil {
+		log.Error("restoring buckets of clients", err)
+	}
+}
@@ -3,31 +3,61 @@ package server
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/hashicorp/serf/serf"
+	"github.com/pepol/databuddy/internal/shard"
 	"github.com/tidwall/redcon"
 )
 
 // This file contains implementation of the "cluster management" commands.
 
-const clusterArgCount = 2
+const clusterArgMinCount = 2
 
 // CLUSTER
 // Basic handler for cluster command container.
 func (h *Handler) cluster(conn redcon.Conn, cmd redcon.Command) {
-	if len(cmd.Args) != clusterArgCount {
+	if len(cmd.Args) < clusterArgMinCount {
 		wrongArgs(conn, "CLUSTER")
 		return
 	}
 
 	subcommand := strings.ToLower(string(cmd.Args[1]))
+	args := cmd.Args[2:]
+
+	switch subcommand {
+	case "keyslot", "repair", "join", "forget", "tags":
+	default:
+		if len(args) != 0 {
+			wrongArgs(conn, "CLUSTER "+strings.ToUpper(subcommand))
+			return
+		}
+	}
 
 	switch subcommand {
 	case "count": //nolint:goconst // "count" happens to be same for multiple commands, however it is independent for each.
 		h.clusterCount(conn)
 	case "peers":
 		h.clusterPeers(conn)
+	case "slots":
+		h.clusterSlots(conn)
+	case "shards":
+		h.clusterShards(conn)
+	case "keyslot":
+		h.clusterKeySlot(conn, args)
+	case "repair":
+		h.clusterRepair(conn, args)
+	case "join":
+		h.clusterJoin(conn, args)
+	case "leave":
+		h.clusterLeave(conn)
+	case "forget":
+		h.clusterForget(conn, args)
+	case "info":
+		h.clusterInfo(conn)
+	case "tags":
+		h.clusterTags(conn, args)
 	default:
 		conn.WriteError(fmt.Sprintf("ERR unknown command '%s %s'", string(cmd.Args[0]), subcommand))
 	}
@@ -51,11 +81,287 @@ func (h *Handler) clusterPeers(conn redcon.Conn) {
 	}
 }
 
+// CLUSTER SLOTS
+// Return ranges of slots with the same owners: first and last slot,
+// followed by host, port and name of each owner (the primary first). Empty
+// if keys aren't partitioned.
+func (h *Handler) clusterSlots(conn redcon.Conn) {
+	table, _ := h.sharding.current()
+	if table == nil {
+		conn.WriteArray(0)
+		return
+	}
+
+	ranges := table.Ranges()
+
+	conn.WriteArray(len(ranges))
+	for _, r := range ranges {
+		conn.WriteArray(2 + len(r.Owners))
+		conn.WriteInt(r.Start)
+		conn.WriteInt(r.End)
+
+		for _, owner := range r.Owners {
+			host, port := splitAddr(owner.Addr)
+
+			conn.WriteArray(3) //nolint:gomnd // Host, port and name.
+			conn.WriteBulkString(host)
+			conn.WriteInt(port)
+			conn.WriteBulkString(owner.Name)
+		}
+	}
+}
+
+// CLUSTER SHARDS
+// Return shards, groups of slot ranges with the same owners: ranges (as
+// flat list of first and last slots) and owners with their role and health.
+// Empty if keys aren't partitioned.
+func (h *Handler) clusterShards(conn redcon.Conn) {
+	table, _ := h.sharding.current()
+	if table == nil {
+		conn.WriteArray(0)
+		return
+	}
+
+	var (
+		order []string
+		slots = make(map[string][]int)
+		nodes = make(map[string][][]field)
+	)
+
+	for _, r := range table.Ranges() {
+		names := make([]string, 0, len(r.Owners))
+		for _, owner := range r.Owners {
+			names = append(names, owner.Name)
+		}
+		id := strings.Join(names, ",")
+
+		if nodes[id] == nil {
+			owners := make([][]field, 0, len(r.Owners))
+			for i, owner := range r.Owners {
+				host, port := splitAddr(owner.Addr)
+
+				role := "replica"
+				if i == 0 {
+					role = "master"
+				}
+
+				health := "online"
+				if owner.Failed {
+					health = "failed"
+				}
+
+				owners = append(owners, []field{
+					{"id", owner.Name},
+					{"port", port},
+					{"ip", host},
+					{"role", role},
+					{"health", health},
+				})
+			}
+
+			nodes[id] = owners
+			order = append(order, id)
+		}
+
+		slots[id] = append(slots[id], r.Start, r.End)
+	}
+
+	conn.WriteArray(len(order))
+	for _, id := range order {
+		writeFields(conn, []field{
+			{"slots", slots[id]},
+			{"nodes", nodes[id]},
+		})
+	}
+}
+
+// CLUSTER KEYSLOT <key>
+// Return slot of key.
+func (h *Handler) clusterKeySlot(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "CLUSTER KEYSLOT")
+		return
+	}
+
+	conn.WriteInt(shard.KeySlot(args[0]))
+}
+
+// CLUSTER JOIN <addr> [<addr> ...]
+// Join cluster through members at addresses (of their Serf agents),
+// returning number of members contacted successfully.
+func (h *Handler) clusterJoin(conn redcon.Conn, args [][]byte) {
+	if len(args) == 0 {
+		wrongArgs(conn, "CLUSTER JOIN")
+		return
+	}
+
+	joined, err := h.serf.Join(stringArgs(args), false)
+	if err != nil && joined == 0 {
+		conn.WriteError(fmt.Sprintf("ERR joining cluster: %v", err))
+		return
+	}
+
+	conn.WriteInt(joined)
+}
+
+// CLUSTER LEAVE
+// Leave cluster gracefully. Member keeps serving clients, but it's not part
+// of cluster (and cannot rejoin it) until restarted.
+func (h *Handler) clusterLeave(conn redcon.Conn) {
+	if err := h.serf.Leave(); err != nil {
+		conn.WriteError(fmt.Sprintf("ERR leaving cluster: %v", err))
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// CLUSTER FORGET <node>
+// Remove failed (or left) member from cluster, so that it's no longer
+// reconnected to.
+func (h *Handler) clusterForget(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "CLUSTER FORGET")
+		return
+	}
+
+	name := string(args[0])
+
+	var found *serf.Member
+	for _, member := range h.serf.Members() {
+		if member.Name == name {
+			member := member
+			found = &member
+		}
+	}
+
+	switch {
+	case found == nil:
+		conn.WriteError(fmt.Sprintf("ERR unknown member '%s'", name))
+		return
+	case found.Status == serf.StatusAlive:
+		conn.WriteError(fmt.Sprintf("ERR member '%s' is alive, only failed or left members can be forgotten", name))
+		return
+	}
+
+	if err := h.serf.RemoveFailedNode(name); err != nil {
+		conn.WriteError(fmt.Sprintf("ERR forgetting member '%s': %v", name, err))
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// CLUSTER INFO
+// Return state of this member: name, address, tags, status, health score
+// (0 is healthy, higher is worse), protocol versions and depths of Serf
+// queues.
+func (h *Handler) clusterInfo(conn redcon.Conn) {
+	member := h.serf.LocalMember()
+	stats := h.serf.Stats()
+
+	queue := func(name string) int {
+		n, _ := strconv.Atoi(stats[name])
+		return n
+	}
+
+	writeFields(conn, []field{
+		{"name", member.Name},
+		{"addr", net.JoinHostPort(member.Addr.String(), fmt.Sprintf("%d", member.Port))},
+		{"tags", member.Tags},
+		{"status", member.Status.String()},
+		{"health_score", h.serf.Memberlist().GetHealthScore()},
+		{"protocol", []uint64{uint64(member.ProtocolMin), uint64(member.ProtocolCur), uint64(member.ProtocolMax)}},
+		{"members", h.serf.NumNodes()},
+		{"event_queue", queue("event_queue")},
+		{"query_queue", queue("query_queue")},
+		{"intent_queue", queue("intent_queue")},
+		{"encrypted", h.serf.EncryptionEnabled()},
+	})
+}
+
+// CLUSTER TAGS [SET <tag> <value> [<tag> <value> ...] | DEL <tag> [<tag> ...]]
+// Return tags of this member, or change them. Changes are gossiped to
+// other members immediately. Tags used by the server itself cannot be
+// changed.
+func (h *Handler) clusterTags(conn redcon.Conn, args [][]byte) {
+	tags := make(map[string]string)
+	for tag, value := range h.serf.LocalMember().Tags {
+		tags[tag] = value
+	}
+
+	if len(args) == 0 {
+		conn.WriteAny(tags)
+		return
+	}
+
+	operation := strings.ToLower(string(args[0]))
+	args = args[1:]
+
+	var names []string
+
+	switch {
+	case operation == "set" && len(args) != 0 && len(args)%2 == 0:
+		for i := 0; i < len(args); i += 2 {
+			names = append(names, string(args[i]))
+		}
+	case operation == "del" && len(args) != 0:
+		names = stringArgs(args)
+	case operation == "set" || operation == "del":
+		wrongArgs(conn, "CLUSTER TAGS "+strings.ToUpper(operation))
+		return
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown command 'CLUSTER TAGS %s'", operation))
+		return
+	}
+
+	for i, name := range names {
+		switch name {
+		case serfRoleTag, serfRESPTag, serfRegionTag, serfZoneTag:
+			conn.WriteError(fmt.Sprintf("ERR tag '%s' is reserved", name))
+			return
+		}
+
+		if operation == "set" {
+			tags[name] = string(args[2*i+1])
+		} else {
+			delete(tags, name)
+		}
+	}
+
+	if err := h.serf.SetTags(tags); err != nil {
+		conn.WriteError(fmt.Sprintf("ERR setting tags: %v", err))
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// Host and port of address.
+func splitAddr(addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
 //nolint:gomnd // Magic numbers in command registration calls are not magic.
 func registerCluster(handler *Handler) {
-	handler.Register("cluster", handler.cluster, 1, []string{"cluster"}, 1, 1, 0, nil, []string{"CLUSTER", "container for cluster commands"})
+	handler.Register("cluster", handler.cluster, -2, []string{"cluster"}, 1, 1, 0, nil, []string{"CLUSTER", "container for cluster commands"})
 	handler.RegisterChild("cluster count", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"CLUSTER COUNT", "return count of all known members of cluster"})
 	handler.RegisterChild("cluster peers", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"CLUSTER PEERS", "return list of all known members of cluster"})
+	handler.RegisterChild("cluster slots", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"CLUSTER SLOTS", "return ranges of slots with addresses of their owners, when keys are partitioned"})
+	handler.RegisterChild("cluster shards", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"CLUSTER SHARDS", "return shards (slot ranges sharing owners) with their owners, when keys are partitioned"})
+	handler.RegisterChild("cluster keyslot", 3, []string{"cluster"}, -1, -1, 0, nil, []string{"CLUSTER KEYSLOT <key>", "return slot of key"})
+	handler.RegisterChild("cluster join", -3, []string{"cluster"}, -1, -1, 0, nil, []string{"CLUSTER JOIN <addr> [<addr> ...]", "join cluster through members at addresses, returns number of members contacted"})
+	handler.RegisterChild("cluster leave", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"CLUSTER LEAVE", "leave cluster gracefully; member keeps serving clients, but stays out of cluster until restarted"})
+	handler.RegisterChild("cluster forget", 3, []string{"cluster"}, -1, -1, 0, nil, []string{"CLUSTER FORGET <node>", "remove failed member from cluster"})
+	handler.RegisterChild("cluster info", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"CLUSTER INFO", "return state of this member: address, tags, health score, protocol versions and queue depths"})
+	handler.RegisterChild("cluster tags", -2, []string{"cluster"}, -1, -1, 0, nil, []string{"CLUSTER TAGS [SET <tag> <value> ...|DEL <tag> ...]", "return or change tags of this member, gossiping changes immediately"})
+	handler.RegisterChild("cluster repair", 3, []string{"cluster"}, 2, 2, 0, nil, []string{"CLUSTER REPAIR <bucket>", "compare bucket with every peer replicating it using Merkle trees, merging versions of differing keys (with conflict policy), and return differences found and merged"})
 }
 
 func writePeerInfo(conn redcon.Conn, member serf.Member) {
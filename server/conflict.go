@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/pepol/databuddy/internal/context"
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains commands resolving concurrent writes of buckets with
+// the siblings conflict policy. Clients read siblings of key together with
+// context (the encoded vector clock of all of them), and write the resolved
+// value back with that context, superseding just the siblings they have
+// seen.
+
+// SIBLINGS <key>
+// Return context of key followed by values of its siblings (null for
+// deletions).
+func (h *Handler) siblings(conn redcon.Conn, cmd redcon.Command) {
+	const siblingsArgsCount = 2
+
+	if len(cmd.Args) != siblingsArgsCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	siblings, clock, err := ctx.Bucket().Siblings(key)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR getting siblings of item '%s': %v", key, err))
+		return
+	}
+
+	// Marshalling map of plain values cannot fail.
+	token, _ := json.Marshal(clock)
+
+	conn.WriteArray(1 + len(siblings))
+	conn.WriteBulk(token)
+	for _, sibling := range siblings {
+		if sibling.Deleted {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulk(sibling.Value)
+		}
+	}
+}
+
+// RESOLVE <key> <context> [<value>]
+// Replace siblings of key included in context (as returned by SIBLINGS)
+// with value, or delete the key if value is not set.
+func (h *Handler) resolve(conn redcon.Conn, cmd redcon.Command) {
+	const (
+		resolveArgsMinCount = 3
+		resolveArgsMaxCount = 4
+	)
+
+	if len(cmd.Args) < resolveArgsMinCount || len(cmd.Args) > resolveArgsMaxCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+
+	var clock db.VectorClock
+	if err := json.Unmarshal(cmd.Args[2], &clock); err != nil {
+		conn.WriteError(fmt.Sprintf("ERR invalid context: %v", err))
+		return
+	}
+
+	var val []byte
+	if len(cmd.Args) == resolveArgsMaxCount {
+		val = cmd.Args[3]
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	bucket := ctx.Bucket()
+
+	err := bucket.Resolve(key, val, clock)
+	if err == nil {
+		err = h.waitReplicated(bucket)
+	}
+
+	if err != nil {
+		if errors.Is(err, db.ErrNoConflictPolicy) || errors.Is(err, db.ErrQuotaExceeded) || errors.Is(err, db.ErrSchemaViolation) {
+			conn.WriteError(fmt.Sprintf("ERR %v", err))
+			return
+		}
+		writeOpError(conn, fmt.Sprintf("resolving item '%s'", key), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+//nolint:gomnd // Magic numbers in command registration calls are not magic.
+func registerConflict(handler *Handler) {
+	handler.Register("siblings", handler.siblings, 2, []string{"read"}, 1, 1, 0, nil, []string{"SIBLINGS <key>", "return context of key followed by values of its concurrent writes (null for deletions), in buckets with siblings conflict policy"})
+	handler.Register("resolve", handler.resolve, -3, []string{"write"}, 1, 1, 0, nil, []string{"RESOLVE <key> <context> [<value>]", "replace concurrent writes of key included in context (as returned by SIBLINGS) with value, or delete key if value is not set"})
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pepol/databuddy/internal/context"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains implementation of the "connection management" commands.
+
+const (
+	// Only RESP2 is supported by the server.
+	protocolVersion = 2
+
+	// Client names of form "<bucket>/<client>" select the bucket used by
+	// the connection, so that tenants land in their own bucket on handshake.
+	clientNameBucketSeparator = "/"
+)
+
+// HELLO [<protover> [SETNAME <clientname>]]
+// Handshake with the server, optionally setting client name.
+func (h *Handler) hello(conn redcon.Conn, cmd redcon.Command) {
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	args := cmd.Args[1:]
+
+	if len(args) > 0 {
+		if string(args[0]) != fmt.Sprintf("%d", protocolVersion) {
+			conn.WriteError(fmt.Sprintf("NOPROTO unsupported protocol version '%s'", string(args[0])))
+			return
+		}
+		args = args[1:]
+	}
+
+	for len(args) > 0 {
+		option := strings.ToLower(string(args[0]))
+
+		switch {
+		case option == "setname" && len(args) > 1:
+			if err := h.setClientName(ctx, string(args[1])); err != nil {
+				conn.WriteError(fmt.Sprintf("ERR setting client name: %v", err))
+				return
+			}
+			args = args[2:]
+		case option == "auth":
+			conn.WriteError("ERR authentication is not supported")
+			return
+		default:
+			conn.WriteError(fmt.Sprintf("ERR syntax error in HELLO option '%s'", option))
+			return
+		}
+	}
+
+	writeFields(conn, []field{
+		{"server", "databuddy"},
+		{"version", h.version},
+		{"proto", protocolVersion},
+		{"bucket", ctx.Bucket().Name},
+	})
+}
+
+// CLIENT
+// Basic handler for client command container.
+func (h *Handler) client(conn redcon.Conn, cmd redcon.Command) {
+	const clientArgsMinCount = 2
+
+	if len(cmd.Args) < clientArgsMinCount {
+		wrongArgs(conn, "CLIENT")
+		return
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	subcommand := strings.ToLower(string(cmd.Args[1]))
+
+	switch subcommand {
+	case "setname":
+		h.clientSetName(conn, ctx, cmd.Args[2:])
+	case "getname":
+		h.clientGetName(conn, ctx)
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown command '%s %s'", string(cmd.Args[0]), subcommand))
+	}
+}
+
+// CLIENT SETNAME <clientname>
+// Set name of current connection.
+func (h *Handler) clientSetName(conn redcon.Conn, ctx *context.Context, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "CLIENT SETNAME")
+		return
+	}
+
+	if err := h.setClientName(ctx, string(args[0])); err != nil {
+		conn.WriteError(fmt.Sprintf("ERR setting client name: %v", err))
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// CLIENT GETNAME
+// Return name of current connection.
+func (h *Handler) clientGetName(conn redcon.Conn, ctx *context.Context) {
+	name := ctx.Name()
+	if name == "" {
+		conn.WriteNull()
+		return
+	}
+
+	conn.WriteBulkString(name)
+}
+
+// Set client name, switching to the bucket selected by the name.
+func (h *Handler) setClientName(ctx *context.Context, name string) error {
+	if strings.ContainsAny(name, " \n") {
+		return fmt.Errorf("client names cannot contain spaces or newlines")
+	}
+
+	if bucketName, _, found := strings.Cut(name, clientNameBucketSeparator); found {
+		if err := h.useBucket(ctx, bucketName); err != nil {
+			return err
+		}
+	}
+
+	ctx.SetName(name)
+	return nil
+}
+
+//nolint:gomnd // Magic numbers in command registration calls are not magic.
+func registerConnection(handler *Handler) {
+	handler.Register("hello", handler.hello, -1, []string{"connection"}, -1, -1, 0, nil, []string{"HELLO [<protover> [SETNAME <clientname>]]", "handshake with the server; client name '<bucket>/<client>' selects bucket used by the connection"})
+	handler.Register("client", handler.client, -2, []string{"connection"}, -1, -1, 0, nil, []string{"CLIENT", "container for client connection commands"})
+	handler.RegisterChild("client setname", 3, []string{"connection"}, -1, -1, 0, nil, []string{"CLIENT SETNAME <clientname>", "set name of current connection; name '<bucket>/<client>' selects bucket used by the connection"})
+	handler.RegisterChild("client getname", 2, []string{"connection"}, -1, -1, 0, nil, []string{"CLIENT GETNAME", "return name of current connection"})
+}
@@ -0,0 +1,589 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/pepol/databuddy/internal/raft"
+	"github.com/pepol/databuddy/internal/resp"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains consensus of strongly consistent buckets. Every such
+// bucket has its own Raft group formed by all kv members of the cluster,
+// which exchange Raft messages as RAFT commands over their RESP port.
+// Writes and reads of clients connected to a follower are forwarded to the
+// leader. Membership of groups is committed through their logs: leaders add
+// joined kv members and remove left ones, one member at a time.
+
+const (
+	raftHeartbeatInterval = 100 * time.Millisecond
+	raftElectionTimeout   = time.Second
+	// Number of applied entries kept in Raft log before it is compacted.
+	raftCompactionThreshold = 10000
+	// How long clients wait for write or read to complete.
+	raftTimeout = 5 * time.Second
+	// How long members wait for response to Raft message.
+	raftMessageTimeout = 2 * time.Second
+	// How often groups are started for new buckets.
+	consensusInterval = time.Second
+
+	tryAgainErrorCode = "TRYAGAIN"
+)
+
+var errNoConsensus = errors.New("consensus of bucket not running")
+
+type consensus struct {
+	mutex sync.Mutex
+	// Raft nodes by bucket name.
+	nodes map[string]*raft.Node
+	// Connections to other members by address, shared by all groups. Reads
+	// and writes forwarded to leaders use their own connections, so that
+	// they don't delay Raft messages.
+	clients    map[string]*resp.Client
+	forwarders map[string]*resp.Client
+}
+
+func newConsensus() *consensus {
+	return &consensus{
+		nodes:      make(map[string]*raft.Node),
+		clients:    make(map[string]*resp.Client),
+		forwarders: make(map[string]*resp.Client),
+	}
+}
+
+func (c *consensus) node(bucket string) *raft.Node {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.nodes[bucket]
+}
+
+// Connection to member with given address, replacing broken one.
+func (c *consensus) client(addr string, forward bool) (*resp.Client, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	clients, timeout := c.clients, raftMessageTimeout
+	if forward {
+		// Forwarded operation waits for consensus on the leader.
+		clients, timeout = c.forwarders, raftTimeout+raftMessageTimeout
+	}
+
+	if client, ok := clients[addr]; ok && !client.Broken() {
+		return client, nil
+	} else if ok {
+		client.Close() //nolint:errcheck // Connection is broken already.
+		delete(clients, addr)
+	}
+
+	client, err := resp.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	clients[addr] = client
+	return client, nil
+}
+
+// Run Raft nodes of strongly consistent buckets until the handler is
+// stopped.
+func (h *Handler) runConsensus() {
+	if h.db.ReadOnly() {
+		return
+	}
+
+	ticker := time.NewTicker(consensusInterval)
+	defer ticker.Stop()
+
+	for {
+		h.updateConsensus()
+		h.updateRaftMembers()
+
+		select {
+		case <-h.stopping:
+			h.stopConsensus()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Start nodes for new strongly consistent buckets and stop nodes of dropped
+// ones.
+func (h *Handler) updateConsensus() {
+	current := make(map[string]bool)
+	for _, name := range h.db.StrongBuckets() {
+		current[name] = true
+	}
+
+	c := h.consensus
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for name, node := range c.nodes {
+		if !current[name] {
+			node.Stop()
+			delete(c.nodes, name)
+		}
+	}
+
+	for name := range current {
+		if _, ok := c.nodes[name]; ok {
+			continue
+		}
+
+		storage, err := h.db.RaftStorage(name)
+		if err != nil {
+			log.Error(fmt.Sprintf("starting consensus of bucket '%s'", name), err)
+			continue
+		}
+
+		node, err := raft.NewNode(raft.Config{
+			ID:                  h.serf.LocalMember().Name,
+			Bootstrap:           h.raftMembers(),
+			Storage:             storage,
+			Transport:           &raftTransport{h: h, bucket: name},
+			HeartbeatInterval:   raftHeartbeatInterval,
+			ElectionTimeout:     raftElectionTimeout,
+			CompactionThreshold: raftCompactionThreshold,
+		})
+		if err != nil {
+			log.Error(fmt.Sprintf("starting consensus of bucket '%s'", name), err)
+			continue
+		}
+
+		c.nodes[name] = node
+	}
+}
+
+func (h *Handler) stopConsensus() {
+	c := h.consensus
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for name, node := range c.nodes {
+		node.Stop()
+		delete(c.nodes, name)
+	}
+
+	for _, clients := range []map[string]*resp.Client{c.clients, c.forwarders} {
+		for addr, client := range clients {
+			if err := client.Close(); err != nil {
+				log.Error(fmt.Sprintf("closing connection to '%s'", addr), err)
+			}
+			delete(clients, addr)
+		}
+	}
+}
+
+// Propose configuration changes of groups led by this member, moving them
+// towards current members, one member at a time.
+func (h *Handler) updateRaftMembers() {
+	c := h.consensus
+
+	c.mutex.Lock()
+	nodes := make(map[string]*raft.Node, len(c.nodes))
+	for name, node := range c.nodes {
+		nodes[name] = node
+	}
+	c.mutex.Unlock()
+
+	members := h.raftMembers()
+	self := h.serf.LocalMember().Name
+
+	for name, node := range nodes {
+		config, committed := node.Configuration()
+		if node.Leader() != self || !committed {
+			continue
+		}
+
+		current := make(map[string]bool, len(config.Members))
+		for _, member := range config.Members {
+			current[member] = true
+		}
+
+		var err error
+
+		// Change waits for commit only until the next round, which skips
+		// the group while the change is pending.
+		switch added, removed := membersDiff(members, current); {
+		case added != "":
+			log.Info("adding member '%s' to consensus of bucket '%s'", added, name)
+			err = node.AddMember(added, consensusInterval)
+		case removed != "":
+			log.Info("removing member '%s' from consensus of bucket '%s'", removed, name)
+			err = node.RemoveMember(removed, consensusInterval)
+		}
+
+		var notLeader *raft.NotLeaderError
+		if err != nil && !errors.Is(err, raft.ErrTimeout) && !errors.As(err, &notLeader) {
+			log.Error(fmt.Sprintf("changing members of consensus of bucket '%s'", name), err)
+		}
+	}
+}
+
+// First member missing from configuration, and first member of
+// configuration no longer wanted.
+func membersDiff(members []string, config map[string]bool) (added, removed string) {
+	wanted := make(map[string]bool, len(members))
+	for _, member := range members {
+		wanted[member] = true
+		if !config[member] && added == "" {
+			added = member
+		}
+	}
+
+	for member := range config {
+		if !wanted[member] && (removed == "" || member < removed) {
+			removed = member
+		}
+	}
+
+	return added, removed
+}
+
+// Members of Raft groups: all kv members which didn't leave the cluster.
+// Failed members still count until they are forgotten, so that majority
+// can't be formed by partitioned minority.
+func (h *Handler) raftMembers() []string {
+	var members []string
+
+	for _, member := range h.serf.Members() {
+		if member.Status == serf.StatusLeft || member.Tags[serfRoleTag] != kvRole {
+			continue
+		}
+
+		members = append(members, member.Name)
+	}
+
+	return members
+}
+
+// RESP address of member with given name.
+func (h *Handler) memberAddr(name string) (string, error) {
+	for _, member := range h.serf.Members() {
+		if member.Name == name && member.Tags[serfRESPTag] != "" {
+			return net.JoinHostPort(member.Addr.String(), member.Tags[serfRESPTag]), nil
+		}
+	}
+
+	return "", fmt.Errorf("member '%s' not found", name)
+}
+
+// Send command to member with given name, over connection for forwarded
+// operations if forward is set.
+func (h *Handler) sendToMember(name string, forward bool, args ...[]byte) (any, error) {
+	addr, err := h.memberAddr(name)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := h.consensus.client(addr, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Do(args...)
+}
+
+// Transport of Raft messages of single bucket.
+type raftTransport struct {
+	h      *Handler
+	bucket string
+}
+
+func (t *raftTransport) send(peer, kind string, req, res any) error {
+	// Marshalling struct of plain fields cannot fail.
+	data, _ := json.Marshal(req)
+
+	reply, err := t.h.sendToMember(peer, false, []byte("RAFT"), []byte(kind), []byte(t.bucket), data)
+	if err != nil {
+		return err
+	}
+
+	value, err := resp.Bytes(reply)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(value, res)
+}
+
+func (t *raftTransport) RequestVote(peer string, req *raft.VoteRequest) (*raft.VoteResponse, error) {
+	var res raft.VoteResponse
+	return &res, t.send(peer, "VOTE", req, &res)
+}
+
+func (t *raftTransport) AppendEntries(peer string, req *raft.AppendRequest) (*raft.AppendResponse, error) {
+	var res raft.AppendResponse
+	return &res, t.send(peer, "APPEND", req, &res)
+}
+
+func (t *raftTransport) InstallSnapshot(peer string, req *raft.SnapshotRequest) (*raft.SnapshotResponse, error) {
+	var res raft.SnapshotResponse
+	return &res, t.send(peer, "SNAPSHOT", req, &res)
+}
+
+// Write key (or delete it) in strongly consistent bucket, forwarding the
+// write to the leader if needed.
+func (h *Handler) proposeWrite(bucket *db.Bucket, key string, value []byte, del bool) error {
+	if err := bucket.ValidateWrite(key, value, del); err != nil {
+		return err
+	}
+
+	node := h.consensus.node(bucket.Name)
+	if node == nil {
+		return errNoConsensus
+	}
+
+	command := db.EncodeCommand(key, value, del)
+
+	err := node.Propose(command, raftTimeout)
+
+	var notLeader *raft.NotLeaderError
+	if !errors.As(err, &notLeader) || notLeader.Leader == "" {
+		return err
+	}
+
+	_, err = h.sendToMember(notLeader.Leader, true, []byte("RAFT"), []byte("WRITE"), []byte(bucket.Name), command)
+	return err
+}
+
+// Read key of strongly consistent bucket after confirming with majority
+// that all committed writes are applied, forwarding the read to the leader
+// if needed.
+func (h *Handler) linearizableGet(bucket *db.Bucket, key string) ([]byte, error) {
+	node := h.consensus.node(bucket.Name)
+	if node == nil {
+		return nil, errNoConsensus
+	}
+
+	err := node.ReadBarrier(raftTimeout)
+
+	var notLeader *raft.NotLeaderError
+	if errors.As(err, &notLeader) && notLeader.Leader != "" {
+		reply, err := h.sendToMember(notLeader.Leader, true, []byte("RAFT"), []byte("READ"), []byte(bucket.Name), []byte(key))
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.Bytes(reply)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return bucket.Get(key)
+}
+
+// Whether bucket needs its reads and writes to go through consensus.
+func isStrong(bucket *db.Bucket) bool {
+	return bucket.Consistency() == db.ConsistencyStrong
+}
+
+// RAFT
+// Basic handler for raft command container.
+func (h *Handler) raftCommand(conn redcon.Conn, cmd redcon.Command) {
+	const raftArgsMinCount = 3
+
+	if len(cmd.Args) < raftArgsMinCount {
+		wrongArgs(conn, "RAFT")
+		return
+	}
+
+	subcommand := strings.ToLower(string(cmd.Args[1]))
+
+	switch subcommand {
+	case "status":
+		h.raftStatus(conn, cmd.Args[2:])
+	case "write":
+		h.raftWrite(conn, cmd.Args[2:])
+	case "read":
+		h.raftRead(conn, cmd.Args[2:])
+	case "vote", "append", "snapshot":
+		h.raftMessage(conn, subcommand, cmd.Args[2:])
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown command '%s %s'", string(cmd.Args[0]), subcommand))
+	}
+}
+
+// RAFT STATUS <bucket>
+// Return state of consensus of strongly consistent bucket: role of this
+// member, known leader, term, commit, applied and last index of log, the
+// latest configuration and whether it is committed, and on leader index
+// replicated to each member.
+func (h *Handler) raftStatus(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "RAFT STATUS")
+		return
+	}
+
+	name := string(args[0])
+
+	node := h.consensus.node(name)
+	if node == nil {
+		conn.WriteError(fmt.Sprintf("ERR bucket '%s': %v", name, errNoConsensus))
+		return
+	}
+
+	status := node.Status()
+
+	result := []field{
+		{"id", status.ID},
+		{"role", status.Role},
+		{"leader", status.Leader},
+		{"term", status.Term},
+		{"commit", status.Commit},
+		{"applied", status.Applied},
+		{"last_index", status.LastIndex},
+		{"compacted", status.Compacted},
+		{"members", status.Members},
+		{"committed", status.Committed},
+	}
+	if status.Match != nil {
+		result = append(result, field{"match", status.Match})
+	}
+
+	writeFields(conn, result)
+}
+
+// RAFT WRITE <bucket> <command>
+// Propose encoded write to consensus of bucket. Used by followers to forward
+// writes of their clients to the leader.
+func (h *Handler) raftWrite(conn redcon.Conn, args [][]byte) {
+	const raftWriteArgsCount = 2
+
+	if len(args) != raftWriteArgsCount {
+		wrongArgs(conn, "RAFT WRITE")
+		return
+	}
+
+	name := string(args[0])
+
+	node := h.consensus.node(name)
+	if node == nil {
+		conn.WriteError(fmt.Sprintf("ERR bucket '%s': %v", name, errNoConsensus))
+		return
+	}
+
+	if err := node.Propose(args[1], raftTimeout); err != nil {
+		writeOpError(conn, fmt.Sprintf("writing to bucket '%s'", name), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// RAFT READ <bucket> <key>
+// Return value of key after confirming leadership. Used by followers to
+// forward reads of their clients to the leader.
+func (h *Handler) raftRead(conn redcon.Conn, args [][]byte) {
+	const raftReadArgsCount = 2
+
+	if len(args) != raftReadArgsCount {
+		wrongArgs(conn, "RAFT READ")
+		return
+	}
+
+	name, key := string(args[0]), string(args[1])
+
+	node := h.consensus.node(name)
+	if node == nil {
+		conn.WriteError(fmt.Sprintf("ERR bucket '%s': %v", name, errNoConsensus))
+		return
+	}
+
+	if err := node.ReadBarrier(raftTimeout); err != nil {
+		writeOpError(conn, fmt.Sprintf("reading bucket '%s'", name), err)
+		return
+	}
+
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+		return
+	}
+	defer h.db.Release(bucket)
+
+	val, err := bucket.Get(key)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR getting item '%s': %v", key, err))
+		return
+	}
+
+	conn.WriteBulk(val)
+}
+
+// RAFT VOTE|APPEND|SNAPSHOT <bucket> <request>
+// Handle Raft message (JSON) of another member, replying with JSON
+// response.
+func (h *Handler) raftMessage(conn redcon.Conn, kind string, args [][]byte) {
+	const raftMessageArgsCount = 2
+
+	if len(args) != raftMessageArgsCount {
+		wrongArgs(conn, "RAFT "+strings.ToUpper(kind))
+		return
+	}
+
+	name := string(args[0])
+
+	node := h.consensus.node(name)
+	if node == nil {
+		conn.WriteError(fmt.Sprintf("ERR bucket '%s': %v", name, errNoConsensus))
+		return
+	}
+
+	var (
+		res any
+		err error
+	)
+
+	switch kind {
+	case "vote":
+		var req raft.VoteRequest
+		if err = json.Unmarshal(args[1], &req); err == nil {
+			res = node.HandleVote(&req)
+		}
+	case "append":
+		var req raft.AppendRequest
+		if err = json.Unmarshal(args[1], &req); err == nil {
+			res, err = node.HandleAppend(&req)
+		}
+	default:
+		var req raft.SnapshotRequest
+		if err = json.Unmarshal(args[1], &req); err == nil {
+			res, err = node.HandleSnapshot(&req)
+		}
+	}
+
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR handling raft %s of bucket '%s': %v", kind, name, err))
+		return
+	}
+
+	// Marshalling struct of plain fields cannot fail.
+	data, _ := json.Marshal(res)
+	conn.WriteBulk(data)
+}
+
+//nolint:gomnd // Magic numbers in command registration calls are not magic.
+func registerConsensus(handler *Handler) {
+	handler.Register("raft", handler.raftCommand, -3, []string{"cluster"}, -1, -1, 0, nil, []string{"RAFT", "container for consensus commands of strongly consistent buckets"})
+	handler.RegisterChild("raft status", 3, []string{"cluster"}, 2, 2, 0, nil, []string{"RAFT STATUS <bucket>", "return state of consensus of bucket on this member"})
+	handler.RegisterChild("raft write", 4, []string{"cluster"}, 2, 2, 0, nil, []string{"RAFT WRITE <bucket> <command>", "propose encoded write to consensus of bucket (used by members to forward writes to leader)"})
+	handler.RegisterChild("raft read", 4, []string{"cluster"}, 2, 2, 0, nil, []string{"RAFT READ <bucket> <key>", "return value of key after confirming leadership (used by members to forward reads to leader)"})
+	handler.RegisterChild("raft vote", 4, []string{"cluster"}, 2, 2, 0, nil, []string{"RAFT VOTE <bucket> <request>", "handle vote request of candidate (used by members)"})
+	handler.RegisterChild("raft append", 4, []string{"cluster"}, 2, 2, 0, nil, []string{"RAFT APPEND <bucket> <request>", "handle log entries sent by leader (used by members)"})
+	handler.RegisterChild("raft snapshot", 4, []string{"cluster"}, 2, 2, 0, nil, []string{"RAFT SNAPSHOT <bucket> <request>", "handle snapshot chunk sent by leader (used by members)"})
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/pepol/databuddy/internal/db"
+)
+
+// Leader of consensus of bucket with all given members in committed
+// configuration, nil if there is none yet.
+func raftLeader(bucket string, nodes ...*testNode) *testNode {
+	for _, n := range nodes {
+		node := n.h.consensus.node(bucket)
+		if node == nil {
+			continue
+		}
+
+		if status := node.Status(); status.Role == "leader" && status.Committed && len(status.Members) == len(nodes) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// Value of key in local state of member, empty if missing.
+func localValue(t *testing.T, n *testNode, bucket, key string) string {
+	t.Helper()
+
+	b, err := n.h.db.Get(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.h.db.Release(b)
+
+	value, _ := b.Get(key)
+	return string(value)
+}
+
+// Members exchange Raft messages over RESP, and followers forward writes
+// and reads of their clients to the leader.
+func TestConsensus(t *testing.T) {
+	a := startTestNode(t, "a")
+	b := startTestNode(t, "b", a)
+	c := startTestNode(t, "c", a)
+	nodes := []*testNode{a, b, c}
+
+	a.mustDo(t, "BUCKET", "CREATE", "strong", "CONSISTENCY", db.ConsistencyStrong)
+
+	var leader *testNode
+	eventually(t, "leader of all members", func() bool {
+		leader = raftLeader("strong", nodes...)
+		return leader != nil
+	})
+
+	var followers []*testNode
+	for _, n := range nodes {
+		if n != leader {
+			followers = append(followers, n)
+		}
+	}
+
+	if _, err := followers[0].doIn(t, "strong", "SET", "key", "value"); err != nil {
+		t.Fatalf("writing through follower: %v", err)
+	}
+
+	// Write is committed by the time it's acknowledged, so the leader reads
+	// it, which the other follower forwards its read to.
+	for _, n := range []*testNode{leader, followers[1]} {
+		if reply, err := n.doIn(t, "strong", "GET", "key"); err != nil || replyString(reply) != "value" {
+			t.Fatalf("member %s read '%s' (error %v), want 'value'", n.h.hostname, replyString(reply), err)
+		}
+	}
+
+	for _, n := range nodes {
+		eventually(t, "write applied by "+n.h.hostname, func() bool {
+			return localValue(t, n, "strong", "key") == "value"
+		})
+	}
+
+	if _, err := followers[1].doIn(t, "strong", "DEL", "key"); err != nil {
+		t.Fatalf("deleting through follower: %v", err)
+	}
+
+	if _, err := followers[0].doIn(t, "strong", "GET", "key"); err == nil {
+		t.Fatal("deleted key read through follower")
+	}
+
+	// Remaining members elect new leader and keep accepting writes.
+	leader.stop()
+
+	var elected *testNode
+	eventually(t, "new leader", func() bool {
+		for _, n := range followers {
+			if node := n.h.consensus.node("strong"); node != nil && node.Status().Role == "leader" {
+				elected = n
+				return true
+			}
+		}
+		return false
+	})
+
+	for _, n := range followers {
+		if n != elected {
+			if _, err := n.doIn(t, "strong", "SET", "key", "again"); err != nil {
+				t.Fatalf("writing through follower after failover: %v", err)
+			}
+		}
+	}
+
+	if reply, err := elected.doIn(t, "strong", "GET", "key"); err != nil || replyString(reply) != "again" {
+		t.Fatalf("new leader read '%s' (error %v), want 'again'", replyString(reply), err)
+	}
+}
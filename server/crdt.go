@@ -0,0 +1,365 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/pepol/databuddy/internal/context"
+	"github.com/pepol/databuddy/internal/crdt"
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains implementation of the conflict-free replicated data
+// type commands. All of them operate on keys of currently used bucket, which
+// must have the crdt conflict policy. Plain SET and DEL of such buckets
+// write registers.
+
+// CINCR <key> [<delta>]
+// Add delta (1 by default, may be negative) to counter, returning its new
+// value.
+func (h *Handler) cincr(conn redcon.Conn, cmd redcon.Command) {
+	const (
+		cincrArgsMinCount = 2
+		cincrArgsMaxCount = 3
+	)
+
+	if len(cmd.Args) < cincrArgsMinCount || len(cmd.Args) > cincrArgsMaxCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+
+	delta := int64(1)
+	if len(cmd.Args) == cincrArgsMaxCount {
+		var err error
+		if delta, err = strconv.ParseInt(string(cmd.Args[2]), 10, 64); err != nil {
+			conn.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+	}
+
+	var value int64
+
+	ok := h.updateCRDT(conn, key, "incrementing counter", func(current *crdt.Value, tag crdt.Tag) (*crdt.Value, error) {
+		counter, err := crdt.AsCounter(current)
+		if err != nil {
+			return nil, err
+		}
+
+		counter = counter.Add(tag.Node, delta)
+		value = counter.Value()
+		return &crdt.Value{Counter: counter}, nil
+	})
+	if ok {
+		conn.WriteInt64(value)
+	}
+}
+
+// CGET <key>
+// Return value of data type: number for counters, array of members for
+// sets, value of registers and array of fields and values for maps.
+func (h *Handler) cget(conn redcon.Conn, cmd redcon.Command) {
+	const cgetArgsCount = 2
+
+	if len(cmd.Args) != cgetArgsCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+
+	bucket, ok := contextBucket(conn)
+	if !ok {
+		return
+	}
+
+	value, err := bucket.CRDT(key)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		conn.WriteNull()
+		return
+	}
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR getting item '%s': %v", key, err))
+		return
+	}
+
+	switch {
+	case value.Counter != nil:
+		conn.WriteInt64(value.Counter.Value())
+	case value.Set != nil:
+		conn.WriteAny(value.Set.Members())
+	case value.Map != nil:
+		fields := value.Map.Fields()
+
+		conn.WriteArray(len(fields) * 2)
+		for _, field := range sortedKeys(fields) {
+			conn.WriteBulkString(field)
+			conn.WriteBulk(fields[field])
+		}
+	case value.Register != nil && !value.Register.Deleted:
+		conn.WriteBulk(value.Register.Value)
+	default:
+		conn.WriteNull()
+	}
+}
+
+// CSADD <key> <member> [<member> ...]
+// Add members to set, returning number of members not present before.
+func (h *Handler) csadd(conn redcon.Conn, cmd redcon.Command) {
+	const csaddArgsMinCount = 3
+
+	if len(cmd.Args) < csaddArgsMinCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+	members := stringArgs(cmd.Args[2:])
+
+	var added int
+
+	ok := h.updateCRDT(conn, key, "adding to set", func(current *crdt.Value, tag crdt.Tag) (*crdt.Value, error) {
+		set, err := crdt.AsSet(current)
+		if err != nil {
+			return nil, err
+		}
+
+		added = 0
+		for _, member := range unique(members) {
+			if !set.Contains(member) {
+				added++
+			}
+		}
+
+		return &crdt.Value{Set: set.Add(tag, members...)}, nil
+	})
+	if ok {
+		conn.WriteInt(added)
+	}
+}
+
+// CSREM <key> <member> [<member> ...]
+// Remove members from set, returning number of members removed. Members
+// added concurrently on other members stay.
+func (h *Handler) csrem(conn redcon.Conn, cmd redcon.Command) {
+	const csremArgsMinCount = 3
+
+	if len(cmd.Args) < csremArgsMinCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+	members := stringArgs(cmd.Args[2:])
+
+	var removed int
+
+	ok := h.updateCRDT(conn, key, "removing from set", func(current *crdt.Value, tag crdt.Tag) (*crdt.Value, error) {
+		set, err := crdt.AsSet(current)
+		if err != nil {
+			return nil, err
+		}
+
+		removed = 0
+		for _, member := range unique(members) {
+			if set.Contains(member) {
+				removed++
+			}
+		}
+
+		return &crdt.Value{Set: set.Remove(members...)}, nil
+	})
+	if ok {
+		conn.WriteInt(removed)
+	}
+}
+
+// CSMEMBERS <key>
+// Return members of set in ascending order.
+func (h *Handler) csmembers(conn redcon.Conn, cmd redcon.Command) {
+	const csmembersArgsCount = 2
+
+	if len(cmd.Args) != csmembersArgsCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+
+	bucket, ok := contextBucket(conn)
+	if !ok {
+		return
+	}
+
+	value, err := bucket.CRDT(key)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		conn.WriteArray(0)
+		return
+	}
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR getting item '%s': %v", key, err))
+		return
+	}
+
+	set, err := crdt.AsSet(value)
+	if err != nil {
+		writeOpError(conn, fmt.Sprintf("getting members of '%s'", key), err)
+		return
+	}
+
+	conn.WriteAny(set.Members())
+}
+
+// CHSET <key> <field> <value> [<field> <value> ...]
+// Set fields of map, returning number of fields not present before.
+func (h *Handler) chset(conn redcon.Conn, cmd redcon.Command) {
+	const chsetArgsMinCount = 4
+
+	if len(cmd.Args) < chsetArgsMinCount || len(cmd.Args)%2 != 0 {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+
+	values := make(map[string][]byte, (len(cmd.Args)-2)/2)
+	for i := 2; i < len(cmd.Args); i += 2 {
+		values[string(cmd.Args[i])] = cmd.Args[i+1]
+	}
+
+	var added int
+
+	ok := h.updateCRDT(conn, key, "setting map fields", func(current *crdt.Value, tag crdt.Tag) (*crdt.Value, error) {
+		m, err := crdt.AsMap(current)
+		if err != nil {
+			return nil, err
+		}
+
+		fields := m.Fields()
+
+		added = 0
+		for field := range values {
+			if _, ok := fields[field]; !ok {
+				added++
+			}
+		}
+
+		return &crdt.Value{Map: m.Set(tag, values)}, nil
+	})
+	if ok {
+		conn.WriteInt(added)
+	}
+}
+
+// CHDEL <key> <field> [<field> ...]
+// Remove fields of map, returning number of fields removed. Fields set
+// concurrently on other members stay.
+func (h *Handler) chdel(conn redcon.Conn, cmd redcon.Command) {
+	const chdelArgsMinCount = 3
+
+	if len(cmd.Args) < chdelArgsMinCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+	fields := stringArgs(cmd.Args[2:])
+
+	var removed int
+
+	ok := h.updateCRDT(conn, key, "removing map fields", func(current *crdt.Value, tag crdt.Tag) (*crdt.Value, error) {
+		m, err := crdt.AsMap(current)
+		if err != nil {
+			return nil, err
+		}
+
+		present := m.Fields()
+
+		removed = 0
+		for _, field := range unique(fields) {
+			if _, ok := present[field]; ok {
+				removed++
+			}
+		}
+
+		return &crdt.Value{Map: m.Remove(fields...)}, nil
+	})
+	if ok {
+		conn.WriteInt(removed)
+	}
+}
+
+// Change data type of key of currently used bucket, writing error if it
+// fails. Returns whether the change succeeded.
+func (h *Handler) updateCRDT(conn redcon.Conn, key, operation string, change func(current *crdt.Value, tag crdt.Tag) (*crdt.Value, error)) bool {
+	bucket, ok := contextBucket(conn)
+	if !ok {
+		return false
+	}
+
+	err := bucket.UpdateCRDT(key, change)
+	if err == nil {
+		err = h.waitReplicated(bucket)
+	}
+
+	if err != nil {
+		writeOpError(conn, fmt.Sprintf("%s '%s'", operation, key), err)
+		return false
+	}
+
+	return true
+}
+
+// Bucket currently used by connection. Writes error and closes connection
+// if none is.
+func contextBucket(conn redcon.Conn) (*db.Bucket, bool) {
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return nil, false
+	}
+
+	return ctx.Bucket(), true
+}
+
+// Values without repetitions, in order of first occurrence.
+func unique(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	result := make([]string, 0, len(values))
+
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+
+	return result
+}
+
+func stringArgs(args [][]byte) []string {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		values[i] = string(arg)
+	}
+
+	return values
+}
+
+//nolint:gomnd // Magic numbers in command registration calls are not magic.
+func registerCRDT(handler *Handler) {
+	handler.Register("cincr", handler.cincr, -2, []string{"write"}, 1, 1, 0, nil, []string{"CINCR <key> [<delta>]", "add delta (1 by default) to counter, returns its new value; counters incremented on several members are summed"})
+	handler.Register("cget", handler.cget, 2, []string{"read"}, 1, 1, 0, nil, []string{"CGET <key>", "return value of counter, set, register or map"})
+	handler.Register("csadd", handler.csadd, -3, []string{"write"}, 1, 1, 0, nil, []string{"CSADD <key> <member> [<member> ...]", "add members to set, returns number of members not present before"})
+	handler.Register("csrem", handler.csrem, -3, []string{"write"}, 1, 1, 0, nil, []string{"CSREM <key> <member> [<member> ...]", "remove members from set (concurrent additions win), returns number of members removed"})
+	handler.Register("csmembers", handler.csmembers, 2, []string{"read"}, 1, 1, 0, nil, []string{"CSMEMBERS <key>", "return members of set"})
+	handler.Register("chset", handler.chset, -4, []string{"write"}, 1, 1, 0, nil, []string{"CHSET <key> <field> <value> [<field> <value> ...]", "set fields of map (the latest write of each field wins), returns number of fields not present before"})
+	handler.Register("chdel", handler.chdel, -3, []string{"write"}, 1, 1, 0, nil, []string{"CHDEL <key> <field> [<field> ...]", "remove fields of map (concurrent writes win), returns number of fields removed"})
+}
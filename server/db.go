@@ -1,10 +1,14 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pepol/databuddy/internal/context"
+	"github.com/pepol/databuddy/internal/db"
 	"github.com/pepol/databuddy/internal/log"
 	"github.com/tidwall/redcon"
 )
@@ -24,7 +28,7 @@ func (h *Handler) bucket(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		conn.WriteString(ctx.Bucket.Name)
+		conn.WriteString(ctx.Bucket().Name)
 		return
 	}
 
@@ -41,6 +45,32 @@ func (h *Handler) bucket(conn redcon.Conn, cmd redcon.Command) {
 		h.bucketUse(conn, cmd.Args[2:])
 	case "drop":
 		h.bucketDrop(conn, cmd.Args[2:])
+	case "stats":
+		h.bucketStats(conn, cmd.Args[2:])
+	case "rename":
+		h.bucketRename(conn, cmd.Args[2:])
+	case "clone":
+		h.bucketClone(conn, cmd.Args[2:])
+	case "flush":
+		h.bucketFlush(conn, cmd.Args[2:])
+	case "undrop":
+		h.bucketUndrop(conn, cmd.Args[2:])
+	case "purge":
+		h.bucketPurge(conn, cmd.Args[2:])
+	case "dropped":
+		h.bucketDropped(conn)
+	case "default":
+		h.bucketDefault(conn, cmd.Args[2:])
+	case "quota":
+		h.bucketQuota(conn, cmd.Args[2:])
+	case "schema":
+		h.bucketSchema(conn, cmd.Args[2:])
+	case "readonly":
+		h.bucketReadOnly(conn, cmd.Args[2:])
+	case "replicate":
+		h.bucketReplicate(conn, cmd.Args[2:])
+	case "unreplicate":
+		h.bucketUnreplicate(conn, cmd.Args[2:])
 	default:
 		conn.WriteError(fmt.Sprintf("ERR unknown command '%s %s'", string(cmd.Args[0]), subcommand))
 	}
@@ -70,20 +100,44 @@ func (h *Handler) bucketList(conn redcon.Conn, args [][]byte) {
 	conn.WriteAny(h.db.List(prefix))
 }
 
-// BUCKET CREATE <bucket>
-// Create bucket with given name.
+// BUCKET CREATE <bucket> [ENGINE <engine>] [CONSISTENCY <mode>] [CONFLICT <policy>]
+// Create bucket with given name, using given storage engine ("badger" by
+// default, or "memory") and consistency mode ("eventual" by default, or
+// "strong" to replicate writes through consensus of kv members). Eventually
+// consistent buckets written on multiple members may resolve concurrent
+// writes by conflict policy ("lww" or "siblings"), or hold conflict-free
+// replicated data types ("crdt"). The bucket is created on all members of
+// the cluster.
 func (h *Handler) bucketCreate(conn redcon.Conn, args [][]byte) {
-	if len(args) != 1 {
+	if len(args)%2 != 1 {
 		wrongArgs(conn, "BUCKET CREATE")
 		return
 	}
 
 	name := string(args[0])
 
-	if err := h.db.Create(name); err != nil {
-		conn.WriteError(fmt.Sprintf("ERR creating bucket '%s': %v", name, err))
+	var opts db.BucketOptions
+	for i := 1; i < len(args); i += 2 {
+		value := strings.ToLower(string(args[i+1]))
+
+		switch strings.ToLower(string(args[i])) {
+		case "engine":
+			opts.Engine = value
+		case "consistency":
+			opts.Consistency = value
+		case "conflict":
+			opts.Conflict = value
+		default:
+			conn.WriteError(fmt.Sprintf("ERR syntax error, expected ENGINE, CONSISTENCY or CONFLICT, got '%s'", string(args[i])))
+			return
+		}
+	}
+
+	if err := h.db.Create(name, opts); err != nil {
+		writeOpError(conn, fmt.Sprintf("creating bucket '%s'", name), err)
 		return
 	}
+	h.publishBucket(name, true)
 
 	conn.WriteString("OK")
 }
@@ -98,43 +152,49 @@ func (h *Handler) bucketUse(conn redcon.Conn, args [][]byte) {
 
 	name := string(args[0])
 
-	bucket, err := h.db.Get(name)
-	if err != nil {
-		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
-		return
-	}
-
 	ctx, ok := conn.Context().(*context.Context)
 	if !ok {
-		ctx = &context.Context{
-			Bucket: bucket,
+		bucket, err := h.db.Get(name)
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+			return
 		}
-		conn.SetContext(ctx)
+
+		h.setClientContext(conn, context.New(bucket))
 		conn.WriteString("OK context set (not set previously)")
 		return
 	}
 
-	if name == ctx.Bucket.Name {
+	if name == ctx.Bucket().Name {
 		conn.WriteString("OK bucket already used")
 		return
 	}
 
-	ctx.Bucket = bucket
+	if err := h.useBucket(ctx, name); err != nil {
+		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+		return
+	}
 
 	conn.WriteString("OK")
 }
 
-// BUCKET DROP <bucket> [<bucket> ...]
-// Remove given buckets, including all data.
+// BUCKET DROP [FORCE] <bucket> [<bucket> ...]
+// Remove given buckets. Buckets in use by any client are only dropped with
+// FORCE, switching such clients to the default bucket. Data is kept until
+// the bucket is purged. Buckets are dropped on all members of the cluster.
 func (h *Handler) bucketDrop(conn redcon.Conn, args [][]byte) {
+	force := len(args) > 0 && strings.ToLower(string(args[0])) == "force"
+	if force {
+		args = args[1:]
+	}
+
 	if len(args) == 0 {
 		wrongArgs(conn, "BUCKET DROP")
 		return
 	}
 
-	ctx, ok := conn.Context().(*context.Context)
-	if !ok {
-		conn.WriteError("ERR context not set on connection")
+	if h.db.ReadOnly() {
+		conn.WriteError("READONLY database is read-only")
 		return
 	}
 
@@ -143,28 +203,566 @@ func (h *Handler) bucketDrop(conn redcon.Conn, args [][]byte) {
 	for _, arg := range args {
 		name := string(arg)
 
-		// TODO: Improve check with all currently connected users.
-		if name == ctx.Bucket.Name {
-			log.Warn(fmt.Sprintf("not dropping bucket '%s' as its used by current user", name))
-			continue
-		}
+		if err := h.dropBucket(name, force); err != nil {
+			if errors.Is(err, errBucketInUse) {
+				log.Warn(fmt.Sprintf("not dropping bucket '%s': %v (use FORCE)", name, err))
+				continue
+			}
+
+			if errors.Is(err, db.ErrReadOnly) || errors.Is(err, db.ErrBucketInUse) {
+				log.Warn(fmt.Sprintf("not dropping bucket '%s': %v", name, err))
+				continue
+			}
 
-		if err := h.db.Drop(name); err != nil {
 			log.Error(fmt.Sprintf("dropping bucket '%s'", name), err)
 			continue
 		}
+		h.publishDrop(name)
 		dropped++
 	}
 
 	conn.WriteInt(dropped)
 }
 
+// BUCKET UNDROP <bucket>
+// Restore dropped bucket, including all data.
+func (h *Handler) bucketUndrop(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "BUCKET UNDROP")
+		return
+	}
+
+	name := string(args[0])
+
+	if err := h.db.Undrop(name); err != nil {
+		writeOpError(conn, fmt.Sprintf("restoring bucket '%s'", name), err)
+		return
+	}
+	h.publishBucket(name, false)
+
+	conn.WriteString("OK")
+}
+
+// BUCKET PURGE <bucket> [<bucket> ...]
+// Remove all files of given dropped buckets.
+func (h *Handler) bucketPurge(conn redcon.Conn, args [][]byte) {
+	if len(args) == 0 {
+		wrongArgs(conn, "BUCKET PURGE")
+		return
+	}
+
+	if h.db.ReadOnly() {
+		conn.WriteError("READONLY database is read-only")
+		return
+	}
+
+	purged := 0
+
+	for _, arg := range args {
+		name := string(arg)
+
+		if err := h.db.Purge(name); err != nil {
+			log.Error(fmt.Sprintf("purging bucket '%s'", name), err)
+			continue
+		}
+		purged++
+	}
+
+	conn.WriteInt(purged)
+}
+
+// BUCKET DROPPED
+// Return list of dropped buckets which were not purged yet.
+func (h *Handler) bucketDropped(conn redcon.Conn) {
+	const droppedInfoEntries = 3
+
+	dropped, err := h.db.Dropped()
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR listing dropped buckets: %v", err))
+		return
+	}
+
+	retention := h.db.DropRetention()
+
+	conn.WriteArray(len(dropped))
+	for _, bucket := range dropped {
+		var purgeAt int64
+		if retention > 0 {
+			purgeAt = bucket.DroppedAt.Add(retention).Unix()
+		}
+
+		conn.WriteArray(droppedInfoEntries)
+		conn.WriteString(bucket.Name)            // 1 - bucket name
+		conn.WriteInt64(bucket.DroppedAt.Unix()) // 2 - time of drop
+		conn.WriteInt64(purgeAt)                 // 3 - time of automatic purge (0 if disabled)
+	}
+}
+
+// BUCKET DEFAULT [<bucket>]
+// Return name of the default bucket, or mark given bucket as default.
+func (h *Handler) bucketDefault(conn redcon.Conn, args [][]byte) {
+	switch len(args) {
+	case 0:
+		conn.WriteString(h.db.DefaultBucket())
+	case 1:
+		name := string(args[0])
+
+		if err := h.db.SetDefaultBucket(name); err != nil {
+			writeOpError(conn, fmt.Sprintf("setting default bucket '%s'", name), err)
+			return
+		}
+
+		conn.WriteString("OK")
+	default:
+		wrongArgs(conn, "BUCKET DEFAULT")
+	}
+}
+
+// BUCKET STATS [<bucket>]
+// Return storage statistics of given bucket (or currently used bucket).
+func (h *Handler) bucketStats(conn redcon.Conn, args [][]byte) {
+	var bucket *db.Bucket
+
+	switch len(args) {
+	case 0:
+		ctx, ok := conn.Context().(*context.Context)
+		if !ok {
+			conn.WriteError("ERR context not set on connection")
+			return
+		}
+		bucket = ctx.Bucket()
+	case 1:
+		name := string(args[0])
+
+		var err error
+		bucket, err = h.db.Get(name)
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+			return
+		}
+		defer h.db.Release(bucket)
+	default:
+		wrongArgs(conn, "BUCKET STATS")
+		return
+	}
+
+	stats, err := bucket.Stats()
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR getting statistics for bucket '%s': %v", bucket.Name, err))
+		return
+	}
+
+	writeBucketStats(conn, stats, h.bucketClients(bucket.Name))
+}
+
+// BUCKET RENAME <old> <new>
+// Rename bucket, keeping all data.
+func (h *Handler) bucketRename(conn redcon.Conn, args [][]byte) {
+	const bucketRenameArgsCount = 2
+
+	if len(args) != bucketRenameArgsCount {
+		wrongArgs(conn, "BUCKET RENAME")
+		return
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		return
+	}
+
+	oldName := string(args[0])
+	newName := string(args[1])
+
+	if err := h.renameBucket(ctx, oldName, newName, false); err != nil {
+		writeOpError(conn, fmt.Sprintf("renaming bucket '%s' to '%s'", oldName, newName), err)
+		return
+	}
+	h.publishRename(oldName, newName)
+
+	conn.WriteString("OK")
+}
+
+// BUCKET CLONE <src> <dst>
+// Create new bucket containing copy of all data from source bucket.
+func (h *Handler) bucketClone(conn redcon.Conn, args [][]byte) {
+	const bucketCloneArgsCount = 2
+
+	if len(args) != bucketCloneArgsCount {
+		wrongArgs(conn, "BUCKET CLONE")
+		return
+	}
+
+	srcName := string(args[0])
+	dstName := string(args[1])
+
+	if err := h.db.Clone(srcName, dstName); err != nil {
+		writeOpError(conn, fmt.Sprintf("cloning bucket '%s' to '%s'", srcName, dstName), err)
+		return
+	}
+	h.publishClone(srcName, dstName)
+
+	conn.WriteString("OK")
+}
+
+// BUCKET FLUSH <bucket>
+// Remove all data from bucket, keeping the bucket itself.
+func (h *Handler) bucketFlush(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "BUCKET FLUSH")
+		return
+	}
+
+	name := string(args[0])
+
+	if err := h.db.Flush(name); err != nil {
+		writeOpError(conn, fmt.Sprintf("flushing bucket '%s'", name), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
 //nolint:gomnd // Magic numbers in command registration calls are not magic.
 func registerDatabaseManagement(handler *Handler) {
 	handler.Register("bucket", handler.bucket, 1, []string{"database"}, 1, 1, 0, nil, []string{"BUCKET", "return currently used bucket"})
 	handler.RegisterChild("bucket count", 2, []string{"database"}, -1, -1, 0, nil, []string{"BUCKET COUNT", "return count of all available buckets"})
 	handler.RegisterChild("bucket list", -2, []string{"database"}, 2, -1, 1, nil, []string{"BUCKET LIST [<prefix>]", "return list of all available buckets matching prefix (or all if prefix is empty)"})
-	handler.RegisterChild("bucket create", 3, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET CREATE <bucket>", "create bucket with given name"})
+	handler.RegisterChild("bucket create", -3, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET CREATE <bucket> [ENGINE badger|memory] [CONSISTENCY eventual|strong] [CONFLICT lww|siblings|crdt]", "create bucket with given name, optionally choosing storage engine (data of memory buckets is lost on restart), consistency mode (writes to strong buckets go through consensus of kv members) and conflict policy (concurrent writes on multiple members are resolved by the latest write, kept as siblings, or merged as conflict-free replicated data types)"})
 	handler.RegisterChild("bucket use", 3, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET USE <bucket>", "set bucket to be used for further queries"})
-	handler.RegisterChild("bucket drop", -3, []string{"database"}, 2, -1, 1, nil, []string{"BUCKET DROP <bucket> [<bucket> ...]", "delete given bucket(s), removing all data"})
+	handler.RegisterChild("bucket drop", -3, []string{"database"}, 2, -1, 1, nil, []string{"BUCKET DROP [FORCE] <bucket> [<bucket> ...]", "drop given bucket(s), keeping data until purged; buckets in use require FORCE"})
+	handler.RegisterChild("bucket undrop", 3, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET UNDROP <bucket>", "restore dropped bucket, including all data"})
+	handler.RegisterChild("bucket purge", -3, []string{"database"}, 2, -1, 1, nil, []string{"BUCKET PURGE <bucket> [<bucket> ...]", "remove all data of given dropped bucket(s)"})
+	handler.RegisterChild("bucket dropped", 2, []string{"database"}, -1, -1, 0, nil, []string{"BUCKET DROPPED", "return list of dropped buckets with time of drop and time of automatic purge"})
+	handler.RegisterChild("bucket default", -2, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET DEFAULT [<bucket>]", "return name of the default bucket, or mark given bucket as default for new connections"})
+	handler.RegisterChild("bucket stats", -2, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET STATS [<bucket>]", "return storage statistics of given bucket (or currently used bucket)"})
+	handler.RegisterChild("bucket rename", 4, []string{"database"}, 2, 3, 1, nil, []string{"BUCKET RENAME <old> <new>", "rename bucket, keeping all data"})
+	handler.RegisterChild("bucket clone", 4, []string{"database"}, 2, 3, 1, nil, []string{"BUCKET CLONE <src> <dst>", "create new bucket with copy of all data from source bucket"})
+	handler.RegisterChild("bucket quota", -3, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET QUOTA <bucket> [<limit> <value> ...]", "return quota and usage of bucket, or change limits MAXBYTES, MAXKEYS, MAXKEYLEN and MAXVALUESIZE (0 removes limit)"})
+	handler.RegisterChild("bucket schema set", -4, []string{"database"}, 3, 3, 0, nil, []string{"BUCKET SCHEMA SET <bucket> [TYPE int|utf8|json] [JSONSCHEMA <schema>] [KEYPATTERN <regex>] [VALIDATE]", "constrain values and keys written to bucket, optionally validating existing data in background"})
+	handler.RegisterChild("bucket schema get", 4, []string{"database"}, 3, 3, 0, nil, []string{"BUCKET SCHEMA GET <bucket>", "return schema of bucket and state of the last validation of its data"})
+	handler.RegisterChild("bucket schema clear", 4, []string{"database"}, 3, 3, 0, nil, []string{"BUCKET SCHEMA CLEAR <bucket>", "remove schema of bucket"})
+	handler.RegisterChild("bucket readonly", -3, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET READONLY <bucket> [ON|OFF]", "return whether bucket is read-only, or make it reject (ON) or accept (OFF) all writes"})
+	handler.RegisterChild("bucket replicate", -3, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET REPLICATE <bucket> [TO <region> [<region> ...] [MODE async|sync]]", "return replication policy of bucket, or replicate it between region of this member and given regions (sync writes wait until applied in all of them)"})
+	handler.RegisterChild("bucket unreplicate", 3, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET UNREPLICATE <bucket>", "remove replication policy of bucket, replicating it only within region of each member"})
+	handler.RegisterChild("bucket flush", 3, []string{"database"}, 2, 2, 0, nil, []string{"BUCKET FLUSH <bucket>", "remove all data from bucket, keeping the bucket itself"})
+}
+
+// BUCKET QUOTA <bucket> [<limit> <value> ...]
+// Return quota and usage of given bucket, or change given limits (MAXBYTES,
+// MAXKEYS, MAXKEYLEN, MAXVALUESIZE; 0 removes the limit).
+func (h *Handler) bucketQuota(conn redcon.Conn, args [][]byte) {
+	if len(args)%2 != 1 {
+		wrongArgs(conn, "BUCKET QUOTA")
+		return
+	}
+
+	name := string(args[0])
+
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+		return
+	}
+	defer h.db.Release(bucket)
+
+	quota := bucket.Quota()
+
+	if len(args) == 1 {
+		usage, err := bucket.Usage()
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("ERR getting usage of bucket '%s': %v", name, err))
+			return
+		}
+
+		writeFields(conn, []field{
+			{"max_bytes", quota.MaxBytes},
+			{"max_keys", quota.MaxKeys},
+			{"max_key_length", quota.MaxKeyLength},
+			{"max_value_size", quota.MaxValueSize},
+			{"used_bytes", usage.Bytes},
+			{"used_keys", usage.Keys},
+		})
+		return
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		limit := strings.ToLower(string(args[i]))
+
+		value, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil || value < 0 {
+			conn.WriteError(fmt.Sprintf("ERR invalid value '%s' of limit '%s'", string(args[i+1]), limit))
+			return
+		}
+
+		switch limit {
+		case "maxbytes":
+			quota.MaxBytes = value
+		case "maxkeys":
+			quota.MaxKeys = value
+		case "maxkeylen":
+			quota.MaxKeyLength = value
+		case "maxvaluesize":
+			quota.MaxValueSize = value
+		default:
+			conn.WriteError(fmt.Sprintf("ERR unknown limit '%s'", limit))
+			return
+		}
+	}
+
+	if err := h.db.SetQuota(name, quota); err != nil {
+		writeOpError(conn, fmt.Sprintf("setting quota of bucket '%s'", name), err)
+		return
+	}
+	h.publishBucket(name, false)
+
+	conn.WriteString("OK")
+}
+
+// BUCKET SCHEMA SET|GET|CLEAR <bucket> ...
+// Manage schema of bucket.
+func (h *Handler) bucketSchema(conn redcon.Conn, args [][]byte) {
+	if len(args) < 2 {
+		wrongArgs(conn, "BUCKET SCHEMA")
+		return
+	}
+
+	subcommand := strings.ToLower(string(args[0]))
+
+	switch subcommand {
+	case "set":
+		h.bucketSchemaSet(conn, args[1:])
+	case "get":
+		h.bucketSchemaGet(conn, args[1:])
+	case "clear":
+		h.bucketSchemaClear(conn, args[1:])
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown command 'BUCKET SCHEMA %s'", subcommand))
+	}
+}
+
+// BUCKET SCHEMA SET <bucket> [TYPE <type>] [JSONSCHEMA <schema>] [KEYPATTERN <regex>] [VALIDATE]
+// Replace schema of bucket, optionally validating existing data in
+// background.
+func (h *Handler) bucketSchemaSet(conn redcon.Conn, args [][]byte) {
+	if len(args) < 1 {
+		wrongArgs(conn, "BUCKET SCHEMA SET")
+		return
+	}
+
+	name := string(args[0])
+
+	var (
+		schema   db.Schema
+		validate bool
+	)
+
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+
+		if option == "validate" {
+			validate = true
+			continue
+		}
+
+		if i+1 >= len(args) {
+			conn.WriteError(fmt.Sprintf("ERR syntax error, missing value of '%s'", option))
+			return
+		}
+		i++
+
+		switch option {
+		case "type":
+			schema.ValueType = strings.ToLower(string(args[i]))
+		case "jsonschema":
+			schema.JSONSchema = append([]byte(nil), args[i]...)
+		case "keypattern":
+			schema.KeyPattern = string(args[i])
+		default:
+			conn.WriteError(fmt.Sprintf("ERR syntax error, unknown option '%s'", option))
+			return
+		}
+	}
+
+	if schema.IsEmpty() {
+		conn.WriteError("ERR syntax error, expected TYPE, JSONSCHEMA or KEYPATTERN")
+		return
+	}
+
+	if err := h.db.SetSchema(name, schema); err != nil {
+		writeOpError(conn, fmt.Sprintf("setting schema of bucket '%s'", name), err)
+		return
+	}
+	h.publishBucket(name, false)
+
+	if validate {
+		if err := h.db.ValidateSchema(name); err != nil {
+			conn.WriteError(fmt.Sprintf("ERR validating bucket '%s': %v", name, err))
+			return
+		}
+	}
+
+	conn.WriteString("OK")
+}
+
+// BUCKET SCHEMA GET <bucket>
+// Return schema of bucket and state of the last validation of its data.
+func (h *Handler) bucketSchemaGet(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "BUCKET SCHEMA GET")
+		return
+	}
+
+	name := string(args[0])
+
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+		return
+	}
+	defer h.db.Release(bucket)
+
+	schema := bucket.Schema()
+	validation := bucket.SchemaValidation()
+
+	writeFields(conn, []field{
+		{"value_type", schema.ValueType},
+		{"json_schema", string(schema.JSONSchema)},
+		{"key_pattern", schema.KeyPattern},
+		{"validation", []field{
+			{"running", validation.Running},
+			{"started", unixMilli(validation.Started)},
+			{"finished", unixMilli(validation.Finished)},
+			{"checked", validation.Checked},
+			{"invalid", validation.Invalid},
+			{"invalid_keys", validation.InvalidKeys},
+			{"error", validation.Error},
+		}},
+	})
+}
+
+// BUCKET SCHEMA CLEAR <bucket>
+// Remove schema of bucket.
+func (h *Handler) bucketSchemaClear(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "BUCKET SCHEMA CLEAR")
+		return
+	}
+
+	name := string(args[0])
+
+	if err := h.db.SetSchema(name, db.Schema{}); err != nil {
+		writeOpError(conn, fmt.Sprintf("clearing schema of bucket '%s'", name), err)
+		return
+	}
+	h.publishBucket(name, false)
+
+	conn.WriteString("OK")
+}
+
+// BUCKET READONLY <bucket> [ON|OFF]
+// Return whether bucket is read-only, or change it.
+func (h *Handler) bucketReadOnly(conn redcon.Conn, args [][]byte) {
+	const bucketReadOnlySetArgsCount = 2
+
+	if len(args) != 1 && len(args) != bucketReadOnlySetArgsCount {
+		wrongArgs(conn, "BUCKET READONLY")
+		return
+	}
+
+	name := string(args[0])
+
+	if len(args) == 1 {
+		bucket, err := h.db.Get(name)
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+			return
+		}
+		defer h.db.Release(bucket)
+
+		if bucket.ReadOnly() {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+		return
+	}
+
+	var readOnly bool
+
+	switch mode := strings.ToLower(string(args[1])); mode {
+	case "on":
+		readOnly = true
+	case "off":
+		readOnly = false
+	default:
+		conn.WriteError(fmt.Sprintf("ERR syntax error, expected ON or OFF, got '%s'", mode))
+		return
+	}
+
+	if err := h.db.SetReadOnly(name, readOnly); err != nil {
+		writeOpError(conn, fmt.Sprintf("changing read-only mode of bucket '%s'", name), err)
+		return
+	}
+	h.publishBucket(name, false)
+
+	conn.WriteString("OK")
+}
+
+// Unix time in milliseconds, 0 for zero time.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixMilli()
+}
+
+func writeBucketStats(conn redcon.Conn, stats *db.BucketStats, clients int) {
+	levels := make([][]field, 0, len(stats.Levels))
+	for _, level := range stats.Levels {
+		levels = append(levels, []field{
+			{"level", level.Level},
+			{"tables", level.Tables},
+			{"size", level.Size},
+			{"target_size", level.TargetSize},
+			{"score", level.Score},
+		})
+	}
+
+	conflict := stats.Conflict
+	if conflict == db.ConflictNone {
+		conflict = "none"
+	}
+
+	writeFields(conn, []field{
+		{"name", stats.Name},
+		{"engine", stats.Engine},
+		{"consistency", stats.Consistency},
+		{"conflict", conflict},
+		{"read_only", stats.ReadOnly},
+		{"size", stats.LSMSize + stats.VLogSize},
+		{"lsm_size", stats.LSMSize},
+		{"vlog_size", stats.VLogSize},
+		{"keys", stats.Keys},
+		{"tables", stats.Tables},
+		{"levels", levels},
+		{"block_cache", cacheStatsFields(stats.BlockCache)},
+		{"index_cache", cacheStatsFields(stats.IndexCache)},
+		{"value_cache", cacheStatsFields(stats.ValueCache)},
+		{"last_write", unixMilli(stats.LastWrite)},
+		{"connections", clients},
+	})
+}
+
+func cacheStatsFields(stats db.CacheStats) []field {
+	return []field{
+		{"hits", stats.Hits},
+		{"misses", stats.Misses},
+		{"hit_ratio", stats.HitRatio},
+		{"keys_added", stats.KeysAdded},
+		{"keys_evicted", stats.KeysEvicted},
+		{"cost_added", stats.CostAdded},
+		{"cost_evicted", stats.CostEvicted},
+	}
 }
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/pepol/databuddy/internal/resp"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains propagation of bucket lifecycle changes (creation,
+// drop, rename, clone, read-only mode, quota and schema) across the cluster.
+// Member changing bucket stores its new definition and broadcasts it as Serf
+// user event; other members store definitions newer than theirs and change
+// their buckets to match. Definitions are also merged from peers when
+// replication connects to them and periodically after, so that members
+// which missed events (e.g. while joining) catch up. Buckets which existed
+// before their first change aren't propagated. Engine, consistency and
+// conflict policy are only set on creation, as buckets can't change them.
+
+const definitionEventName = "bucket-definition"
+
+// Payload of bucket definition event.
+type definitionEvent struct {
+	Bucket     string              `json:"bucket"`
+	Definition db.BucketDefinition `json:"definition"`
+}
+
+// Broadcast current state of bucket, which was created (or restored, if
+// created is false) or changed. Errors are logged, the bucket is changed
+// locally already.
+func (h *Handler) publishBucket(name string, created bool) {
+	if definition, ok := h.currentDefinition(name, created); ok {
+		h.publishDefinition(name, definition)
+	}
+}
+
+// Broadcast drop of bucket.
+func (h *Handler) publishDrop(name string) {
+	if definition, ok := h.dropDefinition(name); ok {
+		h.publishDefinition(name, definition)
+	}
+}
+
+// Broadcast rename of bucket, so that members rename their copy of the
+// bucket instead of dropping it and creating an empty one.
+func (h *Handler) publishRename(oldName, newName string) {
+	if definition, ok := h.dropDefinition(oldName); ok {
+		definition.RenamedTo = newName
+		h.publishDefinition(oldName, definition)
+	}
+
+	if definition, ok := h.currentDefinition(newName, true); ok {
+		definition.RenamedFrom = oldName
+		h.publishDefinition(newName, definition)
+	}
+}
+
+// Broadcast clone of bucket, so that members clone their copy of the source
+// bucket instead of creating an empty one.
+func (h *Handler) publishClone(srcName, dstName string) {
+	if definition, ok := h.currentDefinition(dstName, true); ok {
+		definition.ClonedFrom = srcName
+		h.publishDefinition(dstName, definition)
+	}
+}
+
+// Return definition matching current state of bucket.
+func (h *Handler) currentDefinition(name string, created bool) (db.BucketDefinition, bool) {
+	definition, err := h.db.LocalDefinition(name)
+	if err != nil {
+		log.Error(fmt.Sprintf("publishing definition of bucket '%s'", name), err)
+		return definition, false
+	}
+
+	definition.Updated = time.Now().UnixNano()
+	definition.Created = definition.Updated
+	if current, err := h.db.BucketDefinition(name); err == nil && !created {
+		definition.Created = current.Created
+	}
+
+	return definition, true
+}
+
+// Return definition of dropped bucket.
+func (h *Handler) dropDefinition(name string) (db.BucketDefinition, bool) {
+	definition, err := h.db.BucketDefinition(name)
+	if err != nil && err != db.ErrKeyNotFound {
+		log.Error(fmt.Sprintf("publishing drop of bucket '%s'", name), err)
+		return definition, false
+	}
+
+	definition.Dropped = true
+	definition.Updated = time.Now().UnixNano()
+
+	return definition, true
+}
+
+func (h *Handler) publishDefinition(name string, definition db.BucketDefinition) {
+	if _, err := h.db.SetBucketDefinition(name, definition); err != nil {
+		log.Error(fmt.Sprintf("storing definition of bucket '%s'", name), err)
+		return
+	}
+
+	// Marshalling struct of plain fields cannot fail. Members which miss
+	// the event get the definition from peers later.
+	payload, _ := json.Marshal(definitionEvent{Bucket: name, Definition: definition})
+	if err := h.serf.UserEvent(definitionEventName, payload, false); err != nil {
+		log.Error(fmt.Sprintf("broadcasting definition of bucket '%s'", name), err)
+	}
+}
+
+// Apply definition broadcast by another member.
+func (h *Handler) handleDefinitionEvent(payload []byte) {
+	var event definitionEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		log.Error("decoding bucket definition event", err)
+		return
+	}
+
+	h.mergeDefinition(event.Bucket, event.Definition)
+}
+
+// Store definition of bucket if it's newer than the local one, and change
+// the bucket to match the stored definition.
+func (h *Handler) mergeDefinition(name string, definition db.BucketDefinition) {
+	if h.db.ReadOnly() {
+		return
+	}
+
+	h.definitionsMutex.Lock()
+	defer h.definitionsMutex.Unlock()
+
+	if _, err := h.db.SetBucketDefinition(name, definition); err != nil {
+		log.Error(fmt.Sprintf("storing definition of bucket '%s'", name), err)
+		return
+	}
+
+	stored, err := h.db.BucketDefinition(name)
+	if err != nil {
+		log.Error(fmt.Sprintf("getting definition of bucket '%s'", name), err)
+		return
+	}
+
+	if err := h.applyDefinition(name, stored); err != nil {
+		log.Error(fmt.Sprintf("applying definition of bucket '%s'", name), err)
+	}
+}
+
+// Change bucket to match its definition. Does nothing if it matches
+// already.
+func (h *Handler) applyDefinition(name string, definition db.BucketDefinition) error {
+	exists := h.hasBucket(name)
+
+	switch {
+	case definition.Dropped && exists && definition.RenamedTo != "" && !h.hasBucket(definition.RenamedTo):
+		log.Info("renaming bucket '%s' renamed by peer", name)
+		return h.renameBucket(nil, name, definition.RenamedTo, true)
+	case definition.Dropped && exists:
+		log.Info("dropping bucket '%s' dropped by peer", name)
+		return h.dropBucket(name, true)
+	case definition.Dropped:
+		return nil
+	case !exists:
+		if err := h.restoreBucket(name, definition); err != nil {
+			return err
+		}
+	}
+
+	local, err := h.db.LocalDefinition(name)
+	if err != nil {
+		return err
+	}
+
+	if local.ReadOnly != definition.ReadOnly {
+		log.Info("changing read-only mode of bucket '%s' changed by peer", name)
+		if err := h.db.SetReadOnly(name, definition.ReadOnly); err != nil {
+			return err
+		}
+	}
+
+	if local.Quota != definition.Quota {
+		log.Info("changing quota of bucket '%s' changed by peer", name)
+		if err := h.db.SetQuota(name, definition.Quota); err != nil {
+			return err
+		}
+	}
+
+	if !schemaEqual(local.Schema, definition.Schema) {
+		log.Info("changing schema of bucket '%s' changed by peer", name)
+		if err := h.db.SetSchema(name, definition.Schema); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Create bucket missing locally. Bucket dropped locally after it was
+// created is restored, one dropped before (an earlier bucket of the same
+// name) is purged first.
+func (h *Handler) restoreBucket(name string, definition db.BucketDefinition) error {
+	dropped, err := h.db.Dropped()
+	if err != nil {
+		return err
+	}
+
+	for _, bucket := range dropped {
+		if bucket.Name != name {
+			continue
+		}
+
+		if bucket.DroppedAt.Unix() >= time.Unix(0, definition.Created).Unix() {
+			log.Info("restoring bucket '%s' restored by peer", name)
+			return h.db.Undrop(name)
+		}
+
+		if err := h.db.Purge(name); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case definition.RenamedFrom != "" && h.hasBucket(definition.RenamedFrom):
+		log.Info("renaming bucket '%s' renamed by peer", definition.RenamedFrom)
+		return h.renameBucket(nil, definition.RenamedFrom, name, true)
+	case definition.ClonedFrom != "" && h.hasBucket(definition.ClonedFrom):
+		log.Info("cloning bucket '%s' cloned by peer", definition.ClonedFrom)
+		return h.db.Clone(definition.ClonedFrom, name)
+	}
+
+	log.Info("creating bucket '%s' created by peer", name)
+	return h.db.Create(name, definition.Options())
+}
+
+// Return whether bucket with given name exists locally.
+func (h *Handler) hasBucket(name string) bool {
+	for _, bucket := range h.db.List(name) {
+		if bucket == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func schemaEqual(a, b db.Schema) bool {
+	return a.ValueType == b.ValueType && a.KeyPattern == b.KeyPattern && bytes.Equal(a.JSONSchema, b.JSONSchema)
+}
+
+// Merge definitions known by peer into local ones.
+func (h *Handler) pullDefinitions(peer *replicationPeer) error {
+	reply, err := peer.client.Do([]byte("REPLICATION"), []byte("DEFINITIONS"))
+	if err != nil {
+		return err
+	}
+
+	items, err := resp.Array(reply)
+	if err != nil || len(items)%2 != 0 {
+		return fmt.Errorf("malformed definitions reply: %v", err)
+	}
+
+	for i := 0; i < len(items); i += 2 {
+		name, err := resp.Bytes(items[i])
+		if err != nil {
+			return err
+		}
+
+		value, err := resp.Bytes(items[i+1])
+		if err != nil {
+			return err
+		}
+
+		var definition db.BucketDefinition
+		if err := json.Unmarshal(value, &definition); err != nil {
+			return fmt.Errorf("decoding definition of bucket '%s': %v", name, err)
+		}
+
+		h.mergeDefinition(string(name), definition)
+	}
+
+	return nil
+}
+
+// REPLICATION DEFINITIONS
+// Return bucket name and encoded definition of every bucket with one,
+// including dropped ones. Used by peers to catch up with bucket changes.
+func (h *Handler) replicationDefinitions(conn redcon.Conn, args [][]byte) {
+	if len(args) != 0 {
+		wrongArgs(conn, "REPLICATION DEFINITIONS")
+		return
+	}
+
+	definitions, err := h.db.BucketDefinitions()
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR getting bucket definitions: %v", err))
+		return
+	}
+
+	conn.WriteArray(len(definitions) * 2)
+	for _, name := range sortedKeys(definitions) {
+		// Marshalling struct of plain fields cannot fail.
+		value, _ := json.Marshal(definitions[name])
+
+		conn.WriteBulkString(name)
+		conn.WriteBulk(value)
+	}
+}
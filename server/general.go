@@ -12,12 +12,20 @@ import (
 // INFO
 // Returns node information.
 func (h *Handler) info(conn redcon.Conn, _cmd redcon.Command) {
+	cache := h.db.ValueCacheStats()
+
 	conn.WriteBulkString(fmt.Sprintf(
-		"DataBuddy %s %s (%s) client: %s",
+		"DataBuddy %s %s (%s) client: %s\r\n"+
+			"value_cache_hits:%d\r\n"+
+			"value_cache_misses:%d\r\n"+
+			"value_cache_hit_ratio:%.4f\r\n",
 		h.version,
 		h.addr,
 		h.hostname,
 		conn.RemoteAddr(),
+		cache.Hits,
+		cache.Misses,
+		cache.HitRatio,
 	))
 }
 
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pepol/databuddy/internal/context"
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains implementation of the "secondary index" commands.
+
+const indexArgsMinCount = 3
+
+// INDEX
+// Basic handler for index command container.
+func (h *Handler) index(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < indexArgsMinCount {
+		wrongArgs(conn, "INDEX")
+		return
+	}
+
+	subcommand := strings.ToLower(string(cmd.Args[1]))
+
+	switch subcommand {
+	case "create":
+		h.indexCreate(conn, cmd.Args[2:])
+	case "drop":
+		h.indexDrop(conn, cmd.Args[2:])
+	case "list":
+		h.indexList(conn, cmd.Args[2:])
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown command '%s %s'", string(cmd.Args[0]), subcommand))
+	}
+}
+
+// INDEX CREATE <bucket> <name> ON <field> [UNIQUE|FULLTEXT]
+// Create index of values of JSON field (dot-separated path, "$" for the whole
+// value) of documents in bucket. FULLTEXT index indexes words of text for
+// SEARCH. Existing documents are indexed in background.
+func (h *Handler) indexCreate(conn redcon.Conn, args [][]byte) {
+	const (
+		indexCreateArgsCount       = 4
+		indexCreateUniqueArgsCount = 5
+	)
+
+	if len(args) != indexCreateArgsCount && len(args) != indexCreateUniqueArgsCount {
+		wrongArgs(conn, "INDEX CREATE")
+		return
+	}
+
+	bucketName := string(args[0])
+	name := string(args[1])
+	field := string(args[3])
+
+	if strings.ToLower(string(args[2])) != "on" {
+		conn.WriteError(fmt.Sprintf("ERR syntax error, expected ON, got '%s'", string(args[2])))
+		return
+	}
+
+	kind := db.IndexField
+	unique := false
+	if len(args) == indexCreateUniqueArgsCount {
+		switch strings.ToLower(string(args[4])) {
+		case "unique":
+			unique = true
+		case "fulltext":
+			kind = db.IndexFullText
+		default:
+			conn.WriteError(fmt.Sprintf("ERR syntax error, expected UNIQUE or FULLTEXT, got '%s'", string(args[4])))
+			return
+		}
+	}
+
+	if err := h.db.CreateIndex(bucketName, name, kind, field, unique); err != nil {
+		writeOpError(conn, fmt.Sprintf("creating index '%s' of bucket '%s'", name, bucketName), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// INDEX DROP <bucket> <name>
+// Remove index and all its entries.
+func (h *Handler) indexDrop(conn redcon.Conn, args [][]byte) {
+	const indexDropArgsCount = 2
+
+	if len(args) != indexDropArgsCount {
+		wrongArgs(conn, "INDEX DROP")
+		return
+	}
+
+	bucketName := string(args[0])
+	name := string(args[1])
+
+	if err := h.db.DropIndex(bucketName, name); err != nil {
+		writeOpError(conn, fmt.Sprintf("dropping index '%s' of bucket '%s'", name, bucketName), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// INDEX LIST <bucket>
+// Return all indexes of bucket with their state and build progress.
+func (h *Handler) indexList(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "INDEX LIST")
+		return
+	}
+
+	name := string(args[0])
+
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+		return
+	}
+	defer h.db.Release(bucket)
+
+	indexes := bucket.Indexes()
+
+	conn.WriteArray(len(indexes))
+	for _, index := range indexes {
+		writeFields(conn, []field{
+			{"name", index.Name},
+			{"type", index.Kind()},
+			{"field", index.Field},
+			{"unique", index.Unique},
+			{"state", index.State},
+			{"scanned", index.Scanned},
+			{"error", index.Error},
+		})
+	}
+}
+
+// FIND <index> <value> [LIMIT <count>]
+// FIND <index> <min> <max> [LIMIT <count>]
+// Return keys of documents in currently used bucket with indexed value equal
+// to given value, or within given range, in order of values. Values are
+// JSON scalars (unquoted strings are accepted too), range bounds are
+// inclusive unless prefixed with '(' and '-' or '+' leave them unbounded.
+func (h *Handler) find(conn redcon.Conn, cmd redcon.Command) {
+	const (
+		findLimitArgsCount = 2
+		findRangeArgsCount = 2
+	)
+
+	if len(cmd.Args) < indexArgsMinCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	name := string(cmd.Args[1])
+	args := cmd.Args[2:]
+
+	limit := 0
+	if len(args) > findLimitArgsCount && strings.ToLower(string(args[len(args)-2])) == "limit" {
+		var err error
+		limit, err = strconv.Atoi(string(args[len(args)-1]))
+		if err != nil || limit < 0 {
+			conn.WriteError(fmt.Sprintf("ERR invalid limit '%s'", string(args[len(args)-1])))
+			return
+		}
+		args = args[:len(args)-2]
+	}
+
+	var min, max *db.IndexBound
+
+	switch len(args) {
+	case 1:
+		value := parseIndexValue(args[0])
+		min = &db.IndexBound{Value: value}
+		max = &db.IndexBound{Value: value}
+	case findRangeArgsCount:
+		min = parseIndexBound(args[0], "-")
+		max = parseIndexBound(args[1], "+")
+	default:
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	keys, err := ctx.Bucket().Find(name, min, max, limit)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR searching index '%s': %v", name, err))
+		return
+	}
+
+	conn.WriteAny(keys)
+}
+
+// SEARCH <index> <query> [OFFSET <count>] [LIMIT <count>]
+// Return keys and scores of documents in currently used bucket matching
+// full-text query, best matches first. Query consists of words, "phrases",
+// AND (implied), OR, NOT (or '-') operators and parentheses. Returns at most
+// 10 documents unless LIMIT is given.
+func (h *Handler) search(conn redcon.Conn, cmd redcon.Command) {
+	const (
+		searchOptionArgsCount = 2
+		searchDefaultLimit    = 10
+	)
+
+	if len(cmd.Args) < indexArgsMinCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	name := string(cmd.Args[1])
+	query := string(cmd.Args[2])
+	args := cmd.Args[3:]
+
+	offset, limit := 0, searchDefaultLimit
+	for len(args) > 0 {
+		if len(args) < searchOptionArgsCount {
+			wrongArgs(conn, string(cmd.Args[0]))
+			return
+		}
+
+		value, err := strconv.Atoi(string(args[1]))
+		if err != nil || value < 0 {
+			conn.WriteError(fmt.Sprintf("ERR invalid %s '%s'", strings.ToLower(string(args[0])), string(args[1])))
+			return
+		}
+
+		switch strings.ToLower(string(args[0])) {
+		case "offset":
+			offset = value
+		case "limit":
+			limit = value
+		default:
+			conn.WriteError(fmt.Sprintf("ERR syntax error, unknown option '%s'", string(args[0])))
+			return
+		}
+
+		args = args[searchOptionArgsCount:]
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	if limit == 0 {
+		conn.WriteArray(0)
+		return
+	}
+
+	hits, err := ctx.Bucket().Search(name, query, offset, limit)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR searching index '%s': %v", name, err))
+		return
+	}
+
+	conn.WriteArray(len(hits) * 2)
+	for _, hit := range hits {
+		conn.WriteBulkString(hit.Key)
+		conn.WriteBulkString(strconv.FormatFloat(hit.Score, 'f', -1, 64))
+	}
+}
+
+// Parse range bound, nil if unbounded.
+func parseIndexBound(arg []byte, unbounded string) *db.IndexBound {
+	if string(arg) == unbounded {
+		return nil
+	}
+
+	if len(arg) > 1 && arg[0] == '(' {
+		return &db.IndexBound{Value: parseIndexValue(arg[1:]), Exclusive: true}
+	}
+
+	return &db.IndexBound{Value: parseIndexValue(arg)}
+}
+
+// Parse JSON scalar, falling back to plain string.
+func parseIndexValue(arg []byte) any {
+	var value any
+	if err := json.Unmarshal(arg, &value); err == nil {
+		switch value.(type) {
+		case bool, float64, string:
+			return value
+		}
+	}
+
+	return string(arg)
+}
+
+//nolint:gomnd // Magic numbers in command registration calls are not magic.
+func registerIndex(handler *Handler) {
+	handler.Register("index", handler.index, -3, []string{"database"}, 2, 2, 0, nil, []string{"INDEX", "container for secondary index commands"})
+	handler.RegisterChild("index create", -6, []string{"database"}, 2, 2, 0, nil, []string{"INDEX CREATE <bucket> <name> ON <field> [UNIQUE|FULLTEXT]", "create (full-text) index of JSON field (dot-separated path, '$' for whole value) of bucket values, indexing existing values in background"})
+	handler.RegisterChild("index drop", 4, []string{"database"}, 2, 2, 0, nil, []string{"INDEX DROP <bucket> <name>", "remove index of bucket"})
+	handler.RegisterChild("index list", 3, []string{"database"}, 2, 2, 0, nil, []string{"INDEX LIST <bucket>", "return indexes of bucket with their state and build progress"})
+	handler.Register("find", handler.find, -3, []string{"read"}, -1, -1, 0, nil, []string{"FIND <index> <value>|<min> <max> [LIMIT <count>]", "return keys of values with indexed field equal to value or within range ('(' excludes bound, '-' and '+' leave it open)"})
+	handler.Register("search", handler.search, -3, []string{"read"}, -1, -1, 0, nil, []string{"SEARCH <index> <query> [OFFSET <count>] [LIMIT <count>]", "return keys and BM25 scores of values matching full-text query (words, \"phrases\", AND, OR, NOT/-, parentheses), best first"})
+}
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/pepol/databuddy/internal/context"
+	"github.com/pepol/databuddy/internal/db"
 	"github.com/pepol/databuddy/internal/log"
 	"github.com/tidwall/redcon"
 )
@@ -37,7 +39,7 @@ func (h *Handler) keys(conn redcon.Conn, cmd redcon.Command) {
 		return
 	}
 
-	keys, err := ctx.Bucket.List(prefix)
+	keys, err := ctx.Bucket().List(prefix)
 	if err != nil {
 		conn.WriteError(fmt.Sprintf("ERR getting keys for prefix '%s': %v", prefix, err))
 		return
@@ -69,7 +71,22 @@ func (h *Handler) get(conn redcon.Conn, cmd redcon.Command) {
 		return
 	}
 
-	val, err := ctx.Bucket.Get(key)
+	var (
+		val []byte
+		err error
+	)
+
+	bucket := ctx.Bucket()
+	if isStrong(bucket) {
+		val, err = h.linearizableGet(bucket, key)
+	} else {
+		val, err = bucket.Get(key)
+	}
+
+	if err != nil && isStrong(bucket) && !errors.Is(err, db.ErrKeyNotFound) {
+		writeOpError(conn, fmt.Sprintf("getting item '%s'", key), err)
+		return
+	}
 	if err != nil {
 		conn.WriteError(fmt.Sprintf("ERR getting item '%s': %v", key, err))
 		return
@@ -102,8 +119,19 @@ func (h *Handler) set(conn redcon.Conn, cmd redcon.Command) {
 		return
 	}
 
-	if err := ctx.Bucket.Set(key, val); err != nil {
-		conn.WriteError(fmt.Sprintf("ERR setting item '%s': %v", key, err))
+	var err error
+	if bucket := ctx.Bucket(); isStrong(bucket) {
+		err = h.proposeWrite(bucket, key, val, false)
+	} else if err = bucket.Set(key, val); err == nil {
+		err = h.waitReplicated(bucket)
+	}
+
+	if err != nil {
+		if errors.Is(err, db.ErrQuotaExceeded) || errors.Is(err, db.ErrSchemaViolation) || errors.Is(err, db.ErrUniqueViolation) {
+			conn.WriteError(fmt.Sprintf("ERR %v", err))
+			return
+		}
+		writeOpError(conn, fmt.Sprintf("setting item '%s'", key), err)
 		return
 	}
 
@@ -136,19 +164,37 @@ func (h *Handler) del(conn redcon.Conn, cmd redcon.Command) {
 
 		// TODO: Add more argument checking.
 
-		if err := ctx.Bucket.Delete(key); err != nil {
+		var err error
+		if bucket := ctx.Bucket(); isStrong(bucket) {
+			err = h.proposeWrite(bucket, key, nil, true)
+		} else {
+			err = bucket.Delete(key)
+		}
+
+		if err != nil {
+			if errors.Is(err, db.ErrReadOnly) || isStrong(ctx.Bucket()) {
+				writeOpError(conn, fmt.Sprintf("deleting key '%s'", key), err)
+				return
+			}
 			log.Error(fmt.Sprintf("deleting key '%s'", key), err)
 			continue
 		}
 		deleted++
 	}
 
+	if bucket := ctx.Bucket(); deleted > 0 && !isStrong(bucket) {
+		if err := h.waitReplicated(bucket); err != nil {
+			writeOpError(conn, "deleting keys", err)
+			return
+		}
+	}
+
 	conn.WriteInt(deleted)
 }
 
 //nolint:gomnd // Magic numbers in command registration calls are not magic.
 func registerKV(handler *Handler) {
-	handler.Register("keys", handler.keys, -1, []string{"read"}, 1, 1, 0, nil, []string{"LIST [<prefix>]", "return array of all keys matching prefix"})
+	handler.Register("keys", handler.keys, -1, []string{"read"}, -1, -1, 0, nil, []string{"LIST [<prefix>]", "return array of all keys matching prefix"})
 	handler.Register("get", handler.get, 2, []string{"read"}, 1, 1, 0, nil, []string{"GET <key>", "return value stored under given key"})
 	handler.Register("set", handler.set, 3, []string{"write"}, 1, 1, 0, nil, []string{"SET <key> <value>", "store value under key, returns 'OK' if successful, 'ERR' otherwise"})
 	handler.Register("del", handler.del, -2, []string{"write"}, 1, -1, 1, nil, []string{"DEL <key> [<key> ...]", "delete values stored under key(s), returns number of deleted items"})
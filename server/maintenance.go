@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pepol/databuddy/internal/log"
+)
+
+// This file contains the scheduler of periodic background maintenance tasks.
+
+const (
+	dropPurgeInterval   = time.Minute
+	idleCheckInterval   = 30 * time.Second
+	tsRetentionInterval = time.Minute
+	logTrimInterval     = time.Minute
+)
+
+type maintenanceTask struct {
+	name     string
+	interval time.Duration
+	run      func() error
+}
+
+// Schedule task to be run periodically until the handler is stopped.
+func (h *Handler) schedule(name string, interval time.Duration, run func() error) {
+	h.maintenanceTasks = append(h.maintenanceTasks, maintenanceTask{
+		name:     name,
+		interval: interval,
+		run:      run,
+	})
+}
+
+// Start all scheduled maintenance tasks.
+func (h *Handler) startMaintenance() {
+	for _, task := range h.maintenanceTasks {
+		go h.runMaintenanceTask(task)
+	}
+}
+
+func (h *Handler) runMaintenanceTask(task maintenanceTask) {
+	ticker := time.NewTicker(task.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stopping:
+			return
+		case <-ticker.C:
+			if err := task.run(); err != nil {
+				log.Error(fmt.Sprintf("running maintenance task '%s'", task.name), err)
+			}
+		}
+	}
+}
+
+func registerMaintenance(handler *Handler) {
+	handler.schedule("purge dropped buckets", dropPurgeInterval, func() error {
+		_, err := handler.db.PurgeExpired()
+		return err
+	})
+
+	handler.schedule("close idle buckets", idleCheckInterval, func() error {
+		if closed := handler.db.CloseIdle(); closed > 0 {
+			log.Debug(fmt.Sprintf("closed %d idle bucket(s)", closed))
+		}
+		return nil
+	})
+
+	handler.schedule("trim time series", tsRetentionInterval, func() error {
+		removed, err := handler.db.TrimTimeSeries()
+		if removed > 0 {
+			log.Debug(fmt.Sprintf("removed %d time series sample(s) outside retention", removed))
+		}
+		return err
+	})
+
+	handler.schedule("repair replicated buckets", antiEntropyInterval, handler.repairAll)
+
+	handler.schedule("trim replication logs", logTrimInterval, func() error {
+		removed, err := handler.db.TrimReplicationLogs()
+		if removed > 0 {
+			log.Debug(fmt.Sprintf("removed %d old replication log entries", removed))
+		}
+		return err
+	})
+}
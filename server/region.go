@@ -0,0 +1,406 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/pepol/databuddy/internal/resp"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains regions of kv members and replication policies of
+// buckets. Members only replicate buckets with members of their own region,
+// unless the bucket has a policy listing both regions. Policies are stored
+// by every member: changes are broadcast as Serf user events, and merged
+// from peers when replication connects to them and periodically after, so
+// that members which missed the event catch up.
+
+const (
+	serfRegionTag = "region"
+	serfZoneTag   = "zone"
+	// Region of members not advertising one.
+	defaultRegion = "default"
+
+	policyEventName = "replication-policy"
+	// How often policies are merged from each peer.
+	policySyncInterval = 30 * time.Second
+)
+
+// Payload of replication policy event.
+type policyEvent struct {
+	Bucket string               `json:"bucket"`
+	Policy db.ReplicationPolicy `json:"policy"`
+}
+
+// Region advertised in Serf tags of member.
+func memberRegion(tags map[string]string) string {
+	if region := tags[serfRegionTag]; region != "" {
+		return region
+	}
+
+	return defaultRegion
+}
+
+// Whether bucket is replicated between this member and member of given
+// region. Policies are all known policies by bucket name.
+func (r *replicator) replicatesWith(bucket, region string, policies map[string]db.ReplicationPolicy) bool {
+	if region == r.region {
+		return true
+	}
+
+	policy := policies[bucket]
+	return policy.Includes(r.region) && policy.Includes(region)
+}
+
+// Store policy of bucket and broadcast it to all members.
+func (h *Handler) publishPolicy(name string, policy db.ReplicationPolicy) error {
+	if _, err := h.db.SetReplicationPolicy(name, policy); err != nil {
+		return err
+	}
+
+	// Marshalling struct of plain fields cannot fail. Members which miss
+	// the event get the policy from peers later.
+	payload, _ := json.Marshal(policyEvent{Bucket: name, Policy: policy})
+	if err := h.serf.UserEvent(policyEventName, payload, false); err != nil {
+		log.Error(fmt.Sprintf("broadcasting replication policy of bucket '%s'", name), err)
+	}
+
+	return nil
+}
+
+// Apply policy broadcast by another member.
+func (h *Handler) handlePolicyEvent(payload []byte) {
+	var event policyEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		log.Error("decoding replication policy event", err)
+		return
+	}
+
+	h.mergePolicy(event.Bucket, event.Policy)
+}
+
+func (h *Handler) mergePolicy(name string, policy db.ReplicationPolicy) {
+	stored, err := h.db.SetReplicationPolicy(name, policy)
+	if err != nil {
+		log.Error(fmt.Sprintf("storing replication policy of bucket '%s'", name), err)
+		return
+	}
+
+	if stored {
+		log.Info("replication policy of bucket '%s' changed", name)
+	}
+}
+
+// Merge policies known by peer into local ones.
+func (h *Handler) pullPolicies(peer *replicationPeer) error {
+	reply, err := peer.client.Do([]byte("REPLICATION"), []byte("POLICIES"))
+	if err != nil {
+		return err
+	}
+
+	items, err := resp.Array(reply)
+	if err != nil || len(items)%2 != 0 {
+		return fmt.Errorf("malformed policies reply: %v", err)
+	}
+
+	for i := 0; i < len(items); i += 2 {
+		name, err := resp.Bytes(items[i])
+		if err != nil {
+			return err
+		}
+
+		value, err := resp.Bytes(items[i+1])
+		if err != nil {
+			return err
+		}
+
+		var policy db.ReplicationPolicy
+		if err := json.Unmarshal(value, &policy); err != nil {
+			return fmt.Errorf("decoding replication policy of bucket '%s': %v", name, err)
+		}
+
+		h.mergePolicy(string(name), policy)
+	}
+
+	return nil
+}
+
+// Wait until the latest write of bucket is applied in all other regions of
+// its policy, if the policy is synchronous.
+func (h *Handler) waitReplicated(bucket *db.Bucket) error {
+	policy, err := h.db.ReplicationPolicy(bucket.Name)
+	if err == db.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if policy.Mode != db.ReplicationSync || !policy.Includes(h.replication.region) {
+		return nil
+	}
+
+	position, err := bucket.LogPosition()
+	if err != nil {
+		return err
+	}
+
+	var regions []string
+	for _, region := range policy.Regions {
+		if region != h.replication.region {
+			regions = append(regions, region)
+		}
+	}
+
+	return h.replication.waitAcked(bucket.Name, position, regions, replicationTimeout)
+}
+
+// Wait until some peer of each of given regions acknowledges position of
+// bucket.
+func (r *replicator) waitAcked(bucket string, position db.LogPosition, regions []string, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		r.mutex.Lock()
+		pending := r.unackedRegions(bucket, position, regions)
+		changed := r.acked
+		r.mutex.Unlock()
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("write applied locally, but not in region(s) %s within %v", strings.Join(pending, ", "), timeout)
+		}
+	}
+}
+
+// Regions in which no peer acknowledged position of bucket yet.
+func (r *replicator) unackedRegions(bucket string, position db.LogPosition, regions []string) []string {
+	var pending []string
+
+	for _, region := range regions {
+		acked := false
+
+		for name, peer := range r.peers {
+			ack := r.acks[name][bucket]
+			if peer.region == region && ack.position.ID == position.ID && ack.position.Version >= position.Version {
+				acked = true
+				break
+			}
+		}
+
+		if !acked {
+			pending = append(pending, region)
+		}
+	}
+
+	return pending
+}
+
+// BUCKET REPLICATE <bucket> [TO <region> [<region> ...] [MODE async|sync]]
+// Return replication policy of bucket, or replicate bucket between region
+// of this member and given regions. Writes to buckets with synchronous
+// policy are acknowledged once applied in all regions of the policy.
+func (h *Handler) bucketReplicate(conn redcon.Conn, args [][]byte) {
+	const policyArgsMinCount = 3
+
+	if len(args) == 1 {
+		h.writePolicy(conn, string(args[0]))
+		return
+	}
+
+	if len(args) < policyArgsMinCount || strings.ToLower(string(args[1])) != "to" {
+		wrongArgs(conn, "BUCKET REPLICATE")
+		return
+	}
+
+	name := string(args[0])
+	policy := db.ReplicationPolicy{
+		Regions: []string{h.replication.region},
+		Mode:    db.ReplicationAsync,
+		Updated: time.Now().UnixNano(),
+	}
+
+	regions := args[2:]
+	if n := len(regions); n >= 2 && strings.ToLower(string(regions[n-2])) == "mode" {
+		policy.Mode = strings.ToLower(string(regions[n-1]))
+		regions = regions[:n-2]
+	}
+
+	if len(regions) == 0 {
+		wrongArgs(conn, "BUCKET REPLICATE")
+		return
+	}
+
+	for _, region := range regions {
+		policy.Regions = append(policy.Regions, string(region))
+	}
+
+	if !h.bucketExists(conn, name) {
+		return
+	}
+
+	if err := h.publishPolicy(name, policy); err != nil {
+		writeOpError(conn, fmt.Sprintf("changing replication policy of bucket '%s'", name), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// BUCKET UNREPLICATE <bucket>
+// Remove replication policy of bucket, so that it's only replicated within
+// region of each member.
+func (h *Handler) bucketUnreplicate(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "BUCKET UNREPLICATE")
+		return
+	}
+
+	name := string(args[0])
+
+	if _, err := h.db.ReplicationPolicy(name); err == db.ErrKeyNotFound {
+		conn.WriteError(fmt.Sprintf("ERR bucket '%s' has no replication policy", name))
+		return
+	}
+
+	policy := db.ReplicationPolicy{Updated: time.Now().UnixNano(), Removed: true}
+	if err := h.publishPolicy(name, policy); err != nil {
+		writeOpError(conn, fmt.Sprintf("removing replication policy of bucket '%s'", name), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// Write error if bucket doesn't exist. Returns whether it exists.
+func (h *Handler) bucketExists(conn redcon.Conn, name string) bool {
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+		return false
+	}
+
+	h.db.Release(bucket)
+	return true
+}
+
+func (h *Handler) writePolicy(conn redcon.Conn, name string) {
+	policy, err := h.db.ReplicationPolicy(name)
+	if err == db.ErrKeyNotFound {
+		conn.WriteNull()
+		return
+	}
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR getting replication policy of bucket '%s': %v", name, err))
+		return
+	}
+
+	writeFields(conn, []field{
+		{"regions", policy.Regions},
+		{"mode", policy.Mode},
+		{"updated", unixMilli(time.Unix(0, policy.Updated))},
+	})
+}
+
+// REPLICATION POLICIES
+// Return bucket name and encoded policy of every replication policy,
+// including removed ones. Used by peers to catch up with policy changes.
+func (h *Handler) replicationPolicies(conn redcon.Conn, args [][]byte) {
+	if len(args) != 0 {
+		wrongArgs(conn, "REPLICATION POLICIES")
+		return
+	}
+
+	policies, err := h.db.ReplicationPolicies()
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR getting replication policies: %v", err))
+		return
+	}
+
+	conn.WriteArray(len(policies) * 2)
+	for _, name := range sortedKeys(policies) {
+		// Marshalling struct of plain fields cannot fail.
+		value, _ := json.Marshal(policies[name])
+
+		conn.WriteBulkString(name)
+		conn.WriteBulk(value)
+	}
+}
+
+// REPLICATION REGIONS
+// Return members of each region of the cluster, with the largest lag (in
+// writes) of every bucket replicated from (inbound) and to (outbound)
+// members of the region.
+func (h *Handler) replicationRegions(conn redcon.Conn, args [][]byte) {
+	if len(args) != 0 {
+		wrongArgs(conn, "REPLICATION REGIONS")
+		return
+	}
+
+	positions := h.db.LogPositions()
+
+	r := h.replication
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	type regionStatus struct {
+		members           []string
+		inbound, outbound map[string]uint64
+	}
+
+	regions := make(map[string]*regionStatus)
+	region := func(name string) *regionStatus {
+		if regions[name] == nil {
+			regions[name] = &regionStatus{members: []string{}, inbound: map[string]uint64{}, outbound: map[string]uint64{}}
+		}
+		return regions[name]
+	}
+	region(r.region)
+
+	for _, name := range sortedKeys(r.peers) {
+		peer := r.peers[name]
+
+		status := region(peer.region)
+		status.members = append(status.members, name)
+
+		for bucket, state := range peer.inbound {
+			if current, ok := status.inbound[bucket]; !ok || inboundLag(state) > current {
+				status.inbound[bucket] = inboundLag(state)
+			}
+		}
+
+		for bucket, ack := range r.acks[name] {
+			lag := positions[bucket].Version
+			if ack.position.ID == positions[bucket].ID {
+				lag -= ack.position.Version
+			}
+
+			if current, ok := status.outbound[bucket]; !ok || lag > current {
+				status.outbound[bucket] = lag
+			}
+		}
+	}
+
+	conn.WriteArray(len(regions))
+	for _, name := range sortedKeys(regions) {
+		status := regions[name]
+
+		writeFields(conn, []field{
+			{"region", name},
+			{"members", status.members},
+			{"inbound", status.inbound},
+			{"outbound", status.outbound},
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/pepol/databuddy/internal/merkle"
+	"github.com/pepol/databuddy/internal/resp"
+	"github.com/pepol/databuddy/internal/shard"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains anti-entropy repair of replicated buckets, fixing
+// drift which asynchronous replication leaves behind (e.g. writes lost
+// with truncated logs or crashes). Member splits its keys into ranges and
+// asks each peer replicating the bucket for hashes of the same ranges.
+// Merkle trees built from both sets of hashes are compared, and only keys
+// of differing ranges are streamed from the peer. Buckets with conflict
+// policy merge versions of keys missing locally or differing, which also
+// keeps deleted keys deleted (their versions remain). Without versions,
+// neither the newer value nor whether a missing key was deleted or never
+// replicated can be told, so differences in buckets without conflict policy
+// are only reported. Keys missing on the peer are left to the repair run by
+// the peer.
+//
+// Writes still being replicated would look like drift, so buckets are only
+// repaired from peers with which replication is caught up in both
+// directions.
+
+const (
+	antiEntropyInterval = 10 * time.Minute
+	// Number of keys in each range of the trees.
+	repairRangeSize = 128
+)
+
+var errNotCaughtUp = errors.New("replication with peer not caught up, retry later")
+
+// Differences found and fixed by repair of bucket from peer.
+type repairReport struct {
+	peer      string
+	ranges    int // Ranges compared.
+	differing int // Ranges with different hashes.
+	fetched   int // Keys of differing ranges streamed from the peer.
+	missing   int // Keys missing locally.
+	different int // Keys with different values or versions.
+	merged    int // Keys merged from the peer (with conflict policy only).
+	remote    int // Keys missing on the peer.
+	err       error
+}
+
+func (r repairReport) status() []field {
+	status := []field{
+		{"peer", r.peer},
+		{"ranges", r.ranges},
+		{"differing_ranges", r.differing},
+		{"fetched", r.fetched},
+		{"missing", r.missing},
+		{"different", r.different},
+		{"merged", r.merged},
+		{"missing_remote", r.remote},
+	}
+	if r.err != nil {
+		status = append(status, field{"error", r.err.Error()})
+	}
+
+	return status
+}
+
+// Repair all replicated buckets from all peers.
+func (h *Handler) repairAll() error {
+	if h.db.ReadOnly() {
+		return nil
+	}
+
+	strong := make(map[string]bool)
+	for _, name := range h.db.StrongBuckets() {
+		strong[name] = true
+	}
+
+	for _, name := range h.db.List("") {
+		if strong[name] {
+			continue
+		}
+
+		reports, err := h.repairBucket(name)
+		if err != nil {
+			return fmt.Errorf("repairing bucket '%s': %w", name, err)
+		}
+
+		for _, report := range reports {
+			switch {
+			case errors.Is(report.err, errNotCaughtUp):
+			case report.err != nil:
+				log.Error(fmt.Sprintf("repairing bucket '%s' from peer '%s'", name, report.peer), report.err)
+			case report.merged > 0:
+				log.Info("repaired %d key(s) of bucket '%s' from peer '%s'", report.merged, name, report.peer)
+			case report.missing+report.different > 0:
+				log.Warn("bucket '%s' differs from peer '%s' in %d key(s), which are repaired only with conflict policy", name, report.peer, report.missing+report.different)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Repair bucket from every peer replicating it.
+func (h *Handler) repairBucket(name string) ([]repairReport, error) {
+	policies, err := h.db.ReplicationPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	r := h.replication
+
+	r.mutex.Lock()
+	peers := make([]replicationPeer, 0, len(r.peers))
+	for _, peer := range r.peers {
+		if r.replicatesWith(name, peer.region, policies) {
+			peers = append(peers, replicationPeer{name: peer.name, addr: peer.addr})
+		}
+	}
+	r.mutex.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].name < peers[j].name })
+
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer h.db.Release(bucket)
+
+	if isStrong(bucket) {
+		return nil, errors.New("strongly consistent buckets are replicated by consensus")
+	}
+
+	reports := make([]repairReport, 0, len(peers))
+	for _, peer := range peers {
+		report, err := h.repairFrom(bucket, peer.name, peer.addr)
+		report.peer = peer.name
+		report.err = err
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// Repair bucket from peer with given name and address.
+func (h *Handler) repairFrom(bucket *db.Bucket, peer, addr string) (repairReport, error) {
+	var report repairReport
+
+	position, err := bucket.LogPosition()
+	if err != nil {
+		return report, err
+	}
+
+	if !h.replication.caughtUp(peer, bucket.Name, position) {
+		return report, errNotCaughtUp
+	}
+
+	boundaries, hashes, err := bucket.HashRanges(repairRangeSize, h.sharding.ownedBy(h.sharding.local))
+	if err != nil {
+		return report, err
+	}
+
+	client, err := resp.Dial(addr, replicationTimeout)
+	if err != nil {
+		return report, err
+	}
+	defer client.Close() //nolint:errcheck // Only reads were done.
+
+	args := [][]byte{[]byte("REPLICATION"), []byte("MERKLE"), []byte(bucket.Name), []byte(h.sharding.local)}
+	reply, err := client.Do(append(args, boundaries...)...)
+	if err != nil {
+		return report, err
+	}
+
+	remoteHashes, err := parseHashes(reply, len(boundaries))
+	if err != nil {
+		return report, err
+	}
+
+	report.ranges = len(boundaries)
+
+	differing := merkle.Diff(merkle.New(hashes), merkle.New(remoteHashes))
+	report.differing = len(differing)
+
+	for _, i := range differing {
+		var end []byte
+		if i+1 < len(boundaries) {
+			end = boundaries[i+1]
+		}
+
+		if err := h.repairRange(client, bucket, peer, boundaries[i], end, &report); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// Compare keys of range between start and end (nil for the last key) with
+// peer, merging versions of keys missing locally or differing in bucket with
+// conflict policy.
+func (h *Handler) repairRange(client *resp.Client, bucket *db.Bucket, peer string, start, end []byte, report *repairReport) error {
+	local, err := readRange(start, end, func(start []byte) ([]db.LogEntry, []byte, error) {
+		return bucket.ReadRange(start, repairRangeSize)
+	})
+	if err != nil {
+		return err
+	}
+
+	remote, err := readRange(start, end, func(start []byte) ([]db.LogEntry, []byte, error) {
+		reply, err := client.Do([]byte("REPLICATION"), []byte("COPY"), []byte(bucket.Name), start, formatUint(repairRangeSize))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		_, entries, next, err := parseCopy(reply)
+		return entries, next, err
+	})
+	if err != nil {
+		return err
+	}
+
+	local, remote = h.sharding.owned(local), h.sharding.owned(remote)
+	report.fetched += len(remote)
+
+	entries := make(map[string]db.LogEntry, len(local))
+	for _, entry := range local {
+		entries[string(entry.Key)] = entry
+	}
+
+	versioned := bucket.Conflict() != db.ConflictNone
+
+	var fixes []db.LogEntry
+
+	for _, entry := range remote {
+		current, ok := entries[string(entry.Key)]
+		delete(entries, string(entry.Key))
+
+		switch {
+		case !ok:
+			report.missing++
+		case bytes.Equal(current.Value, entry.Value) && bytes.Equal(current.Meta, entry.Meta):
+			continue
+		default:
+			report.different++
+		}
+
+		// Keys written before the policy was set have no versions.
+		if versioned && entry.Meta != nil {
+			report.merged++
+			fixes = append(fixes, entry)
+		}
+	}
+
+	report.remote += len(entries)
+
+	return bucket.ApplyReplicated(peer, fixes, db.LogPosition{})
+}
+
+// Read all keys between start and end (nil for the last key) using given
+// paged read.
+func readRange(start, end []byte, read func(start []byte) ([]db.LogEntry, []byte, error)) ([]db.LogEntry, error) {
+	var entries []db.LogEntry
+
+	for {
+		page, next, err := read(start)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range page {
+			if end != nil && bytes.Compare(entry.Key, end) >= 0 {
+				return entries, nil
+			}
+			entries = append(entries, entry)
+		}
+
+		if next == nil || (end != nil && bytes.Compare(next, end) >= 0) {
+			return entries, nil
+		}
+		start = next
+	}
+}
+
+// Filter of keys owned by member with given name, nil if keys aren't
+// partitioned.
+func (s *sharding) ownedBy(name string) func(key []byte) bool {
+	table, _ := s.current()
+	if table == nil {
+		return nil
+	}
+
+	return func(key []byte) bool {
+		return table.Owns(name, shard.KeySlot(key))
+	}
+}
+
+// Whether all writes of bucket were pulled from peer, and peer acknowledged
+// given position of local writes.
+func (r *replicator) caughtUp(peer, bucket string, position db.LogPosition) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	p, ok := r.peers[peer]
+	if !ok {
+		return false
+	}
+
+	state := p.inbound[bucket]
+	if !state.synced || state.err != nil || inboundLag(state) > 0 {
+		return false
+	}
+
+	if position.Version == 0 {
+		return true
+	}
+
+	ack := r.acks[peer][bucket]
+	return ack.position.ID == position.ID && ack.position.Version >= position.Version
+}
+
+func parseHashes(reply any, count int) ([][]byte, error) {
+	items, err := resp.Array(reply)
+	if err != nil || len(items) != count {
+		return nil, fmt.Errorf("malformed hashes reply: %v", err)
+	}
+
+	hashes := make([][]byte, len(items))
+	for i, item := range items {
+		if hashes[i], err = resp.Bytes(item); err != nil {
+			return nil, err
+		}
+	}
+
+	return hashes, nil
+}
+
+// CLUSTER REPAIR <bucket>
+// Repair bucket from every peer replicating it, returning differences
+// found and keys merged for each peer.
+func (h *Handler) clusterRepair(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "CLUSTER REPAIR")
+		return
+	}
+
+	name := string(args[0])
+
+	reports, err := h.repairBucket(name)
+	if err != nil {
+		writeOpError(conn, fmt.Sprintf("repairing bucket '%s'", name), err)
+		return
+	}
+
+	conn.WriteArray(len(reports))
+	for _, report := range reports {
+		writeFields(conn, report.status())
+	}
+}
+
+// REPLICATION MERKLE <bucket> <node> [<boundary> ...]
+// Return hashes of keys and values of bucket in ranges starting at given
+// boundaries (the first one is empty), including only keys owned by given
+// node when keys are partitioned. Used by peers repairing the bucket.
+func (h *Handler) replicationMerkle(conn redcon.Conn, args [][]byte) {
+	const merkleArgsMinCount = 3
+
+	if len(args) < merkleArgsMinCount {
+		wrongArgs(conn, "REPLICATION MERKLE")
+		return
+	}
+
+	name := string(args[0])
+
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+		return
+	}
+	defer h.db.Release(bucket)
+
+	hashes, err := bucket.RangeHashes(args[2:], h.sharding.ownedBy(string(args[1])))
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR hashing bucket '%s': %v", name, err))
+		return
+	}
+
+	conn.WriteArray(len(hashes))
+	for _, hash := range hashes {
+		conn.WriteBulk(hash)
+	}
+}
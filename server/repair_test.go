@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/pepol/databuddy/internal/db"
+)
+
+// Write entries to bucket of member without logging them, as drift left by
+// lost writes.
+func drift(t *testing.T, n *testNode, bucket string, entries ...db.LogEntry) {
+	t.Helper()
+
+	b, err := n.h.db.Get(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.h.db.Release(b)
+
+	if err := b.ApplyReplicated("drift", entries, db.LogPosition{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Differences of buckets without conflict policy are only reported, as
+// neither the newer value nor deleted keys can be told.
+func TestRepairPlainBucket(t *testing.T) {
+	a := startTestNode(t, "a")
+	b := startTestNode(t, "b", a)
+
+	for i := 0; i < 300; i++ {
+		a.mustDo(t, "SET", fmt.Sprintf("k%03d", i), "v")
+	}
+
+	eventually(t, "replication of keys", func() bool {
+		reply, _ := b.do(t, "GET", "k299")
+		return replyString(reply) == "v"
+	})
+
+	drift(t, a, db.DefaultBucketName, db.LogEntry{Key: []byte("k500"), Value: []byte("local")})
+	drift(t, b, db.DefaultBucketName,
+		db.LogEntry{Key: []byte("k100"), Value: []byte("changed")},
+		db.LogEntry{Key: []byte("k400"), Value: []byte("remote")},
+	)
+
+	var report repairReport
+
+	eventually(t, "repair of caught up bucket", func() bool {
+		reports, err := a.h.repairBucket(db.DefaultBucketName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != 1 {
+			return false
+		}
+
+		report = reports[0]
+		if report.err != nil && !errors.Is(report.err, errNotCaughtUp) {
+			t.Fatal(report.err)
+		}
+		return report.err == nil
+	})
+
+	if report.peer != "b" || report.missing != 1 || report.different != 1 || report.remote != 1 || report.merged != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	if report.differing == 0 || report.differing == report.ranges {
+		t.Fatalf("%d of %d ranges differ, want only ranges of drifted keys", report.differing, report.ranges)
+	}
+
+	for key, want := range map[string]string{"k100": "v", "k500": "local"} {
+		if reply := a.mustDo(t, "GET", key); replyString(reply) != want {
+			t.Errorf("key '%s' is '%s' after repair, want '%s'", key, replyString(reply), want)
+		}
+	}
+
+	if reply, err := a.do(t, "GET", "k400"); err == nil {
+		t.Errorf("key 'k400' missing locally is '%s' after repair", replyString(reply))
+	}
+}
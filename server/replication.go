@@ -0,0 +1,932 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/pepol/databuddy/internal/resp"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains asynchronous replication of buckets between kv members
+// of the cluster. Every member pulls writes from replication logs of all
+// other members of its region (and of regions of replication policy of the
+// bucket) over their RESP port and applies them to its bucket of the same
+// name. Positions applied from each peer are stored in the bucket, so that
+// restarted member continues where it stopped.
+
+const (
+	// How often peers are polled once caught up.
+	replicationInterval      = 500 * time.Millisecond
+	replicationRetryInterval = 5 * time.Second
+	replicationTimeout       = 10 * time.Second
+	// Maximum number of writes or keys transferred by single request.
+	replicationPageSize = 1024
+
+	serfRoleTag = "role"
+	serfRESPTag = "resp"
+	kvRole      = "kv"
+
+	truncatedErrorCode = "TRUNCATED"
+)
+
+type replicator struct {
+	// Region of this member.
+	region string
+
+	mutex sync.Mutex
+	peers map[string]*replicationPeer
+	// Positions acknowledged by peers pulling from this member, by peer
+	// name and bucket.
+	acks map[string]map[string]replicationAck
+	// Closed (and replaced) whenever peer acknowledges position.
+	acked chan struct{}
+}
+
+type replicationAck struct {
+	position db.LogPosition
+	time     time.Time
+}
+
+type replicationPeer struct {
+	name   string
+	addr   string
+	region string
+	stop   chan struct{}
+
+	// Used only by the goroutine pulling from the peer.
+	client       *resp.Client
+	policiesSync time.Time // When policies and bucket definitions were merged from the peer.
+
+	// Guarded by the replicator mutex.
+	lastContact time.Time
+	lastError   error
+	inbound     map[string]inboundState
+}
+
+// State of replication of a bucket from peer.
+type inboundState struct {
+	applied   db.LogPosition
+	available db.LogPosition
+	acked     db.LogPosition // Position acknowledged by the last pull.
+	lastWrite int64          // Commit time of the last applied write (Unix nanoseconds).
+	synced    bool           // Whether the bucket was pulled since connecting.
+	err       error
+}
+
+func newReplicator(region string) *replicator {
+	return &replicator{
+		region: region,
+		peers:  make(map[string]*replicationPeer),
+		acks:   make(map[string]map[string]replicationAck),
+		acked:  make(chan struct{}),
+	}
+}
+
+// Replicate from kv peers, following membership changes until the handler
+// is stopped.
+func (h *Handler) runReplication() {
+	ticker := time.NewTicker(replicationInterval)
+	defer ticker.Stop()
+
+	for {
+		h.updateReplicationPeers()
+
+		select {
+		case <-h.stopping:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Start pulling from new peers and stop pulling from ones that left.
+func (h *Handler) updateReplicationPeers() {
+	current := make(map[string]replicationPeer)
+	local := h.serf.LocalMember().Name
+
+	for _, member := range h.serf.Members() {
+		if member.Name == local || member.Status != serf.StatusAlive {
+			continue
+		}
+
+		if member.Tags[serfRoleTag] != kvRole || member.Tags[serfRESPTag] == "" {
+			continue
+		}
+
+		current[member.Name] = replicationPeer{
+			addr:   net.JoinHostPort(member.Addr.String(), member.Tags[serfRESPTag]),
+			region: memberRegion(member.Tags),
+		}
+	}
+
+	r := h.replication
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, peer := range r.peers {
+		if member, ok := current[name]; !ok || member.addr != peer.addr || member.region != peer.region {
+			close(peer.stop)
+			delete(r.peers, name)
+		}
+	}
+
+	for name, member := range current {
+		if _, ok := r.peers[name]; ok {
+			continue
+		}
+
+		peer := &replicationPeer{
+			name:    name,
+			addr:    member.addr,
+			region:  member.region,
+			stop:    make(chan struct{}),
+			inbound: make(map[string]inboundState),
+		}
+		r.peers[name] = peer
+
+		go h.replicateFrom(peer)
+	}
+}
+
+func (h *Handler) replicateFrom(peer *replicationPeer) {
+	log.Info("replicating from peer '%s' (%s, region '%s')", peer.name, peer.addr, peer.region)
+
+	defer func() {
+		if peer.client != nil {
+			if err := peer.client.Close(); err != nil {
+				log.Error(fmt.Sprintf("closing connection to peer '%s'", peer.name), err)
+			}
+		}
+	}()
+
+	var lastError string
+
+	for {
+		delay := replicationInterval
+
+		more, err := h.pullPeer(peer)
+		h.replication.contacted(peer, err)
+
+		switch {
+		case err != nil:
+			delay = replicationRetryInterval
+			if err.Error() != lastError {
+				log.Error(fmt.Sprintf("replicating from peer '%s'", peer.name), err)
+			}
+			lastError = err.Error()
+		case more:
+			delay = 0
+		default:
+			lastError = ""
+		}
+
+		select {
+		case <-peer.stop:
+			return
+		case <-h.stopping:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Pull new writes of all buckets from peer. Returns whether some bucket has
+// more writes to pull.
+func (h *Handler) pullPeer(peer *replicationPeer) (bool, error) {
+	if h.db.ReadOnly() {
+		return false, nil
+	}
+
+	if peer.client == nil || peer.client.Broken() {
+		if peer.client != nil {
+			peer.client.Close() //nolint:errcheck // Connection is broken already.
+		}
+		peer.client = nil
+
+		client, err := resp.Dial(peer.addr, replicationTimeout)
+		if err != nil {
+			return false, err
+		}
+		peer.client = client
+		peer.policiesSync = time.Time{}
+		h.replication.resetInbound(peer)
+	}
+
+	if time.Since(peer.policiesSync) >= policySyncInterval {
+		if err := h.pullDefinitions(peer); err != nil {
+			return false, fmt.Errorf("pulling bucket definitions: %w", err)
+		}
+		if err := h.pullPolicies(peer); err != nil {
+			return false, fmt.Errorf("pulling replication policies: %w", err)
+		}
+		peer.policiesSync = time.Now()
+	}
+
+	positions, err := peerPositions(peer.client)
+	if err != nil {
+		return false, err
+	}
+
+	policies, err := h.db.ReplicationPolicies()
+	if err != nil {
+		return false, err
+	}
+
+	// Strongly consistent buckets are replicated by consensus.
+	strong := make(map[string]bool)
+	for _, name := range h.db.StrongBuckets() {
+		strong[name] = true
+	}
+
+	more := false
+
+	for _, name := range h.db.List("") {
+		if strong[name] || !h.replication.replicatesWith(name, peer.region, policies) {
+			continue
+		}
+
+		// Buckets are only acquired (and opened) if their position on the
+		// peer moved. Buckets not opened on the peer since it started have
+		// no new writes; writes missed before that are found by repair.
+		state := h.replication.inboundState(peer, name)
+		remote, known := positions[name]
+		if !known {
+			if !state.synced {
+				h.replication.updateInbound(peer, name, func(state *inboundState) {
+					state.synced = true
+				})
+			}
+			continue
+		}
+		if state.synced && remote == state.applied && state.acked == state.applied {
+			continue
+		}
+
+		pending, err := h.pullBucket(peer, name)
+		if err != nil && peer.client.Broken() {
+			return more, fmt.Errorf("pulling bucket '%s': %w", name, err)
+		}
+		if err != nil {
+			// Error of the bucket (e.g. missing on peer), retried once the
+			// bucket is written there.
+			h.replication.updateInbound(peer, name, func(state *inboundState) {
+				state.synced = true
+				state.available = remote
+				state.err = err
+			})
+		}
+
+		// Writes of synchronously replicated buckets are acknowledged by the
+		// next pull, which follows right away.
+		if policies[name].Mode == db.ReplicationSync && h.replication.inboundState(peer, name).applied != state.applied {
+			pending = true
+		}
+
+		more = more || pending
+	}
+
+	return more, nil
+}
+
+// Pull new writes of bucket from peer. Returns whether there are more
+// writes to pull.
+func (h *Handler) pullBucket(peer *replicationPeer, name string) (bool, error) {
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		return false, err
+	}
+	defer h.db.Release(bucket)
+
+	applied, err := bucket.AppliedPosition(peer.name)
+	if err != nil {
+		return false, err
+	}
+
+	reply, err := peer.client.Do(
+		[]byte("REPLICATION"), []byte("PULL"), []byte(name),
+		formatUint(applied.ID), formatUint(applied.Version),
+		formatUint(replicationPageSize), []byte(h.serf.LocalMember().Name),
+	)
+
+	var replyErr resp.Error
+	if errors.As(err, &replyErr) && strings.HasPrefix(string(replyErr), truncatedErrorCode+" ") {
+		return false, h.copyBucket(peer, bucket)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	available, entries, err := parsePull(reply)
+	if err != nil {
+		return false, err
+	}
+
+	position := applied
+	if len(entries) > 0 {
+		position = db.LogPosition{ID: available.ID, Version: entries[len(entries)-1].Version}
+
+		if err := bucket.ApplyReplicated(peer.name, h.sharding.owned(entries), position); err != nil {
+			return false, err
+		}
+	}
+
+	h.replication.updateInbound(peer, name, func(state *inboundState) {
+		state.applied = position
+		state.available = available
+		state.acked = applied
+		state.synced = true
+		state.err = nil
+		if len(entries) > 0 {
+			state.lastWrite = entries[len(entries)-1].Time
+		}
+	})
+
+	return position.Version < available.Version, nil
+}
+
+// Copy all keys of bucket from peer whose replication log no longer has the
+// writes following the applied position. Pulling continues with the
+// position current when the copy started, so that writes during the copy
+// are applied again. Keys deleted from the peer before the copy aren't
+// deleted locally.
+func (h *Handler) copyBucket(peer *replicationPeer, bucket *db.Bucket) error {
+	log.Info("copying bucket '%s' from peer '%s'", bucket.Name, peer.name)
+
+	var (
+		start    []byte
+		position db.LogPosition
+	)
+
+	for first := true; ; first = false {
+		reply, err := peer.client.Do(
+			[]byte("REPLICATION"), []byte("COPY"), []byte(bucket.Name),
+			start, formatUint(replicationPageSize),
+		)
+		if err != nil {
+			return err
+		}
+
+		current, entries, next, err := parseCopy(reply)
+		if err != nil {
+			return err
+		}
+
+		if first {
+			position = current
+		}
+
+		applied := db.LogPosition{}
+		if next == nil {
+			applied = position
+		}
+
+		if err := bucket.ApplyReplicated(peer.name, h.sharding.owned(entries), applied); err != nil {
+			return err
+		}
+
+		if next == nil {
+			break
+		}
+		start = next
+
+		select {
+		case <-peer.stop:
+			return errors.New("replication stopped")
+		default:
+		}
+	}
+
+	h.replication.updateInbound(peer, bucket.Name, func(state *inboundState) {
+		state.applied = position
+		state.available = position
+		state.synced = true
+		state.err = nil
+	})
+
+	return nil
+}
+
+// Positions of replication logs of peer by bucket name.
+func peerPositions(client *resp.Client) (map[string]db.LogPosition, error) {
+	const positionFields = 3
+
+	reply, err := client.Do([]byte("REPLICATION"), []byte("POSITIONS"))
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := resp.Array(reply)
+	if err != nil || len(items)%positionFields != 0 {
+		return nil, fmt.Errorf("malformed positions reply: %v", err)
+	}
+
+	positions := make(map[string]db.LogPosition)
+
+	for i := 0; i < len(items); i += positionFields {
+		name, err := resp.Bytes(items[i])
+		if err != nil {
+			return nil, err
+		}
+
+		position, err := parsePosition(items[i+1], items[i+2])
+		if err != nil {
+			return nil, err
+		}
+
+		positions[string(name)] = position
+	}
+
+	return positions, nil
+}
+
+// Parse reply of REPLICATION PULL.
+func parsePull(reply any) (db.LogPosition, []db.LogEntry, error) {
+	const entryFields = 5
+
+	items, err := resp.Array(reply)
+	if err != nil || len(items) < 2 || (len(items)-2)%entryFields != 0 {
+		return db.LogPosition{}, nil, fmt.Errorf("malformed pull reply: %v", err)
+	}
+
+	available, err := parsePosition(items[0], items[1])
+	if err != nil {
+		return db.LogPosition{}, nil, err
+	}
+
+	entries := make([]db.LogEntry, 0, (len(items)-2)/entryFields)
+
+	for i := 2; i < len(items); i += entryFields {
+		version, err := parseUint(items[i])
+		if err != nil {
+			return db.LogPosition{}, nil, err
+		}
+
+		at, err := resp.Int(items[i+1])
+		if err != nil {
+			return db.LogPosition{}, nil, err
+		}
+
+		key, err := resp.Bytes(items[i+2])
+		if err != nil {
+			return db.LogPosition{}, nil, err
+		}
+
+		entry := db.LogEntry{Version: version, Time: at, Key: key, Delete: items[i+3] == nil}
+		if !entry.Delete {
+			if entry.Value, err = resp.Bytes(items[i+3]); err != nil {
+				return db.LogPosition{}, nil, err
+			}
+		}
+
+		if entry.Meta, err = optionalBytes(items[i+4]); err != nil {
+			return db.LogPosition{}, nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return available, entries, nil
+}
+
+// Parse reply of REPLICATION COPY.
+func parseCopy(reply any) (db.LogPosition, []db.LogEntry, []byte, error) {
+	const (
+		copyHeaderFields = 3
+		keyFields        = 3
+	)
+
+	items, err := resp.Array(reply)
+	if err != nil || len(items) < copyHeaderFields || (len(items)-copyHeaderFields)%keyFields != 0 {
+		return db.LogPosition{}, nil, nil, fmt.Errorf("malformed copy reply: %v", err)
+	}
+
+	position, err := parsePosition(items[0], items[1])
+	if err != nil {
+		return db.LogPosition{}, nil, nil, err
+	}
+
+	var next []byte
+	if items[2] != nil {
+		if next, err = resp.Bytes(items[2]); err != nil {
+			return db.LogPosition{}, nil, nil, err
+		}
+	}
+
+	entries := make([]db.LogEntry, 0, (len(items)-copyHeaderFields)/keyFields)
+
+	for i := copyHeaderFields; i < len(items); i += keyFields {
+		key, err := resp.Bytes(items[i])
+		if err != nil {
+			return db.LogPosition{}, nil, nil, err
+		}
+
+		value, err := resp.Bytes(items[i+1])
+		if err != nil {
+			return db.LogPosition{}, nil, nil, err
+		}
+
+		meta, err := optionalBytes(items[i+2])
+		if err != nil {
+			return db.LogPosition{}, nil, nil, err
+		}
+
+		entries = append(entries, db.LogEntry{Key: key, Value: value, Meta: meta})
+	}
+
+	return position, entries, next, nil
+}
+
+// Bytes of reply, nil for null reply.
+func optionalBytes(reply any) ([]byte, error) {
+	if reply == nil {
+		return nil, nil
+	}
+
+	return resp.Bytes(reply)
+}
+
+func parsePosition(id, version any) (db.LogPosition, error) {
+	var (
+		position db.LogPosition
+		err      error
+	)
+
+	if position.ID, err = parseUint(id); err != nil {
+		return position, err
+	}
+
+	position.Version, err = parseUint(version)
+	return position, err
+}
+
+func parseUint(reply any) (uint64, error) {
+	value, err := resp.Bytes(reply)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(string(value), 10, 64)
+}
+
+func formatUint(value uint64) []byte {
+	return []byte(strconv.FormatUint(value, 10))
+}
+
+func (r *replicator) contacted(peer *replicationPeer, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	peer.lastError = err
+	if err == nil {
+		peer.lastContact = time.Now()
+	}
+}
+
+// Forget buckets pulled from peer, so that all are pulled again.
+func (r *replicator) resetInbound(peer *replicationPeer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, state := range peer.inbound {
+		state.synced = false
+		peer.inbound[name] = state
+	}
+}
+
+func (r *replicator) inboundState(peer *replicationPeer, name string) inboundState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return peer.inbound[name]
+}
+
+func (r *replicator) updateInbound(peer *replicationPeer, name string, update func(state *inboundState)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	state := peer.inbound[name]
+	update(&state)
+	peer.inbound[name] = state
+}
+
+// Record position of bucket requested by peer, up to which it applied the
+// writes of this member.
+func (r *replicator) ack(peer, bucket string, position db.LogPosition) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.acks[peer] == nil {
+		r.acks[peer] = make(map[string]replicationAck)
+	}
+
+	r.acks[peer][bucket] = replicationAck{position: position, time: time.Now()}
+
+	close(r.acked)
+	r.acked = make(chan struct{})
+}
+
+// REPLICATION
+// Basic handler for replication command container.
+func (h *Handler) replicationCommand(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		wrongArgs(conn, "REPLICATION")
+		return
+	}
+
+	subcommand := strings.ToLower(string(cmd.Args[1]))
+
+	switch subcommand {
+	case "status":
+		h.replicationStatus(conn, cmd.Args[2:])
+	case "positions":
+		h.replicationPositions(conn, cmd.Args[2:])
+	case "pull":
+		h.replicationPull(conn, cmd.Args[2:])
+	case "copy":
+		h.replicationCopy(conn, cmd.Args[2:])
+	case "merkle":
+		h.replicationMerkle(conn, cmd.Args[2:])
+	case "policies":
+		h.replicationPolicies(conn, cmd.Args[2:])
+	case "definitions":
+		h.replicationDefinitions(conn, cmd.Args[2:])
+	case "regions":
+		h.replicationRegions(conn, cmd.Args[2:])
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown command '%s %s'", string(cmd.Args[0]), subcommand))
+	}
+}
+
+// REPLICATION STATUS
+// Return state of replication with each peer: writes pulled from it
+// (inbound) and writes it pulled from this member (outbound), with lag in
+// number of writes per bucket.
+func (h *Handler) replicationStatus(conn redcon.Conn, args [][]byte) {
+	if len(args) != 0 {
+		wrongArgs(conn, "REPLICATION STATUS")
+		return
+	}
+
+	positions := h.db.LogPositions()
+
+	r := h.replication
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	names := make(map[string]bool, len(r.peers))
+	for name := range r.peers {
+		names[name] = true
+	}
+	for name := range r.acks {
+		names[name] = true
+	}
+
+	conn.WriteArray(len(names))
+	for _, name := range sortedKeys(names) {
+		status := []field{{"peer", name}}
+		inbound := []field{}
+
+		if peer, ok := r.peers[name]; ok {
+			status = append(status,
+				field{"addr", peer.addr},
+				field{"region", peer.region},
+				field{"last_contact", unixMilli(peer.lastContact)},
+			)
+			if peer.lastError != nil {
+				status = append(status, field{"error", peer.lastError.Error()})
+			}
+
+			for _, bucket := range sortedKeys(peer.inbound) {
+				inbound = append(inbound, field{bucket, inboundStatus(peer.inbound[bucket])})
+			}
+		}
+
+		outbound := []field{}
+		acks := r.acks[name]
+		for _, bucket := range sortedKeys(acks) {
+			ack := acks[bucket]
+
+			lag := positions[bucket].Version
+			if ack.position.ID == positions[bucket].ID {
+				lag -= ack.position.Version
+			}
+
+			outbound = append(outbound, field{bucket, []field{
+				{"acked", ack.position.Version},
+				{"available", positions[bucket].Version},
+				{"lag", lag},
+				{"last_pull", unixMilli(ack.time)},
+			}})
+		}
+
+		writeFields(conn, append(status, field{"inbound", inbound}, field{"outbound", outbound}))
+	}
+}
+
+func inboundStatus(state inboundState) []field {
+	status := []field{
+		{"applied", state.applied.Version},
+		{"available", state.available.Version},
+		{"lag", inboundLag(state)},
+		{"last_write", unixMilli(time.Unix(0, state.lastWrite))},
+	}
+	if state.err != nil {
+		status = append(status, field{"error", state.err.Error()})
+	}
+
+	return status
+}
+
+// Number of writes of bucket available on peer, but not applied yet.
+func inboundLag(state inboundState) uint64 {
+	lag := state.available.Version
+	if state.applied.ID == state.available.ID && state.applied.Version <= lag {
+		lag -= state.applied.Version
+	}
+
+	return lag
+}
+
+// REPLICATION POSITIONS
+// Return bucket name, replication log ID and last version for each bucket
+// written since the database was opened. Used by peers to find buckets
+// with new writes.
+func (h *Handler) replicationPositions(conn redcon.Conn, args [][]byte) {
+	const positionFields = 3
+
+	if len(args) != 0 {
+		wrongArgs(conn, "REPLICATION POSITIONS")
+		return
+	}
+
+	positions := h.db.LogPositions()
+
+	conn.WriteArray(len(positions) * positionFields)
+	for _, name := range sortedKeys(positions) {
+		conn.WriteBulkString(name)
+		conn.WriteBulk(formatUint(positions[name].ID))
+		conn.WriteBulk(formatUint(positions[name].Version))
+	}
+}
+
+// REPLICATION PULL <bucket> <log ID> <version> <count> <node>
+// Return ID and last version of replication log of bucket, followed by
+// version, commit time, key, value (null if deleted) and version of the key
+// (null unless the bucket has conflict policy) of up to count writes
+// following given position. Node pulling the writes acknowledges
+// the position. TRUNCATED error is returned if the writes are no longer
+// available.
+func (h *Handler) replicationPull(conn redcon.Conn, args [][]byte) {
+	const (
+		pullArgsCount = 5
+		entryFields   = 5
+	)
+
+	if len(args) != pullArgsCount {
+		wrongArgs(conn, "REPLICATION PULL")
+		return
+	}
+
+	name := string(args[0])
+
+	after, err := parsePosition(args[1], args[2])
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR invalid position: %v", err))
+		return
+	}
+
+	count, err := strconv.Atoi(string(args[3]))
+	if err != nil || count < 1 {
+		conn.WriteError(fmt.Sprintf("ERR invalid count '%s'", string(args[3])))
+		return
+	}
+
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+		return
+	}
+	defer h.db.Release(bucket)
+
+	h.replication.ack(string(args[4]), name, after)
+
+	entries, current, err := bucket.ReadLog(after, count)
+	if errors.Is(err, db.ErrLogTruncated) {
+		conn.WriteError(fmt.Sprintf("%s reading replication log of bucket '%s': %v", truncatedErrorCode, name, err))
+		return
+	}
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR reading replication log of bucket '%s': %v", name, err))
+		return
+	}
+
+	conn.WriteArray(2 + len(entries)*entryFields)
+	conn.WriteBulk(formatUint(current.ID))
+	conn.WriteBulk(formatUint(current.Version))
+
+	for _, entry := range entries {
+		conn.WriteBulk(formatUint(entry.Version))
+		conn.WriteInt64(entry.Time)
+		conn.WriteBulk(entry.Key)
+		if entry.Delete {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulk(entry.Value)
+		}
+		writeOptionalBulk(conn, entry.Meta)
+	}
+}
+
+// Write bulk reply, null reply if value is nil.
+func writeOptionalBulk(conn redcon.Conn, value []byte) {
+	if value == nil {
+		conn.WriteNull()
+	} else {
+		conn.WriteBulk(value)
+	}
+}
+
+// REPLICATION COPY <bucket> <start> <count>
+// Return ID and last version of replication log of bucket, key to continue
+// with (null after the last one) and up to count keys with values and
+// versions (null unless the bucket has conflict policy) starting at given
+// key. Used by peers whose position is no longer in the log.
+func (h *Handler) replicationCopy(conn redcon.Conn, args [][]byte) {
+	const (
+		copyArgsCount    = 3
+		copyHeaderFields = 3
+		keyFields        = 3
+	)
+
+	if len(args) != copyArgsCount {
+		wrongArgs(conn, "REPLICATION COPY")
+		return
+	}
+
+	name := string(args[0])
+
+	count, err := strconv.Atoi(string(args[2]))
+	if err != nil || count < 1 {
+		conn.WriteError(fmt.Sprintf("ERR invalid count '%s'", string(args[2])))
+		return
+	}
+
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+		return
+	}
+	defer h.db.Release(bucket)
+
+	// Position is taken first, so that writes during the copy follow it.
+	position, err := bucket.LogPosition()
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR reading replication log of bucket '%s': %v", name, err))
+		return
+	}
+
+	entries, next, err := bucket.ReadRange(args[1], count)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR reading bucket '%s': %v", name, err))
+		return
+	}
+
+	conn.WriteArray(copyHeaderFields + len(entries)*keyFields)
+	conn.WriteBulk(formatUint(position.ID))
+	conn.WriteBulk(formatUint(position.Version))
+	if next == nil {
+		conn.WriteNull()
+	} else {
+		conn.WriteBulk(next)
+	}
+
+	for _, entry := range entries {
+		conn.WriteBulk(entry.Key)
+		conn.WriteBulk(entry.Value)
+		writeOptionalBulk(conn, entry.Meta)
+	}
+}
+
+//nolint:gomnd // Magic numbers in command registration calls are not magic.
+func registerReplication(handler *Handler) {
+	handler.Register("replication", handler.replicationCommand, -2, []string{"cluster"}, -1, -1, 0, nil, []string{"REPLICATION", "container for replication commands"})
+	handler.RegisterChild("replication status", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"REPLICATION STATUS", "return state of replication with each peer, with lag (in writes) of every bucket"})
+	handler.RegisterChild("replication positions", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"REPLICATION POSITIONS", "return replication log ID and version of buckets written since start (used by peers)"})
+	handler.RegisterChild("replication pull", 7, []string{"cluster"}, 2, 2, 0, nil, []string{"REPLICATION PULL <bucket> <log ID> <version> <count> <node>", "return writes of bucket following given position of its replication log (used by peers)"})
+	handler.RegisterChild("replication merkle", -5, []string{"cluster"}, 2, 2, 0, nil, []string{"REPLICATION MERKLE <bucket> <node> [<boundary> ...]", "return hashes of ranges of bucket starting at given keys, with keys owned by node (used by peers repairing the bucket)"})
+	handler.RegisterChild("replication policies", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"REPLICATION POLICIES", "return replication policies of all buckets, including removed ones (used by peers)"})
+	handler.RegisterChild("replication definitions", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"REPLICATION DEFINITIONS", "return definitions of all buckets, including dropped ones (used by peers)"})
+	handler.RegisterChild("replication regions", 2, []string{"cluster"}, -1, -1, 0, nil, []string{"REPLICATION REGIONS", "return members of each region with the largest lag (in writes) of every bucket replicated from and to the region"})
+	handler.RegisterChild("replication copy", 5, []string{"cluster"}, 2, 2, 0, nil, []string{"REPLICATION COPY <bucket> <start> <count>", "return keys and values of bucket starting at given key (used by peers)"})
+}
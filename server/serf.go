@@ -2,12 +2,19 @@ package server
 
 import (
 	"log"
+	"strconv"
 
 	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
 )
 
-func getSerfConfig(host string, port int, id string, logger *log.Logger, eventCh chan<- serf.Event) *serf.Config {
+// Maximum size of user events (the maximum allowed by Serf), so that bucket
+// definitions with schemas fit in.
+const userEventSizeLimit = 9 * 1024
+
+// Serf configuration of member, advertising port of its RESP server, region
+// and zone (if set) to peers.
+func getSerfConfig(host string, port, respPort int, region, zone, id string, logger *log.Logger, eventCh chan<- serf.Event) *serf.Config {
 	memberlistConfig := memberlist.DefaultLANConfig()
 	memberlistConfig.BindAddr = host
 	memberlistConfig.BindPort = port
@@ -16,13 +23,19 @@ func getSerfConfig(host string, port int, id string, logger *log.Logger, eventCh
 
 	serfConfig := serf.DefaultConfig()
 	serfConfig.Tags = map[string]string{
-		"role": "kv",
+		serfRoleTag:   kvRole,
+		serfRESPTag:   strconv.Itoa(respPort),
+		serfRegionTag: region,
+	}
+	if zone != "" {
+		serfConfig.Tags[serfZoneTag] = zone
 	}
 	serfConfig.NodeName = id
 	serfConfig.EventCh = eventCh
 	serfConfig.MemberlistConfig = memberlistConfig
 	serfConfig.Logger = logger
 	serfConfig.ProtocolVersion = 5
+	serfConfig.UserEventSizeLimit = userEventSizeLimit
 
 	return serfConfig
 }
@@ -8,9 +8,11 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/hashicorp/serf/serf"
+	"github.com/pepol/databuddy/internal/config"
 	"github.com/pepol/databuddy/internal/context"
 	"github.com/pepol/databuddy/internal/db"
 	"github.com/pepol/databuddy/internal/log"
@@ -39,9 +41,26 @@ type Handler struct {
 	serf     *serf.Serf
 	eventsCh chan serf.Event
 
+	// State of asynchronous replication with peers.
+	replication *replicator
+	// Raft groups of strongly consistent buckets.
+	consensus *consensus
+	// Partitioning of keys among members.
+	sharding *sharding
+	// Serializes applying definitions of buckets.
+	definitionsMutex sync.Mutex
+
 	// Replace with sorted map implementation for consistent ordering.
 	commandDescriptions map[string]commandInfo
 
+	// Contexts of all currently connected clients.
+	clients      map[redcon.Conn]*context.Context
+	clientsMutex sync.RWMutex
+
+	// Periodic background tasks, stopped by closing the stopping channel.
+	maintenanceTasks []maintenanceTask
+	stopping         chan struct{}
+
 	Mux    *redcon.ServeMux
 	Server *redcon.Server
 
@@ -51,8 +70,8 @@ type Handler struct {
 }
 
 // NewHandler initialized the server Handler.
-func NewHandler(version, addr, hostname, datadir string, s *serf.Serf, eventsCh chan serf.Event) (*Handler, error) {
-	dbs, err := db.OpenDatabase(datadir)
+func NewHandler(version, addr, hostname string, cfg *config.Config, s *serf.Serf, eventsCh chan serf.Event) (*Handler, error) {
+	dbs, err := db.OpenDatabase(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +79,8 @@ func NewHandler(version, addr, hostname, datadir string, s *serf.Serf, eventsCh
 	return &Handler{
 		accepting:           true,
 		commandDescriptions: make(map[string]commandInfo),
+		clients:             make(map[redcon.Conn]*context.Context),
+		stopping:            make(chan struct{}),
 		db:                  dbs,
 		Mux:                 redcon.NewServeMux(),
 		addr:                addr,
@@ -67,6 +88,9 @@ func NewHandler(version, addr, hostname, datadir string, s *serf.Serf, eventsCh
 		version:             version,
 		serf:                s,
 		eventsCh:            eventsCh,
+		replication:         newReplicator(memberRegion(s.LocalMember().Tags)),
+		consensus:           newConsensus(),
+		sharding:            newSharding(cfg, s.LocalMember().Name),
 	}, nil
 }
 
@@ -77,9 +101,24 @@ func Serve(version string) {
 
 	port := viper.GetInt("port")
 	host := viper.GetString("host")
-	datadir := viper.GetString("datadir")
+	cfg := &config.Config{
+		DataDir:           viper.GetString("datadir"),
+		DropRetention:     viper.GetDuration("dropretention"),
+		BucketIdleTimeout: viper.GetDuration("bucketidletimeout"),
+		MaxOpenBuckets:    viper.GetInt("maxopenbuckets"),
+		ValueCacheSize:    viper.GetInt64("valuecachesize"),
+		ReadOnly:          viper.GetBool("readonly"),
+
+		ReplicationLogSize: uint64(viper.GetInt64("replicationlogsize")),
+
+		ShardReplicas:     viper.GetInt("shardreplicas"),
+		ShardVirtualNodes: viper.GetInt("shardvnodes"),
+		ShardProxy:        viper.GetBool("shardproxy"),
+	}
 	join := viper.GetStringSlice("join")
 	serfPort := viper.GetInt("serfport")
+	region := viper.GetString("region")
+	zone := viper.GetString("zone")
 
 	addr := net.JoinHostPort(host, fmt.Sprintf("%d", port))
 
@@ -92,8 +131,9 @@ func Serve(version string) {
 	serfEvents := make(chan serf.Event, serfEventsBufSize)
 
 	hostID := getHostID(hostname, addr)
+	cfg.NodeName = hostID
 
-	serfConfig := getSerfConfig(host, serfPort, hostID, logger, serfEvents)
+	serfConfig := getSerfConfig(host, serfPort, port, region, zone, hostID, logger, serfEvents)
 
 	s, err := serf.Create(serfConfig)
 	if err != nil {
@@ -107,7 +147,7 @@ func Serve(version string) {
 		}
 	}
 
-	handler, err := NewHandler(version, addr, hostname, datadir, s, serfEvents)
+	handler, err := NewHandler(version, addr, hostname, cfg, s, serfEvents)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -118,15 +158,42 @@ func Serve(version string) {
 	// General information commands.
 	registerGeneral(handler)
 
+	// Connection management commands.
+	registerConnection(handler)
+
 	// DB management commands.
 	registerDatabaseManagement(handler)
 
 	// KV commands.
 	registerKV(handler)
 
+	// Conflict resolution commands.
+	registerConflict(handler)
+
+	// Conflict-free replicated data type commands.
+	registerCRDT(handler)
+
+	// Secondary index commands.
+	registerIndex(handler)
+
+	// Vector index commands.
+	registerVector(handler)
+
+	// Time series commands.
+	registerTimeSeries(handler)
+
 	// Cluster commands.
 	registerCluster(handler)
 
+	// Replication commands.
+	registerReplication(handler)
+
+	// Consensus commands.
+	registerConsensus(handler)
+
+	// Background maintenance tasks.
+	registerMaintenance(handler)
+
 	log.Info(fmt.Sprintf("Starting DataBuddy %s RESP server on %s", version, addr))
 
 	sigs := make(chan os.Signal, 1)
@@ -138,7 +205,7 @@ func Serve(version string) {
 		addr,
 		handler.Mux.ServeRESP,
 		handler.acceptConnection,
-		func(conn redcon.Conn, err error) {},
+		handler.closeConnection,
 	)
 	handler.Server = server
 
@@ -149,6 +216,12 @@ func Serve(version string) {
 
 	go handler.handleSerf()
 
+	go handler.runReplication()
+
+	go handler.runConsensus()
+
+	handler.startMaintenance()
+
 	err = server.ListenAndServe()
 	if err != nil {
 		log.Error("serving resp", err)
@@ -182,7 +255,7 @@ func (h *Handler) Register(
 		categories: categories,
 		tips:       tips,
 	}
-	h.Mux.HandleFunc(command, handler)
+	h.Mux.HandleFunc(command, h.routed(h.commandDescriptions[command], handler))
 
 	return h
 }
@@ -215,6 +288,7 @@ func (h *Handler) RegisterChild(
 // Stop handling connection and close database.
 func (h *Handler) Stop(done chan bool) {
 	h.accepting = false
+	close(h.stopping)
 
 	errored := false
 
@@ -228,6 +302,8 @@ func (h *Handler) Stop(done chan bool) {
 		errored = true
 	}
 
+	h.sharding.close()
+
 	if err := h.db.Close(); err != nil {
 		log.Error("closing database", err)
 		errored = true
@@ -241,6 +317,8 @@ func (h *Handler) Stop(done chan bool) {
 
 // Handle Serf events.
 func (h *Handler) handleSerf() {
+	h.updateShards()
+
 	for {
 		select {
 		case ev := <-h.eventsCh:
@@ -253,8 +331,15 @@ func (h *Handler) handleSerfEvent(event serf.Event) {
 	switch ev := event.(type) {
 	case serf.MemberEvent:
 		log.Info("%s: %v", ev.EventType().String(), ev.Members)
+		h.updateShards()
 	case serf.UserEvent:
 		log.Info("User: %s %v", ev.Name, ev.Payload)
+		switch ev.Name {
+		case policyEventName:
+			h.handlePolicyEvent(ev.Payload)
+		case definitionEventName:
+			h.handleDefinitionEvent(ev.Payload)
+		}
 	case *serf.Query:
 		log.Info("Query (due at %v): %s %v", ev.Deadline(), ev.Name, ev.Payload)
 		if err := ev.Respond(nil); err != nil {
@@ -271,16 +356,11 @@ func (h *Handler) acceptConnection(conn redcon.Conn) bool {
 		return false
 	}
 
-	bucket, err := h.db.Get(h.db.DefaultBucket)
-	if err != nil {
+	if err := h.newClientContext(conn); err != nil {
 		conn.WriteError(fmt.Sprintf("ERR initializing connection: %v", err))
 		return false
 	}
 
-	conn.SetContext(&context.Context{
-		Bucket: bucket,
-	})
-
 	return true
 }
 
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/pepol/databuddy/internal/config"
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/resp"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/redcon"
+)
+
+const testTimeout = 10 * time.Second
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// Member of test cluster, serving RESP on addr.
+type testNode struct {
+	h        *Handler
+	addr     string
+	serfAddr string
+	done     chan struct{}
+	stopped  sync.Once
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// Start member with given name, joining cluster of given members. Member is
+// stopped when the test finishes.
+func startTestNode(t *testing.T, name string, join ...*testNode) *testNode {
+	t.Helper()
+
+	// Data directory must not exist yet to get its permissions right.
+	dir := filepath.Join(t.TempDir(), name)
+	if err := db.InitDatabase(dir, db.DefaultBucketName, db.LayoutDir); err != nil {
+		t.Fatal(err)
+	}
+
+	port, serfPort := freePort(t), freePort(t)
+	logger := stdlog.New(io.Discard, "", 0)
+	events := make(chan serf.Event, serfEventsBufSize)
+
+	serfConfig := getSerfConfig("127.0.0.1", serfPort, port, defaultRegion, "", name, logger, events)
+	serfConfig.MemberlistConfig.GossipInterval = 20 * time.Millisecond
+	serfConfig.MemberlistConfig.ProbeInterval = 200 * time.Millisecond
+
+	s, err := serf.Create(serfConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, member := range join {
+		if _, err := s.Join([]string{member.serfAddr}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	cfg := &config.Config{DataDir: dir, ReplicationLogSize: 1000, NodeName: name}
+
+	h, err := NewHandler("test", addr, name, cfg, s, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registerMeta(h)
+	registerGeneral(h)
+	registerConnection(h)
+	registerDatabaseManagement(h)
+	registerKV(h)
+	registerConflict(h)
+	registerCRDT(h)
+	registerCluster(h)
+	registerReplication(h)
+	registerConsensus(h)
+
+	h.Server = redcon.NewServer(addr, h.Mux.ServeRESP, h.acceptConnection, h.closeConnection)
+
+	n := &testNode{h: h, addr: addr, serfAddr: fmt.Sprintf("127.0.0.1:%d", serfPort), done: make(chan struct{})}
+
+	go func() {
+		defer close(n.done)
+		h.Server.ListenAndServe() //nolint:errcheck // Stopped by closing.
+	}()
+
+	go h.handleSerf()
+	go h.runReplication()
+	go h.runConsensus()
+
+	t.Cleanup(n.stop)
+
+	eventually(t, "member "+name+" serving", func() bool {
+		client, err := resp.Dial(addr, time.Second)
+		if err != nil {
+			return false
+		}
+		client.Close() //nolint:errcheck // Only connected.
+		return true
+	})
+
+	return n
+}
+
+// Stop member, unless stopped already.
+func (n *testNode) stop() {
+	n.stopped.Do(n.shutdown)
+}
+
+func (n *testNode) shutdown() {
+	n.h.accepting = false
+	close(n.h.stopping)
+
+	n.h.Server.Close()  //nolint:errcheck // Test is finished.
+	n.h.serf.Leave()    //nolint:errcheck // Test is finished.
+	n.h.serf.Shutdown() //nolint:errcheck // Test is finished.
+	n.h.sharding.close()
+	<-n.done
+
+	n.h.db.Close() //nolint:errcheck // Test is finished.
+}
+
+// Send command to member, returning its reply or error.
+func (n *testNode) do(t *testing.T, args ...string) (any, error) {
+	t.Helper()
+
+	return n.doIn(t, "", args...)
+}
+
+// Send command to member using given bucket (default if empty), returning
+// its reply or error.
+func (n *testNode) doIn(t *testing.T, bucket string, args ...string) (any, error) {
+	t.Helper()
+
+	client, err := resp.Dial(n.addr, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() //nolint:errcheck // Test is finished.
+
+	if bucket != "" {
+		if _, err := client.Do([]byte("BUCKET"), []byte("USE"), []byte(bucket)); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		cmd = append(cmd, []byte(arg))
+	}
+
+	return client.Do(cmd...)
+}
+
+// Send command to member, failing on error.
+func (n *testNode) mustDo(t *testing.T, args ...string) any {
+	t.Helper()
+
+	reply, err := n.do(t, args...)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+
+	return reply
+}
+
+// Wait until condition holds, failing after testTimeout.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Bulk string reply as string, empty for nil.
+func replyString(reply any) string {
+	value, _ := resp.Bytes(reply)
+	return string(value)
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/pepol/databuddy/internal/config"
+	"github.com/pepol/databuddy/internal/context"
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/pepol/databuddy/internal/resp"
+	"github.com/pepol/databuddy/internal/shard"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains partitioning of keys among kv members. Slot table is
+// rebuilt from members which didn't leave on every membership change, so
+// that slots of failed members don't move away from their data until the
+// members are forgotten. Commands with key arguments for slots not owned by
+// this member are redirected to (or proxied to) the first owner of the slot
+// which didn't fail. Asynchronous replication only
+// applies writes of owned keys, so that each key is held by its owners.
+
+const (
+	// How long proxied requests wait for the owner.
+	shardProxyTimeout = 10 * time.Second
+	// Idle connections kept for proxied requests per owner and bucket.
+	// Requests proxied meanwhile open another connection each.
+	shardProxyIdleClients = 4
+	// Redirects of the owner followed by proxied request, while slot
+	// tables of members differ (e.g. during membership change).
+	shardProxyRedirects = 2
+)
+
+type sharding struct {
+	replicas int
+	vnodes   int
+	proxy    bool
+
+	// Name of this member.
+	local string
+
+	mutex sync.RWMutex
+	table *shard.Table // Nil if partitioning is disabled.
+
+	// Idle connections of proxied requests by owner address and bucket.
+	clientsMutex sync.Mutex
+	clients      map[string][]*resp.Client
+}
+
+func newSharding(cfg *config.Config, local string) *sharding {
+	return &sharding{
+		local:    local,
+		replicas: cfg.ShardReplicas,
+		vnodes:   cfg.ShardVirtualNodes,
+		proxy:    cfg.ShardProxy,
+		clients:  make(map[string][]*resp.Client),
+	}
+}
+
+// Current slot table and name of this member, nil table if partitioning is
+// disabled.
+func (s *sharding) current() (*shard.Table, string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.table, s.local
+}
+
+// Entries of keys owned by this member.
+func (s *sharding) owned(entries []db.LogEntry) []db.LogEntry {
+	table, local := s.current()
+	if table == nil {
+		return entries
+	}
+
+	owned := make([]db.LogEntry, 0, len(entries))
+	for _, entry := range entries {
+		if table.Owns(local, shard.KeySlot(entry.Key)) {
+			owned = append(owned, entry)
+		}
+	}
+
+	return owned
+}
+
+// Rebuild slot table from kv members which didn't leave.
+func (h *Handler) updateShards() {
+	s := h.sharding
+	if s.replicas <= 0 {
+		return
+	}
+
+	var members []shard.Member
+
+	for _, member := range h.serf.Members() {
+		if member.Status == serf.StatusLeft || member.Tags[serfRoleTag] != kvRole || member.Tags[serfRESPTag] == "" {
+			continue
+		}
+
+		members = append(members, shard.Member{
+			Name:   member.Name,
+			Addr:   net.JoinHostPort(member.Addr.String(), member.Tags[serfRESPTag]),
+			Failed: member.Status == serf.StatusFailed,
+		})
+	}
+
+	table := shard.NewTable(members, s.vnodes, s.replicas)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.table = table
+}
+
+// Wrap handler of command with key arguments, so that requests for keys
+// owned by other members are routed to them.
+func (h *Handler) routed(info commandInfo, handler redcon.HandlerFunc) redcon.HandlerFunc {
+	if info.firstKey <= 0 || !(hasFlag(info.flags, "read") || hasFlag(info.flags, "write")) {
+		return handler
+	}
+
+	return func(conn redcon.Conn, cmd redcon.Command) {
+		if !h.routeCommand(conn, cmd, info) {
+			handler(conn, cmd)
+		}
+	}
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Redirect or proxy command whose keys aren't owned by this member. Returns
+// whether the command was handled.
+func (h *Handler) routeCommand(conn redcon.Conn, cmd redcon.Command, info commandInfo) bool {
+	table, local := h.sharding.current()
+	if table == nil {
+		return false
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok || isStrong(ctx.Bucket()) {
+		// Strongly consistent buckets are held by all members.
+		return false
+	}
+
+	keys := commandKeys(cmd.Args, info)
+	if len(keys) == 0 {
+		return false
+	}
+
+	slot := shard.KeySlot(keys[0])
+	owned, sameSlot := true, true
+
+	for _, key := range keys {
+		keySlot := shard.KeySlot(key)
+		owned = owned && table.Owns(local, keySlot)
+		sameSlot = sameSlot && keySlot == slot
+	}
+
+	switch {
+	case owned:
+		return false
+	case !sameSlot:
+		conn.WriteError("CROSSSLOT keys in request don't hash to the same slot")
+		return true
+	}
+
+	owner, ok := servingOwner(table.Owners(slot))
+	if !ok {
+		conn.WriteError(fmt.Sprintf("CLUSTERDOWN slot %d is not served", slot))
+		return true
+	}
+
+	if !h.sharding.proxy {
+		conn.WriteError(fmt.Sprintf("MOVED %d %s", slot, owner.Addr))
+		return true
+	}
+
+	reply, err := h.sharding.forward(owner.Addr, ctx.Bucket().Name, cmd.Args)
+
+	var replyErr resp.Error
+	switch {
+	case errors.As(err, &replyErr):
+		conn.WriteError(string(replyErr))
+	case err != nil:
+		conn.WriteError(fmt.Sprintf("ERR proxying to '%s': %v", owner.Name, err))
+	default:
+		writeReply(conn, reply)
+	}
+
+	return true
+}
+
+// First owner of slot which didn't fail.
+func servingOwner(owners []shard.Member) (shard.Member, bool) {
+	for _, owner := range owners {
+		if !owner.Failed {
+			return owner, true
+		}
+	}
+
+	return shard.Member{}, false
+}
+
+// Key arguments of command, as described by its registration.
+func commandKeys(args [][]byte, info commandInfo) [][]byte {
+	last := info.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+
+	step := info.stepKey
+	if step <= 0 {
+		step = 1
+	}
+
+	var keys [][]byte
+	for i := info.firstKey; i <= last && i < len(args); i += step {
+		keys = append(keys, args[i])
+	}
+
+	return keys
+}
+
+// Send command to member with given address in given bucket. MOVED
+// redirects of the member are followed, other replies (including ASK
+// redirects, which members don't send) are returned to the caller.
+func (s *sharding) forward(addr, bucket string, args [][]byte) (any, error) {
+	for redirects := 0; ; redirects++ {
+		reply, err := s.send(addr, bucket, args)
+
+		var replyErr resp.Error
+		if redirects >= shardProxyRedirects || !errors.As(err, &replyErr) {
+			return reply, err
+		}
+
+		fields := strings.Fields(string(replyErr))
+		if len(fields) != 3 || fields[0] != "MOVED" { //nolint:gomnd // MOVED <slot> <addr>
+			return reply, err
+		}
+		addr = fields[2]
+	}
+}
+
+func (s *sharding) send(addr, bucket string, args [][]byte) (any, error) {
+	client, err := s.client(addr, bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release(addr, bucket, client)
+
+	return client.Do(args...)
+}
+
+// Idle connection to member using given bucket, or a new one if there is
+// none. The connection must be released once the request completes.
+func (s *sharding) client(addr, bucket string) (*resp.Client, error) {
+	id := addr + "/" + bucket
+
+	s.clientsMutex.Lock()
+	for idle := s.clients[id]; len(idle) > 0; idle = s.clients[id] {
+		client := idle[len(idle)-1]
+		s.clients[id] = idle[:len(idle)-1]
+
+		if !client.Broken() {
+			s.clientsMutex.Unlock()
+			return client, nil
+		}
+		client.Close() //nolint:errcheck // Connection is broken already.
+	}
+	s.clientsMutex.Unlock()
+
+	client, err := resp.Dial(addr, shardProxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := client.Do([]byte("BUCKET"), []byte("USE"), []byte(bucket)); err != nil {
+		client.Close() //nolint:errcheck // Error of USE is more relevant.
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Keep connection for further requests, unless it's broken or there are
+// enough idle connections already.
+func (s *sharding) release(addr, bucket string, client *resp.Client) {
+	id := addr + "/" + bucket
+
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	if client.Broken() || len(s.clients[id]) >= shardProxyIdleClients {
+		client.Close() //nolint:errcheck // Connection isn't needed.
+		return
+	}
+
+	s.clients[id] = append(s.clients[id], client)
+}
+
+func (s *sharding) close() {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+
+	for id, clients := range s.clients {
+		for _, client := range clients {
+			if err := client.Close(); err != nil {
+				log.Error(fmt.Sprintf("closing proxy connection '%s'", id), err)
+			}
+		}
+		delete(s.clients, id)
+	}
+}
+
+// Write reply received from another member.
+func writeReply(conn redcon.Conn, reply any) {
+	switch value := reply.(type) {
+	case nil:
+		conn.WriteNull()
+	case string:
+		conn.WriteString(value)
+	case []byte:
+		conn.WriteBulk(value)
+	case int64:
+		conn.WriteInt64(value)
+	case resp.Error:
+		conn.WriteError(string(value))
+	case []any:
+		conn.WriteArray(len(value))
+		for _, item := range value {
+			writeReply(conn, item)
+		}
+	default:
+		conn.WriteAny(value)
+	}
+}
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pepol/databuddy/internal/context"
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains implementation of the time series commands. All of them
+// operate on time series of currently used bucket.
+
+const (
+	tsArgsMinCount = 2
+	// Arguments of option followed by value.
+	tsOptionArgsCount = 2
+)
+
+// TS.CREATE <key> [RETENTION <milliseconds>] [LABELS <label> <value> ...]
+// Create empty time series.
+func (h *Handler) tsCreate(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < tsArgsMinCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+
+	options, err := parseSeriesOptions(cmd.Args[2:])
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR %v", err))
+		return
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	if err := ctx.Bucket().CreateTimeSeries(key, options); err != nil {
+		writeOpError(conn, fmt.Sprintf("creating time series '%s'", key), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// TS.ADD <key> <timestamp|*> <value> [RETENTION <milliseconds>] [LABELS <label> <value> ...]
+// Add sample to time series, creating it with given options if it doesn't
+// exist. Timestamp is in Unix milliseconds, '*' is the current time. Sample
+// with the same timestamp is replaced. Returns timestamp of the sample.
+func (h *Handler) tsAdd(conn redcon.Conn, cmd redcon.Command) {
+	const tsAddArgsMinCount = 4
+
+	if len(cmd.Args) < tsAddArgsMinCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+
+	sample, err := parseSample(cmd.Args[2], cmd.Args[3])
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR %v", err))
+		return
+	}
+
+	options, err := parseSeriesOptions(cmd.Args[4:])
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR %v", err))
+		return
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	if err := ctx.Bucket().AddSample(key, sample, &options); err != nil {
+		writeOpError(conn, fmt.Sprintf("adding sample to time series '%s'", key), err)
+		return
+	}
+
+	conn.WriteInt64(sample.Timestamp)
+}
+
+// TS.MADD <key> <timestamp|*> <value> [<key> <timestamp|*> <value> ...]
+// Add samples to existing time series. Returns array of timestamps of the
+// samples, or errors for samples which were not added.
+func (h *Handler) tsMAdd(conn redcon.Conn, cmd redcon.Command) {
+	const tsMAddTupleSize = 3
+
+	if len(cmd.Args) < 1+tsMAddTupleSize || (len(cmd.Args)-1)%tsMAddTupleSize != 0 {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	args := cmd.Args[1:]
+	conn.WriteArray(len(args) / tsMAddTupleSize)
+
+	for i := 0; i < len(args); i += tsMAddTupleSize {
+		key := string(args[i])
+
+		sample, err := parseSample(args[i+1], args[i+2])
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("ERR %v", err))
+			continue
+		}
+
+		if err := ctx.Bucket().AddSample(key, sample, nil); err != nil {
+			writeOpError(conn, fmt.Sprintf("adding sample to time series '%s'", key), err)
+			continue
+		}
+
+		conn.WriteInt64(sample.Timestamp)
+	}
+}
+
+// TS.RANGE <key> <from|-> <to|+> [COUNT <count>] [AGGREGATION <avg|min|max|sum|count> <milliseconds>]
+// Return samples of time series with timestamps within given range
+// (inclusive) as array of timestamp and value pairs, in order of time. With
+// AGGREGATION, samples are aggregated within time buckets of given duration,
+// each reported at its start.
+func (h *Handler) tsRange(conn redcon.Conn, cmd redcon.Command) {
+	const (
+		tsRangeArgsMinCount = 4
+		sampleArgsCount     = 2
+	)
+
+	if len(cmd.Args) < tsRangeArgsMinCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+
+	from, err := parseRangeTimestamp(cmd.Args[2], "-", math.MinInt64)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR %v", err))
+		return
+	}
+
+	to, err := parseRangeTimestamp(cmd.Args[3], "+", math.MaxInt64)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR %v", err))
+		return
+	}
+
+	count, aggregation, err := parseRangeOptions(cmd.Args[4:])
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR %v", err))
+		return
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	samples, err := ctx.Bucket().Range(key, from, to, aggregation, count)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR reading time series '%s': %v", key, err))
+		return
+	}
+
+	conn.WriteArray(len(samples))
+	for _, sample := range samples {
+		conn.WriteArray(sampleArgsCount)
+		conn.WriteInt64(sample.Timestamp)
+		conn.WriteBulkString(strconv.FormatFloat(sample.Value, 'f', -1, 64))
+	}
+}
+
+// TS.CREATERULE <source> <dest> AGGREGATION <avg|min|max|sum|count> <milliseconds>
+// Create compaction rule aggregating samples subsequently added to source
+// time series into time buckets of given duration, stored in destination
+// time series.
+func (h *Handler) tsCreateRule(conn redcon.Conn, cmd redcon.Command) {
+	const tsCreateRuleArgsCount = 6
+
+	if len(cmd.Args) != tsCreateRuleArgsCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	source := string(cmd.Args[1])
+	dest := string(cmd.Args[2])
+
+	if strings.ToLower(string(cmd.Args[3])) != "aggregation" {
+		conn.WriteError(fmt.Sprintf("ERR syntax error, expected AGGREGATION, got '%s'", string(cmd.Args[3])))
+		return
+	}
+
+	aggregation, err := parseAggregation(cmd.Args[4], cmd.Args[5])
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR %v", err))
+		return
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	if err := ctx.Bucket().CreateTimeSeriesRule(source, dest, *aggregation); err != nil {
+		writeOpError(conn, fmt.Sprintf("creating compaction rule from '%s' to '%s'", source, dest), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// TS.DELETERULE <source> <dest>
+// Remove compaction rule, keeping already compacted samples.
+func (h *Handler) tsDeleteRule(conn redcon.Conn, cmd redcon.Command) {
+	const tsDeleteRuleArgsCount = 3
+
+	if len(cmd.Args) != tsDeleteRuleArgsCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	source := string(cmd.Args[1])
+	dest := string(cmd.Args[2])
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	if err := ctx.Bucket().DeleteTimeSeriesRule(source, dest); err != nil {
+		writeOpError(conn, fmt.Sprintf("removing compaction rule from '%s' to '%s'", source, dest), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// TS.INFO <key>
+// Return options, compaction rules and storage statistics of time series.
+func (h *Handler) tsInfo(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) != tsArgsMinCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	key := string(cmd.Args[1])
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	info, err := ctx.Bucket().TimeSeriesInfo(key)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR reading time series '%s': %v", key, err))
+		return
+	}
+
+	labels := info.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	rules := make([][]field, 0, len(info.Rules))
+	for _, rule := range info.Rules {
+		rules = append(rules, []field{
+			{"dest", rule.Dest},
+			{"aggregation", rule.Aggregation.Type},
+			{"duration", rule.Aggregation.Duration},
+		})
+	}
+
+	writeFields(conn, []field{
+		{"samples", info.Samples},
+		{"chunks", info.Chunks},
+		{"first", info.First},
+		{"last", info.Last},
+		{"retention", info.Retention},
+		{"labels", labels},
+		{"source", info.Source},
+		{"rules", rules},
+	})
+}
+
+// Parse timestamp ('*' is the current time) and value of sample.
+func parseSample(timestamp, value []byte) (db.Sample, error) {
+	sample := db.Sample{Timestamp: time.Now().UnixMilli()}
+
+	if string(timestamp) != "*" {
+		var err error
+		if sample.Timestamp, err = strconv.ParseInt(string(timestamp), 10, 64); err != nil {
+			return sample, fmt.Errorf("invalid timestamp '%s'", string(timestamp))
+		}
+	}
+
+	var err error
+	if sample.Value, err = strconv.ParseFloat(string(value), 64); err != nil || math.IsNaN(sample.Value) {
+		return sample, fmt.Errorf("invalid value '%s'", string(value))
+	}
+
+	return sample, nil
+}
+
+func parseRangeTimestamp(arg []byte, unbounded string, bound int64) (int64, error) {
+	if string(arg) == unbounded {
+		return bound, nil
+	}
+
+	timestamp, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp '%s'", string(arg))
+	}
+
+	return timestamp, nil
+}
+
+// Parse COUNT and AGGREGATION options of TS.RANGE.
+func parseRangeOptions(args [][]byte) (int, *db.Aggregation, error) {
+	const aggregationArgsCount = 3
+
+	var (
+		count       int
+		aggregation *db.Aggregation
+		err         error
+	)
+
+	for len(args) > 0 {
+		switch strings.ToLower(string(args[0])) {
+		case "count":
+			if len(args) < tsOptionArgsCount {
+				return 0, nil, fmt.Errorf("syntax error, COUNT requires value")
+			}
+
+			count, err = strconv.Atoi(string(args[1]))
+			if err != nil || count < 0 {
+				return 0, nil, fmt.Errorf("invalid count '%s'", string(args[1]))
+			}
+
+			args = args[tsOptionArgsCount:]
+		case "aggregation":
+			if len(args) < aggregationArgsCount {
+				return 0, nil, fmt.Errorf("syntax error, AGGREGATION requires type and duration")
+			}
+
+			if aggregation, err = parseAggregation(args[1], args[2]); err != nil {
+				return 0, nil, err
+			}
+
+			args = args[aggregationArgsCount:]
+		default:
+			return 0, nil, fmt.Errorf("syntax error, unknown option '%s'", string(args[0]))
+		}
+	}
+
+	return count, aggregation, nil
+}
+
+func parseAggregation(kind, duration []byte) (*db.Aggregation, error) {
+	aggregation := &db.Aggregation{Type: strings.ToLower(string(kind))}
+
+	var err error
+	if aggregation.Duration, err = strconv.ParseInt(string(duration), 10, 64); err != nil || aggregation.Duration <= 0 {
+		return nil, fmt.Errorf("invalid aggregation duration '%s'", string(duration))
+	}
+
+	return aggregation, nil
+}
+
+// Parse RETENTION and LABELS options of time series.
+func parseSeriesOptions(args [][]byte) (db.TimeSeries, error) {
+	var options db.TimeSeries
+
+	for len(args) > 0 {
+		switch strings.ToLower(string(args[0])) {
+		case "retention":
+			if len(args) < tsOptionArgsCount {
+				return options, fmt.Errorf("syntax error, RETENTION requires value")
+			}
+
+			retention, err := strconv.ParseInt(string(args[1]), 10, 64)
+			if err != nil || retention < 0 {
+				return options, fmt.Errorf("invalid retention '%s'", string(args[1]))
+			}
+
+			options.Retention = retention
+			args = args[tsOptionArgsCount:]
+		case "labels":
+			args = args[1:]
+			if len(args) == 0 || len(args)%tsOptionArgsCount != 0 {
+				return options, fmt.Errorf("syntax error, LABELS requires label and value pairs")
+			}
+
+			options.Labels = make(map[string]string, len(args)/tsOptionArgsCount)
+			for i := 0; i < len(args); i += tsOptionArgsCount {
+				options.Labels[string(args[i])] = string(args[i+1])
+			}
+
+			args = nil
+		default:
+			return options, fmt.Errorf("syntax error, unknown option '%s'", string(args[0]))
+		}
+	}
+
+	return options, nil
+}
+
+//nolint:gomnd // Magic numbers in command registration calls are not magic.
+func registerTimeSeries(handler *Handler) {
+	handler.Register("ts.create", handler.tsCreate, -2, []string{"write"}, 1, 1, 0, nil, []string{"TS.CREATE <key> [RETENTION <milliseconds>] [LABELS <label> <value> ...]", "create time series, keeping samples within retention before the latest one"})
+	handler.Register("ts.add", handler.tsAdd, -4, []string{"write"}, 1, 1, 0, nil, []string{"TS.ADD <key> <timestamp|*> <value> [RETENTION <milliseconds>] [LABELS <label> <value> ...]", "add sample to time series (created if missing), returns its timestamp"})
+	handler.Register("ts.madd", handler.tsMAdd, -4, []string{"write"}, 1, -1, 3, nil, []string{"TS.MADD <key> <timestamp|*> <value> [<key> <timestamp|*> <value> ...]", "add samples to existing time series, returns their timestamps"})
+	handler.Register("ts.range", handler.tsRange, -4, []string{"read"}, 1, 1, 0, nil, []string{"TS.RANGE <key> <from|-> <to|+> [COUNT <count>] [AGGREGATION <avg|min|max|sum|count> <milliseconds>]", "return samples of time series within time range, optionally aggregated into time buckets"})
+	handler.Register("ts.createrule", handler.tsCreateRule, 6, []string{"write"}, 1, 2, 1, nil, []string{"TS.CREATERULE <source> <dest> AGGREGATION <avg|min|max|sum|count> <milliseconds>", "compact samples added to source time series into time buckets of destination"})
+	handler.Register("ts.deleterule", handler.tsDeleteRule, 3, []string{"write"}, 1, 2, 1, nil, []string{"TS.DELETERULE <source> <dest>", "remove compaction rule"})
+	handler.Register("ts.info", handler.tsInfo, 2, []string{"read"}, 1, 1, 0, nil, []string{"TS.INFO <key>", "return options, compaction rules and statistics of time series"})
+}
@@ -2,10 +2,16 @@ package server
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	stdlog "log"
+	"sort"
 
+	"github.com/pepol/databuddy/internal/crdt"
+	"github.com/pepol/databuddy/internal/db"
 	"github.com/pepol/databuddy/internal/log"
+	"github.com/pepol/databuddy/internal/raft"
+	"github.com/pepol/databuddy/internal/resp"
 	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -16,6 +22,80 @@ func wrongArgs(conn redcon.Conn, command string) {
 	conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", command))
 }
 
+// Write error of failed operation. Writes rejected by read-only bucket or
+// database are reported with the READONLY error code, operations which may
+// succeed once leader of consensus is elected or bucket is released by its
+// users with the TRYAGAIN code. Error
+// replies of operations forwarded to other members are written unchanged.
+func writeOpError(conn redcon.Conn, operation string, err error) {
+	if errors.Is(err, db.ErrReadOnly) {
+		conn.WriteError(fmt.Sprintf("READONLY %s: %v", operation, err))
+		return
+	}
+
+	var notLeader *raft.NotLeaderError
+	if errors.As(err, &notLeader) || errors.Is(err, raft.ErrTimeout) || errors.Is(err, raft.ErrLeadershipLost) ||
+		errors.Is(err, db.ErrBucketInUse) {
+		conn.WriteError(fmt.Sprintf("%s %s: %v", tryAgainErrorCode, operation, err))
+		return
+	}
+
+	if errors.Is(err, crdt.ErrWrongType) {
+		conn.WriteError(fmt.Sprintf("WRONGTYPE %s: %v", operation, err))
+		return
+	}
+
+	var replyErr resp.Error
+	if errors.As(err, &replyErr) {
+		conn.WriteError(string(replyErr))
+		return
+	}
+
+	conn.WriteError(fmt.Sprintf("ERR %s: %v", operation, err))
+}
+
+// Name and value of reply field.
+type field struct {
+	name  string
+	value any
+}
+
+// Write fields as array of name/value pairs in the given, fixed order, rather
+// than leaving the order to reply encoding of maps. Values which are fields
+// themselves, or lists of them, are written the same way.
+func writeFields(conn redcon.Conn, fields []field) {
+	conn.WriteArray(len(fields) * 2) //nolint:gomnd // Name and value.
+	for _, f := range fields {
+		conn.WriteBulkString(f.name)
+		writeFieldValue(conn, f.value)
+	}
+}
+
+func writeFieldValue(conn redcon.Conn, value any) {
+	switch value := value.(type) {
+	case []field:
+		writeFields(conn, value)
+	case [][]field:
+		conn.WriteArray(len(value))
+		for _, fields := range value {
+			writeFields(conn, fields)
+		}
+	default:
+		conn.WriteAny(value)
+	}
+}
+
+// Keys of map in ascending order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
 func getHostID(hostname, addr string) string {
 	// Generate host ID - SHA256 hash of hostname and listen address.
 	h := sha256.New()
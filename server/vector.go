@@ -0,0 +1,362 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pepol/databuddy/internal/context"
+	"github.com/pepol/databuddy/internal/db"
+	"github.com/pepol/databuddy/internal/log"
+	"github.com/tidwall/redcon"
+)
+
+// This file contains implementation of the vector index commands.
+
+const vectorArgsMinCount = 3
+
+// VECTOR
+// Basic handler for vector index command container.
+func (h *Handler) vector(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < vectorArgsMinCount {
+		wrongArgs(conn, "VECTOR")
+		return
+	}
+
+	subcommand := strings.ToLower(string(cmd.Args[1]))
+
+	switch subcommand {
+	case "create":
+		h.vectorCreate(conn, cmd.Args[2:])
+	case "drop":
+		h.vectorDrop(conn, cmd.Args[2:])
+	case "list":
+		h.vectorList(conn, cmd.Args[2:])
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown command '%s %s'", string(cmd.Args[0]), subcommand))
+	}
+}
+
+// VECTOR CREATE <bucket> <name> DIM <dimension> METRIC <cosine|l2|dot> [HNSW [M <count>] [EF <count>]]
+// Create vector index in bucket. Without HNSW, searches are exact; with it,
+// HNSW graph is maintained for approximate search, with M neighbours per
+// node and candidate list of size EF when inserting.
+func (h *Handler) vectorCreate(conn redcon.Conn, args [][]byte) {
+	const vectorCreateArgsMinCount = 6
+
+	if len(args) < vectorCreateArgsMinCount {
+		wrongArgs(conn, "VECTOR CREATE")
+		return
+	}
+
+	bucketName := string(args[0])
+	name := string(args[1])
+
+	var index db.VectorIndex
+
+	for i := 2; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+
+		if option == "hnsw" {
+			if index.M == 0 {
+				index.M = db.VectorDefaultM
+			}
+			continue
+		}
+
+		if i+1 >= len(args) {
+			wrongArgs(conn, "VECTOR CREATE")
+			return
+		}
+		i++
+
+		if option == "metric" {
+			index.Metric = strings.ToLower(string(args[i]))
+			continue
+		}
+
+		value, err := strconv.Atoi(string(args[i]))
+		if err != nil || value < 1 {
+			conn.WriteError(fmt.Sprintf("ERR invalid %s '%s'", option, string(args[i])))
+			return
+		}
+
+		switch option {
+		case "dim":
+			index.Dim = value
+		case "m":
+			index.M = value
+		case "ef":
+			index.EfConstruction = value
+		default:
+			conn.WriteError(fmt.Sprintf("ERR syntax error, unknown option '%s'", string(args[i-1])))
+			return
+		}
+	}
+
+	if index.M == 0 && index.EfConstruction > 0 {
+		conn.WriteError("ERR EF requires HNSW")
+		return
+	}
+
+	if err := h.db.CreateVectorIndex(bucketName, name, index); err != nil {
+		writeOpError(conn, fmt.Sprintf("creating vector index '%s' of bucket '%s'", name, bucketName), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// VECTOR DROP <bucket> <name>
+// Remove vector index and all its vectors.
+func (h *Handler) vectorDrop(conn redcon.Conn, args [][]byte) {
+	const vectorDropArgsCount = 2
+
+	if len(args) != vectorDropArgsCount {
+		wrongArgs(conn, "VECTOR DROP")
+		return
+	}
+
+	bucketName := string(args[0])
+	name := string(args[1])
+
+	if err := h.db.DropVectorIndex(bucketName, name); err != nil {
+		writeOpError(conn, fmt.Sprintf("dropping vector index '%s' of bucket '%s'", name, bucketName), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// VECTOR LIST <bucket>
+// Return all vector indexes of bucket with their parameters and sizes.
+func (h *Handler) vectorList(conn redcon.Conn, args [][]byte) {
+	if len(args) != 1 {
+		wrongArgs(conn, "VECTOR LIST")
+		return
+	}
+
+	name := string(args[0])
+
+	bucket, err := h.db.Get(name)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR opening bucket '%s': %v", name, err))
+		return
+	}
+	defer h.db.Release(bucket)
+
+	indexes, err := bucket.VectorIndexes()
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR listing vector indexes of bucket '%s': %v", name, err))
+		return
+	}
+
+	conn.WriteArray(len(indexes))
+	for _, index := range indexes {
+		writeFields(conn, []field{
+			{"name", index.Name},
+			{"dim", index.Dim},
+			{"metric", index.Metric},
+			{"hnsw", index.M > 0},
+			{"m", index.M},
+			{"ef_construction", index.EfConstruction},
+			{"size", index.Size},
+		})
+	}
+}
+
+// VADD <index> <key> <vector>
+// Store vector under key in vector index of currently used bucket, replacing
+// the previous one. Vector is a JSON array or comma-separated list of numbers.
+func (h *Handler) vadd(conn redcon.Conn, cmd redcon.Command) {
+	const vaddArgsCount = 4
+
+	if len(cmd.Args) != vaddArgsCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	name := string(cmd.Args[1])
+	key := string(cmd.Args[2])
+
+	vector, err := parseVector(cmd.Args[3])
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR %v", err))
+		return
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	if err := ctx.Bucket().VectorAdd(name, key, vector); err != nil {
+		writeOpError(conn, fmt.Sprintf("adding vector to index '%s'", name), err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
+
+// VDEL <index> <key>
+// Remove vector stored under key from vector index of currently used bucket.
+// Returns number of removed vectors.
+func (h *Handler) vdel(conn redcon.Conn, cmd redcon.Command) {
+	const vdelArgsCount = 3
+
+	if len(cmd.Args) != vdelArgsCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	name := string(cmd.Args[1])
+	key := string(cmd.Args[2])
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	removed, err := ctx.Bucket().VectorDelete(name, key)
+	if err != nil {
+		writeOpError(conn, fmt.Sprintf("removing vector from index '%s'", name), err)
+		return
+	}
+
+	if removed {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+}
+
+// VSEARCH <index> <vector> K <count> [FILTER <prefix>] [EF <count>] [EXACT]
+// Return keys and distances of count vectors nearest to given one in vector
+// index of currently used bucket, closest first. Search is approximate if
+// the index has HNSW graph, unless EXACT is given or keys are filtered by
+// prefix.
+func (h *Handler) vsearch(conn redcon.Conn, cmd redcon.Command) {
+	const vsearchArgsMinCount = 5
+
+	if len(cmd.Args) < vsearchArgsMinCount {
+		wrongArgs(conn, string(cmd.Args[0]))
+		return
+	}
+
+	name := string(cmd.Args[1])
+
+	vector, err := parseVector(cmd.Args[2])
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR %v", err))
+		return
+	}
+
+	k := -1
+	var options db.VectorSearch
+
+	args := cmd.Args[3:]
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+
+		if option == "exact" {
+			options.Exact = true
+			continue
+		}
+
+		if i+1 >= len(args) {
+			wrongArgs(conn, string(cmd.Args[0]))
+			return
+		}
+		i++
+
+		switch option {
+		case "filter":
+			options.Prefix = string(args[i])
+		case "k", "ef":
+			value, err := strconv.Atoi(string(args[i]))
+			if err != nil || value < 0 {
+				conn.WriteError(fmt.Sprintf("ERR invalid %s '%s'", option, string(args[i])))
+				return
+			}
+
+			if option == "k" {
+				k = value
+			} else {
+				options.Ef = value
+			}
+		default:
+			conn.WriteError(fmt.Sprintf("ERR syntax error, unknown option '%s'", string(args[i-1])))
+			return
+		}
+	}
+
+	if k < 0 {
+		conn.WriteError("ERR syntax error, K is required")
+		return
+	}
+
+	ctx, ok := conn.Context().(*context.Context)
+	if !ok {
+		conn.WriteError("ERR context not set on connection")
+		if err := conn.Close(); err != nil {
+			log.Error("closing connection", err)
+		}
+		return
+	}
+
+	hits, err := ctx.Bucket().VectorSearch(name, vector, k, options)
+	if err != nil {
+		conn.WriteError(fmt.Sprintf("ERR searching vector index '%s': %v", name, err))
+		return
+	}
+
+	conn.WriteArray(len(hits) * 2)
+	for _, hit := range hits {
+		conn.WriteBulkString(hit.Key)
+		conn.WriteBulkString(strconv.FormatFloat(hit.Distance, 'f', -1, 64))
+	}
+}
+
+// Parse vector given as JSON array or comma-separated list of numbers.
+func parseVector(arg []byte) ([]float32, error) {
+	text := strings.TrimSpace(string(arg))
+	if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+		text = text[1 : len(text)-1]
+	}
+
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("empty vector")
+	}
+
+	fields := strings.Split(text, ",")
+	vector := make([]float32, 0, len(fields))
+
+	for _, field := range fields {
+		x, err := strconv.ParseFloat(strings.TrimSpace(field), 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector component '%s'", strings.TrimSpace(field))
+		}
+		vector = append(vector, float32(x))
+	}
+
+	return vector, nil
+}
+
+//nolint:gomnd // Magic numbers in command registration calls are not magic.
+func registerVector(handler *Handler) {
+	handler.Register("vector", handler.vector, -3, []string{"database"}, 2, 2, 0, nil, []string{"VECTOR", "container for vector index commands"})
+	handler.RegisterChild("vector create", -8, []string{"database"}, 2, 2, 0, nil, []string{"VECTOR CREATE <bucket> <name> DIM <dimension> METRIC <cosine|l2|dot> [HNSW [M <count>] [EF <count>]]", "create vector index of bucket, with HNSW graph for approximate search if requested"})
+	handler.RegisterChild("vector drop", 4, []string{"database"}, 2, 2, 0, nil, []string{"VECTOR DROP <bucket> <name>", "remove vector index of bucket"})
+	handler.RegisterChild("vector list", 3, []string{"database"}, 2, 2, 0, nil, []string{"VECTOR LIST <bucket>", "return vector indexes of bucket with their parameters and sizes"})
+	handler.Register("vadd", handler.vadd, 4, []string{"write"}, 2, 2, 0, nil, []string{"VADD <index> <key> <vector>", "store vector (JSON array or comma-separated numbers) under key in vector index"})
+	handler.Register("vdel", handler.vdel, 3, []string{"write"}, 2, 2, 0, nil, []string{"VDEL <index> <key>", "remove vector stored under key from vector index, returns number of removed vectors"})
+	handler.Register("vsearch", handler.vsearch, -5, []string{"read"}, -1, -1, 0, nil, []string{"VSEARCH <index> <vector> K <count> [FILTER <prefix>] [EF <count>] [EXACT]", "return keys and distances of nearest vectors, closest first (FILTER and EXACT search exhaustively)"})
+}